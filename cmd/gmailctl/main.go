@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli/apitransport"
+	"gmail-api-client/internal/cli/auth"
+	"gmail-api-client/internal/cli/exportcmd"
+	"gmail-api-client/internal/cli/imaptransport"
+	"gmail-api-client/internal/cli/importcmd"
+	"gmail-api-client/internal/cli/labelscmd"
+	"gmail-api-client/internal/cli/sendmail"
+	"gmail-api-client/internal/cli/servecmd"
+)
+
+// aliases are the program names gmailctl answers to when installed under
+// them, e.g. as a symlink, so existing Exim configurations keep working
+var aliases = map[string]func(program string, args []string){
+	"gmail-api-transport":           apitransport.Main,
+	"gmail-imap-transport":          imaptransport.Main,
+	"gmail-api-transport-get-token": auth.Main,
+	"sendmail":                      sendmail.Main,
+}
+
+// command is a gmailctl subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// Delivery methods for --via
+const (
+	viaAPI  = "api"
+	viaIMAP = "imap"
+)
+
+var commands = []command{
+	{"deliver", "Deliver a message from stdin (--via api or imap, default api)", deliver},
+	{"send", "Send a message from stdin like sendmail (-t, -f, -i, recipients)", func(args []string) {
+		sendmail.Main("gmailctl send", args)
+	}},
+	{"import", "Import mbox files and Maildir trees, folders becoming labels", func(args []string) {
+		importcmd.Main("gmailctl import", args)
+	}},
+	{"export", "Export messages to a Maildir or mbox file, incrementally", func(args []string) {
+		exportcmd.Main("gmailctl export", args)
+	}},
+	{"labels", "List the mailbox's labels, or create labels (labels create)", func(args []string) {
+		labelscmd.Main("gmailctl labels", args)
+	}},
+	{"serve", "Serve metrics and a health check over HTTP until interrupted", func(args []string) {
+		servecmd.Main("gmailctl serve", args)
+	}},
+	{"check-config", "Check a configuration without delivering (--via api or imap)", checkConfig},
+	{"auth", "Obtain and save an OAuth2 token interactively", func(args []string) {
+		auth.Main("gmailctl auth", args)
+	}},
+	{"token", "Show when a token expires, refreshing it if needed", func(args []string) {
+		os.Exit(auth.Token("gmailctl token", args))
+	}},
+	{"version", "Show version information", func([]string) {
+		fmt.Println(internal.VersionString("gmailctl"))
+	}},
+}
+
+func main() {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if run, ok := aliases[name]; ok {
+		run(name, os.Args[1:])
+		return
+	}
+
+	if len(os.Args) < 2 {
+		usageError("missing command")
+	}
+	switch os.Args[1] {
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return
+	case "--version":
+		fmt.Println(internal.VersionString("gmailctl"))
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			cmd.run(os.Args[2:])
+			return
+		}
+	}
+	usageError("unknown command %q", os.Args[1])
+}
+
+// deliver implements the deliver command
+func deliver(args []string) {
+	via, args := viaFlag(args)
+	switch via {
+	case viaAPI:
+		apitransport.Main("gmailctl deliver --via api", args)
+	case viaIMAP:
+		imaptransport.Main("gmailctl deliver --via imap", args)
+	}
+}
+
+// checkConfig implements the check-config command
+func checkConfig(args []string) {
+	via, args := viaFlag(args)
+	switch via {
+	case viaAPI:
+		os.Exit(apitransport.CheckConfig("gmailctl check-config --via api", args))
+	case viaIMAP:
+		os.Exit(imaptransport.CheckConfig("gmailctl check-config --via imap", args))
+	}
+}
+
+// viaFlag removes --via from the arguments and returns its value, which
+// defaults to api
+func viaFlag(args []string) (string, []string) {
+	via := viaAPI
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "via" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				usageError("flag needs an argument: --via")
+			}
+			i++
+			value = args[i]
+		}
+		via = value
+	}
+	if via != viaAPI && via != viaIMAP {
+		usageError("--via must be %q or %q, got %q", viaAPI, viaIMAP, via)
+	}
+	return via, rest
+}
+
+// usageError reports an invalid command line and exits with ExitUsage
+func usageError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gmailctl: %s\n", fmt.Sprintf(format, args...))
+	fmt.Fprintf(os.Stderr, "Run 'gmailctl --help' for usage.\n")
+	os.Exit(internal.ExitUsage)
+}
+
+// printUsage writes the --help text
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: gmailctl <command> [arguments]\n\n")
+	fmt.Fprintf(w, "Delivers mail to Gmail and manages the OAuth2 token it needs.\n")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nRun 'gmailctl <command> --help' for a command's options.\n")
+	fmt.Fprintf(w, "Installed as gmail-api-transport, gmail-imap-transport,\n")
+	fmt.Fprintf(w, "gmail-api-transport-get-token or sendmail, e.g. through a symlink, gmailctl runs\n")
+	fmt.Fprintf(w, "as that program.\n")
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"gmail-api-client/pkg/deliver"
+)
+
+// Audit transports
+const (
+	AuditTransportImport = "import"
+	AuditTransportInsert = "insert"
+	AuditTransportIMAP   = "imap"
+	// AuditTransportSend is outbound mail sent with users.messages.send
+	AuditTransportSend = "send"
+)
+
+// Audit outcomes
+const (
+	// AuditDelivered means the message was delivered by this invocation
+	AuditDelivered = deliver.StatusDelivered
+	// AuditDuplicate means the message had already been delivered and was skipped
+	AuditDuplicate = deliver.StatusDuplicate
+	// AuditDeferred means delivery failed temporarily and Exim will retry
+	AuditDeferred = deliver.StatusDeferred
+	// AuditFailed means delivery failed permanently
+	AuditFailed = deliver.StatusFailed
+)
+
+// AuditRecord is a single line of the audit log, describing one delivery attempt
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	DeliveryID string    `json:"delivery_id,omitempty"`
+	Account    string    `json:"account,omitempty"`
+	Transport  string    `json:"transport"`
+	// Envelope sender and recipient, as passed by Exim in $SENDER and $RECIPIENT
+	Sender     string   `json:"sender,omitempty"`
+	Recipient  string   `json:"recipient,omitempty"`
+	MessageID  string   `json:"message_id,omitempty"`
+	Size       int      `json:"size"`
+	BodySHA256 string   `json:"body_sha256"`
+	GmailID    string   `json:"gmail_id,omitempty"`
+	ThreadID   string   `json:"thread_id,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	HistoryID  uint64   `json:"history_id,omitempty"`
+	Attempts   int      `json:"attempts"`
+	Retries    int      `json:"retries"`
+	Outcome    string   `json:"outcome"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// NewAuditRecord creates a record for a message about to be delivered
+// The envelope sender and recipient are left for the caller to fill in
+func NewAuditRecord(transport string, rawMessage []byte) *AuditRecord {
+	bodyHash := sha256.Sum256(messageBody(rawMessage))
+	return &AuditRecord{
+		Transport:  transport,
+		MessageID:  MessageID(rawMessage),
+		Size:       len(rawMessage),
+		BodySHA256: hex.EncodeToString(bodyHash[:]),
+	}
+}
+
+// CountAttempt records one attempt at the delivery call; the first attempt
+// doesn't count as a retry
+func (r *AuditRecord) CountAttempt(attempt int) {
+	r.Attempts = attempt
+	if attempt > 1 {
+		r.Retries = attempt - 1
+	}
+}
+
+// Finish sets the time and outcome of the record from the delivery result,
+// with the error text redacted by redactor
+// A record already marked as a duplicate keeps that outcome on success
+func (r *AuditRecord) Finish(err error, redactor *Redactor) {
+	r.Time = time.Now().UTC()
+	switch {
+	case err == nil && r.Outcome == AuditDuplicate:
+	case err == nil:
+		r.Outcome = AuditDelivered
+	case ExitCode(err) == ExitTempFail:
+		r.Outcome = AuditDeferred
+		r.Error = redactor.String(err.Error())
+	default:
+		r.Outcome = AuditFailed
+		r.Error = redactor.String(err.Error())
+	}
+}
+
+// AuditLog is an append-only JSON lines file shared between processes,
+// rotated once it reaches a maximum size
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+// NewAuditLog creates an audit log at path
+// Once the file would exceed maxSize bytes it is renamed to path.1 (shifting
+// older files up to path.<maxFiles>); a maxSize of 0 disables rotation
+func NewAuditLog(path string, maxSize int64, maxFiles int) *AuditLog {
+	return &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+// NewAuditLogFromConfig returns the audit log configured by audit_log, or
+// nil if auditing is disabled
+func NewAuditLogFromConfig(common *Common) *AuditLog {
+	if common.AuditLog == "" {
+		return nil
+	}
+	return NewAuditLog(common.AuditLog, int64(common.AuditMaxSize)*1024*1024, common.AuditMaxFiles)
+}
+
+// maxAuditOpenAttempts bounds how often Write reopens the log after finding
+// it was rotated by another process
+const maxAuditOpenAttempts = 10
+
+// Write appends a record and syncs it to disk before returning
+func (a *AuditLog) Write(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	for attempt := 0; attempt < maxAuditOpenAttempts; attempt++ {
+		done, err := a.tryWrite(line)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("audit log %s kept being rotated while writing", a.path)
+}
+
+// tryWrite appends line under an exclusive lock, rotating first if needed
+// It returns false if the file was replaced while waiting for the lock, or
+// was just rotated, and the write should be retried on the new file
+func (a *AuditLog) tryWrite(line []byte) (bool, error) {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return false, fmt.Errorf("opening audit log: %w", err)
+	}
+	defer file.Close()
+
+	if err := acquireFileLock(file); err != nil {
+		return false, fmt.Errorf("locking audit log: %w", err)
+	}
+	defer releaseFileLock(file)
+
+	// Another process may have rotated the file while we waited for the lock
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("checking audit log: %w", err)
+	}
+	current, err := os.Stat(a.path)
+	if err != nil || !os.SameFile(info, current) {
+		return false, nil
+	}
+
+	if a.maxSize > 0 && info.Size() > 0 && info.Size()+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if _, err := file.Write(line); err != nil {
+		return false, fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return false, fmt.Errorf("syncing audit log: %w", err)
+	}
+	return true, nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and moves the
+// current file to path.1
+// It must be called with the current file locked
+func (a *AuditLog) rotate() error {
+	if a.maxFiles < 1 {
+		return os.Remove(a.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		older := fmt.Sprintf("%s.%d", a.path, i)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return fmt.Errorf("rotating audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets all requests through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects all requests until the cooldown has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe request through to test recovery
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// ErrCircuitOpen is returned (wrapped in a TempFailError) while the breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker stops all transport processes for an account from calling
+// the API while it is failing, sharing its state via a locked state file
+type CircuitBreaker struct {
+	path      string
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+}
+
+// breakerState is the persisted breaker state
+type breakerState struct {
+	State       BreakerState `json:"state"`
+	Failures    int          `json:"failures"`
+	OpenedAt    time.Time    `json:"opened_at,omitzero"`
+	LastFailure time.Time    `json:"last_failure,omitzero"`
+	ProbeAt     time.Time    `json:"probe_at,omitzero"`
+}
+
+// NewCircuitBreaker creates a circuit breaker for an account storing its state in dir
+// The breaker opens after threshold consecutive transient failures and lets a
+// probe through once cooldown has passed
+func NewCircuitBreaker(dir, account string, threshold int, cooldown time.Duration, clock Clock) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	return &CircuitBreaker{
+		path:      StateFilePath(dir, account, "breaker.json"),
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock,
+	}
+}
+
+// Allow reports whether a request may be made
+// It returns a TempFailError wrapping ErrCircuitOpen if the breaker is open,
+// or if it is half-open and another process is already probing
+func (b *CircuitBreaker) Allow() error {
+	var state breakerState
+	var rejectErr error
+
+	err := UpdateStateFile(b.path, &state, func() error {
+		now := b.clock.Now()
+		switch state.State {
+		case BreakerOpen:
+			if now.Sub(state.OpenedAt) < b.cooldown {
+				rejectErr = b.openError(state.OpenedAt.Add(b.cooldown).Sub(now))
+				return nil
+			}
+			// Cooldown over: this caller becomes the probe
+			state.State = BreakerHalfOpen
+			state.ProbeAt = now
+		case BreakerHalfOpen:
+			// Only one probe at a time; a probe that never reported back is
+			// considered lost after another cooldown period
+			if now.Sub(state.ProbeAt) < b.cooldown {
+				rejectErr = b.openError(state.ProbeAt.Add(b.cooldown).Sub(now))
+				return nil
+			}
+			state.ProbeAt = now
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return rejectErr
+}
+
+// openError builds the error returned while requests are being rejected
+func (b *CircuitBreaker) openError(remaining time.Duration) error {
+	return &TempFailError{
+		Reason: "circuit open",
+		Err:    fmt.Errorf("%w, retry in %s", ErrCircuitOpen, remaining.Round(time.Second)),
+	}
+}
+
+// Record updates the breaker with the outcome of a request
+// Only transient failures count against the breaker; permanent errors show
+// the service is responding and are treated like successes
+func (b *CircuitBreaker) Record(opErr error) (BreakerState, error) {
+	var state breakerState
+
+	err := UpdateStateFile(b.path, &state, func() error {
+		now := b.clock.Now()
+		if state.State == "" {
+			state.State = BreakerClosed
+		}
+
+		if opErr == nil || ClassifyError(opErr) == ClassPermanent {
+			state.State = BreakerClosed
+			state.Failures = 0
+			state.OpenedAt = time.Time{}
+			state.ProbeAt = time.Time{}
+			return nil
+		}
+
+		state.Failures++
+		state.LastFailure = now
+		if state.State == BreakerHalfOpen || state.Failures >= b.threshold {
+			state.State = BreakerOpen
+			state.OpenedAt = now
+			state.ProbeAt = time.Time{}
+		}
+		return nil
+	})
+	return state.State, err
+}
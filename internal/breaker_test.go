@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readBreakerState returns the state a breaker has stored
+func readBreakerState(t *testing.T, b *CircuitBreaker) breakerState {
+	t.Helper()
+	var state breakerState
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// assertOpen checks that Allow rejects a request, saying when to retry
+func assertOpen(t *testing.T, b *CircuitBreaker, retryIn string) {
+	t.Helper()
+	err := b.Allow()
+	var tempErr *TempFailError
+	if !errors.As(err, &tempErr) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow = %v, want a TempFailError wrapping ErrCircuitOpen", err)
+	}
+	if !strings.HasSuffix(err.Error(), "retry in "+retryIn) {
+		t.Errorf("Allow = %q, want retry in %s", err, retryIn)
+	}
+}
+
+// recordState records the outcome of a request and checks the new state
+func recordState(t *testing.T, b *CircuitBreaker, opErr error, want BreakerState) {
+	t.Helper()
+	state, err := b.Record(opErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != want {
+		t.Fatalf("Record(%v) = %s, want %s", opErr, state, want)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	b := NewCircuitBreaker(t.TempDir(), "user@example.com", 3, 30*time.Second, clock)
+	unavailable := apiError(503, "")
+
+	// Closed: failures below the threshold let requests through
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow on a new breaker = %v", err)
+	}
+	recordState(t, b, unavailable, BreakerClosed)
+	recordState(t, b, unavailable, BreakerClosed)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow below the threshold = %v", err)
+	}
+
+	// Open: the third consecutive failure rejects requests until the
+	// cooldown has passed
+	recordState(t, b, unavailable, BreakerOpen)
+	assertOpen(t, b, "30s")
+	clock.now = clock.now.Add(29 * time.Second)
+	assertOpen(t, b, "1s")
+
+	// Half-open: the first request after the cooldown is the only probe
+	clock.now = clock.now.Add(time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after the cooldown = %v, want the probe let through", err)
+	}
+	if state := readBreakerState(t, b); state.State != BreakerHalfOpen || !state.ProbeAt.Equal(clock.now) {
+		t.Errorf("state = %+v, want half-open with the probe at %v", state, clock.now)
+	}
+	assertOpen(t, b, "30s")
+
+	// A failed probe opens the breaker again at once
+	recordState(t, b, unavailable, BreakerOpen)
+	assertOpen(t, b, "30s")
+
+	// A successful probe closes it and forgets the failures
+	clock.now = clock.now.Add(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after the second cooldown = %v", err)
+	}
+	recordState(t, b, nil, BreakerClosed)
+	if state := readBreakerState(t, b); state.Failures != 0 || !state.OpenedAt.IsZero() || !state.ProbeAt.IsZero() {
+		t.Errorf("state after closing = %+v, want the failures cleared", state)
+	}
+	recordState(t, b, unavailable, BreakerClosed)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after closing = %v", err)
+	}
+}
+
+func TestCircuitBreakerPermanentErrors(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	b := NewCircuitBreaker(t.TempDir(), "user@example.com", 2, time.Minute, clock)
+
+	// A permanent error shows the API is answering, so it resets the count
+	recordState(t, b, apiError(503, ""), BreakerClosed)
+	recordState(t, b, apiError(400, "invalidArgument"), BreakerClosed)
+	recordState(t, b, apiError(503, ""), BreakerClosed)
+	recordState(t, b, apiError(429, "rateLimitExceeded"), BreakerOpen)
+}
+
+func TestCircuitBreakerLostProbe(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	b := NewCircuitBreaker(t.TempDir(), "user@example.com", 1, time.Minute, clock)
+	recordState(t, b, apiError(503, ""), BreakerOpen)
+
+	clock.now = clock.now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("first probe = %v", err)
+	}
+	// The probe never reports back; after another cooldown a new one is let
+	// through instead of the breaker staying half-open for ever
+	clock.now = clock.now.Add(59 * time.Second)
+	assertOpen(t, b, "1s")
+	clock.now = clock.now.Add(time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("second probe = %v", err)
+	}
+}
+
+func TestCircuitBreakerSharedState(t *testing.T) {
+	// Breakers of two processes for the same account share the state file,
+	// while another account's breaker is independent
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	first := NewCircuitBreaker(dir, "user@example.com", 2, time.Minute, clock)
+	second := NewCircuitBreaker(dir, "user@example.com", 2, time.Minute, clock)
+	other := NewCircuitBreaker(dir, "other@example.com", 2, time.Minute, clock)
+
+	recordState(t, first, apiError(503, ""), BreakerClosed)
+	recordState(t, second, apiError(503, ""), BreakerOpen)
+	assertOpen(t, first, "1m0s")
+	if err := other.Allow(); err != nil {
+		t.Errorf("other account's Allow = %v, want its breaker closed", err)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if err := first.Allow(); err != nil {
+		t.Fatalf("probe = %v", err)
+	}
+	assertOpen(t, second, "1m0s")
+}
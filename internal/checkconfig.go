@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// CheckStatus is the outcome of one configuration check
+type CheckStatus string
+
+// Check statuses; only failures make check-config exit non-zero
+const (
+	CheckPass CheckStatus = "PASS"
+	CheckWarn CheckStatus = "WARN"
+	CheckFail CheckStatus = "FAIL"
+)
+
+// Scopes needed by the transports
+const (
+	// ScopeGmailModify covers users.messages.import/insert and label changes
+	ScopeGmailModify = "https://www.googleapis.com/auth/gmail.modify"
+	// ScopeMailGoogle is the full mail scope Gmail requires for IMAP XOAUTH2
+	ScopeMailGoogle = "https://mail.google.com/"
+)
+
+// access(2) modes
+const (
+	accessWrite = 0x2
+	accessExec  = 0x1
+)
+
+// tokenInfoURL is Google's endpoint describing an access token
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// CheckResult is one line of a configuration report
+type CheckResult struct {
+	Status CheckStatus
+	Name   string
+	Detail string
+}
+
+// ConfigReport collects the results of check-config
+type ConfigReport struct {
+	Results []CheckResult
+}
+
+// Pass records a successful check
+func (r *ConfigReport) Pass(name, format string, args ...interface{}) {
+	r.add(CheckPass, name, format, args...)
+}
+
+// Warn records a problem that doesn't stop delivery
+func (r *ConfigReport) Warn(name, format string, args ...interface{}) {
+	r.add(CheckWarn, name, format, args...)
+}
+
+// Fail records a problem that will make deliveries fail
+func (r *ConfigReport) Fail(name, format string, args ...interface{}) {
+	r.add(CheckFail, name, format, args...)
+}
+
+// Check records a failure if err is set and a pass otherwise
+func (r *ConfigReport) Check(name string, err error, format string, args ...interface{}) bool {
+	if err != nil {
+		r.Fail(name, "%v", err)
+		return false
+	}
+	r.Pass(name, format, args...)
+	return true
+}
+
+func (r *ConfigReport) add(status CheckStatus, name, format string, args ...interface{}) {
+	r.Results = append(r.Results, CheckResult{
+		Status: status,
+		Name:   name,
+		Detail: secrets.String(fmt.Sprintf(format, args...)),
+	})
+}
+
+// Count returns the number of results with a status
+func (r *ConfigReport) Count(status CheckStatus) int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed reports whether any check failed
+func (r *ConfigReport) Failed() bool {
+	return r.Count(CheckFail) > 0
+}
+
+// Print writes the report followed by a summary line
+func (r *ConfigReport) Print(w io.Writer) {
+	width := 0
+	for _, result := range r.Results {
+		width = max(width, len(result.Name))
+	}
+	for _, result := range r.Results {
+		fmt.Fprintf(w, "%s  %-*s  %s\n", result.Status, width, result.Name, result.Detail)
+	}
+
+	status := CheckPass
+	if r.Failed() {
+		status = CheckFail
+	}
+	fmt.Fprintf(w, "\nResult: %s (%d passed, %d warnings, %d failed)\n",
+		status, r.Count(CheckPass), r.Count(CheckWarn), r.Count(CheckFail))
+}
+
+// CheckCommon checks the files and settings shared by both transports
+// It returns the decoded token, or nil if the token file is unusable
+func CheckCommon(report *ConfigReport, common *Common) *oauth2.Token {
+	CheckCredentialsFile(report, common.CredentialsFile)
+	token := CheckTokenFile(report, common.TokenFile)
+
+	for _, dir := range []struct{ name, path string }{
+		{"state_dir", common.StateDir},
+		{"metrics_dir", common.MetricsDir},
+	} {
+		if dir.path != "" {
+			checkWritable(report, dir.name, dir.path)
+		}
+	}
+	for _, file := range []struct{ name, path string }{
+		{"dedup_index", common.DedupIndex},
+		{"log_file", common.LogFile},
+		{"audit_log", common.AuditLog},
+	} {
+		if file.path != "" {
+			checkWritable(report, file.name, filepath.Dir(file.path))
+		}
+	}
+	return token
+}
+
+// credentialsJSON is the client secrets file downloaded from Google Cloud
+// Console; only one of the application types is present
+type credentialsJSON struct {
+	Type      string             `json:"type"`
+	Installed *credentialsClient `json:"installed"`
+	Web       *credentialsClient `json:"web"`
+}
+
+// credentialsClient holds the fields of an OAuth client used by this module
+type credentialsClient struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	AuthURI      string   `json:"auth_uri"`
+	TokenURI     string   `json:"token_uri"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// CheckCredentialsFile checks the OAuth client credentials
+// Desktop ("installed") clients are expected; web clients work if
+// http://localhost:8080/oauth2callback is an authorised redirect URI, and
+// service account keys can't be used with a user token at all
+func CheckCredentialsFile(report *ConfigReport, filename string) {
+	const name = "credentials_file"
+	if filename == "" {
+		report.Fail(name, "not set")
+		return
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		report.Fail(name, "%v", err)
+		return
+	}
+	checkPermissions(report, name, filename)
+
+	var creds credentialsJSON
+	if err := json.Unmarshal(data, &creds); err != nil {
+		report.Fail(name, "%s is not valid JSON: %v", filename, err)
+		return
+	}
+
+	var client *credentialsClient
+	switch {
+	case creds.Type == "service_account":
+		report.Fail(name, "%s is a service account key; an OAuth client ID of type Desktop app is required", filename)
+		return
+	case creds.Installed != nil:
+		client = creds.Installed
+		report.Pass(name, "%s: Desktop app OAuth client", filename)
+	case creds.Web != nil:
+		client = creds.Web
+		report.Warn(name, "%s: Web application OAuth client; a Desktop app client is recommended", filename)
+	default:
+		report.Fail(name, "%s has no \"installed\" or \"web\" client; download the OAuth client ID JSON from Google Cloud Console", filename)
+		return
+	}
+
+	var missing []string
+	for _, field := range []struct{ key, value string }{
+		{"client_id", client.ClientID},
+		{"client_secret", client.ClientSecret},
+		{"token_uri", client.TokenURI},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.key)
+		}
+	}
+	if len(client.RedirectURIs) == 0 {
+		missing = append(missing, "redirect_uris")
+	}
+	if len(missing) > 0 {
+		report.Fail(name, "%s is missing %s", filename, strings.Join(missing, ", "))
+	}
+}
+
+// CheckTokenFile checks that the token file can be decoded and refreshed
+// and is only readable by its owner
+func CheckTokenFile(report *ConfigReport, filename string) *oauth2.Token {
+	const name = "token_file"
+	if filename == "" {
+		report.Fail(name, "not set")
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		report.Fail(name, "%v", err)
+		return nil
+	}
+	checkPermissions(report, name, filename)
+	if err := syscall.Access(filename, accessWrite); err != nil {
+		report.Warn(name, "%s is not writable; refreshed tokens can't be saved", filename)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		report.Fail(name, "%s is not a valid token: %v", filename, err)
+		return nil
+	}
+
+	switch {
+	case token.RefreshToken == "":
+		report.Fail(name, "%s has no refresh_token; run gmail-api-transport-get-token again", filename)
+	case token.Expiry.IsZero():
+		report.Pass(name, "%s has a refresh token", filename)
+	case token.Expiry.Before(time.Now()):
+		report.Pass(name, "%s has a refresh token (access token expired %s, will be refreshed)", filename, token.Expiry.Format(time.RFC3339))
+	default:
+		report.Pass(name, "%s has a refresh token (access token valid until %s)", filename, token.Expiry.Format(time.RFC3339))
+	}
+
+	// Tokens saved from the initial grant may record their scopes
+	var extra struct {
+		Scope string `json:"scope"`
+	}
+	if json.Unmarshal(data, &extra) == nil && extra.Scope != "" {
+		report.Pass("token_scopes", "%s", extra.Scope)
+	}
+	return &token
+}
+
+// checkPermissions warns when a secret file is readable by group or others
+func checkPermissions(report *ConfigReport, name, filename string) {
+	perm, err := GetFilePermissions(filename)
+	if err != nil {
+		report.Warn(name, "%v", err)
+		return
+	}
+	if perm&0o077 != 0 {
+		report.Warn(name, "%s is accessible by group or others (mode %04o); run chmod 600 %s", filename, perm, filename)
+	}
+}
+
+// checkWritable checks that a directory exists and is writable
+func checkWritable(report *ConfigReport, name, dir string) {
+	info, err := os.Stat(dir)
+	switch {
+	case err != nil:
+		report.Fail(name, "%v", err)
+	case !info.IsDir():
+		report.Fail(name, "%s is not a directory", dir)
+	case syscall.Access(dir, accessWrite|accessExec) != nil:
+		report.Fail(name, "%s is not writable", dir)
+	default:
+		report.Pass(name, "%s is writable", dir)
+	}
+}
+
+// CheckEmailUserID checks that user_id is a bare email address, as needed
+// for IMAP authentication
+func CheckEmailUserID(report *ConfigReport, userID string) {
+	addr, err := mail.ParseAddress(userID)
+	if err != nil || addr.Address != userID {
+		report.Fail("user_id", "%q must be the account's full email address", userID)
+		return
+	}
+	report.Pass("user_id", "%s", userID)
+}
+
+// CheckAPIUserID checks that user_id is "me" or an email address
+func CheckAPIUserID(report *ConfigReport, userID string) {
+	if userID == "me" {
+		report.Pass("user_id", "me (the authorised account)")
+		return
+	}
+	CheckEmailUserID(report, userID)
+}
+
+// CheckServerAddress checks a host:port address
+func CheckServerAddress(report *ConfigReport, name, address string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		report.Fail(name, "%q is not a host:port address: %v", address, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		report.Fail(name, "%q has an invalid port", address)
+		return
+	}
+	if host == "" {
+		report.Fail(name, "%q has no host", address)
+		return
+	}
+	report.Pass(name, "%s", address)
+}
+
+// CheckScopes looks up the scopes granted to an access token and fails if
+// any required scope is missing
+func CheckScopes(ctx context.Context, report *ConfigReport, accessToken string, required ...string) {
+	scopes, err := TokenScopes(ctx, accessToken)
+	if err != nil {
+		report.Warn("token_scopes", "could not look up scopes: %v", err)
+		return
+	}
+
+	granted := make(map[string]bool)
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+	var missing []string
+	for _, scope := range required {
+		// The full mail scope includes gmail.modify
+		if !granted[scope] && !(scope == ScopeGmailModify && granted[ScopeMailGoogle]) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		report.Fail("token_scopes", "token lacks %s (granted: %s); run gmail-api-transport-get-token again",
+			strings.Join(missing, ", "), strings.Join(scopes, " "))
+		return
+	}
+	report.Pass("token_scopes", "%s", strings.Join(scopes, " "))
+}
+
+// TokenScopes returns the scopes granted to an access token
+func TokenScopes(ctx context.Context, accessToken string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		tokenInfoURL+"?access_token="+url.QueryEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		Scope            string `json:"scope"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding tokeninfo response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo: %s %s", resp.Status, info.ErrorDescription)
+	}
+	return strings.Fields(info.Scope), nil
+}
@@ -0,0 +1,71 @@
+package apitransport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/gmaildeliver"
+)
+
+// CheckConfig implements the check-config subcommand and returns the exit code
+func CheckConfig(program string, args []string) int {
+	var online bool
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file>",
+		"Checks the configuration, credentials and token without delivering a message\n"+
+			"and prints a pass/fail report. Exits non-zero if any check fails.")
+	flags.BoolVar(&online, "online", "Also refresh the token, check its scopes and call the Gmail API")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	if len(flags.Args()) > 0 {
+		flags.UsageError("unexpected argument %q", flags.Args()[0])
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-api-transport")
+
+	fmt.Printf("Checking gmail-api-transport configuration %s\n\n", flags.ConfigFile())
+	report := &internal.ConfigReport{}
+	cfg, err := loadConfig(flags, logger)
+	if report.Check("config", err, "parsed %s", flags.ConfigFile()) {
+		deliverer, err := gmaildeliver.New(cfg, cli.Telemetry(logger, nil))
+		report.Check("settings", err, "all options are valid")
+		internal.CheckAPIUserID(report, cfg.UserID)
+		token := internal.CheckCommon(report, &cfg.Common)
+		if online && token != nil && !report.Failed() {
+			probeAPI(report, deliverer)
+		}
+	}
+
+	report.Print(os.Stdout)
+	if report.Failed() {
+		return internal.ExitFailure
+	}
+	return 0
+}
+
+// probeAPI refreshes the token, checks its scopes and fetches the profile
+func probeAPI(report *internal.ConfigReport, deliverer *gmaildeliver.Deliverer) {
+	cfg := deliverer.Config()
+	service, tokenSource, err := deliverer.Service()
+	if !report.Check("token_refresh", err, "obtained an access token") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.APITimeout)*time.Second)
+	defer cancel()
+
+	if token, err := tokenSource.Token(); err == nil {
+		internal.CheckScopes(ctx, report, token.AccessToken, internal.ScopeGmailModify)
+	}
+
+	profile, err := service.Users.GetProfile(cfg.UserID).Context(ctx).Do()
+	if err != nil {
+		report.Fail("gmail_api", "users.getProfile: %v", err)
+		return
+	}
+	report.Pass("gmail_api", "connected to %s (%d messages)", profile.EmailAddress, profile.MessagesTotal)
+}
@@ -0,0 +1,210 @@
+// Package apitransport implements gmail-api-transport, which delivers a
+// message from stdin with the Gmail API
+package apitransport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Main runs the transport with the command line arguments following program,
+// the name shown in usage messages
+// "check-config" as the first argument runs CheckConfig instead
+func Main(program string, args []string) {
+	start := time.Now()
+	var testAPI, dryRunMode bool
+
+	if len(args) > 0 && args[0] == "check-config" {
+		os.Exit(CheckConfig(program+" check-config", args[1:]))
+	}
+
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file>\n       "+program+" check-config [options] [--config] <config-file>",
+		"Reads email message from stdin and imports it to Gmail using the API.")
+	flags.BoolVar(&testAPI, "test-api", "Test API connection (shows Gmail language settings)")
+	flags.BoolVar(&dryRunMode, "dry-run", "Show the request that would deliver the message without contacting Gmail")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	if len(flags.Args()) > 0 {
+		flags.UsageError("unexpected argument %q", flags.Args()[0])
+	}
+
+	// Initialize logger
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-api-transport")
+	metrics := internal.NewMetrics()
+
+	logger.Debug("starting gmail-api-transport", "config_file", flags.ConfigFile())
+
+	// Load configuration
+	configStart := time.Now()
+	cfg, err := loadConfig(flags, logger)
+	if err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+
+	// Validate configuration
+	deliverer, err := gmaildeliver.New(cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+
+	// Apply logging options now that the configuration is known
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+
+	// A dry run reads the message and prints what would be sent, without
+	// refreshing the token, exporting traces or writing audit records and metrics
+	if dryRunMode {
+		logger.Debug("reading message from stdin")
+		message, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			logger.Fatal("failed to read from stdin", err)
+		}
+		if len(message) == 0 {
+			logger.Fatal("no message received from stdin", nil)
+		}
+		if err := deliverer.DryRun(os.Stdout, message); err != nil {
+			logger.Fatal("dry run failed", err)
+		}
+		return
+	}
+
+	cli.WriteMetricsOnClose(logger, metrics, &cfg.Common, "gmail-api-transport")
+	configEnd := time.Now()
+
+	// Start tracing; spans are flushed when the logger is closed on exit
+	tracerProvider, err := cli.StartTracing(logger, &cfg.Common, "gmail-api-transport")
+	if err != nil {
+		logger.Fatal("invalid tracing configuration", err)
+	}
+
+	logger.Debug("configuration loaded successfully",
+		"user_id", cfg.UserID,
+		"not_spam", cfg.NotSpam,
+		"use_insert", cfg.UseInsert)
+
+	// Overall budget for the whole run, covering retries and filter waits
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.OperationTimeout)*time.Second)
+	defer cancel()
+
+	// Root span for the run, backdated to cover loading the configuration
+	tracer := internal.Tracer(tracerProvider)
+	ctx, span := tracer.Start(ctx, "gmail-api-transport",
+		trace.WithTimestamp(configStart),
+		trace.WithAttributes(attribute.String("gmail.user_id", cfg.UserID)))
+	logger.OnClose(func() { span.End() })
+	_, configSpan := tracer.Start(ctx, "config.load", trace.WithTimestamp(configStart))
+	configSpan.End(trace.WithTimestamp(configEnd))
+
+	// If test-api mode, just test the API connection and exit
+	if testAPI {
+		logger.Info("testing Gmail API connection")
+		langSettings, err := deliverer.TestConnection(ctx)
+		if err != nil {
+			internal.EndSpan(span, err)
+			logger.Fatal("API test failed", err)
+		}
+		fmt.Println("\n=== Gmail API Connection Test ===")
+		fmt.Println("Status: SUCCESS")
+		fmt.Printf("User ID: %s\n", cfg.UserID)
+		fmt.Printf("Display Language: %s\n", langSettings.DisplayLanguage)
+		fmt.Println("=================================")
+		return
+	}
+
+	// Pre-validate and refresh token before reading message from stdin
+	// This ensures we don't read and lose a message if auth fails
+	logger.Debug("validating OAuth2 token before reading message")
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	err = deliverer.PrepareToken()
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		internal.EndSpan(span, err)
+		logger.Fatal("token validation failed", err)
+	}
+	logger.Debug("token validated successfully")
+
+	// Read email message from stdin
+	logger.Debug("reading message from stdin")
+	message, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		logger.Fatal("failed to read from stdin", err)
+	}
+
+	if len(message) == 0 {
+		logger.Fatal("no message received from stdin", nil)
+	}
+
+	if messageID := internal.MessageID(message); messageID != "" {
+		logger.SetAttr("message_id", messageID)
+		span.SetAttributes(attribute.String("email.message_id", messageID))
+	}
+	span.SetAttributes(attribute.Int("email.size", len(message)))
+	logger.Debug("message received", "bytes", len(message))
+
+	// Deliver message to Gmail
+	result, err := deliverer.Deliver(ctx, bytes.NewReader(message), deliver.Options{
+		Sender:    os.Getenv("SENDER"),
+		Recipient: os.Getenv("RECIPIENT"),
+	})
+	result.Duration = time.Since(start).Seconds()
+	span.SetAttributes(attribute.String("delivery.outcome", result.Status))
+	if err != nil {
+		internal.EndSpan(span, err)
+		if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+			logger.Result(result)
+		}
+		logger.Fatal("message delivery failed", err)
+	}
+	if result.Warning != "" {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", result.Warning)
+	}
+
+	if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+		logger.Result(result)
+		return
+	}
+
+	// Success message for Exim - first line of stdout
+	logger.Success("Message delivered successfully to Gmail")
+}
+
+// loadConfig reads and parses the configuration file, applying environment
+// and command line overrides
+func loadConfig(flags *internal.FlagSet, logger *internal.Logger) (*gmaildeliver.Config, error) {
+	filename := flags.ConfigFile()
+	logger.Debug("loading configuration", "file", filename)
+
+	var cfg gmaildeliver.Config
+	if err := flags.LoadConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	// Expand relative paths
+	internal.ExpandCommonPaths(filename, &cfg.Common)
+
+	logger.Debug("paths expanded",
+		"credentials_file", cfg.CredentialsFile,
+		"token_file", cfg.TokenFile,
+		"state_dir", cfg.StateDir,
+		"dedup_index", cfg.DedupIndex,
+		"log_file", cfg.LogFile,
+		"audit_log", cfg.AuditLog,
+		"metrics_dir", cfg.MetricsDir)
+
+	return &cfg, nil
+}
@@ -0,0 +1,155 @@
+// Package auth implements the commands that obtain and inspect OAuth2 tokens
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"gmail-api-client/internal"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Main runs the interactive OAuth2 flow to authorize the application and
+// save the token, with the command line arguments following program
+func Main(program string, args []string) {
+	flags := internal.NewFlagSet(program, "[options] <credentials.json> <token.json>",
+		"Interactive OAuth2 flow to obtain and save a token.\n"+
+			"This starts a local web server on port 8080 for the OAuth callback.")
+	flags.Parse(args)
+	if len(flags.Args()) != 2 {
+		flags.UsageError("expected <credentials.json> and <token.json>, got %d arguments", len(flags.Args()))
+	}
+
+	credentialsFile := flags.Args()[0]
+	tokenFile := flags.Args()[1]
+
+	// Warnings and errors go to stderr alongside the interactive output
+	logger := internal.NewLogger(true, "gmail-auth")
+	logger.SetLevel(internal.LevelInfo)
+	logger.SetOutput(os.Stderr)
+
+	// Read credentials
+	credentials, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		logger.Fatal("unable to read credentials file", err)
+	}
+
+	// Parse OAuth2 config with required scopes
+	// gmail.modify includes both insert and settings.basic permissions
+	config, err := google.ConfigFromJSON(credentials, gmail.GmailModifyScope)
+	if err != nil {
+		logger.Fatal("unable to parse credentials", err)
+	}
+
+	// Use localhost redirect URL for production OAuth
+	config.RedirectURL = "http://localhost:8080/oauth2callback"
+
+	// Get token using localhost web server callback
+	token := getTokenFromWeb(config, logger)
+
+	// Save token using shared oauth package with secure 0600 permissions
+	if err := internal.SaveToken(tokenFile, token, 0600, logger); err != nil {
+		logger.Fatal("unable to save token", err)
+	}
+
+	fmt.Printf("\nToken saved to: %s\n", tokenFile)
+	fmt.Println("You can now use this token with the transports.")
+}
+
+// getTokenFromWeb requests a token from the web using a local callback server
+func getTokenFromWeb(config *oauth2.Config, logger *internal.Logger) *oauth2.Token {
+	// Generate auth URL with offline access and force approval prompt
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+
+	// Channels to receive the authorization code or error
+	codeChan := make(chan string)
+	errChan := make(chan error)
+
+	// Start local HTTP server to receive the callback
+	server := &http.Server{Addr: ":8080"}
+
+	http.HandleFunc("/oauth2callback", func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			errChan <- fmt.Errorf("no authorization code received")
+			http.Error(w, "No authorization code received", http.StatusBadRequest)
+			return
+		}
+
+		// Send success response to browser
+		fmt.Fprintf(w, "<html><body><h1>Authorization Successful!</h1><p>You can close this window and return to the terminal.</p></body></html>")
+
+		// Send code to main goroutine
+		codeChan <- code
+	})
+
+	// Start the server in a goroutine
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("failed to start server: %w", err)
+		}
+	}()
+
+	fmt.Println("=================================================================")
+	fmt.Println("Gmail OAuth2 Authorization")
+	fmt.Println("=================================================================")
+	fmt.Println("\nOpening your browser to authorize the application...")
+	fmt.Println("\nIf the browser doesn't open automatically, visit this URL:")
+	fmt.Println(authURL)
+	fmt.Println()
+
+	// Try to open the browser
+	openBrowser(authURL, logger)
+
+	// Wait for authorization code or error
+	var authCode string
+	select {
+	case authCode = <-codeChan:
+		fmt.Println("\n✓ Authorization code received!")
+	case err := <-errChan:
+		logger.Fatal("error during authorization", err)
+	}
+
+	// Shutdown the server
+	if err := server.Shutdown(context.Background()); err != nil {
+		logger.Warn("error shutting down callback server", "error", err)
+	}
+
+	fmt.Println("Exchanging authorization code for access token...")
+
+	// Exchange authorization code for token
+	token, err := config.Exchange(context.Background(), authCode)
+	if err != nil {
+		logger.Fatal("unable to retrieve token", err)
+	}
+
+	fmt.Println("✓ Token obtained successfully!")
+
+	return token
+}
+
+// openBrowser attempts to open the default browser to the specified URL
+func openBrowser(url string, logger *internal.Logger) {
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = exec.Command("xdg-open", url).Start()
+	case "windows":
+		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		err = exec.Command("open", url).Start()
+	default:
+		err = fmt.Errorf("unsupported platform")
+	}
+
+	if err != nil {
+		logger.Warn("unable to open browser automatically, please open the URL manually", "error", err)
+	}
+}
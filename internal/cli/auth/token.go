@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gmail-api-client/internal"
+)
+
+// Token implements the token command, which shows a token's state and
+// refreshes it if it expired, and returns the exit code
+func Token(program string, args []string) int {
+	var forceRefresh, showScopes bool
+	flags := internal.NewFlagSet(program, "[options] <credentials.json> <token.json>",
+		"Shows when a saved token's access token expires, refreshing and saving it\n"+
+			"first if it has expired.")
+	flags.BoolVar(&forceRefresh, "refresh", "Refresh the access token even if it is still valid")
+	flags.BoolVar(&showScopes, "scopes", "Look up the scopes granted to the token")
+	flags.Parse(args)
+	if len(flags.Args()) != 2 {
+		flags.UsageError("expected <credentials.json> and <token.json>, got %d arguments", len(flags.Args()))
+	}
+	credentialsFile := flags.Args()[0]
+	tokenFile := flags.Args()[1]
+	// The report below says what happened; the helpers' logs aren't shown
+	logger := internal.NewLoggerWithHandler(slog.DiscardHandler, "gmail-token")
+
+	originalToken, err := internal.LoadToken(tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: loading token: %v\n", program, err)
+		return internal.ExitFailure
+	}
+	oauthConfig, err := internal.LoadOAuthConfig(credentialsFile, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: loading OAuth config: %v\n", program, err)
+		return internal.ExitFailure
+	}
+
+	fmt.Printf("Token file:    %s\n", tokenFile)
+	if originalToken.RefreshToken == "" {
+		fmt.Println("Refresh token: missing; run the auth command again")
+	} else {
+		fmt.Println("Refresh token: present")
+	}
+
+	// An expired copy makes the token source refresh it
+	current := *originalToken
+	if forceRefresh {
+		current.Expiry = time.Now().Add(-time.Minute)
+	}
+	tokenSource := internal.CreateTokenSource(oauthConfig, &current, nil)
+	freshToken, _, err := internal.RefreshToken(tokenSource, originalToken, logger)
+	if err != nil {
+		fmt.Printf("Access token:  expired %s and could not be refreshed\n", originalToken.Expiry.Format(time.RFC3339))
+		fmt.Fprintf(os.Stderr, "%s: %v\n", program, err)
+		return internal.ExitCode(err)
+	}
+	if internal.TokenChanged(originalToken, freshToken) {
+		if err := internal.SaveTokenIfChanged(tokenFile, originalToken, freshToken, logger); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: saving refreshed token: %v\n", program, err)
+			return internal.ExitFailure
+		}
+		fmt.Printf("Access token:  refreshed, valid until %s\n", freshToken.Expiry.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Access token:  valid until %s\n", freshToken.Expiry.Format(time.RFC3339))
+	}
+
+	if showScopes {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		scopes, err := internal.TokenScopes(ctx, freshToken.AccessToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: looking up scopes: %v\n", program, err)
+			return internal.ExitFailure
+		}
+		fmt.Printf("Scopes:        %s\n", strings.Join(scopes, " "))
+	}
+	return 0
+}
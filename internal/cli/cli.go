@@ -0,0 +1,73 @@
+// Package cli holds the setup shared by the commands: logging, metrics and
+// tracing as the configuration asks
+package cli
+
+import (
+	"context"
+	"os"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger creates the logger of a command, writing every level to stderr
+// in verbose mode
+func NewLogger(verbose bool, component string) *internal.Logger {
+	logger := internal.NewLogger(verbose, component)
+	if verbose {
+		logger.SetOutput(os.Stderr)
+	}
+	return logger
+}
+
+// Configure applies the logging options of the loaded configuration and
+// adds the account to every log line
+// Verbose mode is turned on here too when it comes from the environment or
+// the configuration file rather than the command line
+func Configure(logger *internal.Logger, common *internal.Common) error {
+	if err := logger.Configure(common); err != nil {
+		return err
+	}
+	if common.Verbose {
+		logger.SetVerbose(os.Stderr)
+	}
+	logger.SetAttr("account", common.UserID)
+	return nil
+}
+
+// Telemetry hands a command's logger and metrics, if not nil, to the
+// delivery packages
+// Spans follow the command's root span in the context passed to them
+func Telemetry(logger *internal.Logger, metrics *internal.Metrics) deliver.Telemetry {
+	telemetry := deliver.Telemetry{Logger: logger.Handler()}
+	if metrics != nil {
+		telemetry.Metrics = metrics
+	}
+	return telemetry
+}
+
+// WriteMetricsOnClose adds the metrics of this run to the textfile collector
+// file in metrics_dir, if configured, when logger is closed
+func WriteMetricsOnClose(logger *internal.Logger, metrics *internal.Metrics, common *internal.Common, program string) {
+	if common.MetricsDir == "" {
+		return
+	}
+	logger.OnClose(func() {
+		if err := metrics.WriteTextfile(common.MetricsDir, program); err != nil {
+			logger.Warn("failed to write metrics", "error", err)
+		}
+	})
+}
+
+// StartTracing returns the tracer provider for the command's root span
+// Spans are flushed when logger is closed
+func StartTracing(logger *internal.Logger, common *internal.Common, program string) (trace.TracerProvider, error) {
+	provider, shutdown, err := internal.InitTracing(context.Background(), common, program, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.OnClose(shutdown)
+	return provider, nil
+}
@@ -0,0 +1,678 @@
+// Package exportcmd implements gmailctl export, which copies messages from
+// Gmail into a Maildir or mbox file
+package exportcmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+	"gmail-api-client/pkg/mailbox"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Output formats
+const (
+	formatMaildir = "maildir"
+	formatMbox    = "mbox"
+)
+
+// Ways of recording labels
+const (
+	// labelsHeader adds an X-Gmail-Labels header to each message
+	labelsHeader = "header"
+	// labelsSidecar leaves messages unchanged; labels are only in the manifest
+	labelsSidecar = "sidecar"
+)
+
+// options are the command line options of an export
+type options struct {
+	format           string
+	query            string
+	labelMode        string
+	includeSpamTrash bool
+	full             bool
+	verify           bool
+	concurrency      int
+	reportFile       string
+}
+
+// failure describes a message that couldn't be exported
+type failure struct {
+	GmailID string `json:"gmail_id"`
+	Error   string `json:"error"`
+}
+
+// report summarises an export run
+type report struct {
+	Exported int `json:"exported"`
+	// Skipped messages were exported by an earlier run, have since been
+	// deleted, or are in spam or trash
+	Skipped     int  `json:"skipped"`
+	Failed      int  `json:"failed"`
+	Incremental bool `json:"incremental"`
+	// HistoryID is where the next incremental run starts, if this run
+	// completed
+	HistoryID   uint64    `json:"history_id,omitempty"`
+	Interrupted bool      `json:"interrupted,omitempty"`
+	Duration    float64   `json:"duration"`
+	Failures    []failure `json:"failures,omitempty"`
+}
+
+// Main exports messages to the output named on the command line following
+// program
+func Main(program string, args []string) {
+	start := time.Now()
+	opts := options{concurrency: 4}
+
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file> <output>",
+		"Exports Gmail messages to a Maildir or mbox file. Later runs add only\n"+
+			"the messages that arrived since.")
+	flags.StringVar(&opts.format, "format", "format", "Output format: maildir or mbox (default maildir)")
+	flags.StringVar(&opts.query, "query", "query", "Export only messages matching a Gmail search, e.g. \"label:work older_than:1y\"")
+	flags.StringVar(&opts.labelMode, "labels", "mode", "Record labels in an X-Gmail-Labels \"header\" or only in the \"sidecar\" manifest (default header)")
+	flags.BoolVar(&opts.includeSpamTrash, "include-spam-trash", "Also export messages in spam and trash")
+	flags.BoolVar(&opts.full, "full", "List every matching message instead of only those added since the last run")
+	flags.BoolVar(&opts.verify, "verify", "Check the exported messages against the manifest checksums without contacting Gmail")
+	flags.IntVar(&opts.concurrency, "concurrency", "n", "Messages fetched at once (default 4)")
+	flags.StringVar(&opts.reportFile, "report", "file", "Write a JSON report of the export, including failures, to file")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	switch len(flags.Args()) {
+	case 0:
+		flags.UsageError("no output Maildir or mbox file given")
+	case 1:
+	default:
+		flags.UsageError("unexpected argument %q", flags.Args()[1])
+	}
+	output := flags.Args()[0]
+	if opts.format == "" {
+		opts.format = formatMaildir
+	}
+	if opts.labelMode == "" {
+		opts.labelMode = labelsHeader
+	}
+	if opts.format != formatMaildir && opts.format != formatMbox {
+		flags.UsageError("unknown format %q (expected maildir or mbox)", opts.format)
+	}
+	if opts.labelMode != labelsHeader && opts.labelMode != labelsSidecar {
+		flags.UsageError("unknown --labels mode %q (expected header or sidecar)", opts.labelMode)
+	}
+	if opts.concurrency < 1 {
+		flags.UsageError("--concurrency must be at least 1")
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-export")
+	metrics := internal.NewMetrics()
+	logger.Debug("starting gmail-export", "config_file", flags.ConfigFile(), "output", output)
+
+	// Verifying needs only the output, not a working configuration
+	if opts.verify {
+		ok, err := verify(os.Stdout, output)
+		if err != nil {
+			logger.Fatal("verification failed", err)
+		}
+		if !ok {
+			os.Exit(internal.ExitFailure)
+		}
+		return
+	}
+
+	var cfg gmaildeliver.Config
+	if err := flags.LoadConfig(&cfg); err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+	internal.ExpandCommonPaths(flags.ConfigFile(), &cfg.Common)
+
+	deliverer, err := gmaildeliver.New(&cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+	cli.WriteMetricsOnClose(logger, metrics, &cfg.Common, "gmail-export")
+
+	// An interrupt stops the export after the messages in flight; the next
+	// run carries on from the manifest
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rep, err := run(ctx, deliverer, output, opts, logger, metrics)
+	if err != nil {
+		logger.Fatal("export failed", err)
+	}
+	rep.Duration = time.Since(start).Seconds()
+
+	if opts.reportFile != "" {
+		if err := writeReport(opts.reportFile, rep); err != nil {
+			logger.Fatal("failed to write report", err)
+		}
+	}
+	if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+		data, _ := json.Marshal(rep)
+		fmt.Println(string(data))
+	} else {
+		printReport(os.Stdout, rep)
+	}
+
+	switch {
+	case rep.Interrupted:
+		logger.Close()
+		os.Exit(internal.ExitTempFail)
+	case rep.Failed > 0:
+		logger.Close()
+		os.Exit(internal.ExitFailure)
+	}
+}
+
+// exporter holds what the workers of one run share
+type exporter struct {
+	opts     options
+	logger   *internal.Logger
+	cfg      *gmaildeliver.Config
+	service  *gmail.Service
+	retryCfg *internal.RetryConfig
+	// labelNames maps user label IDs to their names
+	labelNames map[string]string
+	manifest   *manifest
+
+	// Only the goroutine writing messages in order uses the output
+	mbox    *mailbox.MboxWriter
+	maildir *mailbox.MaildirWriter
+}
+
+// fetched is a message ready to be written
+type fetched struct {
+	msg    *gmail.Message
+	stored []byte
+	labels []string
+	date   time.Time
+}
+
+// fetchResult is the outcome of fetching one message; msg is nil for a
+// message that is skipped
+type fetchResult struct {
+	id  string
+	msg *fetched
+	err error
+}
+
+// fetchJob asks a worker to fetch a message and send the result to done
+type fetchJob struct {
+	id   string
+	done chan<- fetchResult
+}
+
+// run exports the messages to output and returns the report
+// It fails only if the export can't start; failures of single messages are
+// listed in the report
+func run(ctx context.Context, deliverer *gmaildeliver.Deliverer, output string, opts options, logger *internal.Logger, metrics deliver.Metrics) (*report, error) {
+	cfg := deliverer.Config()
+	e := &exporter{
+		opts:     opts,
+		logger:   logger,
+		cfg:      cfg,
+		retryCfg: internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, metrics),
+	}
+
+	var err error
+	if opts.format == formatMaildir {
+		e.maildir, err = mailbox.CreateMaildir(output)
+	} else {
+		e.mbox, err = mailbox.CreateMbox(output)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening output: %w", err)
+	}
+	if e.mbox != nil {
+		defer func() {
+			if err := e.mbox.Close(); err != nil {
+				logger.Warn("failed to close mbox", "error", err)
+			}
+		}()
+	}
+
+	manifestFile, stateFile := outputFiles(output, opts.format)
+	e.manifest, err = openManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := e.manifest.close(); err != nil {
+			logger.Warn("failed to close manifest", "error", err)
+		}
+	}()
+	var state exportState
+	if err := internal.UpdateStateFile(stateFile, &state, func() error { return nil }); err != nil {
+		return nil, err
+	}
+
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading token: %w", err)
+	}
+	service, tokenSource, err := deliverer.Service()
+	if err != nil {
+		return nil, fmt.Errorf("creating Gmail service: %w", err)
+	}
+	defer func() {
+		if token, err := tokenSource.Token(); err == nil {
+			if err := internal.SaveTokenIfChanged(cfg.TokenFile, originalToken, token, logger); err != nil {
+				logger.Warn("failed to save token", "error", err)
+			}
+		}
+	}()
+	e.service = service
+
+	if err := e.loadLabels(ctx); err != nil {
+		return nil, err
+	}
+
+	// The mailbox's history ID before listing is where the next run starts,
+	// so nothing arriving during this run is missed
+	started := time.Now()
+	var profile *gmail.Profile
+	err = internal.RetryOperationContext(ctx, e.retryCfg, logger, func(ctx context.Context) error {
+		var err error
+		profile, err = service.Users.GetProfile(cfg.UserID).Context(ctx).Do()
+		return err
+	}, "get profile")
+	if err != nil {
+		return nil, fmt.Errorf("getting profile: %w", err)
+	}
+
+	rep := &report{}
+	var ids []string
+	if !opts.full && state.HistoryID != 0 && state.Query == opts.query && state.IncludeSpamTrash == opts.includeSpamTrash {
+		ids, err = e.addedSince(ctx, state.HistoryID, state.Started)
+		if isNotFound(err) {
+			logger.Warn("history too old for an incremental export, listing all messages", "history_id", state.HistoryID)
+		} else if err != nil {
+			return nil, err
+		} else {
+			rep.Incremental = true
+		}
+	}
+	if !rep.Incremental {
+		ids, err = e.list(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("messages to export", "count", len(ids), "incremental", rep.Incremental)
+	e.exportAll(ctx, ids, rep)
+
+	rep.Interrupted = ctx.Err() != nil
+	sort.Slice(rep.Failures, func(i, j int) bool { return rep.Failures[i].GmailID < rep.Failures[j].GmailID })
+
+	// Only a complete run moves the starting point on, so failed messages
+	// are tried again next time
+	if !rep.Interrupted && rep.Failed == 0 {
+		err := internal.UpdateStateFile(stateFile, &state, func() error {
+			state = exportState{
+				HistoryID:        profile.HistoryId,
+				Query:            opts.query,
+				IncludeSpamTrash: opts.includeSpamTrash,
+				Started:          started.UTC(),
+				Updated:          time.Now().UTC(),
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		rep.HistoryID = profile.HistoryId
+	}
+	return rep, nil
+}
+
+// exportAll exports the messages with ids, adding the outcomes to rep
+// Workers fetch several messages at once, but messages are written in the
+// order of ids, so the output doesn't depend on --concurrency; only a few
+// fetched messages wait for their turn at a time
+func (e *exporter) exportAll(ctx context.Context, ids []string, rep *report) {
+	jobs := make(chan fetchJob)
+	var wg sync.WaitGroup
+	for i := 0; i < e.opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := ctx.Err(); err != nil {
+					job.done <- fetchResult{id: job.id, err: err}
+					continue
+				}
+				msg, err := e.fetch(ctx, job.id)
+				job.done <- fetchResult{id: job.id, msg: msg, err: err}
+			}
+		}()
+	}
+
+	// pending holds the results to write, in order
+	pending := make(chan chan fetchResult, 2*e.opts.concurrency)
+	written := make(chan struct{})
+	var mu sync.Mutex
+	go func() {
+		defer close(written)
+		for done := range pending {
+			result := <-done
+			err := result.err
+			exported := false
+			if err == nil && result.msg != nil {
+				err = e.write(result.msg)
+				exported = err == nil
+			}
+			mu.Lock()
+			switch {
+			case err != nil && ctx.Err() != nil:
+			case err != nil:
+				rep.Failed++
+				rep.Failures = append(rep.Failures, failure{GmailID: result.id, Error: err.Error()})
+				e.logger.Warn("failed to export message", "gmail_id", result.id, "error", err)
+			case exported:
+				rep.Exported++
+			default:
+				rep.Skipped++
+			}
+			mu.Unlock()
+		}
+	}()
+
+	for _, id := range ids {
+		if e.manifest.has(id) {
+			mu.Lock()
+			rep.Skipped++
+			mu.Unlock()
+			continue
+		}
+		// Every queued result gets a job, so the writer never waits for a
+		// fetch that wasn't started
+		done := make(chan fetchResult, 1)
+		select {
+		case pending <- done:
+			jobs <- fetchJob{id: id, done: done}
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	close(pending)
+	wg.Wait()
+	<-written
+}
+
+// loadLabels reads the names of the mailbox's labels
+func (e *exporter) loadLabels(ctx context.Context) error {
+	var resp *gmail.ListLabelsResponse
+	err := internal.RetryOperationContext(ctx, e.retryCfg, e.logger, func(ctx context.Context) error {
+		var err error
+		resp, err = e.service.Users.Labels.List(e.cfg.UserID).Context(ctx).Do()
+		return err
+	}, "label list")
+	if err != nil {
+		return fmt.Errorf("listing labels: %w", err)
+	}
+	e.labelNames = make(map[string]string, len(resp.Labels))
+	for _, label := range resp.Labels {
+		e.labelNames[label.Id] = label.Name
+	}
+	return nil
+}
+
+// list returns the IDs of all messages matching the query and the
+// additional search terms in extra, oldest first
+func (e *exporter) list(ctx context.Context, extra string) ([]string, error) {
+	query := strings.TrimSpace(e.opts.query + " " + extra)
+	var ids []string
+	pageToken := ""
+	for {
+		var resp *gmail.ListMessagesResponse
+		err := internal.RetryOperationContext(ctx, e.retryCfg, e.logger, func(ctx context.Context) error {
+			call := e.service.Users.Messages.List(e.cfg.UserID).
+				Q(query).
+				IncludeSpamTrash(e.opts.includeSpamTrash).
+				MaxResults(500).
+				Context(ctx)
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			var err error
+			resp, err = call.Do()
+			return err
+		}, "message list")
+		if err != nil {
+			return nil, fmt.Errorf("listing messages: %w", err)
+		}
+		for _, msg := range resp.Messages {
+			ids = append(ids, msg.Id)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	// Gmail lists the newest first
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, nil
+}
+
+// addedSince returns the IDs of messages added since a history ID, oldest
+// first, restricted to those matching the query if there is one
+// Only messages dated after a day before since are searched for the query,
+// so an incremental run doesn't list the whole mailbox; a zero since
+// searches them all
+// History older than about a week is gone; that is a not found error
+func (e *exporter) addedSince(ctx context.Context, historyID uint64, since time.Time) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	pageToken := ""
+	for {
+		var resp *gmail.ListHistoryResponse
+		err := internal.RetryOperationContext(ctx, e.retryCfg, e.logger, func(ctx context.Context) error {
+			call := e.service.Users.History.List(e.cfg.UserID).
+				StartHistoryId(historyID).
+				HistoryTypes("messageAdded").
+				MaxResults(500).
+				Context(ctx)
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			var err error
+			resp, err = call.Do()
+			return err
+		}, "history list")
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range resp.History {
+			for _, added := range h.MessagesAdded {
+				if id := added.Message.Id; !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	// History can't be searched, so intersect with the query's results
+	// since the last run; the margin covers clock skew and slow arrivals
+	if e.opts.query != "" && len(ids) > 0 {
+		bound := ""
+		if !since.IsZero() {
+			bound = fmt.Sprintf("after:%d", since.Add(-24*time.Hour).Unix())
+		}
+		matching, err := e.list(ctx, bound)
+		if err != nil {
+			return nil, err
+		}
+		match := make(map[string]bool, len(matching))
+		for _, id := range matching {
+			match[id] = true
+		}
+		kept := ids[:0]
+		for _, id := range ids {
+			if match[id] {
+				kept = append(kept, id)
+			}
+		}
+		ids = kept
+	}
+	return ids, nil
+}
+
+// fetch fetches one message and prepares it for writing
+// It returns nil without an error for a message that was deleted since it
+// was listed, or is in spam or trash without --include-spam-trash
+func (e *exporter) fetch(ctx context.Context, id string) (*fetched, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.cfg.OperationTimeout)*time.Second)
+	defer cancel()
+
+	var msg *gmail.Message
+	err := internal.RetryOperationContext(ctx, e.retryCfg, e.logger, func(ctx context.Context) error {
+		var err error
+		msg, err = e.service.Users.Messages.Get(e.cfg.UserID, id).Format("raw").Context(ctx).Do()
+		return err
+	}, "message get")
+	if isNotFound(err) {
+		e.logger.Info("message deleted before it could be exported", "gmail_id", id)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting message: %w", err)
+	}
+	if !e.opts.includeSpamTrash && (hasLabel(msg, "SPAM") || hasLabel(msg, "TRASH")) {
+		e.logger.Debug("skipping message in spam or trash", "gmail_id", id)
+		return nil, nil
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("decoding message: %w", err)
+	}
+	names := make([]string, 0, len(msg.LabelIds))
+	for _, labelID := range msg.LabelIds {
+		if name, ok := e.labelNames[labelID]; ok && labelID != name {
+			names = append(names, name)
+		} else {
+			names = append(names, mailbox.SystemLabelName(labelID))
+		}
+	}
+
+	stored := mailbox.Normalize(raw)
+	if e.opts.labelMode == labelsHeader {
+		// A message imported from an mbox may carry a header from before
+		stored = mailbox.SetGmailLabels(stored, names)
+	}
+	return &fetched{
+		msg:    msg,
+		stored: stored,
+		labels: names,
+		date:   time.UnixMilli(msg.InternalDate).UTC(),
+	}, nil
+}
+
+// write writes a fetched message to the output and records it in the
+// manifest
+func (e *exporter) write(f *fetched) error {
+	msg := f.msg
+	var key string
+	var err error
+	if e.maildir != nil {
+		key, err = e.maildir.Write(f.stored, msg.Id, f.date, !hasLabel(msg, "UNREAD"), hasLabel(msg, "STARRED"))
+	} else {
+		key, err = e.mbox.Write(f.stored, f.date)
+	}
+	if err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+
+	sum := sha256.Sum256(f.stored)
+	entry := &manifestEntry{
+		GmailID:  msg.Id,
+		ThreadID: msg.ThreadId,
+		Location: locationOf(key, e.opts.format),
+		Date:     f.date,
+		Labels:   f.labels,
+		Size:     len(f.stored),
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+	if err := e.manifest.add(entry); err != nil {
+		return err
+	}
+	e.logger.Debug("message exported", "gmail_id", msg.Id, "location", entry.Location)
+	return nil
+}
+
+// hasLabel reports whether a message has a label
+func hasLabel(msg *gmail.Message, labelID string) bool {
+	for _, id := range msg.LabelIds {
+		if id == labelID {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether an API call failed with 404 Not Found
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// printReport writes the summary of an export
+func printReport(w io.Writer, rep *report) {
+	kind := "full"
+	if rep.Incremental {
+		kind = "incremental"
+	}
+	fmt.Fprintf(w, "Exported %d messages (%s), %d skipped, %d failed\n", rep.Exported, kind, rep.Skipped, rep.Failed)
+	if rep.Interrupted {
+		fmt.Fprintln(w, "Interrupted; run the same command again to resume")
+	}
+	if len(rep.Failures) > 0 {
+		fmt.Fprintln(w, "Failures:")
+		for _, f := range rep.Failures {
+			fmt.Fprintf(w, "  %s: %s\n", f.GmailID, f.Error)
+		}
+	}
+}
+
+// writeReport writes the report as JSON
+func writeReport(filename string, rep *report) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
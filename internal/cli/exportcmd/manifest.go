@@ -0,0 +1,136 @@
+package exportcmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestEntry is a line of the manifest, describing an exported message
+type manifestEntry struct {
+	GmailID  string `json:"gmail_id"`
+	ThreadID string `json:"thread_id,omitempty"`
+	// Location is the message's Maildir file name without flags, or the
+	// offset of its "From " line in the mbox file
+	Location string    `json:"location"`
+	Date     time.Time `json:"date"`
+	Labels   []string  `json:"labels,omitempty"`
+	Size     int       `json:"size"`
+	// SHA256 is the checksum of the message as stored, which is what
+	// reading it back with an mbox or Maildir reader returns
+	SHA256 string `json:"sha256"`
+}
+
+// exportState is kept between runs for incremental export
+type exportState struct {
+	HistoryID        uint64 `json:"history_id"`
+	Query            string `json:"query"`
+	IncludeSpamTrash bool   `json:"include_spam_trash"`
+	// Started is when the run that stored HistoryID began, bounding the
+	// search for messages matching Query in the next run
+	Started time.Time `json:"started,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// outputFiles returns the manifest and state files of an export: hidden
+// files inside a Maildir, or files next to an mbox file
+func outputFiles(output, format string) (manifest, state string) {
+	if format == formatMaildir {
+		return filepath.Join(output, ".gmail-export.jsonl"), filepath.Join(output, ".gmail-export.state")
+	}
+	return output + ".gmail-export.jsonl", output + ".gmail-export.state"
+}
+
+// locationOf returns a message's location within the output from its key
+func locationOf(key, format string) string {
+	if format == formatMaildir {
+		return filepath.Base(key)
+	}
+	return key[strings.LastIndex(key, "@")+1:]
+}
+
+// manifest records the exported messages; new entries are appended as each
+// message is written
+type manifest struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*manifestEntry
+}
+
+// loadManifest reads a manifest's entries by Gmail ID
+// A missing file has none; a truncated last line, left by a crash, is
+// ignored
+func loadManifest(filename string) (map[string]*manifestEntry, error) {
+	entries := make(map[string]*manifestEntry)
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.GmailID != "" {
+			entries[entry.GmailID] = &entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// openManifest loads a manifest and opens it for appending
+func openManifest(filename string) (*manifest, error) {
+	entries, err := loadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening manifest: %w", err)
+	}
+	return &manifest{file: file, entries: entries}, nil
+}
+
+// has reports whether a message has been exported
+func (m *manifest) has(gmailID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[gmailID] != nil
+}
+
+// add records an exported message
+func (m *manifest) add(entry *manifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[entry.GmailID] = entry
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
+
+// close syncs and closes the manifest
+func (m *manifest) close() error {
+	if err := m.file.Sync(); err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
@@ -0,0 +1,81 @@
+package exportcmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"gmail-api-client/pkg/mailbox"
+)
+
+// verify reads an export back and compares every message with the
+// checksum in the manifest, reporting messages that changed, are missing,
+// or aren't in the manifest
+// The format is taken from the output itself: a directory is a Maildir
+func verify(w io.Writer, output string) (bool, error) {
+	info, err := os.Stat(output)
+	if err != nil {
+		return false, err
+	}
+	outputFormat := formatMbox
+	if info.IsDir() {
+		outputFormat = formatMaildir
+	}
+	manifestFile, _ := outputFiles(output, outputFormat)
+	entries, err := loadManifest(manifestFile)
+	if err != nil {
+		return false, err
+	}
+	if len(entries) == 0 {
+		return false, fmt.Errorf("no manifest found at %s", manifestFile)
+	}
+	byLocation := make(map[string]*manifestEntry, len(entries))
+	for _, entry := range entries {
+		byLocation[entry.Location] = entry
+	}
+
+	var changed, unknown []string
+	found := make(map[string]bool)
+	checked := 0
+	err = mailbox.Walk(output, mailbox.MboxRD, func(msg *mailbox.Message) error {
+		location := locationOf(msg.Key, outputFormat)
+		entry, ok := byLocation[location]
+		if !ok {
+			unknown = append(unknown, location)
+			return nil
+		}
+		found[location] = true
+		checked++
+		sum := sha256.Sum256(msg.Raw)
+		if hex.EncodeToString(sum[:]) != entry.SHA256 {
+			changed = append(changed, fmt.Sprintf("%s (%s)", location, entry.GmailID))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	var missing []string
+	for location, entry := range byLocation {
+		if !found[location] {
+			missing = append(missing, fmt.Sprintf("%s (%s)", location, entry.GmailID))
+		}
+	}
+	sort.Strings(missing)
+
+	fmt.Fprintf(w, "Verified %d messages: %d changed, %d missing, %d not in manifest\n",
+		checked, len(changed), len(missing), len(unknown))
+	for _, location := range changed {
+		fmt.Fprintf(w, "  changed: %s\n", location)
+	}
+	for _, location := range missing {
+		fmt.Fprintf(w, "  missing: %s\n", location)
+	}
+	for _, location := range unknown {
+		fmt.Fprintf(w, "  not in manifest: %s\n", location)
+	}
+	return len(changed) == 0 && len(missing) == 0, nil
+}
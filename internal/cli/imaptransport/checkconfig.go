@@ -0,0 +1,70 @@
+package imaptransport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/imapdeliver"
+)
+
+// CheckConfig implements the check-config subcommand and returns the exit code
+func CheckConfig(program string, args []string) int {
+	var online bool
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file>",
+		"Checks the configuration, credentials and token without delivering a message\n"+
+			"and prints a pass/fail report. Exits non-zero if any check fails.")
+	flags.BoolVar(&online, "online", "Also refresh the token, check its scopes and log in to the IMAP server")
+	flags.ConfigFlags(&imapdeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	if len(flags.Args()) > 0 {
+		flags.UsageError("unexpected argument %q", flags.Args()[0])
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-imap-transport")
+
+	fmt.Printf("Checking gmail-imap-transport configuration %s\n\n", flags.ConfigFile())
+	report := &internal.ConfigReport{}
+	cfg, err := loadConfig(flags, logger)
+	if report.Check("config", err, "parsed %s", flags.ConfigFile()) {
+		deliverer, err := imapdeliver.New(cfg, cli.Telemetry(logger, nil))
+		report.Check("settings", err, "all options are valid")
+		internal.CheckEmailUserID(report, cfg.UserID)
+		internal.CheckServerAddress(report, "imap_server", cfg.IMAPServer)
+		token := internal.CheckCommon(report, &cfg.Common)
+		if online && token != nil && !report.Failed() {
+			probeIMAP(report, deliverer, logger)
+		}
+	}
+
+	report.Print(os.Stdout)
+	if report.Failed() {
+		return internal.ExitFailure
+	}
+	return 0
+}
+
+// probeIMAP refreshes the token, checks its scopes and logs in to the server
+func probeIMAP(report *internal.ConfigReport, deliverer *imapdeliver.Deliverer, logger *internal.Logger) {
+	cfg := deliverer.Config()
+	token, _, err := internal.RefreshAndSaveToken(cfg.CredentialsFile, cfg.TokenFile, logger, nil)
+	if !report.Check("token_refresh", err, "obtained an access token") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ConnectionTimeout)*time.Second)
+	defer cancel()
+	internal.CheckScopes(ctx, report, token.AccessToken, internal.ScopeMailGoogle)
+
+	c, err := deliverer.Connect(ctx)
+	if err != nil {
+		report.Fail("imap", "%v", err)
+		return
+	}
+	defer c.Logout()
+	report.Pass("imap", "logged in to %s as %s", cfg.IMAPServer, cfg.UserID)
+}
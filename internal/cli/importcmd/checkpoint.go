@@ -0,0 +1,109 @@
+package importcmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// checkpointEntry is a line of the checkpoint file, recording a message
+// that was imported or found to be a duplicate
+type checkpointEntry struct {
+	Key     string `json:"key"`
+	GmailID string `json:"gmail_id,omitempty"`
+}
+
+// checkpoint records which messages are done so an interrupted import can
+// be resumed; the file is appended to as each message completes
+type checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// loadCheckpoint reads the messages already done from a checkpoint file
+// A missing file means nothing is done; a truncated last line, left by a
+// crash, is ignored
+func loadCheckpoint(filename string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry checkpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.Key != "" {
+			done[entry.Key] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	return done, nil
+}
+
+// openCheckpoint loads a checkpoint file and opens it for appending
+func openCheckpoint(filename string) (*checkpoint, error) {
+	done, err := loadCheckpoint(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening checkpoint: %w", err)
+	}
+
+	// Terminate a partial line left by a crash so the next entry stays intact
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening checkpoint: %w", err)
+	}
+	if end := info.Size(); end > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, end-1); err == nil && last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("writing checkpoint: %w", err)
+			}
+		}
+	}
+	return &checkpoint{file: file, done: done}, nil
+}
+
+// isDone reports whether a message was done by an earlier run
+func (c *checkpoint) isDone(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[key]
+}
+
+// add records a message as done
+func (c *checkpoint) add(key, gmailID string) error {
+	line, err := json.Marshal(checkpointEntry{Key: key, GmailID: gmailID})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[key] = true
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+// close closes the checkpoint file
+func (c *checkpoint) close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,62 @@
+package importcmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResumeAfterPartialLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "import.checkpoint")
+	c, err := openCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"first", "second"} {
+		if err := c.add(key, "gmail-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.close()
+
+	// A crash while writing the second entry leaves half of its line
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, data[:len(data)-10], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = openCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.isDone("first") || c.isDone("second") {
+		t.Fatalf("after the crash first done %v, second done %v; want true, false", c.isDone("first"), c.isDone("second"))
+	}
+	// The resumed import records the second message again, then the third
+	for _, key := range []string{"second", "third"} {
+		if err := c.add(key, "gmail-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.close()
+
+	done, err := loadCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"first", "second", "third"} {
+		if !done[key] {
+			t.Errorf("%s not done after resuming, checkpoint has %v", key, done)
+		}
+	}
+}
+
+func TestCheckpointMissingFile(t *testing.T) {
+	done, err := loadCheckpoint(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || len(done) != 0 {
+		t.Errorf("loadCheckpoint = %v, %v; want nothing done", done, err)
+	}
+}
@@ -0,0 +1,396 @@
+// Package importcmd implements gmailctl import, which imports the messages
+// of local mbox files and Maildir trees into Gmail
+package importcmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+	"gmail-api-client/pkg/mailbox"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/gmail/v1"
+)
+
+// DefaultCheckpointFile is the checkpoint file when neither --checkpoint nor
+// state_dir is given
+const DefaultCheckpointFile = "gmail-import.checkpoint"
+
+// options are the command line options of an import
+type options struct {
+	concurrency    int
+	checkpointFile string
+	mboxFormat     string
+	labelPrefix    string
+	extraLabel     string
+	reportFile     string
+	dryRun         bool
+}
+
+// importer imports messages with the options of one run
+type importer struct {
+	opts      options
+	deliverer *gmaildeliver.Deliverer
+	logger    *internal.Logger
+	metrics   deliver.Metrics
+	// tracer starts a trace for each message
+	tracer trace.Tracer
+}
+
+// failure describes a message that couldn't be imported
+type failure struct {
+	Key       string `json:"key"`
+	Folder    string `json:"folder,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// report summarises an import run
+type report struct {
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	// Skipped messages were done by an earlier run, per the checkpoint
+	Skipped     int       `json:"skipped"`
+	Failed      int       `json:"failed"`
+	Interrupted bool      `json:"interrupted,omitempty"`
+	Duration    float64   `json:"duration"`
+	Failures    []failure `json:"failures,omitempty"`
+}
+
+// Main imports the mail stores named on the command line following program
+func Main(program string, args []string) {
+	start := time.Now()
+	opts := options{concurrency: 4}
+
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file> <path>...",
+		"Imports the messages of mbox files and Maildir trees into Gmail, with\n"+
+			"folders as labels. An interrupted import resumes from its checkpoint.")
+	flags.IntVar(&opts.concurrency, "concurrency", "n", "Messages imported at once (default 4)")
+	flags.StringVar(&opts.checkpointFile, "checkpoint", "file", "File recording imported messages, for resuming (default <state_dir>/<user_id>.import.jsonl or "+DefaultCheckpointFile+")")
+	flags.StringVar(&opts.mboxFormat, "mbox-format", "format", "mbox variant: mboxrd, mboxo, mboxcl or mboxcl2 (default mboxrd)")
+	flags.StringVar(&opts.labelPrefix, "label-prefix", "label", "Parent label for the labels made from folders")
+	flags.StringVar(&opts.extraLabel, "label", "label", "Label added to every imported message")
+	flags.StringVar(&opts.reportFile, "report", "file", "Write a JSON report of the import, including failures, to file")
+	flags.BoolVar(&opts.dryRun, "dry-run", "Show the folders and labels that would be imported without contacting Gmail")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) == 0 {
+		flags.UsageError("no mbox file or Maildir given")
+	}
+	if opts.concurrency < 1 {
+		flags.UsageError("--concurrency must be at least 1")
+	}
+	format, err := mailbox.ParseMboxFormat(opts.mboxFormat)
+	if err != nil {
+		flags.UsageError("%v", err)
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-import")
+	metrics := internal.NewMetrics()
+	logger.Debug("starting gmail-import", "config_file", flags.ConfigFile(), "paths", paths)
+
+	var cfg gmaildeliver.Config
+	if err := flags.LoadConfig(&cfg); err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+	internal.ExpandCommonPaths(flags.ConfigFile(), &cfg.Common)
+
+	deliverer, err := gmaildeliver.New(&cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+
+	if opts.checkpointFile == "" {
+		opts.checkpointFile = DefaultCheckpointFile
+		if cfg.StateDir != "" {
+			opts.checkpointFile = internal.StateFilePath(cfg.StateDir, cfg.UserID, "import.jsonl")
+		}
+	}
+	imp := &importer{opts: opts, deliverer: deliverer, logger: logger, metrics: metrics}
+
+	if opts.dryRun {
+		if err := imp.dryRun(os.Stdout, paths, format); err != nil {
+			logger.Fatal("dry run failed", err)
+		}
+		return
+	}
+
+	cli.WriteMetricsOnClose(logger, metrics, &cfg.Common, "gmail-import")
+	tracerProvider, err := cli.StartTracing(logger, &cfg.Common, "gmail-import")
+	if err != nil {
+		logger.Fatal("invalid tracing configuration", err)
+	}
+
+	// An interrupt stops the import after the messages in flight; the
+	// checkpoint lets the next run carry on
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	imp.tracer = internal.Tracer(tracerProvider)
+
+	rep, err := imp.run(ctx, paths, format)
+	if err != nil {
+		logger.Fatal("import failed", err)
+	}
+	rep.Duration = time.Since(start).Seconds()
+
+	if opts.reportFile != "" {
+		if err := writeReport(opts.reportFile, rep); err != nil {
+			logger.Fatal("failed to write report", err)
+		}
+	}
+	if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+		data, _ := json.Marshal(rep)
+		fmt.Println(string(data))
+	} else {
+		printReport(os.Stdout, rep)
+	}
+
+	switch {
+	case rep.Interrupted:
+		logger.Close()
+		os.Exit(internal.ExitTempFail)
+	case rep.Failed > 0:
+		logger.Close()
+		os.Exit(internal.ExitFailure)
+	}
+}
+
+// job is a message waiting to be imported
+type job struct {
+	msg    *mailbox.Message
+	labels messageLabels
+}
+
+// run imports the messages under paths and returns the report
+// It fails only if the import can't start; failures of single messages and
+// unreadable mail stores are listed in the report
+func (imp *importer) run(ctx context.Context, paths []string, format string) (*report, error) {
+	cfg := imp.deliverer.Config()
+	logger := imp.logger
+
+	cp, err := openCheckpoint(imp.opts.checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	defer cp.close()
+	logger.Debug("checkpoint loaded", "file", imp.opts.checkpointFile, "done", len(cp.done))
+
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading token: %w", err)
+	}
+	service, tokenSource, err := imp.deliverer.Service()
+	if err != nil {
+		return nil, fmt.Errorf("creating Gmail service: %w", err)
+	}
+	defer func() {
+		if token, err := tokenSource.Token(); err == nil {
+			if err := internal.SaveTokenIfChanged(cfg.TokenFile, originalToken, token, logger); err != nil {
+				logger.Warn("failed to save token", "error", err)
+			}
+		}
+	}()
+
+	userLabels := cli.NewLabels(service, cfg.UserID,
+		internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, imp.metrics), logger)
+
+	rep := &report{}
+	var mu sync.Mutex
+	fail := func(msg *mailbox.Message, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rep.Failed++
+		rep.Failures = append(rep.Failures, failure{
+			Key:       msg.Key,
+			Folder:    msg.Folder,
+			MessageID: internal.MessageID(msg.Raw),
+			Error:     err.Error(),
+		})
+		logger.Warn("failed to import message", "key", msg.Key, "error", err)
+	}
+
+	jobs := make(chan job, imp.opts.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < imp.opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				result, err := imp.importOne(ctx, service, userLabels, j)
+				if err != nil {
+					if ctx.Err() == nil {
+						fail(j.msg, err)
+					}
+					continue
+				}
+				if err := cp.add(j.msg.Key, result.GmailID); err != nil {
+					logger.Warn("failed to update checkpoint", "error", err)
+				}
+				mu.Lock()
+				if result.Status == deliver.StatusDuplicate {
+					rep.Duplicates++
+				} else {
+					rep.Imported++
+				}
+				mu.Unlock()
+				logger.Info("message imported", "key", j.msg.Key, "status", result.Status, "gmail_id", result.GmailID)
+			}
+		}()
+	}
+
+	for _, root := range paths {
+		err := mailbox.Walk(root, format, func(msg *mailbox.Message) error {
+			if cp.isDone(msg.Key) {
+				mu.Lock()
+				rep.Skipped++
+				mu.Unlock()
+				return nil
+			}
+			select {
+			case jobs <- job{msg: msg, labels: labelsFor(msg, imp.opts.labelPrefix, imp.opts.extraLabel)}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			fail(&mailbox.Message{Key: root}, err)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	rep.Interrupted = ctx.Err() != nil
+	sort.Slice(rep.Failures, func(i, j int) bool { return rep.Failures[i].Key < rep.Failures[j].Key })
+	return rep, nil
+}
+
+// importOne imports a message with its own operation timeout and trace
+func (imp *importer) importOne(ctx context.Context, service *gmail.Service, userLabels *cli.Labels, j job) (result *deliver.Result, err error) {
+	cfg := imp.deliverer.Config()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.OperationTimeout)*time.Second)
+	defer cancel()
+	ctx, span := imp.tracer.Start(ctx, "gmail-import.message",
+		trace.WithAttributes(attribute.String("import.key", j.msg.Key)))
+	defer func() { internal.EndSpan(span, err) }()
+
+	labelIDs, err := resolveLabels(ctx, userLabels, j.labels)
+	if err != nil {
+		return nil, err
+	}
+	return imp.deliverer.Import(ctx, service, j.msg.Raw, gmaildeliver.ImportOptions{LabelIDs: labelIDs})
+}
+
+// dryRun lists the folders under paths with their message counts and the
+// labels their messages would get
+func (imp *importer) dryRun(w io.Writer, paths []string, format string) error {
+	done, err := loadCheckpoint(imp.opts.checkpointFile)
+	if err != nil {
+		return err
+	}
+
+	type folderSummary struct {
+		messages, unread, starred, done, labelled int
+		labels                                    string
+	}
+	var order []string
+	folders := make(map[string]*folderSummary)
+	for _, root := range paths {
+		err := mailbox.Walk(root, format, func(msg *mailbox.Message) error {
+			summary, ok := folders[msg.Folder]
+			if !ok {
+				labels := labelsFor(&mailbox.Message{Folder: msg.Folder, Seen: true}, imp.opts.labelPrefix, imp.opts.extraLabel)
+				summary = &folderSummary{labels: strings.Join(labels.names(), ", ")}
+				if summary.labels == "" {
+					summary.labels = "(archived)"
+				}
+				folders[msg.Folder] = summary
+				order = append(order, msg.Folder)
+			}
+			summary.messages++
+			if !msg.Seen {
+				summary.unread++
+			}
+			if msg.Flagged {
+				summary.starred++
+			}
+			if done[msg.Key] {
+				summary.done++
+			}
+			if msg.Labels != nil {
+				summary.labelled++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	total := 0
+	for _, folder := range order {
+		s := folders[folder]
+		total += s.messages
+		fmt.Fprintf(w, "%s: %d messages (%d unread, %d starred", folder, s.messages, s.unread, s.starred)
+		if s.labelled > 0 {
+			fmt.Fprintf(w, ", %d labelled by %s", s.labelled, mailbox.GmailLabelsHeader)
+		}
+		if s.done > 0 {
+			fmt.Fprintf(w, ", %d already imported", s.done)
+		}
+		fmt.Fprintf(w, ") -> %s\n", s.labels)
+	}
+	fmt.Fprintf(w, "Total: %d messages in %d folders\n", total, len(order))
+	return nil
+}
+
+// printReport writes the summary of an import
+func printReport(w io.Writer, rep *report) {
+	fmt.Fprintf(w, "Imported %d messages, %d duplicates, %d already done, %d failed\n",
+		rep.Imported, rep.Duplicates, rep.Skipped, rep.Failed)
+	if rep.Interrupted {
+		fmt.Fprintln(w, "Interrupted; run the same command again to resume")
+	}
+	if len(rep.Failures) > 0 {
+		fmt.Fprintln(w, "Failures:")
+		for _, f := range rep.Failures {
+			fmt.Fprintf(w, "  %s: %s\n", f.Key, f.Error)
+		}
+	}
+}
+
+// writeReport writes the report as JSON
+func writeReport(filename string, rep *report) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
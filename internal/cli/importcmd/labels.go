@@ -0,0 +1,102 @@
+package importcmd
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/mailbox"
+)
+
+// specialFolders maps folder names, compared case-insensitively, to the
+// system label their messages get instead of a user label
+// "" means the messages are archived without a label
+var specialFolders = map[string]string{
+	"sent":             "SENT",
+	"sent items":       "SENT",
+	"sent mail":        "SENT",
+	"sent messages":    "SENT",
+	"trash":            "TRASH",
+	"deleted items":    "TRASH",
+	"deleted messages": "TRASH",
+	"spam":             "SPAM",
+	"junk":             "SPAM",
+	"junk e-mail":      "SPAM",
+	"junk email":       "SPAM",
+	"all mail":         "",
+	"archive":          "",
+}
+
+// messageLabels are the labels a message gets: system label IDs, and user
+// label names that are created if they don't exist
+type messageLabels struct {
+	system []string
+	user   []string
+}
+
+// names returns all the labels, system ones first
+func (l messageLabels) names() []string {
+	return append(append([]string(nil), l.system...), l.user...)
+}
+
+// unimportableLabels are system labels messages.import doesn't accept
+var unimportableLabels = map[string]bool{
+	"DRAFT": true,
+	"CHAT":  true,
+}
+
+// labelsFor returns the labels of a message from its folder and state
+// The top-level INBOX gets INBOX, special folders their system label, and
+// any other folder a user label named after it, under prefix if one is given
+// Other messages are archived, as Gmail's own importer does
+// A message with an X-Gmail-Labels header gets those labels instead of its
+// folder's
+func labelsFor(msg *mailbox.Message, prefix, extra string) messageLabels {
+	var labels messageLabels
+	folder := strings.Trim(msg.Folder, "/")
+	base := strings.ToLower(path.Base(folder))
+	if msg.Labels != nil {
+		for _, name := range msg.Labels {
+			if id, ok := mailbox.SystemLabelID(name); ok {
+				if !unimportableLabels[id] {
+					labels.system = append(labels.system, id)
+				}
+			} else {
+				labels.user = append(labels.user, path.Join(prefix, name))
+			}
+		}
+	} else if special, ok := specialFolders[base]; ok {
+		if special != "" {
+			labels.system = append(labels.system, special)
+		}
+	} else if strings.EqualFold(folder, mailbox.InboxFolder) {
+		labels.system = append(labels.system, "INBOX")
+	} else if folder != "" {
+		labels.user = append(labels.user, path.Join(prefix, folder))
+	}
+	if !msg.Seen {
+		labels.system = append(labels.system, "UNREAD")
+	}
+	if msg.Flagged {
+		labels.system = append(labels.system, "STARRED")
+	}
+	if extra != "" {
+		labels.user = append(labels.user, extra)
+	}
+	return labels
+}
+
+// resolveLabels returns the label IDs for a message's labels, creating
+// missing user labels
+func resolveLabels(ctx context.Context, userLabels *cli.Labels, labels messageLabels) ([]string, error) {
+	ids := append([]string(nil), labels.system...)
+	for _, name := range labels.user {
+		id, err := userLabels.ID(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gmail-api-client/internal"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Labels finds the mailbox's user labels by name, creating missing ones and
+// their parents so Gmail shows them nested
+// Names are compared ignoring case, as Gmail does
+// It is safe for concurrent use
+type Labels struct {
+	mu       sync.Mutex
+	service  *gmail.Service
+	userID   string
+	retryCfg *internal.RetryConfig
+	logger   *internal.Logger
+	labels   []*gmail.Label
+	byName   map[string]*gmail.Label
+}
+
+// NewLabels returns the labels of the mailbox of userID, read on first use
+func NewLabels(service *gmail.Service, userID string, retryCfg *internal.RetryConfig, logger *internal.Logger) *Labels {
+	return &Labels{service: service, userID: userID, retryCfg: retryCfg, logger: logger}
+}
+
+// List returns the mailbox's labels, including those created since they
+// were read
+func (l *Labels) List(ctx context.Context) ([]*gmail.Label, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(ctx); err != nil {
+		return nil, err
+	}
+	return append([]*gmail.Label(nil), l.labels...), nil
+}
+
+// ID returns the ID of the user label name, creating it and any missing
+// parents if needed
+// Leading and trailing slashes are ignored
+func (l *Labels) ID(ctx context.Context, name string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(ctx); err != nil {
+		return "", err
+	}
+
+	trimmed := strings.Trim(name, "/")
+	if label, ok := l.byName[strings.ToLower(trimmed)]; ok {
+		return label.Id, nil
+	}
+	parts := strings.Split(trimmed, "/")
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	var id string
+	for i := range parts {
+		partial := strings.Join(parts[:i+1], "/")
+		if existing, ok := l.byName[strings.ToLower(partial)]; ok {
+			id = existing.Id
+			continue
+		}
+		label, err := l.create(ctx, partial)
+		if err != nil {
+			return "", fmt.Errorf("creating label %q: %w", partial, err)
+		}
+		id = label.Id
+	}
+	return id, nil
+}
+
+// load reads the mailbox's labels unless they have been already
+func (l *Labels) load(ctx context.Context) error {
+	if l.byName != nil {
+		return nil
+	}
+	var resp *gmail.ListLabelsResponse
+	err := internal.RetryOperationContext(ctx, l.retryCfg, l.logger, func(ctx context.Context) error {
+		var err error
+		resp, err = l.service.Users.Labels.List(l.userID).Context(ctx).Do()
+		return err
+	}, "label list")
+	if err != nil {
+		return fmt.Errorf("listing labels: %w", err)
+	}
+	l.labels = resp.Labels
+	l.byName = make(map[string]*gmail.Label, len(resp.Labels))
+	for _, label := range resp.Labels {
+		l.byName[strings.ToLower(label.Name)] = label
+	}
+	l.logger.Debug("labels loaded", "count", len(resp.Labels))
+	return nil
+}
+
+// create creates a user label
+func (l *Labels) create(ctx context.Context, name string) (*gmail.Label, error) {
+	l.logger.Info("creating label", "label", name)
+	var label *gmail.Label
+	err := internal.RetryOperationContext(ctx, l.retryCfg, l.logger, func(ctx context.Context) error {
+		var err error
+		label, err = l.service.Users.Labels.Create(l.userID, &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Context(ctx).Do()
+		return err
+	}, "label create")
+	if err != nil {
+		return nil, err
+	}
+	l.labels = append(l.labels, label)
+	l.byName[strings.ToLower(name)] = label
+	return label, nil
+}
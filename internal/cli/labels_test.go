@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/fakegmail"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// newTestLabels returns Labels using a fake Gmail API
+func newTestLabels(t *testing.T, api *fakegmail.Server) *Labels {
+	t.Helper()
+	service, err := gmail.NewService(context.Background(),
+		option.WithEndpoint(api.Endpoint()), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := internal.NewLoggerWithHandler(slog.DiscardHandler, "test")
+	return NewLabels(service, "me", &internal.RetryConfig{}, logger)
+}
+
+func TestLabelsID(t *testing.T) {
+	api := fakegmail.New()
+	defer api.Close()
+	projects := api.CreateLabel("Projects")
+	labels := newTestLabels(t, api)
+	ctx := context.Background()
+
+	// Existing labels are found ignoring case and slashes around the name
+	for _, name := range []string{"Projects", "projects", "/Projects/"} {
+		id, err := labels.ID(ctx, name)
+		if err != nil || id != projects.Id {
+			t.Errorf("ID(%q) = %q, %v; want %q", name, id, err, projects.Id)
+		}
+	}
+
+	// Missing parents are created before the label
+	id, err := labels.ID(ctx, "projects/2024/Q1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := labels.ID(ctx, "Projects/2024/q1"); err != nil || again != id {
+		t.Errorf("second ID = %q, %v; want %q without creating it again", again, err, id)
+	}
+
+	list, err := labels.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created labels come last, parents first
+	var created []string
+	for _, label := range list[len(list)-2:] {
+		created = append(created, label.Name)
+	}
+	if created[0] != "projects/2024" || created[1] != "projects/2024/Q1" || list[len(list)-1].Id != id {
+		t.Errorf("List ends with %q, want projects/2024 then projects/2024/Q1 with ID %q", created, id)
+	}
+	if n := api.CountRequests("users.labels.list"); n != 1 {
+		t.Errorf("labels listed %d times, want once", n)
+	}
+	if n := api.CountRequests("users.labels.create"); n != 2 {
+		t.Errorf("labels created %d times, want twice", n)
+	}
+}
+
+func TestLabelsInvalidName(t *testing.T) {
+	api := fakegmail.New()
+	defer api.Close()
+	labels := newTestLabels(t, api)
+
+	for _, name := range []string{"", "/", "//", "Projects//2024", "Projects/ /2024"} {
+		_, err := labels.ID(context.Background(), name)
+		// The error shows the name as given, not as trimmed
+		if want := `invalid label name "` + name + `"`; err == nil || err.Error() != want {
+			t.Errorf("ID(%q) error = %v, want %s", name, err, want)
+		}
+	}
+	if n := api.CountRequests("users.labels.create"); n != 0 {
+		t.Errorf("labels created %d times for invalid names", n)
+	}
+}
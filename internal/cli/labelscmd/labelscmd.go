@@ -0,0 +1,137 @@
+// Package labelscmd implements gmailctl labels, which lists a mailbox's
+// labels or creates new ones
+package labelscmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/gmaildeliver"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Actions, given before the options
+const (
+	actionList   = "list"
+	actionCreate = "create"
+)
+
+// Main lists or creates labels, with the command line arguments following
+// program
+func Main(program string, args []string) {
+	action := actionList
+	if len(args) > 0 && (args[0] == actionList || args[0] == actionCreate) {
+		action, args = args[0], args[1:]
+	}
+
+	synopsis := "[list] [options] [--config] <config-file>"
+	if action == actionCreate {
+		synopsis = "create [options] [--config] <config-file> <label>..."
+	}
+	flags := internal.NewFlagSet(program, synopsis,
+		"Lists the labels of the mailbox, or with create adds labels, creating\n"+
+			"missing parents of nested labels such as Projects/2024 too.")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	names := flags.Args()
+	switch {
+	case action == actionCreate && len(names) == 0:
+		flags.UsageError("no labels to create given")
+	case action == actionList && len(names) > 0:
+		flags.UsageError("unexpected argument %q", names[0])
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-labels")
+	metrics := internal.NewMetrics()
+	logger.Debug("starting gmail-labels", "config_file", flags.ConfigFile(), "action", action)
+
+	var cfg gmaildeliver.Config
+	if err := flags.LoadConfig(&cfg); err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+	internal.ExpandCommonPaths(flags.ConfigFile(), &cfg.Common)
+
+	deliverer, err := gmaildeliver.New(&cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+	cli.WriteMetricsOnClose(logger, metrics, &cfg.Common, "gmail-labels")
+
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		logger.Fatal("failed to load token", err)
+	}
+	service, tokenSource, err := deliverer.Service()
+	if err != nil {
+		logger.Fatal("failed to create Gmail service", err)
+	}
+	defer func() {
+		if token, err := tokenSource.Token(); err == nil {
+			if err := internal.SaveTokenIfChanged(cfg.TokenFile, originalToken, token, logger); err != nil {
+				logger.Warn("failed to save token", "error", err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.OperationTimeout)*time.Second)
+	defer cancel()
+	userLabels := cli.NewLabels(service, cfg.UserID,
+		internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, metrics), logger)
+	labels, err := userLabels.List(ctx)
+	if err != nil {
+		logger.Fatal("failed to list labels", err)
+	}
+	if action == actionCreate {
+		// Labels that already exist, ignoring case, are left alone
+		for _, name := range names {
+			if _, err := userLabels.ID(ctx, name); err != nil {
+				logger.Fatal("failed to create labels", err)
+			}
+		}
+		if labels, err = userLabels.List(ctx); err != nil {
+			logger.Fatal("failed to list labels", err)
+		}
+	}
+	sortLabels(labels)
+
+	if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+		data, _ := json.Marshal(labels)
+		fmt.Println(string(data))
+	} else {
+		printLabels(os.Stdout, labels)
+	}
+}
+
+// sortLabels sorts system labels before user labels, each by name
+func sortLabels(labels []*gmail.Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Type != labels[j].Type {
+			return labels[i].Type == "system"
+		}
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+// printLabels writes the labels as a table
+func printLabels(w io.Writer, labels []*gmail.Label) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tTYPE\tNAME\n")
+	for _, label := range labels {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", label.Id, label.Type, label.Name)
+	}
+	tw.Flush()
+}
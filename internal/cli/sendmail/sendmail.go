@@ -0,0 +1,247 @@
+// Package sendmail implements a sendmail-compatible command that sends a
+// message from stdin through Gmail with users.messages.send
+package sendmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/gmailsend"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultConfigFile is read when neither -C nor ConfigEnv names a
+// configuration file
+const DefaultConfigFile = "/etc/gmailctl/sendmail.json"
+
+// ConfigEnv names the environment variable holding the configuration file
+const ConfigEnv = "GMAIL_SENDMAIL_CONFIG"
+
+// invocation is a parsed sendmail command line
+type invocation struct {
+	configFile string
+	opts       gmailsend.Options
+	// dotEnds stops reading the message at a line holding a single dot,
+	// unless -i or -oi is given
+	dotEnds bool
+	verbose bool
+}
+
+// Main sends a message from stdin, with sendmail's command line arguments
+// following program
+func Main(program string, args []string) {
+	inv := parseArgs(program, args)
+
+	logger := cli.NewLogger(inv.verbose, "gmail-sendmail")
+	metrics := internal.NewMetrics()
+	logger.Debug("starting gmail-sendmail", "config_file", inv.configFile)
+
+	var cfg gmailsend.Config
+	if err := internal.LoadConfig(inv.configFile, &cfg); err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+	internal.ExpandCommonPaths(inv.configFile, &cfg.Common)
+
+	sender, err := gmailsend.New(&cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+
+	// Apply logging options now that the configuration is known
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+	cli.WriteMetricsOnClose(logger, metrics, &cfg.Common, "gmail-sendmail")
+
+	// Start tracing; spans are flushed when the logger is closed on exit
+	tracerProvider, err := cli.StartTracing(logger, &cfg.Common, "gmail-sendmail")
+	if err != nil {
+		logger.Fatal("invalid tracing configuration", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.OperationTimeout)*time.Second)
+	defer cancel()
+	ctx, span := internal.Tracer(tracerProvider).Start(ctx, "gmail-sendmail")
+	logger.OnClose(func() { span.End() })
+
+	// Check the token before reading the message so a caller that can't
+	// resend it gets the error before handing it over
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	err = sender.PrepareToken()
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		internal.EndSpan(span, err)
+		logger.Fatal("token validation failed", err)
+	}
+
+	logger.Debug("reading message from stdin")
+	message, err := readMessage(os.Stdin, inv.dotEnds)
+	if err != nil {
+		logger.Fatal("failed to read from stdin", err)
+	}
+	if len(message) == 0 {
+		logger.Fatal("no message received from stdin", nil)
+	}
+	if messageID := internal.MessageID(message); messageID != "" {
+		logger.SetAttr("message_id", messageID)
+		span.SetAttributes(attribute.String("email.message_id", messageID))
+	}
+	span.SetAttributes(attribute.Int("email.size", len(message)))
+
+	result, err := sender.Send(ctx, bytes.NewReader(message), inv.opts)
+	span.SetAttributes(attribute.String("delivery.outcome", result.Status))
+	if err != nil {
+		internal.EndSpan(span, err)
+		if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+			logger.Result(result)
+		}
+		logger.Fatal("sending failed", err)
+	}
+
+	// Like sendmail, stay quiet on success unless asked for a result
+	if cfg.ResultFormat == string(internal.ResultFormatJSON) {
+		logger.Result(result)
+	}
+}
+
+// parseArgs parses sendmail's command line, exiting on --help, --version or
+// a usage error
+// Options that only matter to a real MTA, such as -oem or -B8BITMIME, are
+// accepted and ignored
+func parseArgs(program string, args []string) *invocation {
+	inv := &invocation{configFile: os.Getenv(ConfigEnv), dotEnds: true}
+	if inv.configFile == "" {
+		inv.configFile = DefaultConfigFile
+	}
+	usageError := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", program, fmt.Sprintf(format, a...))
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", program)
+		os.Exit(internal.ExitUsage)
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			inv.opts.Recipients = append(inv.opts.Recipients, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			inv.opts.Recipients = append(inv.opts.Recipients, arg)
+			continue
+		}
+
+		// value returns an option's argument, attached or the next one
+		value := func(attached string) string {
+			if attached != "" {
+				return attached
+			}
+			if i+1 == len(args) {
+				usageError("option %s needs an argument", arg[:2])
+			}
+			i++
+			return args[i]
+		}
+
+		switch {
+		case len(arg) > 2 && strings.Trim(arg[1:], bundleFlags) == "":
+			// Single-letter flags given together, such as -ti
+			for j := 1; j < len(arg); j++ {
+				inv.setFlag(arg[j])
+			}
+		case arg == "--help":
+			printUsage(program)
+			os.Exit(0)
+		case arg == "--version":
+			fmt.Println(internal.VersionString(program))
+			os.Exit(0)
+		case len(arg) == 2 && strings.IndexByte(bundleFlags, arg[1]) >= 0:
+			inv.setFlag(arg[1])
+		case arg == "-oi":
+			inv.dotEnds = false
+		case arg[1] == 'f', arg[1] == 'r':
+			inv.opts.From = value(arg[2:])
+		case arg[1] == 'F':
+			inv.opts.FromName = value(arg[2:])
+		case arg[1] == 'C':
+			inv.configFile = value(arg[2:])
+		case arg[1] == 'B', arg[1] == 'N', arg[1] == 'R', arg[1] == 'V', arg[1] == 'L':
+			// Body type, DSN and envelope ID options
+			value(arg[2:])
+		case arg == "-bm", strings.HasPrefix(arg, "-o"), strings.HasPrefix(arg, "-e"):
+			// Default mode and MTA options
+		case strings.HasPrefix(arg, "-b"):
+			usageError("mode %s is not supported; only sending a message (-bm) is", arg)
+		default:
+			usageError("unknown option %s", arg)
+		}
+	}
+	return inv
+}
+
+// bundleFlags are the options without an argument, which can be given
+// together as in -ti
+const bundleFlags = "timnUv"
+
+// setFlag applies an option from bundleFlags
+func (inv *invocation) setFlag(flag byte) {
+	switch flag {
+	case 't':
+		inv.opts.ExtractRecipients = true
+	case 'i':
+		inv.dotEnds = false
+	case 'v':
+		inv.verbose = true
+	}
+	// -m, -n and -U are accepted and ignored
+}
+
+// printUsage writes the --help text
+func printUsage(program string) {
+	fmt.Printf("Usage: %s [options] [recipient ...]\n\n", program)
+	fmt.Printf("Sends the message on stdin through Gmail with users.messages.send, like\n")
+	fmt.Printf("sendmail. The configuration is read from -C, $%s or %s.\n\n", ConfigEnv, DefaultConfigFile)
+	fmt.Printf("Options:\n")
+	fmt.Printf("  -t            Also send to the To, Cc and Bcc addresses in the message\n")
+	fmt.Printf("  -i, -oi       Don't treat a line holding a single dot as the end of the message\n")
+	fmt.Printf("  -f address    Envelope sender; used for From if the message has none\n")
+	fmt.Printf("  -F name       Full name for an added From header\n")
+	fmt.Printf("  -C file       Configuration file\n")
+	fmt.Printf("  -v            Enable verbose logging\n")
+	fmt.Printf("  --help        Show this help and exit\n")
+	fmt.Printf("  --version     Show version information and exit\n")
+	fmt.Printf("\n-B, -N, -R, -V, -bm, -e* and -o* are accepted and ignored. Options without an\n")
+	fmt.Printf("argument can be given together, as in -ti.\n")
+}
+
+// readMessage reads the message from r, stopping at a line holding a
+// single dot if dotEnds is set
+func readMessage(r io.Reader, dotEnds bool) ([]byte, error) {
+	if !dotEnds {
+		return io.ReadAll(r)
+	}
+	var message bytes.Buffer
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if string(bytes.TrimRight(line, "\r\n")) == "." {
+			return message.Bytes(), nil
+		}
+		message.Write(line)
+		if err == io.EOF {
+			return message.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package sendmail
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gmail-api-client/internal"
+)
+
+func TestParseArgs(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+	tests := []struct {
+		args           []string
+		wantExtract    bool
+		wantDotEnds    bool
+		wantVerbose    bool
+		wantFrom       string
+		wantRecipients []string
+	}{
+		{[]string{"a@example.com"}, false, true, false, "", []string{"a@example.com"}},
+		{[]string{"-t"}, true, true, false, "", nil},
+		{[]string{"-i", "a@example.com"}, false, false, false, "", []string{"a@example.com"}},
+		{[]string{"-oi", "-f", "cron@example.com", "root"}, false, false, false, "cron@example.com", []string{"root"}},
+		{[]string{"-ti"}, true, false, false, "", nil},
+		{[]string{"-it"}, true, false, false, "", nil},
+		{[]string{"-oi", "-t"}, true, false, false, "", nil},
+		{[]string{"-tiv", "-fcron@example.com"}, true, false, true, "cron@example.com", nil},
+		{[]string{"-Uti", "-oem", "--", "-odd@example.com"}, true, false, false, "", []string{"-odd@example.com"}},
+	}
+	for _, tt := range tests {
+		inv := parseArgs("sendmail", tt.args)
+		if inv.opts.ExtractRecipients != tt.wantExtract || inv.dotEnds != tt.wantDotEnds || inv.verbose != tt.wantVerbose {
+			t.Errorf("%q: -t %v, dot ends %v, verbose %v; want %v, %v, %v", tt.args,
+				inv.opts.ExtractRecipients, inv.dotEnds, inv.verbose, tt.wantExtract, tt.wantDotEnds, tt.wantVerbose)
+		}
+		if inv.opts.From != tt.wantFrom || !reflect.DeepEqual(inv.opts.Recipients, tt.wantRecipients) {
+			t.Errorf("%q: from %q, recipients %q; want %q, %q", tt.args, inv.opts.From, inv.opts.Recipients, tt.wantFrom, tt.wantRecipients)
+		}
+		if inv.configFile != DefaultConfigFile {
+			t.Errorf("%q: config file %q, want %q", tt.args, inv.configFile, DefaultConfigFile)
+		}
+	}
+}
+
+// TestParseArgsUsageError parses arguments in a child process, since a
+// usage error exits, and checks the exit code
+func TestParseArgsUsageError(t *testing.T) {
+	if args := os.Getenv("SENDMAIL_TEST_ARGS"); args != "" {
+		parseArgs("sendmail", strings.Fields(args))
+		return
+	}
+
+	for _, args := range []string{"-tx", "-bp", "-f", "-q"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestParseArgsUsageError$")
+		cmd.Env = append(os.Environ(), "SENDMAIL_TEST_ARGS="+args)
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != internal.ExitUsage {
+			t.Errorf("%s: child exited with %v, want exit code %d", args, err, internal.ExitUsage)
+		}
+	}
+}
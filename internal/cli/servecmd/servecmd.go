@@ -0,0 +1,154 @@
+// Package servecmd implements gmailctl serve, which serves metrics and a
+// health check over HTTP for monitoring
+package servecmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/cli"
+	"gmail-api-client/pkg/gmaildeliver"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// defaultListen is the address served when --listen isn't given
+const defaultListen = "localhost:9464"
+
+// Main serves /metrics and /healthz until interrupted, with the command
+// line arguments following program
+func Main(program string, args []string) {
+	listen := defaultListen
+	flags := internal.NewFlagSet(program, "[options] [--config] <config-file>",
+		"Serves Prometheus metrics at /metrics and a health check at /healthz that\n"+
+			"refreshes the token and calls Gmail, until interrupted.")
+	flags.StringVar(&listen, "listen", "address", "Address to listen on (default "+defaultListen+")")
+	flags.ConfigFlags(&gmaildeliver.Config{})
+	flags.Alias("v", "verbose")
+	flags.Parse(args)
+	if len(flags.Args()) > 0 {
+		flags.UsageError("unexpected argument %q", flags.Args()[0])
+	}
+
+	logger := cli.NewLogger(flags.ConfigBool("verbose"), "gmail-serve")
+	metrics := internal.NewMetrics()
+	logger.Debug("starting gmail-serve", "config_file", flags.ConfigFile(), "listen", listen)
+
+	var cfg gmaildeliver.Config
+	if err := flags.LoadConfig(&cfg); err != nil {
+		logger.Fatal("failed to load config", err)
+	}
+	internal.ExpandCommonPaths(flags.ConfigFile(), &cfg.Common)
+
+	deliverer, err := gmaildeliver.New(&cfg, cli.Telemetry(logger, metrics))
+	if err != nil {
+		logger.Fatal("invalid configuration", err)
+	}
+	if err := cli.Configure(logger, &cfg.Common); err != nil {
+		logger.Fatal("invalid logging configuration", err)
+	}
+	defer logger.Close()
+
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		logger.Fatal("failed to load token", err)
+	}
+	service, tokenSource, err := deliverer.Service()
+	if err != nil {
+		logger.Fatal("failed to create Gmail service", err)
+	}
+	checker := &healthChecker{
+		cfg:       &cfg,
+		logger:    logger,
+		service:   service,
+		tokens:    tokenSource,
+		lastSaved: originalToken,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(logger))
+	mux.Handle("/healthz", checker)
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("serving metrics and health check", "listen", listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal("server failed", err)
+	}
+	logger.Info("server stopped")
+}
+
+// healthChecker answers health checks by refreshing the token if needed and
+// reading the mailbox profile
+type healthChecker struct {
+	cfg     *gmaildeliver.Config
+	logger  *internal.Logger
+	service *gmail.Service
+	tokens  oauth2.TokenSource
+
+	// mu guards lastSaved, the token as last written to the token file
+	mu        sync.Mutex
+	lastSaved *oauth2.Token
+}
+
+// ServeHTTP implements http.Handler
+// The answer is 200 if Gmail could be reached with the token and 503 with
+// the reason otherwise
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := h.check(r.Context()); err != nil {
+		h.logger.Warn("health check failed", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, h.logger.Redact(err.Error()))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// check refreshes the token if it expired, saving it, and calls getProfile
+func (h *healthChecker) check(ctx context.Context) error {
+	token, err := h.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("refreshing token: %w", err)
+	}
+	h.saveToken(token)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.cfg.APITimeout)*time.Second)
+	defer cancel()
+	if _, err := h.service.Users.GetProfile(h.cfg.UserID).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("calling getProfile: %w", err)
+	}
+	return nil
+}
+
+// saveToken writes a refreshed token to the token file, so the transports
+// find it still valid
+func (h *healthChecker) saveToken(token *oauth2.Token) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !internal.TokenChanged(h.lastSaved, token) {
+		return
+	}
+	if err := internal.SaveTokenIfChanged(h.cfg.TokenFile, h.lastSaved, token, h.logger); err != nil {
+		h.logger.Warn("failed to save token", "error", err)
+		return
+	}
+	h.lastSaved = token
+}
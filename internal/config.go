@@ -5,17 +5,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"gmail-api-client/pkg/deliver"
 )
 
 // Common holds configuration options common to both transports
-type Common struct {
-	CredentialsFile string `json:"credentials_file"`
-	TokenFile       string `json:"token_file"`
-	UserID          string `json:"user_id"`
-	Verbose         bool   `json:"verbose"`
-	MaxRetries      int    `json:"max_retries"`
-	RetryDelay      int    `json:"retry_delay"`
-}
+type Common = deliver.Common
 
 // Validator interface for configuration validation
 type Validator interface {
@@ -37,14 +33,27 @@ func LoadJSON(filename string, config interface{}) error {
 }
 
 // ExpandPath expands a relative path to absolute based on config file directory
+// An empty path is returned unchanged so that unset options stay unset
 func ExpandPath(configFile, path string) string {
-	if filepath.IsAbs(path) {
+	if path == "" || filepath.IsAbs(path) {
 		return path
 	}
 	dir := filepath.Dir(configFile)
 	return filepath.Join(dir, path)
 }
 
+// ExpandCommonPaths expands the shared path options relative to the
+// configuration file
+func ExpandCommonPaths(configFile string, common *Common) {
+	common.CredentialsFile = ExpandPath(configFile, common.CredentialsFile)
+	common.TokenFile = ExpandPath(configFile, common.TokenFile)
+	common.StateDir = ExpandPath(configFile, common.StateDir)
+	common.DedupIndex = ExpandPath(configFile, common.DedupIndex)
+	common.LogFile = ExpandPath(configFile, common.LogFile)
+	common.AuditLog = ExpandPath(configFile, common.AuditLog)
+	common.MetricsDir = ExpandPath(configFile, common.MetricsDir)
+}
+
 // ValidateCommon validates common configuration fields and sets defaults
 func ValidateCommon(common *Common) error {
 	// Validate required fields
@@ -70,6 +79,81 @@ func ValidateCommon(common *Common) error {
 	if common.RetryDelay <= 0 {
 		common.RetryDelay = 1
 	}
+	jitter, err := ParseJitterMode(common.RetryJitter)
+	if err != nil {
+		return err
+	}
+	common.RetryJitter = string(jitter)
+
+	// Validate logging settings
+	if _, err := ParseLogFormat(common.LogFormat); err != nil {
+		return err
+	}
+	resultFormat, err := ParseResultFormat(common.ResultFormat)
+	if err != nil {
+		return err
+	}
+	common.ResultFormat = string(resultFormat)
+	switch strings.ToLower(common.LogSink) {
+	case "", SinkNone, SinkSyslog, SinkJournald:
+	default:
+		return fmt.Errorf("unknown log_sink %q (expected none, syslog or journald)", common.LogSink)
+	}
+	if _, err := ParseSyslogFacility(common.SyslogFacility); err != nil {
+		return err
+	}
+	if strings.ToLower(common.LogSink) == SinkSyslog {
+		if _, _, err := ParseSyslogAddress(common.SyslogAddress); err != nil {
+			return err
+		}
+	}
+
+	// Set defaults for rate limiting and circuit breaking
+	if common.RateLimit < 0 {
+		return fmt.Errorf("rate_limit cannot be negative")
+	}
+	SetDefaults(&common.RateBurst, 1)
+	SetDefaults(&common.BreakerThreshold, 5)
+	SetDefaults(&common.BreakerCooldown, 60)
+	if common.StateDir != "" {
+		if info, err := os.Stat(common.StateDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("state directory not found: %s", common.StateDir)
+		}
+	}
+
+	// Validate deduplication settings
+	dedupMode, err := ParseDedupMode(common.DedupMode)
+	if err != nil {
+		return err
+	}
+	common.DedupMode = dedupMode
+	SetDefaults(&common.DedupExpiry, 168)
+	if DedupUsesIndex(common.DedupMode) && common.DedupIndex == "" {
+		if common.StateDir == "" {
+			return fmt.Errorf("dedup_mode %q requires dedup_index or state_dir", common.DedupMode)
+		}
+		userID := common.UserID
+		if userID == "" {
+			userID = "me"
+		}
+		common.DedupIndex = StateFilePath(common.StateDir, userID, "delivered.jsonl")
+	}
+
+	// Set defaults for the audit log
+	SetDefaults(&common.AuditMaxSize, 100)
+	SetDefaults(&common.AuditMaxFiles, 10)
+
+	if common.MetricsDir != "" {
+		if info, err := os.Stat(common.MetricsDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("metrics directory not found: %s", common.MetricsDir)
+		}
+	}
+
+	if common.OTLPEndpoint != "" {
+		if _, err := tracesEndpointURL(common.OTLPEndpoint); err != nil {
+			return err
+		}
+	}
 
 	// Set default user ID
 	if common.UserID == "" {
@@ -0,0 +1,378 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvOverridePrefix is the prefix of environment variables overriding
+// configuration keys, e.g. GMAIL_TRANSPORT_MAX_RETRIES for max_retries
+const EnvOverridePrefix = "GMAIL_TRANSPORT_"
+
+// Config file formats, selected by file extension
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// ConfigFormat returns the format of a configuration file from its
+// extension; anything other than .yaml, .yml or .toml is read as JSON
+func ConfigFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	default:
+		return ConfigFormatJSON
+	}
+}
+
+// LoadConfig reads a JSON, YAML or TOML configuration file into config, a
+// pointer to a struct whose fields carry json tags
+//
+// ${NAME} and ${NAME:-default} references in string values are replaced
+// with environment variables after parsing, so values need no escaping and
+// comments are left alone, then any GMAIL_TRANSPORT_<KEY> variable overrides
+// the file's value for <key>
+// Keys that don't match a configuration field are rejected with their line
+// Paths are left as written; callers expand them with ExpandPath so relative
+// paths stay relative to the configuration file
+func LoadConfig(filename string, config interface{}) error {
+	return loadConfig(filename, config, nil)
+}
+
+// loadConfig implements LoadConfig, applying overrides from command line
+// flags after the environment
+// An empty filename loads the configuration from overrides alone
+func loadConfig(filename string, config interface{}, overrides map[string]interface{}) error {
+	var data []byte
+	if filename != "" {
+		var err error
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("reading config file: %w", err)
+		}
+	}
+
+	values, err := parseConfigValues(ConfigFormat(filename), data)
+	if err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+
+	fields := configFields(reflect.TypeOf(config))
+
+	// Reject unknown keys, reporting them in file order
+	var unknown []string
+	for key := range values {
+		if _, ok := fields[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Slice(unknown, func(i, j int) bool {
+			return keyLine(data, unknown[i]) < keyLine(data, unknown[j])
+		})
+		msgs := make([]string, len(unknown))
+		for i, key := range unknown {
+			msgs[i] = describeKey(data, key)
+		}
+		return fmt.Errorf("parsing config file: unknown config key %s", strings.Join(msgs, ", "))
+	}
+
+	if err := interpolateValues(values, fields, data); err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+
+	if err := applyEnvOverrides(values, fields); err != nil {
+		return err
+	}
+	for key, value := range overrides {
+		values[key] = value
+	}
+
+	// Decode through JSON so every format shares the json struct tags
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+	if err := json.Unmarshal(encoded, config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return fmt.Errorf("parsing config file: %s has the wrong type (expected %s)", describeKey(data, typeErr.Field), typeErr.Type)
+		}
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+	return nil
+}
+
+// parseConfigValues decodes a configuration file into its top-level keys
+func parseConfigValues(format string, data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if len(bytes.TrimSpace(data)) == 0 {
+		return values, nil
+	}
+
+	switch format {
+	case ConfigFormatYAML:
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	case ConfigFormatTOML:
+		if err := toml.Unmarshal(data, &values); err != nil {
+			var decodeErr *toml.DecodeError
+			if errors.As(err, &decodeErr) {
+				row, col := decodeErr.Position()
+				return nil, fmt.Errorf("line %d column %d: %w", row, col, err)
+			}
+			return nil, err
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, fmt.Errorf("line %d: %w", lineAt(data, syntaxErr.Offset), err)
+			}
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// configField describes a configuration key
+type configField struct {
+	key  string
+	kind reflect.Kind
+	// help and def come from the help and default struct tags
+	help string
+	def  string
+}
+
+// configFieldList returns the configuration keys of a struct type (or
+// pointer to one) in declaration order, including those of embedded structs
+func configFieldList(t reflect.Type) []configField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			fields = append(fields, configFieldList(f.Type)...)
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" || name == "-" || !f.IsExported() {
+			continue
+		}
+		field := configField{
+			key:  name,
+			kind: f.Type.Kind(),
+			help: f.Tag.Get("help"),
+			def:  f.Tag.Get("default"),
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// configFields returns the configuration keys of a struct type by name
+func configFields(t reflect.Type) map[string]configField {
+	fields := make(map[string]configField)
+	for _, field := range configFieldList(t) {
+		fields[field.key] = field
+	}
+	return fields
+}
+
+// EnvOverrideName returns the environment variable overriding a configuration key
+func EnvOverrideName(key string) string {
+	return EnvOverridePrefix + strings.ToUpper(key)
+}
+
+// applyEnvOverrides replaces values with GMAIL_TRANSPORT_* variables
+func applyEnvOverrides(values map[string]interface{}, fields map[string]configField) error {
+	for key, field := range fields {
+		name := EnvOverrideName(key)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		value, err := parseFieldValue(field, raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		values[key] = value
+	}
+	return nil
+}
+
+// parseFieldValue converts a string (from the environment or a command line
+// flag) to a value of the field's type; lists are comma-separated, and maps
+// comma-separated key=value pairs
+func parseFieldValue(field configField, raw string) (interface{}, error) {
+	switch field.kind {
+	case reflect.Map:
+		m := make(map[string]string)
+		if raw == "" {
+			return m, nil
+		}
+		for _, pair := range strings.Split(raw, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("%q is not a key=value pair", strings.TrimSpace(pair))
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		return m, nil
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, 64)
+	case reflect.Slice:
+		if raw == "" {
+			return []string{}, nil
+		}
+		parts := strings.Split(raw, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return parts, nil
+	default:
+		return raw, nil
+	}
+}
+
+// envReference matches $$, ${NAME} and ${NAME:-default}
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// InterpolateEnv replaces ${NAME} with the value of environment variable
+// NAME, or with default in ${NAME:-default} when NAME is unset or empty
+// A reference to an unset variable without a default is an error; $$ is
+// replaced with a single $
+func InterpolateEnv(s string) (string, error) {
+	var missing []string
+	result := envReference.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		groups := envReference.FindStringSubmatch(match)
+		name := groups[1]
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			missing = append(missing, name)
+		}
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unset environment variable %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// interpolateValues applies InterpolateEnv to the string values of a parsed
+// configuration, including those in lists and tables
+// A value holding only references, such as max_retries: ${RETRIES} in YAML,
+// is converted to its field's type
+func interpolateValues(values map[string]interface{}, fields map[string]configField, data []byte) error {
+	for key, value := range values {
+		interpolated, err := interpolateValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", describeKey(data, key), err)
+		}
+		if s, ok := interpolated.(string); ok && s != value {
+			switch fields[key].kind {
+			case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+				if converted, err := parseFieldValue(fields[key], s); err == nil {
+					interpolated = converted
+				}
+			}
+		}
+		values[key] = interpolated
+	}
+	return nil
+}
+
+// interpolateValue applies InterpolateEnv to a string, or to the strings in
+// a list or table
+func interpolateValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return InterpolateEnv(v)
+	case []interface{}:
+		for i, item := range v {
+			interpolated, err := interpolateValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = interpolated
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			interpolated, err := interpolateValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = interpolated
+		}
+	}
+	return value, nil
+}
+
+// lineAt returns the 1-based line number of a byte offset
+func lineAt(data []byte, offset int64) int {
+	if offset < 0 {
+		return 0
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// keyLine returns the line on which a top-level key is defined, or 0 if it
+// can't be found
+// Keys are matched as `key =`, `key:`, `"key":` or a TOML `[key]` table
+func keyLine(data []byte, key string) int {
+	quoted := regexp.QuoteMeta(key)
+	re := regexp.MustCompile(`(?m)^[ \t]*(?:\[[ \t]*)?["']?` + quoted + `["']?[ \t]*[=:\]]|["']` + quoted + `["'][ \t]*:`)
+	loc := re.FindIndex(data)
+	if loc == nil {
+		return 0
+	}
+	return lineAt(data, int64(loc[0]))
+}
+
+// describeKey quotes a key with its line number, if known
+func describeKey(data []byte, key string) string {
+	if line := keyLine(data, key); line > 0 {
+		return fmt.Sprintf("%q (line %d)", key, line)
+	}
+	return fmt.Sprintf("%q", key)
+}
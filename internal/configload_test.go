@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig is a configuration with a field of each kind
+type loadTestConfig struct {
+	TokenFile     string            `json:"token_file"`
+	UserID        string            `json:"user_id"`
+	MaxRetries    int               `json:"max_retries"`
+	Verbose       bool              `json:"verbose"`
+	RateLimit     float64           `json:"rate_limit"`
+	RedactHeaders []string          `json:"redact_headers"`
+	Aliases       map[string]string `json:"aliases"`
+}
+
+// writeTestConfig writes data to a configuration file with the extension of
+// format and returns its name
+func writeTestConfig(t *testing.T, format, data string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config."+format)
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Each format's configuration referring to environment variables, with
+// comments where the format allows them
+var interpolationConfigs = map[string]string{
+	ConfigFormatJSON: `{
+  "token_file": "${TEST_DIR}/token.json",
+  "user_id": "${TEST_USER:-me}",
+  "max_retries": 2,
+  "redact_headers": ["${TEST_HEADER}", "To"],
+  "aliases": {"root": "${TEST_ROOT}"}
+}
+`,
+	ConfigFormatYAML: `# ${TEST_UNSET} in a comment is left alone
+token_file: ${TEST_DIR}/token.json
+user_id: ${TEST_USER:-me}
+max_retries: ${TEST_RETRIES}
+redact_headers: ["${TEST_HEADER}", To]
+aliases:
+  root: ${TEST_ROOT}
+`,
+	ConfigFormatTOML: `# ${TEST_UNSET} in a comment is left alone
+token_file = "${TEST_DIR}/token.json"
+user_id = "${TEST_USER:-me}"
+max_retries = 2
+redact_headers = ["${TEST_HEADER}", "To"]
+
+[aliases]
+root = "${TEST_ROOT}" # and ${TEST_UNSET} here
+`,
+}
+
+func TestLoadConfigInterpolation(t *testing.T) {
+	// Values that would break the file's syntax if pasted into it
+	dir := `C:\mail "quoted"` + "\nnext: injected"
+	t.Setenv("TEST_DIR", dir)
+	t.Setenv("TEST_HEADER", `Sub"ject`)
+	t.Setenv("TEST_ROOT", "admin@example.com\n")
+	t.Setenv("TEST_RETRIES", "2")
+	os.Unsetenv("TEST_USER")
+	os.Unsetenv("TEST_UNSET")
+
+	for format, data := range interpolationConfigs {
+		t.Run(format, func(t *testing.T) {
+			var cfg loadTestConfig
+			if err := LoadConfig(writeTestConfig(t, format, data), &cfg); err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			want := loadTestConfig{
+				TokenFile:     dir + "/token.json",
+				UserID:        "me",
+				MaxRetries:    2,
+				RedactHeaders: []string{`Sub"ject`, "To"},
+				Aliases:       map[string]string{"root": "admin@example.com\n"},
+			}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("config = %+v\nwant %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnsetVariable(t *testing.T) {
+	os.Unsetenv("TEST_UNSET")
+	configs := map[string]string{
+		ConfigFormatJSON: "{\n  \"user_id\": \"me\",\n  \"token_file\": \"${TEST_UNSET}/token.json\"\n}\n",
+		ConfigFormatYAML: "user_id: me\n\ntoken_file: ${TEST_UNSET}/token.json\n",
+		ConfigFormatTOML: "user_id = \"me\"\n\ntoken_file = \"${TEST_UNSET}/token.json\"\n",
+	}
+	for format, data := range configs {
+		t.Run(format, func(t *testing.T) {
+			var cfg loadTestConfig
+			err := LoadConfig(writeTestConfig(t, format, data), &cfg)
+			if err == nil || !strings.Contains(err.Error(), `"token_file" (line 3): unset environment variable TEST_UNSET`) {
+				t.Errorf("error = %v, want TEST_UNSET reported for token_file on line 3", err)
+			}
+		})
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("TEST_SET", "value")
+	t.Setenv("TEST_EMPTY", "")
+	os.Unsetenv("TEST_UNSET")
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"${TEST_SET}", "value", false},
+		{"a-${TEST_SET}-b", "a-value-b", false},
+		{"${TEST_UNSET:-fallback}", "fallback", false},
+		{"${TEST_EMPTY:-fallback}", "fallback", false},
+		{"${TEST_EMPTY}", "", false},
+		{"$$HOME and $${TEST_SET}", "$HOME and ${TEST_SET}", false},
+		{"$TEST_SET", "$TEST_SET", false},
+		{"${TEST_UNSET}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := InterpolateEnv(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("InterpolateEnv(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	configs := map[string]string{
+		ConfigFormatJSON: `{"user_id": "me", "max_retries": 3, "verbose": false}`,
+		ConfigFormatYAML: "user_id: me\nmax_retries: 3\nverbose: false\n",
+		ConfigFormatTOML: "user_id = \"me\"\nmax_retries = 3\nverbose = false\n",
+	}
+	t.Setenv(EnvOverrideName("max_retries"), "5")
+	t.Setenv(EnvOverrideName("verbose"), "1")
+	t.Setenv(EnvOverrideName("rate_limit"), "2.5")
+	t.Setenv(EnvOverrideName("redact_headers"), "Subject, To")
+	t.Setenv(EnvOverrideName("aliases"), "root=admin@example.com, postmaster=pm@example.com")
+
+	for format, data := range configs {
+		t.Run(format, func(t *testing.T) {
+			var cfg loadTestConfig
+			if err := LoadConfig(writeTestConfig(t, format, data), &cfg); err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			want := loadTestConfig{
+				UserID:        "me",
+				MaxRetries:    5,
+				Verbose:       true,
+				RateLimit:     2.5,
+				RedactHeaders: []string{"Subject", "To"},
+				Aliases:       map[string]string{"root": "admin@example.com", "postmaster": "pm@example.com"},
+			}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("config = %+v\nwant %+v", cfg, want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv(EnvOverrideName("max_retries"), "many")
+		var cfg loadTestConfig
+		err := LoadConfig(writeTestConfig(t, ConfigFormatJSON, configs[ConfigFormatJSON]), &cfg)
+		if err == nil || !strings.Contains(err.Error(), "invalid GMAIL_TRANSPORT_MAX_RETRIES") {
+			t.Errorf("error = %v, want invalid GMAIL_TRANSPORT_MAX_RETRIES", err)
+		}
+	})
+}
+
+func TestLoadConfigErrorLines(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		want   string
+	}{
+		{
+			ConfigFormatJSON,
+			"{\n  \"user_id\": \"me\",\n  \"max_retry\": 3,\n  \"verbos\": true\n}\n",
+			`unknown config key "max_retry" (line 3), "verbos" (line 4)`,
+		},
+		{
+			ConfigFormatYAML,
+			"# comment\nuser_id: me\nverbos: true\nmax_retry: 3\n",
+			`unknown config key "verbos" (line 3), "max_retry" (line 4)`,
+		},
+		{
+			ConfigFormatTOML,
+			"user_id = \"me\"\nmax_retry = 3\n\n[alias]\nroot = \"admin@example.com\"\n",
+			`unknown config key "max_retry" (line 2), "alias" (line 4)`,
+		},
+		{
+			ConfigFormatJSON,
+			"{\n  \"user_id\": \"me\",\n  \"max_retries\": \"three\"\n}\n",
+			`"max_retries" (line 3) has the wrong type`,
+		},
+		{
+			ConfigFormatYAML,
+			"user_id: me\nverbose: [yes]\n",
+			`"verbose" (line 2) has the wrong type`,
+		},
+		{
+			ConfigFormatJSON,
+			"{\n  \"user_id\": \"me\",\n  \"verbose\": tru,\n  \"max_retries\": 3\n}\n",
+			"line 3",
+		},
+		{
+			ConfigFormatTOML,
+			"user_id = \"me\"\nverbose = \n",
+			"line 2 column",
+		},
+	}
+	for _, tt := range tests {
+		var cfg loadTestConfig
+		err := LoadConfig(writeTestConfig(t, tt.format, tt.data), &cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s %q: error = %v, want %q", tt.format, tt.data, err, tt.want)
+		}
+	}
+}
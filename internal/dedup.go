@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Deduplication modes
+const (
+	// DedupOff disables deduplication
+	DedupOff = "off"
+	// DedupLocal checks a local index of delivered messages
+	DedupLocal = "local"
+	// DedupSearch searches the mailbox for the Message-ID (API transport only)
+	DedupSearch = "search"
+	// DedupBoth checks the local index first, then searches the mailbox
+	DedupBoth = "both"
+)
+
+// ParseDedupMode validates a dedup_mode configuration value
+// An empty string disables deduplication
+func ParseDedupMode(s string) (string, error) {
+	switch mode := strings.ToLower(s); mode {
+	case "":
+		return DedupOff, nil
+	case DedupOff, DedupLocal, DedupSearch, DedupBoth:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown dedup_mode %q (expected off, local, search or both)", s)
+	}
+}
+
+// DedupUsesIndex reports whether a dedup mode uses the local index
+func DedupUsesIndex(mode string) bool {
+	return mode == DedupLocal || mode == DedupBoth
+}
+
+// DedupUsesSearch reports whether a dedup mode searches the mailbox
+func DedupUsesSearch(mode string) bool {
+	return mode == DedupSearch || mode == DedupBoth
+}
+
+// MessageID returns the Message-ID header of a raw message without angle
+// brackets, or an empty string if the message has none
+func MessageID(rawMessage []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(rawMessage))
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(msg.Header.Get("Message-Id"))
+	return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+// messageBody returns the part of a raw message after the header block, or
+// the whole message if it has no blank line
+func messageBody(rawMessage []byte) []byte {
+	if i := bytes.Index(rawMessage, []byte("\r\n\r\n")); i >= 0 {
+		return rawMessage[i+4:]
+	}
+	if i := bytes.Index(rawMessage, []byte("\n\n")); i >= 0 {
+		return rawMessage[i+2:]
+	}
+	return rawMessage
+}
+
+// DedupKey returns the deduplication key for a raw message, combining its
+// Message-ID with a SHA-256 of the body so that distinct messages reusing a
+// Message-ID aren't dropped
+// ok is false if the message has no Message-ID and can't be safely deduplicated
+func DedupKey(rawMessage []byte) (key string, ok bool) {
+	messageID := MessageID(rawMessage)
+	if messageID == "" {
+		return "", false
+	}
+
+	bodyHash := sha256.Sum256(messageBody(rawMessage))
+
+	h := sha256.New()
+	h.Write([]byte(messageID))
+	h.Write([]byte{0})
+	h.Write(bodyHash[:])
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// DeliveredIndex is an append-only index of delivered messages shared
+// between processes, with entries expiring after a fixed period
+type DeliveredIndex struct {
+	path   string
+	expiry time.Duration
+	clock  Clock
+}
+
+// deliveredEntry is a single line of the index
+type deliveredEntry struct {
+	Key         string    `json:"key"`
+	MessageID   string    `json:"message_id,omitempty"`
+	GmailID     string    `json:"gmail_id,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// NewDeliveredIndex creates an index stored at path
+func NewDeliveredIndex(path string, expiry time.Duration, clock Clock) *DeliveredIndex {
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	return &DeliveredIndex{path: path, expiry: expiry, clock: clock}
+}
+
+// Lookup returns the unexpired entry for key, if any
+func (d *DeliveredIndex) Lookup(key string) (gmailID string, found bool, err error) {
+	err = d.withLockedIndex(func(file *os.File, entries []deliveredEntry, expired int) error {
+		for _, entry := range entries {
+			if entry.Key == key {
+				gmailID, found = entry.GmailID, true
+				return nil
+			}
+		}
+		return nil
+	})
+	return gmailID, found, err
+}
+
+// Add records a delivered message
+// Expired entries are dropped once they make up most of the file
+func (d *DeliveredIndex) Add(key, messageID, gmailID string) error {
+	entry := deliveredEntry{
+		Key:         key,
+		MessageID:   messageID,
+		GmailID:     gmailID,
+		DeliveredAt: d.clock.Now().UTC(),
+	}
+
+	return d.withLockedIndex(func(file *os.File, entries []deliveredEntry, expired int) error {
+		if expired > 0 && expired >= len(entries) {
+			// Compact: rewrite the file with only the live entries
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("truncating index: %w", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("seeking index: %w", err)
+			}
+			entries = append(entries, entry)
+		} else {
+			end, err := file.Seek(0, io.SeekEnd)
+			if err != nil {
+				return fmt.Errorf("seeking index: %w", err)
+			}
+			entries = []deliveredEntry{entry}
+
+			// Terminate a partial line left by a crash so the new entry stays intact
+			if end > 0 {
+				last := make([]byte, 1)
+				if _, err := file.ReadAt(last, end-1); err == nil && last[0] != '\n' {
+					if _, err := file.Write([]byte{'\n'}); err != nil {
+						return fmt.Errorf("writing index: %w", err)
+					}
+				}
+			}
+		}
+
+		w := bufio.NewWriter(file)
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return fmt.Errorf("writing index: %w", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("writing index: %w", err)
+		}
+		return file.Sync()
+	})
+}
+
+// withLockedIndex opens and locks the index, reads its live entries and
+// passes them to fn along with the number of expired entries skipped
+func (d *DeliveredIndex) withLockedIndex(fn func(file *os.File, entries []deliveredEntry, expired int) error) error {
+	file, err := os.OpenFile(d.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening delivered index: %w", err)
+	}
+	defer file.Close()
+
+	if err := acquireFileLock(file); err != nil {
+		return fmt.Errorf("locking delivered index: %w", err)
+	}
+	defer releaseFileLock(file)
+
+	cutoff := d.clock.Now().Add(-d.expiry)
+	var entries []deliveredEntry
+	expired := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deliveredEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			// Skip partial lines left by a crash mid-write
+			expired++
+			continue
+		}
+		if entry.DeliveredAt.Before(cutoff) {
+			expired++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading delivered index: %w", err)
+	}
+
+	return fn(file, entries, expired)
+}
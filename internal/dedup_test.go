@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// indexKeys returns the keys of the lines of an index file, with "?" for a
+// line that isn't an entry
+func indexKeys(t *testing.T, file string) []string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry deliveredEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			keys = append(keys, "?")
+			continue
+		}
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+// assertLookup checks whether the index has a live entry for key
+func assertLookup(t *testing.T, index *DeliveredIndex, key, wantGmailID string, wantFound bool) {
+	t.Helper()
+	gmailID, found, err := index.Lookup(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != wantFound || gmailID != wantGmailID {
+		t.Errorf("Lookup(%q) = %q, %v; want %q, %v", key, gmailID, found, wantGmailID, wantFound)
+	}
+}
+
+func TestDeliveredIndexExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	index := NewDeliveredIndex(filepath.Join(t.TempDir(), "delivered.jsonl"), time.Hour, clock)
+
+	assertLookup(t, index, "a", "", false)
+	if err := index.Add("a", "a@example.com", "gmail-a"); err != nil {
+		t.Fatal(err)
+	}
+	assertLookup(t, index, "a", "gmail-a", true)
+
+	// An entry is live for exactly the expiry period
+	clock.now = clock.now.Add(time.Hour)
+	assertLookup(t, index, "a", "gmail-a", true)
+	clock.now = clock.now.Add(time.Nanosecond)
+	assertLookup(t, index, "a", "", false)
+}
+
+func TestDeliveredIndexCompaction(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	file := filepath.Join(t.TempDir(), "delivered.jsonl")
+	index := NewDeliveredIndex(file, time.Hour, clock)
+
+	add := func(key string) {
+		t.Helper()
+		if err := index.Add(key, "", "gmail-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a")
+	clock.now = clock.now.Add(40 * time.Minute)
+	add("b")
+	add("c")
+	add("d")
+
+	// a expires, but as long as expired entries are fewer than live ones the
+	// file is only appended to
+	clock.now = clock.now.Add(30 * time.Minute)
+	add("e")
+	if got, want := indexKeys(t, file), []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index = %q, want %q", got, want)
+	}
+
+	// Once they are at least as many as the live ones the file is rewritten
+	// with the live entries only
+	clock.now = clock.now.Add(31 * time.Minute)
+	add("f")
+	if got, want := indexKeys(t, file), []string{"e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index after compaction = %q, want %q", got, want)
+	}
+	assertLookup(t, index, "c", "", false)
+	assertLookup(t, index, "e", "gmail-e", true)
+	assertLookup(t, index, "f", "gmail-f", true)
+}
+
+func TestDeliveredIndexTruncatedLine(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	file := filepath.Join(t.TempDir(), "delivered.jsonl")
+	index := NewDeliveredIndex(file, time.Hour, clock)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := index.Add(key, "", "gmail-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A crash while appending leaves the last line cut short
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data[:len(data)-20], 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertLookup(t, index, "b", "gmail-b", true)
+	assertLookup(t, index, "c", "", false)
+
+	// The next entry starts on a line of its own, so it stays readable
+	if err := index.Add("d", "", "gmail-d"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexKeys(t, file), []string{"a", "b", "?", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index = %q, want %q", got, want)
+	}
+	assertLookup(t, index, "a", "gmail-a", true)
+	assertLookup(t, index, "d", "gmail-d", true)
+
+	// The broken line counts as expired, so it goes at the next compaction
+	clock.now = clock.now.Add(time.Hour + time.Second)
+	if err := index.Add("e", "", "gmail-e"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexKeys(t, file), []string{"e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index after compaction = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"io"
+	"time"
+
+	"gmail-api-client/pkg/deliver"
+)
+
+// ErrEmptyMessage is returned when there is no message to deliver
+var ErrEmptyMessage = deliver.ErrEmptyMessage
+
+// ReadMessage reads a whole message, failing if it is empty
+func ReadMessage(r io.Reader) ([]byte, error) {
+	rawMessage, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(rawMessage) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	return rawMessage, nil
+}
+
+// FinishDelivery completes the audit record of a delivery that started at
+// start: it sets the outcome, counts the delivery in metrics (if not nil),
+// appends the record to the audit log if configured, and returns the result
+// Audit log failures are logged but don't affect the delivery result
+func FinishDelivery(common *Common, logger *Logger, metrics deliver.Metrics, account string, record *AuditRecord, start time.Time, err error) *DeliveryResult {
+	record.Finish(err, logger.redactor)
+	if metrics != nil {
+		metrics.ObserveDelivery(record.Transport, record.Outcome, record.Size)
+	}
+	if auditLog := NewAuditLogFromConfig(common); auditLog != nil {
+		record.Account = account
+		record.DeliveryID = logger.DeliveryID()
+		if err := auditLog.Write(record); err != nil {
+			logger.Warn("failed to write audit log", "error", err)
+		}
+	}
+	return NewDeliveryResult(record, time.Since(start))
+}
+
+// DeliveryError wraps an error returned by a delivery package as a
+// *deliver.Error, recording whether it is temporary
+func DeliveryError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &deliver.Error{Temporary: ExitCode(err) == ExitTempFail, Err: err}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDryRun is returned by CaptureTransport in place of a response
+var ErrDryRun = errors.New("dry run: request not sent")
+
+// CapturedRequest is an HTTP request recorded by CaptureTransport
+type CapturedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// CaptureTransport is an http.RoundTripper that records requests instead of
+// sending them, so --dry-run can show exactly what would be sent
+type CaptureTransport struct {
+	mu       sync.Mutex
+	Requests []*CapturedRequest
+}
+
+// RoundTrip implements http.RoundTripper; it always fails with ErrDryRun
+func (t *CaptureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	captured := &CapturedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		captured.Body = body
+	}
+
+	t.mu.Lock()
+	t.Requests = append(t.Requests, captured)
+	t.mu.Unlock()
+	return nil, ErrDryRun
+}
+
+// DryRunReport builds the description printed by --dry-run
+// Everything is redacted like log output before it is printed
+type DryRunReport struct {
+	b strings.Builder
+}
+
+// Section starts a titled section
+func (r *DryRunReport) Section(title string) {
+	if r.b.Len() > 0 {
+		r.b.WriteByte('\n')
+	}
+	r.b.WriteString(title)
+	r.b.WriteString(":\n")
+}
+
+// Line adds an indented line to the current section
+func (r *DryRunReport) Line(format string, args ...interface{}) {
+	if line := fmt.Sprintf(format, args...); line != "" {
+		r.b.WriteString("  ")
+		r.b.WriteString(line)
+	}
+	r.b.WriteByte('\n')
+}
+
+// Print writes the report, redacted by logger
+func (r *DryRunReport) Print(w io.Writer, logger *Logger) {
+	io.WriteString(w, logger.Redact(r.b.String()))
+}
+
+// dryRunHeaders are the message headers shown by a dry run
+var dryRunHeaders = []string{"From", "To", "Cc", "Subject", "Date", "Message-Id"}
+
+// Message describes the message that would be delivered
+func (r *DryRunReport) Message(rawMessage []byte) {
+	r.Section("Message")
+	msg, err := mail.ReadMessage(bytes.NewReader(rawMessage))
+	if err != nil {
+		r.Line("headers could not be parsed: %v", err)
+	} else {
+		for _, name := range dryRunHeaders {
+			if value := msg.Header.Get(name); value != "" {
+				r.Line("%s: %s", name, value)
+			}
+		}
+		if msg.Header.Get("Date") == "" {
+			r.Line("(no Date header; Gmail will use the delivery time)")
+		} else if _, err := msg.Header.Date(); err != nil {
+			r.Line("(Date header can't be parsed; Gmail will use the delivery time)")
+		}
+	}
+	r.Line("Size: %d bytes", len(rawMessage))
+}
+
+// Dedup evaluates duplicate delivery protection without touching the
+// network and reports whether delivery would be skipped
+// The local index is read, but a mailbox search is only described
+func (r *DryRunReport) Dedup(common *Common, rawMessage []byte) bool {
+	r.Section(fmt.Sprintf("Duplicate check (dedup_mode %s)", common.DedupMode))
+	if common.DedupMode == DedupOff {
+		r.Line("disabled")
+		return false
+	}
+
+	dedupKey, ok := DedupKey(rawMessage)
+	if !ok {
+		r.Line("skipped: message has no Message-ID")
+		return false
+	}
+	r.Line("key: %s", dedupKey)
+
+	if DedupUsesIndex(common.DedupMode) && r.dedupIndex(common, dedupKey) {
+		return true
+	}
+	if DedupUsesSearch(common.DedupMode) {
+		r.Line("would search the mailbox for rfc822msgid:%s", MessageID(rawMessage))
+	}
+	return false
+}
+
+// dedupIndex looks a message up in the local delivered index
+func (r *DryRunReport) dedupIndex(common *Common, dedupKey string) bool {
+	// Looking up creates a missing index, which a dry run mustn't do
+	if _, err := os.Stat(common.DedupIndex); os.IsNotExist(err) {
+		r.Line("local index %s: doesn't exist yet, so not delivered before", common.DedupIndex)
+		return false
+	}
+
+	index := NewDeliveredIndex(common.DedupIndex, time.Duration(common.DedupExpiry)*time.Hour, nil)
+	existingID, found, err := index.Lookup(dedupKey)
+	switch {
+	case err != nil:
+		r.Line("local index %s: lookup failed (%v); delivery would go ahead", common.DedupIndex, err)
+	case found && existingID != "":
+		r.Line("local index %s: already delivered as %s; delivery would be skipped", common.DedupIndex, existingID)
+		return true
+	case found:
+		r.Line("local index %s: already delivered; delivery would be skipped", common.DedupIndex)
+		return true
+	default:
+		r.Line("local index %s: not delivered before", common.DedupIndex)
+	}
+	return false
+}
+
+// Request describes a captured HTTP request
+// A base64url "raw" message in a JSON body is summarised rather than printed
+func (r *DryRunReport) Request(req *CapturedRequest) {
+	r.Line("%s %s", req.Method, req.URL)
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	r.Line("Authorization: Bearer %s", redactedValue)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			r.Line("%s: %s", name, value)
+		}
+	}
+
+	if len(req.Body) > 0 {
+		r.Line("")
+		r.Line("%s", summarizeRawBody(req.Body))
+	}
+}
+
+// summarizeRawBody replaces the raw message in a Gmail API request body with
+// a description of its size
+func summarizeRawBody(body []byte) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Sprintf("<%d byte body>", len(body))
+	}
+	if raw, ok := fields["raw"].(string); ok {
+		fields["raw"] = fmt.Sprintf("<%d bytes of base64url-encoded message>", len(raw))
+	}
+	var summary strings.Builder
+	enc := json.NewEncoder(&summary)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fields); err != nil {
+		return fmt.Sprintf("<%d byte body>", len(body))
+	}
+	return strings.TrimSuffix(summary.String(), "\n")
+}
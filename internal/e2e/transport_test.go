@@ -0,0 +1,267 @@
+// Package e2e_test runs the transport binaries the way Exim does, piping a
+// message to them and checking their exit codes, against the fake servers
+package e2e_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/fakegmail"
+	"gmail-api-client/internal/fakeimap"
+	"gmail-api-client/internal/fakeoauth"
+)
+
+// binDir holds the binaries built by TestMain
+var binDir string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+// run builds the transports into a temporary directory and runs the tests
+func run(m *testing.M) int {
+	flag.Parse()
+	if testing.Short() {
+		fmt.Println("skipping end-to-end tests in short mode")
+		return 0
+	}
+	dir, err := os.MkdirTemp("", "gmail-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	build := exec.Command("go", "build", "-o", dir, "./cmd/gmail-api-transport", "./cmd/gmail-imap-transport")
+	build.Dir = filepath.Join("..", "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "building transports: %v\n%s", err, out)
+		return 1
+	}
+	binDir = dir
+	return m.Run()
+}
+
+// writeConfig writes a configuration file with credentials and an expired
+// token for tokens, and the settings in extra
+func writeConfig(t *testing.T, tokens *fakeoauth.Server, extra map[string]any) string {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := map[string]any{
+		"credentials_file": filepath.Join(dir, "credentials.json"),
+		"token_file":       filepath.Join(dir, "token.json"),
+		"max_retries":      1,
+		"retry_delay":      1,
+		"result_format":    "json",
+	}
+	for key, value := range extra {
+		cfg[key] = value
+	}
+	if err := tokens.WriteCredentials(cfg["credentials_file"].(string)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.WriteToken(cfg["token_file"].(string), true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// runTransport pipes test-message.eml to program and returns its exit code,
+// the delivery result it printed and its stderr
+func runTransport(t *testing.T, program, configFile string) (int, *internal.DeliveryResult, string) {
+	t.Helper()
+	message, err := os.Open(filepath.Join("..", "..", "test-message.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer message.Close()
+
+	cmd := exec.Command(filepath.Join(binDir, program), configFile)
+	cmd.Stdin = message
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running %s: %v", program, err)
+	}
+	t.Logf("%s exited with %d\nstdout:\n%s\nstderr:\n%s", program, code, stdout.String(), stderr.String())
+
+	var result internal.DeliveryResult
+	if line := strings.TrimSpace(stdout.String()); line != "" {
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Errorf("stdout %q is not a JSON result: %v", line, err)
+		}
+	}
+	return code, &result, stderr.String()
+}
+
+func TestAPITransportExitCodes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		fault        *fakegmail.Fault
+		wantCode     int
+		wantStatus   string
+		wantMessages int
+	}{
+		{"delivered", nil, 0, "delivered", 1},
+		{"server errors", &fakegmail.Fault{Method: "users.messages.import", Status: 503}, internal.ExitTempFail, "deferred", 0},
+		{"rejected", &fakegmail.Fault{Method: "users.messages.import", Status: 400, Reason: "invalidArgument"}, internal.ExitFailure, "failed", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			api := fakegmail.New()
+			defer api.Close()
+			if tt.fault != nil {
+				api.InjectFault(*tt.fault)
+			}
+			tokens := fakeoauth.New()
+			defer tokens.Close()
+			configFile := writeConfig(t, tokens, map[string]any{
+				"api_endpoint": api.Endpoint(),
+				"filter_delay": 1,
+			})
+
+			code, result, _ := runTransport(t, "gmail-api-transport", configFile)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if result.Status != tt.wantStatus {
+				t.Errorf("result status = %q, want %q", result.Status, tt.wantStatus)
+			}
+			if n := len(api.Messages()); n != tt.wantMessages {
+				t.Errorf("mailbox has %d messages, want %d", n, tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestIMAPTransportExitCodes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		prepare      func(*fakeimap.Server)
+		wantCode     int
+		wantStatus   string
+		wantMessages int
+	}{
+		{"delivered", func(*fakeimap.Server) {}, 0, "delivered", 1},
+		{
+			"disconnect during APPEND",
+			func(s *fakeimap.Server) { s.InjectFault(fakeimap.Fault{Command: "APPEND", Disconnect: true}) },
+			internal.ExitTempFail, "deferred", 0,
+		},
+		{
+			"XOAUTH2 rejects the token",
+			func(s *fakeimap.Server) { s.AccessToken = "another-token" },
+			internal.ExitFailure, "failed", 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			server, err := fakeimap.New(fakeimap.TLSImplicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			tokens := fakeoauth.New()
+			defer tokens.Close()
+			server.AccessToken = tokens.AccessToken
+			tt.prepare(server)
+
+			caFile := filepath.Join(t.TempDir(), "ca.pem")
+			if err := server.WriteCACert(caFile); err != nil {
+				t.Fatal(err)
+			}
+			configFile := writeConfig(t, tokens, map[string]any{
+				"user_id":            fakeimap.DefaultEmail,
+				"imap_server":        server.Addr(),
+				"imap_tls":           "tls",
+				"imap_ca_file":       caFile,
+				"connection_timeout": 5,
+			})
+
+			code, result, _ := runTransport(t, "gmail-imap-transport", configFile)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if result.Status != tt.wantStatus {
+				t.Errorf("result status = %q, want %q", result.Status, tt.wantStatus)
+			}
+			if n := len(server.Messages()); n != tt.wantMessages {
+				t.Errorf("server has %d messages, want %d", n, tt.wantMessages)
+			}
+		})
+	}
+}
+
+// deliverAPI runs gmail-api-transport against a fresh fake server with the
+// settings in extra and returns its exit code, the number of messages
+// delivered and its stderr
+func deliverAPI(t *testing.T, extra map[string]any) (int, int, string) {
+	t.Helper()
+	api := fakegmail.New()
+	defer api.Close()
+	tokens := fakeoauth.New()
+	defer tokens.Close()
+	extra["api_endpoint"] = api.Endpoint()
+	extra["filter_delay"] = 1
+	code, _, stderr := runTransport(t, "gmail-api-transport", writeConfig(t, tokens, extra))
+	return code, len(api.Messages()), stderr
+}
+
+func TestTransportUnreachableLogSink(t *testing.T) {
+	t.Parallel()
+	// Nothing listens on the socket, so connecting to syslog fails
+	socket := filepath.Join(t.TempDir(), "missing.sock")
+	code, messages, _ := deliverAPI(t, map[string]any{
+		"log_sink":       "syslog",
+		"syslog_address": "unix://" + socket,
+	})
+	if code != 0 || messages != 1 {
+		t.Errorf("exit code %d with %d messages delivered, want 0 and 1", code, messages)
+	}
+}
+
+func TestTransportUnwritableLogFile(t *testing.T) {
+	t.Parallel()
+	logFile := filepath.Join(t.TempDir(), "missing", "transport.log")
+	code, messages, stderr := deliverAPI(t, map[string]any{"log_file": logFile})
+	if code != 0 || messages != 1 {
+		t.Errorf("exit code %d with %d messages delivered, want 0 and 1", code, messages)
+	}
+	// The log lines go to stderr instead, after the reason
+	for _, want := range []string{"log file unavailable, logging to stderr", "message delivered successfully"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr = %q, want %q", stderr, want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Exit codes understood by MTAs (see sysexits.h)
+const (
+	// ExitFailure is a permanent failure; the MTA should bounce the message
+	ExitFailure = 1
+	// ExitTempFail asks the MTA to queue the message and try again later
+	ExitTempFail = 75
+)
+
+// Gmail API error reasons that need special handling
+const (
+	ReasonRateLimitExceeded     = "rateLimitExceeded"
+	ReasonUserRateLimitExceeded = "userRateLimitExceeded"
+	ReasonDailyLimitExceeded    = "dailyLimitExceeded"
+	ReasonFailedPrecondition    = "failedPrecondition"
+	ReasonInvalidArgument       = "invalidArgument"
+	ReasonInvalid               = "invalid"
+)
+
+// ErrorClass describes how an error should be handled
+type ErrorClass int
+
+const (
+	// ClassPermanent errors will never succeed and should not be retried
+	ClassPermanent ErrorClass = iota
+	// ClassRetryable errors are transient and can be retried straight away
+	ClassRetryable
+	// ClassDeferred errors are transient but won't clear within this run
+	// (e.g. exhausted daily quota); the message should go back to the MTA
+	ClassDeferred
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassPermanent:
+		return "permanent"
+	case ClassRetryable:
+		return "retryable"
+	case ClassDeferred:
+		return "deferred"
+	default:
+		return "unknown"
+	}
+}
+
+// TempFailError marks an error that should be reported to the MTA as a
+// temporary failure instead of being retried in-process
+type TempFailError struct {
+	Reason string
+	Err    error
+}
+
+func (e *TempFailError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("temporary failure (%s): %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("temporary failure: %v", e.Err)
+}
+
+func (e *TempFailError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the process exit code to use for an error
+// Errors that may succeed on a later delivery attempt map to ExitTempFail,
+// everything else maps to ExitFailure
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var tempErr *TempFailError
+	if errors.As(err, &tempErr) {
+		return ExitTempFail
+	}
+	if ClassifyError(err) != ClassPermanent {
+		return ExitTempFail
+	}
+	return ExitFailure
+}
+
+// APIErrorReason returns the first reason reported in a Google API error,
+// or an empty string if err is not a Google API error or carries no reason
+func APIErrorReason(err error) string {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason != "" {
+			return item.Reason
+		}
+	}
+	return ""
+}
+
+// RetryAfter returns the delay requested by the server via a Retry-After
+// header on a Google API error, if any
+func RetryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0, false
+	}
+	return parseRetryAfter(apiErr.Header.Get("Retry-After"), time.Now())
+}
+
+// parseRetryAfter parses a Retry-After value given as either delay-seconds
+// or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		d := at.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// classifyAPIError classifies a Google API error using its status code and reason
+func classifyAPIError(apiErr *googleapi.Error) ErrorClass {
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case ReasonDailyLimitExceeded:
+			return ClassDeferred
+		case ReasonRateLimitExceeded, ReasonUserRateLimitExceeded:
+			return ClassRetryable
+		case ReasonFailedPrecondition, ReasonInvalidArgument, ReasonInvalid:
+			return ClassPermanent
+		}
+	}
+
+	// Retry on rate limit, server errors, and service unavailable
+	// 429 - Too Many Requests (rate limit)
+	// 500 - Internal Server Error
+	// 502 - Bad Gateway
+	// 503 - Service Unavailable
+	// 504 - Gateway Timeout
+	if apiErr.Code == 429 || apiErr.Code >= 500 {
+		return ClassRetryable
+	}
+	return ClassPermanent
+}
+
+// ClassifyError determines how an error should be handled
+// Classification walks the error chain with errors.As/errors.Is, so wrapped
+// errors are classified by their underlying cause rather than their text
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ClassPermanent
+	}
+
+	var tempErr *TempFailError
+	if errors.As(err, &tempErr) {
+		return ClassDeferred
+	}
+
+	// Cancellation is a decision by the caller; a missed deadline is transient
+	if errors.Is(err, context.Canceled) {
+		return ClassPermanent
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ClassRetryable
+	}
+
+	// Token endpoint errors (these arrive wrapped in *url.Error from HTTP clients,
+	// so they must be checked before the generic network checks)
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return classifyRetrieveError(retrieveErr)
+	}
+
+	// Check for Google API errors
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return classifyAPIError(apiErr)
+	}
+
+	// IMAP server responses
+	var cmdErr *IMAPCommandError
+	if errors.As(err, &cmdErr) {
+		return classifyIMAPCommandError(cmdErr)
+	}
+	var statusErr *imap.ErrStatusResp
+	if errors.As(err, &statusErr) {
+		return classifyIMAPStatus(statusErr.Resp)
+	}
+
+	// TLS and certificate problems won't fix themselves between attempts
+	if isTLSError(err) {
+		return ClassPermanent
+	}
+
+	// Connection-level failures
+	if isTransientErrno(err) {
+		return ClassRetryable
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ClassRetryable
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout || dnsErr.IsTemporary {
+			return ClassRetryable
+		}
+		return ClassPermanent
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Timeout() {
+		return ClassRetryable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ClassRetryable
+	}
+
+	return ClassPermanent
+}
+
+// classifyRetrieveError classifies an error returned by the OAuth2 token endpoint
+func classifyRetrieveError(retrieveErr *oauth2.RetrieveError) ErrorClass {
+	switch retrieveErr.ErrorCode {
+	case "invalid_grant", "invalid_client", "unauthorized_client", "invalid_scope", "access_denied":
+		// The refresh token or client is no longer usable; needs re-authorisation
+		return ClassPermanent
+	}
+	if retrieveErr.Response != nil {
+		code := retrieveErr.Response.StatusCode
+		if code == http.StatusTooManyRequests || code >= 500 {
+			return ClassRetryable
+		}
+	}
+	return ClassPermanent
+}
+
+// transientErrnos are socket errors that typically clear on a fresh connection
+var transientErrnos = []syscall.Errno{
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+	syscall.ETIMEDOUT,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+	syscall.ENETDOWN,
+	syscall.EAGAIN,
+}
+
+// isTransientErrno reports whether err wraps a transient socket errno
+func isTransientErrno(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, transient := range transientErrnos {
+		if errno == transient {
+			return true
+		}
+	}
+	return false
+}
+
+// isTLSError reports whether err is a TLS handshake or certificate failure
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// IsRetryableError determines if an error is transient and should be retried
+func IsRetryableError(err error) bool {
+	return ClassifyError(err) == ClassRetryable
+}
+
+// IMAPCommandError reports a failed IMAP command
+// go-imap's client flattens NO/BAD responses into plain errors, so the
+// transport wraps them with the command name and, when known, the status
+// response or whether the connection dropped during the command
+type IMAPCommandError struct {
+	Command string
+	// Status is the server's status response, if available
+	Status *imap.StatusResp
+	// Disconnected is set when the connection closed while the command was running
+	Disconnected bool
+	Err          error
+}
+
+func (e *IMAPCommandError) Error() string {
+	if e.Disconnected {
+		return fmt.Sprintf("IMAP %s failed, connection closed: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("IMAP %s failed: %v", e.Command, e.Err)
+}
+
+func (e *IMAPCommandError) Unwrap() error {
+	return e.Err
+}
+
+// classifyIMAPCommandError classifies a failed IMAP command
+func classifyIMAPCommandError(cmdErr *IMAPCommandError) ErrorClass {
+	if cmdErr.Disconnected {
+		return ClassRetryable
+	}
+	if cmdErr.Status != nil {
+		return classifyIMAPStatus(cmdErr.Status)
+	}
+	// Network failures underneath the command are classified on their own merits
+	if cmdErr.Err != nil {
+		if class := ClassifyError(cmdErr.Err); class != ClassPermanent {
+			return class
+		}
+	}
+	return ClassPermanent
+}
+
+// classifyIMAPStatus classifies an IMAP status response using its type and
+// response code (RFC 5530)
+func classifyIMAPStatus(resp *imap.StatusResp) ErrorClass {
+	if resp == nil {
+		return ClassPermanent
+	}
+	if resp.Type == imap.StatusRespBye {
+		return ClassRetryable
+	}
+	switch resp.Code {
+	case "UNAVAILABLE", "INUSE", "SERVERBUG", "LIMIT":
+		return ClassRetryable
+	case "OVERQUOTA":
+		return ClassDeferred
+	}
+	return ClassPermanent
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/oauth2"
+)
+
+// netError is a net.Error with a fixed Timeout result
+type netError struct {
+	timeout bool
+}
+
+func (e netError) Error() string   { return "network error" }
+func (e netError) Timeout() bool   { return e.timeout }
+func (e netError) Temporary() bool { return e.timeout }
+
+// dialError returns the error a failed connection attempt gives
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+// urlError wraps err as the HTTP client does
+func urlError(err error) error {
+	return &url.Error{Op: "Post", URL: "https://gmail.googleapis.com/upload/gmail/v1/users/me/messages/import", Err: err}
+}
+
+// retrieveError returns a token endpoint error
+func retrieveError(status int, code string) *oauth2.RetrieveError {
+	return &oauth2.RetrieveError{
+		Response:  &http.Response{StatusCode: status},
+		ErrorCode: code,
+	}
+}
+
+// imapStatus returns a tagged IMAP status response
+func imapStatus(kind imap.StatusRespType, code imap.StatusRespCode) *imap.StatusResp {
+	return &imap.StatusResp{Tag: "a1", Type: kind, Code: code, Info: "test"}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ClassPermanent},
+
+		// Network timeouts and socket errors
+		{"net.Error timeout", netError{timeout: true}, ClassRetryable},
+		{"net.Error without timeout", netError{timeout: false}, ClassPermanent},
+		{"wrapped net.Error timeout", fmt.Errorf("reading response: %w", netError{timeout: true}), ClassRetryable},
+		{"ECONNRESET", dialError(syscall.ECONNRESET), ClassRetryable},
+		{"ECONNREFUSED", dialError(syscall.ECONNREFUSED), ClassRetryable},
+		{"bare errno", syscall.EPIPE, ClassRetryable},
+		{"non-transient errno", dialError(syscall.EACCES), ClassPermanent},
+		{"EOF", io.EOF, ClassRetryable},
+		{"unexpected EOF", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), ClassRetryable},
+		{"DNS not found", &net.DNSError{Err: "no such host", Name: "gmail.googleapis.com", IsNotFound: true}, ClassPermanent},
+		{"DNS timeout", &net.DNSError{Err: "i/o timeout", Name: "gmail.googleapis.com", IsTimeout: true}, ClassRetryable},
+
+		// TLS and certificates
+		{"tls record header", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, ClassPermanent},
+		{"tls alert", fmt.Errorf("handshake: %w", tls.AlertError(40)), ClassPermanent},
+		{"certificate verification", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, ClassPermanent},
+		{"x509 unknown authority", x509.UnknownAuthorityError{}, ClassPermanent},
+		{"x509 hostname", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "imap.example.com"}, ClassPermanent},
+		{"x509 expired", x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}, ClassPermanent},
+		{"tls error under url.Error", urlError(x509.UnknownAuthorityError{}), ClassPermanent},
+
+		// *url.Error wrapping
+		{"url.Error timeout", urlError(netError{timeout: true}), ClassRetryable},
+		{"url.Error connection reset", urlError(dialError(syscall.ECONNRESET)), ClassRetryable},
+		{"url.Error deadline", urlError(context.DeadlineExceeded), ClassRetryable},
+		{"url.Error plain", urlError(errors.New("unsupported protocol scheme")), ClassPermanent},
+
+		// Token endpoint
+		{"invalid_grant", retrieveError(400, "invalid_grant"), ClassPermanent},
+		{"invalid_client", retrieveError(401, "invalid_client"), ClassPermanent},
+		{"token endpoint 500", retrieveError(500, ""), ClassRetryable},
+		{"token endpoint 503", retrieveError(503, ""), ClassRetryable},
+		{"token endpoint 429", retrieveError(429, ""), ClassRetryable},
+		{"token endpoint 400 without code", retrieveError(400, ""), ClassPermanent},
+		{"invalid_grant under url.Error", urlError(retrieveError(400, "invalid_grant")), ClassPermanent},
+		{"token endpoint 503 under url.Error", fmt.Errorf("refreshing token: %w", urlError(retrieveError(503, ""))), ClassRetryable},
+
+		// IMAP status responses
+		{"IMAP NO", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespNo, "")}, ClassPermanent},
+		{"IMAP BAD", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespBad, "")}, ClassPermanent},
+		{"IMAP NO [UNAVAILABLE]", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespNo, "UNAVAILABLE")}, ClassRetryable},
+		{"IMAP NO [INUSE]", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespNo, "INUSE")}, ClassRetryable},
+		{"IMAP NO [OVERQUOTA]", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespNo, "OVERQUOTA")}, ClassDeferred},
+		{"IMAP NO [AUTHENTICATIONFAILED]", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespNo, "AUTHENTICATIONFAILED")}, ClassPermanent},
+		{"IMAP BYE", &imap.ErrStatusResp{Resp: imapStatus(imap.StatusRespBye, "")}, ClassRetryable},
+		{"IMAP command NO", &IMAPCommandError{Command: "APPEND", Status: imapStatus(imap.StatusRespNo, ""), Err: errors.New("append failed")}, ClassPermanent},
+		{"IMAP command BAD", &IMAPCommandError{Command: "APPEND", Status: imapStatus(imap.StatusRespBad, ""), Err: errors.New("syntax error")}, ClassPermanent},
+		{"IMAP command NO [LIMIT]", &IMAPCommandError{Command: "APPEND", Status: imapStatus(imap.StatusRespNo, "LIMIT"), Err: errors.New("too many")}, ClassRetryable},
+		{"IMAP command disconnected", &IMAPCommandError{Command: "APPEND", Disconnected: true, Err: errors.New("connection closed")}, ClassRetryable},
+		{"IMAP command connection reset", &IMAPCommandError{Command: "LOGIN", Err: dialError(syscall.ECONNRESET)}, ClassRetryable},
+		{"IMAP command plain error", &IMAPCommandError{Command: "SELECT", Err: errors.New("mailbox doesn't exist")}, ClassPermanent},
+
+		// Gmail API errors, wrapped as the transports return them
+		{"API 400", fmt.Errorf("importing message: %w", apiError(400, "")), ClassPermanent},
+		{"API 400 invalidArgument", fmt.Errorf("importing message: %w", apiError(400, ReasonInvalidArgument)), ClassPermanent},
+		{"API 401", fmt.Errorf("importing message: %w", apiError(401, "")), ClassPermanent},
+		{"API 403", fmt.Errorf("importing message: %w", apiError(403, "")), ClassPermanent},
+		{"API 404", fmt.Errorf("getting message: %w", apiError(404, "")), ClassPermanent},
+		{"API 429", fmt.Errorf("importing message: %w", apiError(429, "")), ClassRetryable},
+		{"API 403 rateLimitExceeded", fmt.Errorf("importing message: %w", apiError(403, ReasonRateLimitExceeded)), ClassRetryable},
+		{"API 403 userRateLimitExceeded", fmt.Errorf("importing message: %w", apiError(403, ReasonUserRateLimitExceeded)), ClassRetryable},
+		{"API 403 dailyLimitExceeded", fmt.Errorf("importing message: %w", apiError(403, ReasonDailyLimitExceeded)), ClassDeferred},
+		{"API 500", fmt.Errorf("importing message: %w", apiError(500, "")), ClassRetryable},
+		{"API 502", fmt.Errorf("importing message: %w", apiError(502, "")), ClassRetryable},
+		{"API 503", fmt.Errorf("importing message: %w", apiError(503, "")), ClassRetryable},
+		{"API 500 failedPrecondition", fmt.Errorf("importing message: %w", apiError(500, ReasonFailedPrecondition)), ClassPermanent},
+
+		// Context errors
+		{"context canceled", context.Canceled, ClassPermanent},
+		{"wrapped context canceled", fmt.Errorf("importing message: %w", context.Canceled), ClassPermanent},
+		{"context deadline", context.DeadlineExceeded, ClassRetryable},
+		{"wrapped context deadline", fmt.Errorf("importing message: %w", context.DeadlineExceeded), ClassRetryable},
+
+		// Errors marked for the MTA
+		{"TempFailError", &TempFailError{Reason: "test", Err: errors.New("later")}, ClassDeferred},
+		{"wrapped TempFailError", fmt.Errorf("delivering: %w", &TempFailError{Err: apiError(400, "")}), ClassDeferred},
+
+		// Classification goes by type, never by message text
+		{"plain error mentioning token", errors.New("oauth2: token expired and refresh token is not set"), ClassPermanent},
+		{"plain error mentioning timeout", errors.New("timeout waiting for token"), ClassPermanent},
+		{"plain error mentioning 503", errors.New("server returned 503"), ClassPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"permanent", apiError(400, ""), ExitFailure},
+		{"retryable", apiError(503, ""), ExitTempFail},
+		{"deferred", apiError(403, ReasonDailyLimitExceeded), ExitTempFail},
+		{"TempFailError around a permanent error", &TempFailError{Err: apiError(400, "")}, ExitTempFail},
+		{"retries exhausted", fmt.Errorf("max retries exceeded: %w", dialError(syscall.ECONNREFUSED)), ExitTempFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"30", 30 * time.Second, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Wed, 01 Jan 2025 12:01:00 GMT", time.Minute, true},
+		{"Wed, 01 Jan 2025 11:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAPIErrorReason(t *testing.T) {
+	if got := APIErrorReason(fmt.Errorf("wrapped: %w", apiError(403, ReasonDailyLimitExceeded))); got != ReasonDailyLimitExceeded {
+		t.Errorf("APIErrorReason = %q, want %q", got, ReasonDailyLimitExceeded)
+	}
+	if got := APIErrorReason(apiError(500, "")); got != "" {
+		t.Errorf("APIErrorReason without reason = %q, want empty", got)
+	}
+	if got := APIErrorReason(errors.New("plain")); got != "" {
+		t.Errorf("APIErrorReason of a plain error = %q, want empty", got)
+	}
+}
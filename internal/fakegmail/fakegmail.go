@@ -0,0 +1,690 @@
+// Package fakegmail is an in-memory fake of the Gmail v1 API endpoints used
+// by the transports, for hermetic integration tests
+//
+// It serves users.messages.import/insert/send/get/list/modify, labels,
+// settings.getLanguage, history.list and getProfile over an httptest server,
+// and can inject errors and latency and run filters that label messages
+// some time after delivery. Point a transport at it with the api_endpoint
+// option or option.WithEndpoint(server.Endpoint()).
+package fakegmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gmail-api-client/internal"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// DefaultEmail is the address of the fake mailbox
+const DefaultEmail = "user@example.com"
+
+// systemLabels exist in every mailbox
+var systemLabels = []string{
+	"INBOX", "SPAM", "TRASH", "UNREAD", "STARRED", "IMPORTANT", "SENT", "DRAFT",
+	"CATEGORY_PERSONAL", "CATEGORY_SOCIAL", "CATEGORY_PROMOTIONS", "CATEGORY_UPDATES", "CATEGORY_FORUMS",
+}
+
+// Fault makes matching requests fail or respond slowly
+type Fault struct {
+	// Method is the API method to affect, e.g. "users.messages.import";
+	// empty matches every request
+	Method string
+	// Status is the HTTP status to fail with; zero only adds Delay
+	Status int
+	// Reason is the error reason in the response, e.g. "rateLimitExceeded"
+	Reason string
+	// RetryAfter sets the Retry-After header of the error response
+	RetryAfter string
+	// Delay is added before responding
+	Delay time.Duration
+	// Times limits how many requests are affected; zero means all of them
+	Times int
+}
+
+// Filter labels delivered messages whose raw content contains Match,
+// optionally some time after delivery like Gmail's asynchronous filters
+type Filter struct {
+	// Match is a substring of the raw message; empty matches every message
+	Match string
+	// AddLabels and RemoveLabels are label IDs
+	AddLabels    []string
+	RemoveLabels []string
+	// Delay is how long after delivery the filter runs
+	Delay time.Duration
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string // API method name, see internal.APIMethod
+	Path   string
+	Query  string
+	Status int
+}
+
+// message is a stored message
+type message struct {
+	id           string
+	threadID     string
+	raw          []byte
+	labels       []string
+	historyID    uint64
+	internalDate int64
+	messageID    string
+}
+
+// historyRecord is one change to the mailbox
+type historyRecord struct {
+	id            uint64
+	messageID     string
+	added         bool
+	labelsAdded   []string
+	labelsRemoved []string
+}
+
+// Server is a fake Gmail API server
+type Server struct {
+	*httptest.Server
+
+	// Email is the mailbox address returned by getProfile
+	Email string
+	// Language is returned by settings.getLanguage
+	Language string
+	// AccessToken, if set, is the only bearer token accepted
+	AccessToken string
+
+	mu        sync.Mutex
+	messages  map[string]*message
+	order     []string
+	labels    map[string]*gmail.Label
+	history   []historyRecord
+	historyID uint64
+	nextID    uint64
+	nextLabel int
+	faults    []*Fault
+	filters   []Filter
+	requests  []Request
+	timers    []*time.Timer
+}
+
+// New starts a fake Gmail API server; call Close when done
+func New() *Server {
+	s := &Server{
+		Email:     DefaultEmail,
+		Language:  "en",
+		messages:  make(map[string]*message),
+		labels:    make(map[string]*gmail.Label),
+		historyID: 1000,
+		nextID:    0x18c0000000000000,
+	}
+	for _, id := range systemLabels {
+		s.labels[id] = &gmail.Label{Id: id, Name: id, Type: "system"}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the base URL to pass to option.WithEndpoint
+func (s *Server) Endpoint() string {
+	return s.URL + "/"
+}
+
+// Close stops pending filters and shuts the server down
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.mu.Unlock()
+	s.Server.Close()
+}
+
+// InjectFault adds a fault; faults are checked in the order they were added
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fault := f
+	s.faults = append(s.faults, &fault)
+}
+
+// AddFilter adds a filter run on every later delivery
+func (s *Server) AddFilter(f Filter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filters = append(s.filters, f)
+}
+
+// CreateLabel adds a user label and returns it
+func (s *Server) CreateLabel(name string) *gmail.Label {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createLabel(name)
+}
+
+func (s *Server) createLabel(name string) *gmail.Label {
+	s.nextLabel++
+	label := &gmail.Label{Id: fmt.Sprintf("Label_%d", s.nextLabel), Name: name, Type: "user"}
+	s.labels[label.Id] = label
+	return label
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// CountRequests returns how many requests were made to an API method
+func (s *Server) CountRequests(method string) int {
+	n := 0
+	for _, req := range s.Requests() {
+		if req.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+// Messages returns the stored messages in delivery order
+func (s *Server) Messages() []*gmail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]*gmail.Message, len(s.order))
+	for i, id := range s.order {
+		msgs[i] = s.messages[id].resource("raw")
+	}
+	return msgs
+}
+
+// Message returns a stored message, including its raw content
+func (s *Server) Message(id string) (*gmail.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, false
+	}
+	return msg.resource("raw"), true
+}
+
+// resource converts a stored message to its API representation
+func (m *message) resource(format string) *gmail.Message {
+	res := &gmail.Message{
+		Id:           m.id,
+		ThreadId:     m.threadID,
+		LabelIds:     append([]string(nil), m.labels...),
+		HistoryId:    m.historyID,
+		InternalDate: m.internalDate,
+		SizeEstimate: int64(len(m.raw)),
+	}
+	switch format {
+	case "raw":
+		res.Raw = base64.URLEncoding.EncodeToString(m.raw)
+	case "minimal":
+	default:
+		res.Payload = &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "Message-ID", Value: "<" + m.messageID + ">"},
+		}}
+	}
+	return res
+}
+
+// serveHTTP routes a request by its API method name
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	method := internal.APIMethod(r.Method, r.URL.Path)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: method, Path: r.URL.Path, Query: r.URL.RawQuery, Status: rec.status})
+		s.mu.Unlock()
+	}()
+
+	if s.AccessToken != "" && r.Header.Get("Authorization") != "Bearer "+s.AccessToken {
+		writeError(rec, http.StatusUnauthorized, "authError", "Invalid Credentials", "")
+		return
+	}
+
+	if fault := s.matchFault(method); fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.Status != 0 {
+			writeError(rec, fault.Status, fault.Reason, http.StatusText(fault.Status), fault.RetryAfter)
+			return
+		}
+	}
+
+	// Paths are /gmail/v1/users/{userId}/...; the fields after the user ID
+	// hold message and label IDs
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/upload"), "/gmail/v1/"), "/"), "/")
+	pathID := func(i int) string {
+		if i < len(parts) {
+			return parts[i]
+		}
+		return ""
+	}
+
+	switch method {
+	case "users.messages.import", "users.messages.insert":
+		s.deliver(rec, r, false)
+	case "users.messages.send":
+		s.deliver(rec, r, true)
+	case "users.messages.get":
+		s.getMessage(rec, r, pathID(3))
+	case "users.messages.list":
+		s.listMessages(rec, r)
+	case "users.messages.modify":
+		s.modifyMessage(rec, r, pathID(3))
+	case "users.labels.list":
+		s.listLabels(rec)
+	case "users.labels.create":
+		s.createLabelRequest(rec, r)
+	case "users.labels.get":
+		s.getLabel(rec, pathID(3))
+	case "users.settings.getLanguage":
+		writeJSON(rec, &gmail.LanguageSettings{DisplayLanguage: s.Language})
+	case "users.history.list":
+		s.listHistory(rec, r)
+	case "users.getProfile":
+		s.getProfile(rec)
+	default:
+		writeError(rec, http.StatusNotFound, "notFound", "unsupported method "+method, "")
+	}
+}
+
+// matchFault returns the first fault affecting a method, using it up
+func (s *Server) matchFault(method string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fault := range s.faults {
+		if fault.Method != "" && fault.Method != method {
+			continue
+		}
+		matched := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+// deliver handles messages.import and messages.insert, and messages.send if
+// send is set
+// Sent messages need a recipient and are stored with the SENT label only,
+// without running filters
+func (s *Server) deliver(w http.ResponseWriter, r *http.Request, send bool) {
+	var req gmail.Message
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "invalid request body: "+err.Error(), "")
+		return
+	}
+	raw, err := base64.URLEncoding.DecodeString(req.Raw)
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(req.Raw)
+	}
+	if err != nil || len(raw) == 0 {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "'raw' RFC822 payload message string or uploading message via /upload/* URL required", "")
+		return
+	}
+
+	internalDate := time.Now()
+	var messageID string
+	var recipients int
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		messageID = strings.Trim(strings.TrimSpace(parsed.Header.Get("Message-Id")), "<>")
+		if r.URL.Query().Get("internalDateSource") == "dateHeader" {
+			if date, err := parsed.Header.Date(); err == nil {
+				internalDate = date
+			}
+		}
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			addresses, _ := parsed.Header.AddressList(field)
+			recipients += len(addresses)
+		}
+	}
+	labels := append([]string(nil), req.LabelIds...)
+	if send {
+		if recipients == 0 {
+			writeError(w, http.StatusBadRequest, "invalidArgument", "Recipient address required", "")
+			return
+		}
+		labels = []string{"SENT"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := strconv.FormatUint(s.nextID, 16)
+	threadID := req.ThreadId
+	if threadID == "" {
+		threadID = id
+	}
+	s.historyID++
+	msg := &message{
+		id:           id,
+		threadID:     threadID,
+		raw:          raw,
+		labels:       labels,
+		historyID:    s.historyID,
+		internalDate: internalDate.UnixMilli(),
+		messageID:    messageID,
+	}
+	s.messages[id] = msg
+	s.order = append(s.order, id)
+	s.history = append(s.history, historyRecord{id: s.historyID, messageID: id, added: true})
+
+	filters := s.filters
+	if send {
+		filters = nil
+	}
+	for _, filter := range filters {
+		if filter.Match != "" && !bytes.Contains(raw, []byte(filter.Match)) {
+			continue
+		}
+		if filter.Delay <= 0 {
+			s.applyLabels(msg, filter.AddLabels, filter.RemoveLabels)
+			continue
+		}
+		filter := filter
+		s.timers = append(s.timers, time.AfterFunc(filter.Delay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.applyLabels(msg, filter.AddLabels, filter.RemoveLabels)
+		}))
+	}
+
+	writeJSON(w, msg.resource("minimal"))
+}
+
+// applyLabels changes a message's labels and records the change in history
+// The caller must hold s.mu
+func (s *Server) applyLabels(msg *message, add, remove []string) {
+	var added, removed []string
+	for _, label := range add {
+		if !contains(msg.labels, label) {
+			msg.labels = append(msg.labels, label)
+			added = append(added, label)
+		}
+	}
+	for _, label := range remove {
+		for i, existing := range msg.labels {
+			if existing == label {
+				msg.labels = append(msg.labels[:i], msg.labels[i+1:]...)
+				removed = append(removed, label)
+				break
+			}
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	s.historyID++
+	msg.historyID = s.historyID
+	s.history = append(s.history, historyRecord{
+		id:            s.historyID,
+		messageID:     msg.id,
+		labelsAdded:   added,
+		labelsRemoved: removed,
+	})
+}
+
+// getMessage handles messages.get
+func (s *Server) getMessage(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	msg, ok := s.messages[id]
+	var res *gmail.Message
+	if ok {
+		res = msg.resource(r.URL.Query().Get("format"))
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.", "")
+		return
+	}
+	writeJSON(w, res)
+}
+
+// listMessages handles messages.list, supporting rfc822msgid: and label
+// filters
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	msgID := ""
+	if q := query.Get("q"); strings.HasPrefix(q, "rfc822msgid:") {
+		msgID = strings.Trim(strings.TrimPrefix(q, "rfc822msgid:"), "<>")
+	}
+	labelIDs := query["labelIds"]
+	maxResults, _ := strconv.Atoi(query.Get("maxResults"))
+
+	s.mu.Lock()
+	resp := &gmail.ListMessagesResponse{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		msg := s.messages[s.order[i]]
+		if msgID != "" && msg.messageID != msgID {
+			continue
+		}
+		if !containsAll(msg.labels, labelIDs) {
+			continue
+		}
+		if query.Get("includeSpamTrash") != "true" && (contains(msg.labels, "SPAM") || contains(msg.labels, "TRASH")) {
+			continue
+		}
+		resp.Messages = append(resp.Messages, &gmail.Message{Id: msg.id, ThreadId: msg.threadID})
+		if maxResults > 0 && len(resp.Messages) >= maxResults {
+			break
+		}
+	}
+	s.mu.Unlock()
+	resp.ResultSizeEstimate = int64(len(resp.Messages))
+	writeJSON(w, resp)
+}
+
+// modifyMessage handles messages.modify
+func (s *Server) modifyMessage(w http.ResponseWriter, r *http.Request, id string) {
+	var req gmail.ModifyMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "invalid request body: "+err.Error(), "")
+		return
+	}
+
+	s.mu.Lock()
+	msg, ok := s.messages[id]
+	var res *gmail.Message
+	if ok {
+		for _, label := range append(req.AddLabelIds, req.RemoveLabelIds...) {
+			if _, exists := s.labels[label]; !exists {
+				s.mu.Unlock()
+				writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid label: "+label, "")
+				return
+			}
+		}
+		s.applyLabels(msg, req.AddLabelIds, req.RemoveLabelIds)
+		res = msg.resource("minimal")
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.", "")
+		return
+	}
+	writeJSON(w, res)
+}
+
+// listLabels handles labels.list
+func (s *Server) listLabels(w http.ResponseWriter) {
+	s.mu.Lock()
+	resp := &gmail.ListLabelsResponse{}
+	for _, label := range s.labels {
+		resp.Labels = append(resp.Labels, label)
+	}
+	s.mu.Unlock()
+	sort.Slice(resp.Labels, func(i, j int) bool { return resp.Labels[i].Id < resp.Labels[j].Id })
+	writeJSON(w, resp)
+}
+
+// createLabelRequest handles labels.create
+func (s *Server) createLabelRequest(w http.ResponseWriter, r *http.Request) {
+	var req gmail.Label
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid label name", "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, label := range s.labels {
+		if strings.EqualFold(label.Name, req.Name) {
+			writeError(w, http.StatusConflict, "duplicate", "Label name exists or conflicts", "")
+			return
+		}
+	}
+	writeJSON(w, s.createLabel(req.Name))
+}
+
+// getLabel handles labels.get
+func (s *Server) getLabel(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	label, ok := s.labels[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.", "")
+		return
+	}
+	writeJSON(w, label)
+}
+
+// listHistory handles history.list
+func (s *Server) listHistory(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid startHistoryId", "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &gmail.ListHistoryResponse{HistoryId: s.historyID}
+	for _, rec := range s.history {
+		if rec.id <= start {
+			continue
+		}
+		msg := s.messages[rec.messageID].resource("minimal")
+		h := &gmail.History{Id: rec.id, Messages: []*gmail.Message{{Id: msg.Id, ThreadId: msg.ThreadId}}}
+		if rec.added {
+			h.MessagesAdded = []*gmail.HistoryMessageAdded{{Message: msg}}
+		}
+		if len(rec.labelsAdded) > 0 {
+			h.LabelsAdded = []*gmail.HistoryLabelAdded{{Message: msg, LabelIds: rec.labelsAdded}}
+		}
+		if len(rec.labelsRemoved) > 0 {
+			h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{Message: msg, LabelIds: rec.labelsRemoved}}
+		}
+		resp.History = append(resp.History, h)
+	}
+	writeJSON(w, resp)
+}
+
+// getProfile handles getProfile
+func (s *Server) getProfile(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, &gmail.Profile{
+		EmailAddress:  s.Email,
+		HistoryId:     s.historyID,
+		MessagesTotal: int64(len(s.messages)),
+		ThreadsTotal:  int64(len(s.messages)),
+	})
+}
+
+// statusRecorder remembers the status written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// writeJSON writes a successful JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the Google API error format
+func writeError(w http.ResponseWriter, status int, reason, message, retryAfter string) {
+	if reason == "" {
+		reason = defaultReason(status)
+	}
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors": []map[string]string{
+				{"message": message, "domain": "global", "reason": reason},
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// defaultReason returns the reason Gmail usually gives for a status
+func defaultReason(status int) string {
+	switch status {
+	case http.StatusTooManyRequests:
+		return internal.ReasonRateLimitExceeded
+	case http.StatusBadRequest:
+		return internal.ReasonInvalidArgument
+	case http.StatusUnauthorized:
+		return "authError"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "notFound"
+	default:
+		return "backendError"
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(list, want []string) bool {
+	for _, s := range want {
+		if !contains(list, s) {
+			return false
+		}
+	}
+	return true
+}
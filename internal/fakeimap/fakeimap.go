@@ -0,0 +1,389 @@
+// Package fakeimap is a local IMAP server standing in for Gmail in hermetic
+// integration tests of gmail-imap-transport
+//
+// It accepts XOAUTH2 the way Gmail does, records APPENDed messages with their
+// flags and dates, and can fail or drop the connection during AUTHENTICATE
+// or APPEND. It listens with implicit TLS, STARTTLS or plain TCP using a
+// self-signed certificate that WriteCACert exports for imap_ca_file.
+package fakeimap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+)
+
+// DefaultEmail is the address of the fake mailbox
+const DefaultEmail = "user@example.com"
+
+// TLSMode selects how clients secure the connection
+type TLSMode string
+
+// TLS modes, matching the transport's imap_tls option
+const (
+	TLSImplicit TLSMode = "tls"
+	TLSStartTLS TLSMode = "starttls"
+	TLSNone     TLSMode = "none"
+)
+
+// Fault makes a command fail or drops the connection while it runs
+type Fault struct {
+	// Command is "AUTHENTICATE" or "APPEND"
+	Command string
+	// Disconnect closes the connection instead of answering
+	Disconnect bool
+	// Store keeps an APPENDed message before disconnecting or failing, so the
+	// client can't tell whether delivery happened
+	Store bool
+	// Code and Info make up the NO response, e.g. "OVERQUOTA"
+	Code string
+	Info string
+	// Times limits how many commands are affected; zero means all of them
+	Times int
+}
+
+// Message is a message received by APPEND
+type Message struct {
+	Mailbox string
+	Flags   []string
+	Date    time.Time
+	Body    []byte
+}
+
+// Server is a fake Gmail IMAP server
+type Server struct {
+	// Email is the only user accepted
+	Email string
+	// AccessToken, if set, is the only bearer token accepted
+	AccessToken string
+
+	imap     *server.Server
+	listener net.Listener
+	certPEM  []byte
+
+	mu       sync.Mutex
+	conns    map[string]net.Conn
+	faults   []*Fault
+	messages []Message
+	auths    int
+}
+
+// New starts a fake IMAP server on a loopback port; call Close when done
+func New(mode TLSMode) (*Server, error) {
+	cert, certPEM, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Email:   DefaultEmail,
+		certPEM: certPEM,
+		conns:   make(map[string]net.Conn),
+	}
+
+	users := memory.New()
+	user, err := users.Login(nil, "username", "password")
+	if err != nil {
+		return nil, err
+	}
+	s.imap = server.New(&fakeBackend{s: s, user: user})
+	s.imap.ErrorLog = log.New(io.Discard, "", 0)
+	s.imap.EnableAuth("XOAUTH2", func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{s: s, conn: conn}
+	})
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.listener = &trackingListener{Listener: tcp, s: s}
+	switch mode {
+	case TLSImplicit:
+		s.listener = tls.NewListener(s.listener, tlsConfig)
+	case TLSStartTLS:
+		s.imap.TLSConfig = tlsConfig
+	case TLSNone:
+		s.imap.AllowInsecureAuth = true
+	default:
+		tcp.Close()
+		return nil, fmt.Errorf("unknown TLS mode %q", mode)
+	}
+
+	go s.imap.Serve(s.listener)
+	return s, nil
+}
+
+// Addr returns the host:port address to use as imap_server
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() error {
+	return s.imap.Close()
+}
+
+// WriteCACert writes the server's certificate as PEM, for imap_ca_file
+func (s *Server) WriteCACert(filename string) error {
+	return os.WriteFile(filename, s.certPEM, 0644)
+}
+
+// InjectFault adds a fault; faults are checked in the order they were added
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fault := f
+	s.faults = append(s.faults, &fault)
+}
+
+// Messages returns the APPENDed messages in order
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Authentications returns how many XOAUTH2 logins succeeded
+func (s *Server) Authentications() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auths
+}
+
+// matchFault returns the first fault affecting a command, using it up
+func (s *Server) matchFault(command string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fault := range s.faults {
+		if !strings.EqualFold(fault.Command, command) {
+			continue
+		}
+		matched := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+// drop closes the raw connection from a remote address, or every
+// connection if remote is nil
+func (s *Server) drop(remote net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, conn := range s.conns {
+		if remote == nil || addr == remote.String() {
+			conn.Close()
+		}
+	}
+}
+
+// faultError carries out a fault, returning the error to answer with
+func (s *Server) faultError(fault *Fault, remote net.Addr) error {
+	if fault.Disconnect {
+		s.drop(remote)
+		return errors.New("connection dropped")
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: imap.StatusRespCode(fault.Code),
+		Info: fault.Info,
+	}}
+}
+
+// trackingListener remembers raw connections so faults can drop them
+type trackingListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.s.mu.Lock()
+	l.s.conns[conn.RemoteAddr().String()] = conn
+	l.s.mu.Unlock()
+	return conn, nil
+}
+
+// xoauth2Server implements Gmail's XOAUTH2 mechanism: a bad token gets a
+// JSON error challenge, and the client's empty reply then fails the command
+type xoauth2Server struct {
+	s      *Server
+	conn   server.Conn
+	failed bool
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failed {
+		return nil, true, &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "AUTHENTICATIONFAILED",
+			Info: "Invalid credentials (Failure)",
+		}}
+	}
+	if response == nil {
+		// No initial response; ask for it
+		return []byte{}, false, nil
+	}
+
+	if fault := a.s.matchFault("AUTHENTICATE"); fault != nil {
+		return nil, true, a.s.faultError(fault, a.conn.Info().RemoteAddr)
+	}
+
+	user, token, ok := parseXOAuth2(response)
+	if !ok {
+		return nil, true, &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "Invalid SASL argument",
+		}}
+	}
+	if user != a.s.Email || (a.s.AccessToken != "" && token != a.s.AccessToken) {
+		a.failed = true
+		return []byte(`{"status":"400","schemes":"Bearer","scope":"https://mail.google.com/"}`), false, nil
+	}
+
+	a.s.mu.Lock()
+	a.s.auths++
+	a.s.mu.Unlock()
+
+	ctx := a.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User, _ = a.conn.Server().Backend.Login(a.conn.Info(), user, "")
+	return nil, true, nil
+}
+
+// parseXOAuth2 decodes "user=U\x01auth=Bearer T\x01\x01"
+func parseXOAuth2(response []byte) (user, token string, ok bool) {
+	fields := strings.Split(string(response), "\x01")
+	if len(fields) != 4 || fields[2] != "" || fields[3] != "" {
+		return "", "", false
+	}
+	user, ok1 := strings.CutPrefix(fields[0], "user=")
+	token, ok2 := strings.CutPrefix(fields[1], "auth=Bearer ")
+	return user, token, ok1 && ok2
+}
+
+// fakeBackend serves the memory backend's mailboxes to the authenticated
+// user and records APPENDs
+type fakeBackend struct {
+	s    *Server
+	user backend.User
+}
+
+func (b *fakeBackend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	if username != b.s.Email {
+		return nil, errors.New("Invalid credentials (Failure)")
+	}
+	return &fakeUser{User: b.user, s: b.s}, nil
+}
+
+type fakeUser struct {
+	backend.User
+	s *Server
+}
+
+func (u *fakeUser) Username() string {
+	return u.s.Email
+}
+
+func (u *fakeUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeMailbox{Mailbox: mbox, s: u.s}, nil
+}
+
+type fakeMailbox struct {
+	backend.Mailbox
+	s *Server
+}
+
+func (m *fakeMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	fault := m.s.matchFault("APPEND")
+	if fault == nil || fault.Store {
+		if err := m.Mailbox.CreateMessage(flags, date, bytes.NewBuffer(data)); err != nil {
+			return err
+		}
+		m.s.mu.Lock()
+		m.s.messages = append(m.s.messages, Message{
+			Mailbox: m.Name(),
+			Flags:   append([]string(nil), flags...),
+			Date:    date,
+			Body:    data,
+		})
+		m.s.mu.Unlock()
+	}
+	if fault != nil {
+		// The backend doesn't know which connection is appending, so a
+		// disconnect drops them all
+		return m.s.faultError(fault, nil)
+	}
+	return nil
+}
+
+// selfSignedCert creates a certificate for 127.0.0.1 and localhost
+func selfSignedCert() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fakeimap"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return cert, certPEM, err
+}
@@ -0,0 +1,153 @@
+// Package fakeoauth is a fake Google OAuth2 token endpoint for hermetic
+// integration tests
+//
+// It answers refresh_token grants with a fixed access token, or with an error
+// to simulate a revoked grant, and can write a credentials file whose
+// token_uri points at itself together with a matching token file.
+package fakeoauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Default values issued and expected by the server
+const (
+	DefaultClientID     = "fake-client-id.apps.googleusercontent.com"
+	DefaultClientSecret = "fake-client-secret"
+	DefaultRefreshToken = "fake-refresh-token"
+	DefaultAccessToken  = "fake-access-token"
+)
+
+// Server is a fake OAuth2 token endpoint
+type Server struct {
+	*httptest.Server
+
+	// AccessToken is issued on every successful refresh
+	AccessToken string
+	// RefreshToken is the only refresh token accepted
+	RefreshToken string
+	// ExpiresIn is the lifetime of issued access tokens
+	ExpiresIn time.Duration
+	// Scope is returned with issued tokens
+	Scope string
+	// Error, if set, is returned instead of a token, e.g. "invalid_grant"
+	Error string
+
+	mu        sync.Mutex
+	refreshes int
+}
+
+// New starts a fake token endpoint; call Close when done
+func New() *Server {
+	s := &Server{
+		AccessToken:  DefaultAccessToken,
+		RefreshToken: DefaultRefreshToken,
+		ExpiresIn:    time.Hour,
+		Scope:        "https://mail.google.com/",
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// TokenURL returns the URL of the token endpoint
+func (s *Server) TokenURL() string {
+	return s.URL + "/token"
+}
+
+// Refreshes returns how many refresh requests succeeded
+func (s *Server) Refreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, "invalid_request", err.Error())
+		return
+	}
+
+	switch {
+	case r.PostForm.Get("grant_type") != "refresh_token":
+		writeError(w, "unsupported_grant_type", "Invalid grant_type: "+r.PostForm.Get("grant_type"))
+		return
+	case r.PostForm.Get("refresh_token") != s.RefreshToken:
+		writeError(w, "invalid_grant", "Bad Request")
+		return
+	case s.Error != "":
+		writeError(w, s.Error, "Token has been expired or revoked.")
+		return
+	}
+
+	s.mu.Lock()
+	s.refreshes++
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": s.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.ExpiresIn.Seconds()),
+		"scope":        s.Scope,
+	})
+}
+
+// writeError writes an OAuth2 error response
+func writeError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// WriteCredentials writes a Desktop app credentials file using this server
+// as its token endpoint
+func (s *Server) WriteCredentials(filename string) error {
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"installed": map[string]interface{}{
+			"client_id":     DefaultClientID,
+			"client_secret": DefaultClientSecret,
+			"auth_uri":      s.URL + "/auth",
+			"token_uri":     s.TokenURL(),
+			"redirect_uris": []string{"http://localhost"},
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
+
+// WriteToken writes a token file holding the server's refresh token
+// If expired is set the access token has already expired, so the first use
+// refreshes it through this server
+func (s *Server) WriteToken(filename string, expired bool) error {
+	token := &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		TokenType:    "Bearer",
+		RefreshToken: s.RefreshToken,
+		Expiry:       time.Now().Add(s.ExpiresIn),
+	}
+	if expired {
+		token.AccessToken = "expired-" + s.AccessToken
+		token.Expiry = time.Now().Add(-time.Hour)
+	}
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ExitUsage is the exit code for command line usage errors (EX_USAGE)
+const ExitUsage = 64
+
+// FlagSet parses a program's command line
+// Besides command-specific flags it provides --help and --version and, once
+// ConfigFlags is called, --config plus a flag for every configuration key
+// (max_retries becomes --max-retries)
+// Flags may appear before or after positional arguments and can be written
+// with one or two dashes
+type FlagSet struct {
+	program  string
+	synopsis string
+	summary  string
+	fs       *flag.FlagSet
+
+	// options, configOptions and builtin list flags in the order they are
+	// shown by --help
+	options       []*flagOption
+	configOptions []*flagOption
+	builtin       []*flagOption
+
+	// overrides holds configuration values set by flags, by key
+	overrides  map[string]interface{}
+	configFile string
+	args       []string
+	help       bool
+	version    bool
+}
+
+// flagOption describes a flag for --help
+type flagOption struct {
+	names []string
+	arg   string
+	help  string
+	def   string
+}
+
+// NewFlagSet creates the flag set for a program
+// synopsis follows the program name in the usage line and summary describes
+// what the program does
+func NewFlagSet(program, synopsis, summary string) *FlagSet {
+	f := &FlagSet{
+		program:   program,
+		synopsis:  synopsis,
+		summary:   summary,
+		fs:        flag.NewFlagSet(program, flag.ContinueOnError),
+		overrides: make(map[string]interface{}),
+	}
+	f.fs.SetOutput(io.Discard)
+	f.fs.Usage = func() {}
+	f.BoolVar(&f.help, "help", "Show this help and exit")
+	f.Alias("h", "help")
+	f.BoolVar(&f.version, "version", "Show version information and exit")
+	f.builtin, f.options = f.options, nil
+	return f
+}
+
+// BoolVar defines a command-specific boolean flag
+func (f *FlagSet) BoolVar(p *bool, name, usage string) {
+	f.fs.BoolVar(p, name, false, usage)
+	f.options = append(f.options, &flagOption{names: []string{name}, help: usage})
+}
+
+// StringVar defines a command-specific string flag
+func (f *FlagSet) StringVar(p *string, name, arg, usage string) {
+	f.fs.StringVar(p, name, "", usage)
+	f.options = append(f.options, &flagOption{names: []string{name}, arg: arg, help: usage})
+}
+
+// IntVar defines a command-specific integer flag whose default is the value
+// p points to
+func (f *FlagSet) IntVar(p *int, name, arg, usage string) {
+	f.fs.IntVar(p, name, *p, usage)
+	f.options = append(f.options, &flagOption{names: []string{name}, arg: arg, help: usage, def: strconv.Itoa(*p)})
+}
+
+// Alias adds another name for a flag, such as -v for --verbose
+func (f *FlagSet) Alias(alias, name string) {
+	target := f.fs.Lookup(name)
+	if target == nil {
+		panic(fmt.Sprintf("flag alias %q for undefined flag %q", alias, name))
+	}
+	f.fs.Var(target.Value, alias, target.Usage)
+	for _, options := range [][]*flagOption{f.options, f.configOptions, f.builtin} {
+		for _, option := range options {
+			if option.names[len(option.names)-1] == name {
+				option.names = append([]string{alias}, option.names...)
+			}
+		}
+	}
+}
+
+// ConfigFlags defines --config and a flag for every key of config, a pointer
+// to a configuration struct
+// Usage text and defaults come from the help and default struct tags
+func (f *FlagSet) ConfigFlags(config interface{}) {
+	f.StringVar(&f.configFile, "config", "file", "Configuration file (JSON, YAML or TOML, chosen by extension)")
+	for _, field := range configFieldList(reflect.TypeOf(config)) {
+		name := strings.ReplaceAll(field.key, "_", "-")
+		f.fs.Var(&fieldFlag{field: field, overrides: f.overrides}, name, field.help)
+		f.configOptions = append(f.configOptions, &flagOption{
+			names: []string{name},
+			arg:   fieldArg(field.kind),
+			help:  field.help,
+			def:   field.def,
+		})
+	}
+}
+
+// fieldArg names the value of a configuration flag in --help
+func fieldArg(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "list"
+	case reflect.Map:
+		return "key=value,..."
+	default:
+		return "string"
+	}
+}
+
+// fieldFlag sets a configuration key from the command line
+type fieldFlag struct {
+	field     configField
+	overrides map[string]interface{}
+}
+
+// String implements flag.Value
+func (v *fieldFlag) String() string {
+	return ""
+}
+
+// Set implements flag.Value; lists and maps may be given as a
+// comma-separated value or by repeating the flag
+func (v *fieldFlag) Set(s string) error {
+	value, err := parseFieldValue(v.field, s)
+	if err != nil {
+		return err
+	}
+	if list, ok := value.([]string); ok {
+		if previous, ok := v.overrides[v.field.key].([]string); ok {
+			value = append(previous, list...)
+		}
+	}
+	if m, ok := value.(map[string]string); ok {
+		if previous, ok := v.overrides[v.field.key].(map[string]string); ok {
+			for key, item := range m {
+				previous[key] = item
+			}
+			value = previous
+		}
+	}
+	v.overrides[v.field.key] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean configuration flags be given without a value
+func (v *fieldFlag) IsBoolFlag() bool {
+	return v.field.kind == reflect.Bool
+}
+
+// Parse parses the command line arguments, excluding the program name
+// --help and --version print to stdout and exit; invalid arguments print an
+// error to stderr and exit with ExitUsage
+// If --config isn't given, the first positional argument is the
+// configuration file
+func (f *FlagSet) Parse(arguments []string) {
+	args, err := f.parse(arguments)
+	if errors.Is(err, flag.ErrHelp) {
+		f.help = true
+	} else if err != nil {
+		// The flag package names flags with a single dash
+		msg := err.Error()
+		if name, ok := strings.CutPrefix(msg, "flag provided but not defined: -"); ok {
+			msg = "unknown flag -" + name
+			if len(name) > 1 {
+				msg = "unknown flag --" + name
+			}
+		}
+		f.UsageError("%s", msg)
+	}
+
+	if f.help {
+		f.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if f.version {
+		fmt.Println(VersionString(f.program))
+		os.Exit(0)
+	}
+
+	if f.fs.Lookup("config") != nil && f.configFile == "" && len(args) > 0 {
+		f.configFile, args = args[0], args[1:]
+	}
+	f.args = args
+}
+
+// parse parses flags interspersed with positional arguments, which it
+// returns; everything after "--" is positional
+func (f *FlagSet) parse(arguments []string) ([]string, error) {
+	var args []string
+	for {
+		if err := f.fs.Parse(arguments); err != nil {
+			return nil, err
+		}
+		rest := f.fs.Args()
+		consumed := len(arguments) - len(rest)
+		if consumed > 0 && arguments[consumed-1] == "--" {
+			return append(args, rest...), nil
+		}
+		if len(rest) == 0 {
+			return args, nil
+		}
+		args = append(args, rest[0])
+		arguments = rest[1:]
+	}
+}
+
+// Args returns the positional arguments left after Parse
+func (f *FlagSet) Args() []string {
+	return f.args
+}
+
+// ConfigFile returns the configuration file given on the command line
+func (f *FlagSet) ConfigFile() string {
+	return f.configFile
+}
+
+// ConfigBool returns the value of a boolean configuration key if it was set
+// on the command line, or false
+func (f *FlagSet) ConfigBool(key string) bool {
+	value, _ := f.overrides[key].(bool)
+	return value
+}
+
+// LoadConfig loads the configuration file into config like LoadConfig,
+// with command line flags taking precedence over the environment
+// Precedence is flags, then GMAIL_TRANSPORT_* variables, then the file;
+// defaults are applied afterwards by validation
+func (f *FlagSet) LoadConfig(config interface{}) error {
+	return loadConfig(f.configFile, config, f.overrides)
+}
+
+// UsageError reports an invalid command line and exits with ExitUsage
+func (f *FlagSet) UsageError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", f.program, fmt.Sprintf(format, args...))
+	fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", f.program)
+	os.Exit(ExitUsage)
+}
+
+// PrintUsage writes the --help text
+func (f *FlagSet) PrintUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s %s\n", f.program, f.synopsis)
+	if f.summary != "" {
+		fmt.Fprintf(w, "\n%s\n", f.summary)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nOptions:\n")
+	for _, option := range append(f.options[:len(f.options):len(f.options)], f.builtin...) {
+		printOption(tw, option)
+	}
+	if len(f.configOptions) > 0 {
+		fmt.Fprintf(tw, "\nConfiguration options (override %s<OPTION> variables and the configuration file):\n", EnvOverridePrefix)
+		for _, option := range f.configOptions {
+			printOption(tw, option)
+		}
+	}
+	tw.Flush()
+}
+
+// printOption writes one line of --help
+func printOption(w io.Writer, option *flagOption) {
+	names := make([]string, len(option.names))
+	for i, name := range option.names {
+		if len(name) == 1 {
+			names[i] = "-" + name
+		} else {
+			names[i] = "--" + name
+		}
+	}
+	usage := strings.Join(names, ", ")
+	if len(option.names[0]) > 1 {
+		usage = "    " + usage
+	}
+	if option.arg != "" {
+		usage += " " + option.arg
+	}
+
+	help := option.help
+	if option.def != "" {
+		help += " (default: " + option.def + ")"
+	}
+	fmt.Fprintf(w, "  %s\t%s\n", usage, help)
+}
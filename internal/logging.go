@@ -1,161 +1,366 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Level represents a log level
-type Level int
+type Level = slog.Level
 
 const (
-	LevelDebug Level = iota
-	LevelInfo
-	LevelWarn
-	LevelError
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
 )
 
-func (l Level) String() string {
-	switch l {
-	case LevelDebug:
-		return "DEBUG"
-	case LevelInfo:
-		return "INFO"
-	case LevelWarn:
-		return "WARN"
-	case LevelError:
-		return "ERROR"
+// LogFormat selects how log lines are written
+type LogFormat string
+
+const (
+	// LogFormatText is the human-readable "[component] [LEVEL] msg key=value" format
+	LogFormatText LogFormat = "text"
+	// LogFormatLogfmt writes logfmt key=value lines with quoting
+	LogFormatLogfmt LogFormat = "logfmt"
+	// LogFormatJSON writes one JSON object per line
+	LogFormatJSON LogFormat = "json"
+)
+
+// ParseLogFormat converts a configuration string to a LogFormat
+// An empty string selects the text format
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch LogFormat(strings.ToLower(s)) {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatLogfmt:
+		return LogFormatLogfmt, nil
+	case LogFormatJSON:
+		return LogFormatJSON, nil
 	default:
-		return "UNKNOWN"
+		return "", fmt.Errorf("unknown log_format %q (expected text, logfmt or json)", s)
 	}
 }
 
 // Logger provides structured logging with support for verbose mode
+// It is a thin facade over a slog.Handler: by default the built-in output
+// handler (verbose stderr, log file and sinks), or any handler supplied via
+// NewLoggerWithHandler. Every record carries the component and a
+// per-invocation delivery ID, and passes through a Redactor.
 type Logger struct {
-	verbose   bool
-	minLevel  Level
-	logger    *log.Logger
-	component string
-	firstLine bool // Track if we've written the first line to stdout
+	mu         sync.Mutex
+	slog       *slog.Logger
+	output     *outputHandler // nil when a custom handler was supplied
+	level      *slog.LevelVar
+	attrs      []any
+	redactor   *Redactor
+	onClose    []func()
+	component  string
+	deliveryID string
 }
 
-// NewLogger creates a new logger
+// NewLogger creates a new logger using the built-in output handler
+// In verbose mode every level is written to the verbose output (stderr);
+// a log file or sink, if configured, receives Info and above regardless
 func NewLogger(verbose bool, component string) *Logger {
-	minLevel := LevelInfo
+	level := new(slog.LevelVar)
+	level.Set(LevelInfo)
 	if verbose {
-		minLevel = LevelDebug
+		level.Set(LevelDebug)
 	}
 
+	output := newOutputHandler(verbose, level)
+	l := newLogger(output, level, component)
+	l.output = output
+	return l
+}
+
+// NewLoggerWithHandler creates a logger that sends records to handler, for
+// library users who want delivery logs in their own logging pipeline
+// Level filtering is left to the handler
+func NewLoggerWithHandler(handler slog.Handler, component string) *Logger {
+	return newLogger(handler, nil, component)
+}
+
+// newLogger wires a handler into a Logger with the standard attributes
+func newLogger(handler slog.Handler, level *slog.LevelVar, component string) *Logger {
+	deliveryID := newDeliveryID()
+	redactor := NewRedactor(nil)
+	attrs := []any{}
+	if component != "" {
+		attrs = append(attrs, "component", component)
+	}
+	attrs = append(attrs, "delivery_id", deliveryID)
+
 	return &Logger{
-		verbose:   verbose,
-		minLevel:  minLevel,
-		logger:    log.New(io.Discard, "", log.LstdFlags),
-		component: component,
-		firstLine: true,
+		slog:       slog.New(newRedactHandler(handler, redactor)).With(attrs...),
+		level:      level,
+		redactor:   redactor,
+		component:  component,
+		deliveryID: deliveryID,
+	}
+}
+
+// newDeliveryID returns a short random identifier for one invocation
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// LoggerForHandler returns a logger for a delivery package sending records
+// to handler, or discarding them if handler is nil
+// A handler from Logger.Handler gives back that Logger, so a program and the
+// packages it drives share attributes and the delivery ID
+func LoggerForHandler(handler slog.Handler, component string) *Logger {
+	switch h := handler.(type) {
+	case nil:
+		return NewLoggerWithHandler(slog.DiscardHandler, component)
+	case *loggerHandler:
+		return h.logger
+	}
+	return NewLoggerWithHandler(handler, component)
+}
+
+// loggerHandler is the handler of a Logger, remembering the Logger
+type loggerHandler struct {
+	slog.Handler
+	logger *Logger
+}
+
+// Slog returns the underlying slog.Logger
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
+}
+
+// Handler returns the slog.Handler records are sent to
+func (l *Logger) Handler() slog.Handler {
+	return &loggerHandler{Handler: l.slog.Handler(), logger: l}
+}
+
+// SetLevel sets the minimum level logged by the built-in output handler
+func (l *Logger) SetLevel(level Level) {
+	if l.level != nil {
+		l.level.Set(level)
 	}
 }
 
 // SetOutput sets the log output writer (for verbose mode)
 func (l *Logger) SetOutput(w io.Writer) {
-	l.logger.SetOutput(w)
+	if l.output != nil {
+		l.output.setVerboseOutput(w)
+	}
 }
 
-// formatMessage formats a structured log message
-func (l *Logger) formatMessage(level Level, msg string, args ...interface{}) string {
-	var sb strings.Builder
+// SetVerbose switches to verbose mode, writing every level to w, for when
+// the configuration turns it on after the logger was created
+func (l *Logger) SetVerbose(w io.Writer) {
+	l.SetLevel(LevelDebug)
+	if l.output != nil {
+		l.output.setVerbose(w)
+	}
+}
+
+// SetFormat sets the format used for all log output
+func (l *Logger) SetFormat(format LogFormat) {
+	if l.output != nil {
+		l.output.setFormat(format)
+	}
+}
 
-	// Component prefix
-	if l.component != "" {
-		sb.WriteString(fmt.Sprintf("[%s] ", l.component))
+// OpenLogFile appends log output to a file, even when not in verbose mode
+func (l *Logger) OpenLogFile(path string) error {
+	if l.output == nil {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
 	}
+	l.output.setFile(file)
+	return nil
+}
 
-	// Level prefix for verbose mode
-	if l.verbose {
-		sb.WriteString(fmt.Sprintf("[%s] ", level.String()))
+// AddSink sends all log entries at or above the minimum level to a sink,
+// even when not in verbose mode
+func (l *Logger) AddSink(sink Sink) {
+	if l.output != nil {
+		l.output.addSink(sink)
 	}
+}
 
-	// Message
-	sb.WriteString(msg)
+// SetAttr attaches a key-value pair to every subsequent log line
+// Setting an existing key replaces its value
+func (l *Logger) SetAttr(key string, value any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i+1 < len(l.attrs); i += 2 {
+		if l.attrs[i] == key {
+			l.attrs[i+1] = value
+			return
+		}
+	}
+	l.attrs = append(l.attrs, key, value)
+}
 
-	// Key-value pairs
-	if len(args) > 0 {
-		for i := 0; i < len(args); i += 2 {
-			if i+1 < len(args) {
-				key := args[i]
-				value := args[i+1]
+// Configure applies the logging options from the configuration file
+// Output options are ignored when a custom handler was supplied
+// Only invalid settings are errors: a log file that can't be opened is
+// replaced by stderr and a sink that can't connect is skipped, with a warning
+func (l *Logger) Configure(common *Common) error {
+	format, err := ParseLogFormat(common.LogFormat)
+	if err != nil {
+		return err
+	}
+	l.redactor.SetHeaders(common.RedactHeaders)
+	if l.output == nil {
+		return nil
+	}
+	l.SetFormat(format)
 
-				// Format duration values nicely
-				if dur, ok := value.(time.Duration); ok {
-					sb.WriteString(fmt.Sprintf(" %v=%v", key, dur))
-				} else {
-					sb.WriteString(fmt.Sprintf(" %v=%v", key, value))
-				}
-			}
+	// Like a sink, a log file that can't be opened must not stop the
+	// delivery, so its lines go to stderr instead
+	if common.LogFile != "" {
+		if err := l.OpenLogFile(common.LogFile); err != nil {
+			l.output.setFileStderr()
+			l.Warn("log file unavailable, logging to stderr", "log_file", common.LogFile, "error", err)
 		}
 	}
 
-	return sb.String()
+	// A sink that can't be reached must not stop the delivery, so it is
+	// left out; ValidateCommon has already rejected invalid settings
+	sink, err := NewSink(common, l.component)
+	if err != nil {
+		l.Warn("log sink unavailable, continuing without it", "log_sink", common.LogSink, "error", err)
+		return nil
+	}
+	if sink != nil {
+		l.AddSink(sink)
+	}
+	return nil
 }
 
-// log is the internal logging function
-func (l *Logger) log(level Level, msg string, args ...interface{}) {
-	if level < l.minLevel {
-		return
+// OnClose registers fn to run when the logger is closed, before its outputs
+// are closed so fn can still log
+// Functions run in reverse order of registration, like deferred calls
+// Fatal closes the logger, so fn also runs when exiting on an error
+func (l *Logger) OnClose(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onClose = append(l.onClose, fn)
+}
+
+// Close runs any OnClose functions and closes the log file and sinks, if any
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	hooks := l.onClose
+	l.onClose = nil
+	l.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+
+	if l.output == nil {
+		return nil
 	}
+	return l.output.close()
+}
 
-	formatted := l.formatMessage(level, msg, args...)
+// DeliveryID returns the identifier attached to every line from this invocation
+func (l *Logger) DeliveryID() string {
+	return l.deliveryID
+}
 
-	// In verbose mode, write to the logger (stderr by default)
-	if l.verbose {
-		l.logger.Output(2, formatted)
+// log is the internal logging function
+func (l *Logger) log(ctx context.Context, level Level, msg string, args ...any) {
+	if !l.slog.Enabled(ctx, level) {
+		return
+	}
+	l.mu.Lock()
+	if len(l.attrs) > 0 {
+		args = append(append([]any{}, l.attrs...), args...)
 	}
+	l.mu.Unlock()
+	l.slog.Log(ctx, level, msg, args...)
 }
 
 // Debug logs a debug message (only in verbose mode)
 func (l *Logger) Debug(msg string, args ...interface{}) {
-	l.log(LevelDebug, msg, args...)
+	l.log(context.Background(), LevelDebug, msg, args...)
 }
 
 // Info logs an info message
 func (l *Logger) Info(msg string, args ...interface{}) {
-	l.log(LevelInfo, msg, args...)
+	l.log(context.Background(), LevelInfo, msg, args...)
 }
 
 // Warn logs a warning message
 func (l *Logger) Warn(msg string, args ...interface{}) {
-	l.log(LevelWarn, msg, args...)
+	l.log(context.Background(), LevelWarn, msg, args...)
 }
 
 // Error logs an error message
 func (l *Logger) Error(msg string, args ...interface{}) {
-	l.log(LevelError, msg, args...)
+	l.log(context.Background(), LevelError, msg, args...)
+}
+
+// Redact returns s with secrets and redacted header values replaced, for
+// output that doesn't go through the logger
+func (l *Logger) Redact(s string) string {
+	return l.redactor.String(s)
 }
 
 // Success writes a success message to stdout (for Exim logging)
 // This should be called once at the end of successful operations
 func (l *Logger) Success(msg string) {
-	fmt.Println(msg)
+	l.log(withoutVerbose(context.Background()), LevelInfo, msg)
+	fmt.Println(l.Redact(msg))
 }
 
-// Fatal writes an error message to stderr and exits with code 1
+// Result writes a delivery result to stdout as a single JSON object
+// It replaces Success when JSON results were requested, and is also called
+// for failed deliveries just before Fatal
+// The error is redacted before encoding, as JSON escaping would hide secrets
+// from the redactor afterwards
+func (l *Logger) Result(result *DeliveryResult) {
+	l.log(withoutVerbose(context.Background()), LevelInfo, "delivery result", "status", result.Status)
+	redacted := *result
+	redacted.Error = l.Redact(result.Error)
+	fmt.Println(MarshalResult(&redacted))
+}
+
+// Fatal writes an error message to stderr and exits
 // This writes to stderr for Exim error capture and ensures first line is useful
+// The exit code is ExitTempFail for errors that may succeed on a later
+// delivery attempt and ExitFailure otherwise
 func (l *Logger) Fatal(msg string, err error) {
+	ctx := withoutVerbose(context.Background())
+	code := ExitFailure
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", msg, err)
+		code = ExitCode(err)
+		l.log(ctx, LevelError, msg, "error", err, "exit_code", code)
+		fmt.Fprintln(os.Stderr, l.Redact(fmt.Sprintf("ERROR: %s: %v", msg, err)))
 	} else {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n", msg)
+		l.log(ctx, LevelError, msg, "exit_code", code)
+		fmt.Fprintln(os.Stderr, l.Redact("ERROR: "+msg))
 	}
-	os.Exit(1)
+	l.Close()
+	os.Exit(code)
 }
 
 // Progress logs a progress message that's always shown (for critical operations)
 // In non-verbose mode, these help track what's happening without flooding logs
 func (l *Logger) Progress(msg string) {
-	if l.verbose {
-		l.logger.Output(2, fmt.Sprintf("[%s] [INFO] %s", l.component, msg))
-	}
+	l.log(context.Background(), LevelInfo, msg)
 }
@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// verboseKey marks a context whose records should skip the verbose output
+type verboseKey struct{}
+
+// withoutVerbose returns a context whose records skip the verbose output, for
+// messages (success, fatal errors) that are printed to stdout/stderr directly
+func withoutVerbose(ctx context.Context) context.Context {
+	return context.WithValue(ctx, verboseKey{}, false)
+}
+
+// outputs is the state shared by an outputHandler and the handlers derived
+// from it with WithAttrs/WithGroup
+type outputs struct {
+	mu      sync.Mutex
+	verbose bool
+	format  LogFormat
+	out     io.Writer // verbose output
+	file    *os.File  // log file, written even when not verbose
+	sinks   []Sink    // structured sinks (syslog, journald), written even when not verbose
+}
+
+// outputHandler is the built-in slog.Handler: it renders records in the
+// configured format to the verbose output and log file, and forwards them
+// to any sinks
+type outputHandler struct {
+	outputs    *outputs
+	level      slog.Leveler
+	component  string
+	deliveryID string
+	attrs      []any
+	prefix     string // group prefix for attribute keys
+}
+
+// newOutputHandler creates an output handler writing nothing until an
+// output, file or sink is configured
+func newOutputHandler(verbose bool, level slog.Leveler) *outputHandler {
+	return &outputHandler{
+		outputs: &outputs{
+			verbose: verbose,
+			format:  LogFormatText,
+			out:     io.Discard,
+		},
+		level: level,
+	}
+}
+
+func (h *outputHandler) setVerboseOutput(w io.Writer) {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+	h.outputs.out = w
+}
+
+func (h *outputHandler) setVerbose(w io.Writer) {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+	h.outputs.verbose = true
+	h.outputs.out = w
+}
+
+func (h *outputHandler) setFormat(format LogFormat) {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+	h.outputs.format = format
+}
+
+func (h *outputHandler) setFile(file *os.File) {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+	if h.outputs.file != nil && h.outputs.file != os.Stderr {
+		h.outputs.file.Close()
+	}
+	h.outputs.file = file
+}
+
+// setFileStderr sends the log file output to stderr, for when the log file
+// can't be opened
+func (h *outputHandler) setFileStderr() {
+	h.setFile(os.Stderr)
+}
+
+func (h *outputHandler) addSink(sink Sink) {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+	h.outputs.sinks = append(h.outputs.sinks, sink)
+}
+
+func (h *outputHandler) close() error {
+	h.outputs.mu.Lock()
+	defer h.outputs.mu.Unlock()
+
+	var firstErr error
+	if h.outputs.file != nil && h.outputs.file != os.Stderr {
+		firstErr = h.outputs.file.Close()
+	}
+	h.outputs.file = nil
+	for _, sink := range h.outputs.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	h.outputs.sinks = nil
+	return firstErr
+}
+
+// Enabled implements slog.Handler
+func (h *outputHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// WithAttrs implements slog.Handler
+// The component and delivery_id attributes are kept aside so each format can
+// place them consistently
+func (h *outputHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]any{}, h.attrs...)
+	for _, a := range attrs {
+		switch {
+		case h.prefix == "" && a.Key == "component":
+			clone.component = a.Value.String()
+		case h.prefix == "" && a.Key == "delivery_id":
+			clone.deliveryID = a.Value.String()
+		default:
+			clone.attrs = append(clone.attrs, h.prefix+a.Key, a.Value.Resolve().Any())
+		}
+	}
+	return &clone
+}
+
+// WithGroup implements slog.Handler; groups are flattened into dotted keys
+func (h *outputHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// Handle implements slog.Handler
+func (h *outputHandler) Handle(ctx context.Context, r slog.Record) error {
+	args := append([]any{}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		args = appendAttr(args, h.prefix, a)
+		return true
+	})
+
+	entry := &Entry{
+		Time:       r.Time,
+		Level:      r.Level,
+		Component:  h.component,
+		DeliveryID: h.deliveryID,
+		Message:    r.Message,
+		Args:       args,
+	}
+
+	o := h.outputs
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	toVerbose, ok := ctx.Value(verboseKey{}).(bool)
+	writeVerbose := o.verbose && (!ok || toVerbose)
+
+	// A log file replaced by stderr skips lines already written there: in
+	// verbose mode, and those printed to stderr or stdout directly
+	writeFile := o.file != nil
+	if o.file == os.Stderr && (writeVerbose && o.out == io.Writer(os.Stderr) || ok && !toVerbose) {
+		writeFile = false
+	}
+
+	for _, sink := range o.sinks {
+		sink.Write(entry)
+	}
+	if !writeVerbose && !writeFile {
+		return nil
+	}
+
+	line := formatEntry(o.format, o.verbose, entry) + "\n"
+
+	// In verbose mode, write to the verbose output (stderr by default)
+	if writeVerbose {
+		io.WriteString(o.out, line)
+	}
+	if writeFile {
+		o.file.WriteString(line)
+	}
+	return nil
+}
+
+// appendAttr flattens an attribute (and any group members) onto args
+func appendAttr(args []any, prefix string, a slog.Attr) []any {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix += a.Key + "."
+		}
+		for _, member := range v.Group() {
+			args = appendAttr(args, groupPrefix, member)
+		}
+		return args
+	}
+	return append(args, prefix+a.Key, v.Any())
+}
+
+// formatEntry formats an entry in the given format
+func formatEntry(format LogFormat, verbose bool, e *Entry) string {
+	switch format {
+	case LogFormatLogfmt:
+		return formatLogfmt(e)
+	case LogFormatJSON:
+		return formatJSON(e)
+	default:
+		return formatText(verbose, e)
+	}
+}
+
+// formatText formats an entry in the human-readable text format
+func formatText(verbose bool, e *Entry) string {
+	var sb strings.Builder
+
+	sb.WriteString(e.Time.Format("2006/01/02 15:04:05 "))
+
+	// Component prefix
+	if e.Component != "" {
+		sb.WriteString(fmt.Sprintf("[%s] ", e.Component))
+	}
+
+	// Level prefix for verbose mode
+	if verbose {
+		sb.WriteString(fmt.Sprintf("[%s] ", e.Level.String()))
+	}
+
+	// Message
+	sb.WriteString(e.Message)
+
+	// Key-value pairs
+	for i := 0; i+1 < len(e.Args); i += 2 {
+		sb.WriteString(fmt.Sprintf(" %v=%v", e.Args[i], formatValue(e.Args[i+1])))
+	}
+	if e.DeliveryID != "" {
+		sb.WriteString(" delivery_id=" + e.DeliveryID)
+	}
+
+	return sb.String()
+}
+
+// formatLogfmt formats an entry as a logfmt line
+func formatLogfmt(e *Entry) string {
+	var sb strings.Builder
+
+	writePair := func(key string, value string) {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(logfmtKey(key))
+		sb.WriteByte('=')
+		sb.WriteString(logfmtValue(value))
+	}
+
+	writePair("time", e.Time.Format(time.RFC3339))
+	writePair("level", strings.ToLower(e.Level.String()))
+	if e.Component != "" {
+		writePair("component", e.Component)
+	}
+	if e.DeliveryID != "" {
+		writePair("delivery_id", e.DeliveryID)
+	}
+	writePair("msg", e.Message)
+	for i := 0; i+1 < len(e.Args); i += 2 {
+		writePair(fmt.Sprint(e.Args[i]), formatValue(e.Args[i+1]))
+	}
+
+	return sb.String()
+}
+
+// formatJSON formats an entry as a single-line JSON object
+// Keys are written in order: time, level, component, delivery_id, msg, args
+func formatJSON(e *Entry) string {
+	var sb strings.Builder
+
+	writePair := func(key string, value interface{}) {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		sb.Write(k)
+		sb.WriteByte(':')
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		sb.Write(v)
+	}
+
+	sb.WriteByte('{')
+	writePair("time", e.Time.Format(time.RFC3339))
+	writePair("level", strings.ToLower(e.Level.String()))
+	if e.Component != "" {
+		writePair("component", e.Component)
+	}
+	if e.DeliveryID != "" {
+		writePair("delivery_id", e.DeliveryID)
+	}
+	writePair("msg", e.Message)
+	for i := 0; i+1 < len(e.Args); i += 2 {
+		writePair(fmt.Sprint(e.Args[i]), jsonValue(e.Args[i+1]))
+	}
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+// formatValue converts a log argument to its string form
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// jsonValue converts a log argument to a value that marshals sensibly
+// Numbers, booleans, strings and slices keep their JSON types; durations,
+// times, errors and other types are rendered as strings
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, int32, int64, uint, uint32, uint64, float32, float64, []string:
+		return v
+	default:
+		return formatValue(v)
+	}
+}
+
+// logfmtKey sanitises a logfmt key, replacing characters that would break parsing
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue quotes a logfmt value when it contains spaces, quotes, equals
+// signs or control characters
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
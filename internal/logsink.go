@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Entry is a single log record passed to a Sink
+type Entry struct {
+	Time       time.Time
+	Level      Level
+	Component  string
+	DeliveryID string
+	Message    string
+	// Args holds alternating keys and values
+	Args []interface{}
+}
+
+// Sink receives structured log entries
+// Sinks are best-effort: a failing sink must never affect delivery
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+// Log sink names for the log_sink option
+const (
+	SinkNone     = "none"
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
+)
+
+// NewSink creates the sink selected by the log_sink option, or nil if none
+func NewSink(common *Common, component string) (Sink, error) {
+	switch strings.ToLower(common.LogSink) {
+	case "", SinkNone:
+		return nil, nil
+	case SinkSyslog:
+		facility, err := ParseSyslogFacility(common.SyslogFacility)
+		if err != nil {
+			return nil, err
+		}
+		return NewSyslogSink(common.SyslogAddress, facility, component)
+	case SinkJournald:
+		return NewJournaldSink(component)
+	default:
+		return nil, fmt.Errorf("unknown log_sink %q (expected none, syslog or journald)", common.LogSink)
+	}
+}
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseSyslogFacility converts a facility name to its code
+// An empty string selects the mail facility
+func ParseSyslogFacility(name string) (int, error) {
+	if name == "" {
+		return syslogFacilities["mail"], nil
+	}
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog_facility %q", name)
+	}
+	return facility, nil
+}
+
+// syslogSeverity maps a log level to an RFC 5424 severity
+func syslogSeverity(level Level) int {
+	switch {
+	case level < LevelInfo:
+		return 7
+	case level < LevelWarn:
+		return 6
+	case level < LevelError:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// ParseSyslogAddress splits a syslog_address into a network and address
+// An empty string selects the local /dev/log socket
+func ParseSyslogAddress(address string) (network, addr string, err error) {
+	switch {
+	case address == "":
+		return "unixgram", "/dev/log", nil
+	case strings.HasPrefix(address, "unix://"):
+		return "unixgram", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "udp://"):
+		return "udp", strings.TrimPrefix(address, "udp://"), nil
+	case strings.HasPrefix(address, "/"):
+		return "unixgram", address, nil
+	default:
+		return "", "", fmt.Errorf("unsupported syslog_address %q (expected unix://, udp:// or an absolute socket path)", address)
+	}
+}
+
+// SyslogSink writes RFC 5424 messages to a local or remote syslog daemon
+type SyslogSink struct {
+	conn     net.Conn
+	facility int
+	appName  string
+	hostname string
+	pid      int
+}
+
+// NewSyslogSink connects to a syslog daemon
+// address may be empty (the local /dev/log socket), "unix:///path/to/socket",
+// a bare absolute socket path or "udp://host:port"
+func NewSyslogSink(address string, facility int, appName string) (*SyslogSink, error) {
+	network, addr, err := ParseSyslogAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if appName == "" {
+		appName = "-"
+	}
+
+	return &SyslogSink{
+		conn:     conn,
+		facility: facility,
+		appName:  appName,
+		hostname: hostname,
+		pid:      os.Getpid(),
+	}, nil
+}
+
+// Write sends an entry as a single RFC 5424 message
+// The delivery ID is used as the MSGID and the message text is followed by
+// the entry's key-value pairs in logfmt form
+func (s *SyslogSink) Write(entry *Entry) error {
+	var msg strings.Builder
+	msg.WriteString(entry.Message)
+	for i := 0; i+1 < len(entry.Args); i += 2 {
+		msg.WriteByte(' ')
+		msg.WriteString(logfmtKey(fmt.Sprint(entry.Args[i])))
+		msg.WriteByte('=')
+		msg.WriteString(logfmtValue(formatValue(entry.Args[i+1])))
+	}
+
+	msgID := entry.DeliveryID
+	if msgID == "" {
+		msgID = "-"
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		s.pid,
+		msgID,
+		msg.String())
+
+	_, err := s.conn.Write([]byte(line))
+	return err
+}
+
+// Close closes the connection to the syslog daemon
+func (s *SyslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// journaldSocket is the native journald protocol socket
+const journaldSocket = "/run/systemd/journal/socket"
+
+// JournaldSink writes entries to journald using its native protocol, so
+// every key-value pair becomes a separate, queryable journal field
+type JournaldSink struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+// NewJournaldSink connects to the local journald socket
+func NewJournaldSink(identifier string) (*JournaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %w", err)
+	}
+	return &JournaldSink{conn: conn, identifier: identifier}, nil
+}
+
+// journaldFieldName converts a log key to a valid journald field name
+// (upper case letters, digits and underscores, not starting with an underscore)
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		return "FIELD"
+	}
+	return name
+}
+
+// writeJournaldField appends a field in the native protocol format, using
+// the length-prefixed form for values containing newlines
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// Write sends an entry to journald
+// Log keys map directly to fields, so "account", "message_id", "gmail_id" and
+// "thread_id" become ACCOUNT, MESSAGE_ID, GMAIL_ID and THREAD_ID
+func (j *JournaldSink) Write(entry *Entry) error {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", entry.Message)
+	writeJournaldField(&buf, "PRIORITY", fmt.Sprint(syslogSeverity(entry.Level)))
+	if j.identifier != "" {
+		writeJournaldField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	}
+	if entry.DeliveryID != "" {
+		writeJournaldField(&buf, "DELIVERY_ID", entry.DeliveryID)
+	}
+	for i := 0; i+1 < len(entry.Args); i += 2 {
+		writeJournaldField(&buf, journaldFieldName(fmt.Sprint(entry.Args[i])), formatValue(entry.Args[i+1]))
+	}
+
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the connection to journald
+func (j *JournaldSink) Close() error {
+	return j.conn.Close()
+}
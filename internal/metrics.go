@@ -0,0 +1,426 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gmail-api-client/pkg/deliver"
+)
+
+// Metric names
+const (
+	metricAPIDuration    = "gmail_transport_api_request_duration_seconds"
+	metricAttempts       = "gmail_transport_operation_attempts_total"
+	metricErrors         = "gmail_transport_errors_total"
+	metricTokenRefreshes = "gmail_transport_token_refreshes_total"
+	metricMessageSize    = "gmail_transport_message_size_bytes"
+	metricDeliveries     = "gmail_transport_deliveries_total"
+)
+
+// metricDesc describes a metric for the exposition format
+type metricDesc struct {
+	help    string
+	kind    string    // "counter" or "histogram"
+	buckets []float64 // upper bounds for histograms
+}
+
+var metricDescs = map[string]metricDesc{
+	metricAPIDuration: {
+		help:    "Duration of Gmail API HTTP requests by API method and status code",
+		kind:    "histogram",
+		buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	metricAttempts: {
+		help: "Attempts made by retried operations, by operation and result",
+		kind: "counter",
+	},
+	metricErrors: {
+		help: "Failed attempts by error class (retryable, deferred or permanent)",
+		kind: "counter",
+	},
+	metricTokenRefreshes: {
+		help: "OAuth2 access token refreshes",
+		kind: "counter",
+	},
+	metricMessageSize: {
+		help:    "Size of delivered messages in bytes",
+		kind:    "histogram",
+		buckets: []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 35 << 20},
+	},
+	metricDeliveries: {
+		help: "Deliveries by transport and outcome",
+		kind: "counter",
+	},
+}
+
+// histogramValue holds the observations of one histogram series
+// Counts are per bucket (not cumulative), with one extra bucket for +Inf
+type histogramValue struct {
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// Metrics collects counters and histograms in memory and renders them in
+// the Prometheus text exposition format
+// Series are keyed by their name and labels as they appear in the output,
+// e.g. `gmail_transport_errors_total{class="retryable"}`
+type Metrics struct {
+	mu         sync.Mutex
+	Counters   map[string]float64         `json:"counters"`
+	Histograms map[string]*histogramValue `json:"histograms"`
+}
+
+var _ deliver.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates an empty metrics collection
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Counters:   make(map[string]float64),
+		Histograms: make(map[string]*histogramValue),
+	}
+}
+
+// seriesKey renders a metric name and alternating label names and values
+func seriesKey(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// escapeLabelValue escapes a label value for the exposition format
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Add increments a counter
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Counters[key] += value
+}
+
+// Observe records a histogram observation
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	buckets := metricDescs[name].buckets
+	key := seriesKey(name, labels...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.Histograms[key]
+	if h == nil {
+		h = &histogramValue{Counts: make([]uint64, len(buckets)+1)}
+		m.Histograms[key] = h
+	}
+	i := sort.SearchFloat64s(buckets, value)
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// ObserveAPICall records the duration of a Gmail API request
+func (m *Metrics) ObserveAPICall(method string, code int, d time.Duration) {
+	m.Observe(metricAPIDuration, d.Seconds(), "method", method, "code", strconv.Itoa(code))
+}
+
+// CountAttempt records one attempt of a retried operation and, if it
+// failed, the class of its error given as result
+func (m *Metrics) CountAttempt(operation, result string) {
+	if result == deliver.AttemptSuccess {
+		m.Add(metricAttempts, 1, "operation", operation, "result", "success")
+		return
+	}
+	m.Add(metricAttempts, 1, "operation", operation, "result", "error")
+	m.Add(metricErrors, 1, "class", result)
+}
+
+// CountTokenRefresh records an OAuth2 access token refresh
+func (m *Metrics) CountTokenRefresh() {
+	m.Add(metricTokenRefreshes, 1)
+}
+
+// ObserveDelivery records the outcome and message size of a finished delivery
+func (m *Metrics) ObserveDelivery(transport, outcome string, size int) {
+	m.Add(metricDeliveries, 1, "transport", transport, "outcome", outcome)
+	m.Observe(metricMessageSize, float64(size), "transport", transport)
+}
+
+// merge adds the values of other to m
+func (m *Metrics) merge(other *Metrics) {
+	for key, value := range other.Counters {
+		m.Counters[key] += value
+	}
+	for key, h := range other.Histograms {
+		existing := m.Histograms[key]
+		if existing == nil || len(existing.Counts) != len(h.Counts) {
+			// Missing, or recorded with different buckets by an older version
+			existing = &histogramValue{Counts: make([]uint64, len(h.Counts))}
+			m.Histograms[key] = existing
+		}
+		for i, c := range h.Counts {
+			existing.Counts[i] += c
+		}
+		existing.Sum += h.Sum
+		existing.Count += h.Count
+	}
+}
+
+// reset clears all values
+func (m *Metrics) reset() {
+	m.Counters = make(map[string]float64)
+	m.Histograms = make(map[string]*histogramValue)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+// constLabels (alternating names and values) are added to every series
+func (m *Metrics) WriteText(w io.Writer, constLabels ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Group series by metric name so each gets a single HELP/TYPE header
+	series := make(map[string][]string)
+	for key := range m.Counters {
+		name := metricName(key)
+		series[name] = append(series[name], key)
+	}
+	for key := range m.Histograms {
+		name := metricName(key)
+		series[name] = append(series[name], key)
+	}
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		desc := metricDescs[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, desc.help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, desc.kind)
+
+		keys := series[name]
+		sort.Strings(keys)
+		for _, key := range keys {
+			labels := withLabels(key, constLabels...)
+			if value, ok := m.Counters[key]; ok {
+				fmt.Fprintf(&sb, "%s%s %s\n", name, labels, formatFloat(value))
+				continue
+			}
+
+			h := m.Histograms[key]
+			var cumulative uint64
+			for i, bound := range desc.buckets {
+				if i < len(h.Counts) {
+					cumulative += h.Counts[i]
+				}
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, withLabels(labels, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, withLabels(labels, "le", "+Inf"), h.Count)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, labels, h.Count)
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// metricName returns the metric name part of a series key
+func metricName(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// withLabels returns the label set of a series key (or an existing label set)
+// with extra labels appended
+func withLabels(key string, extra ...string) string {
+	labels := ""
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		labels = strings.TrimSuffix(key[i+1:], "}")
+	}
+	if add := seriesKey("", extra...); add != "" {
+		add = strings.TrimSuffix(strings.TrimPrefix(add, "{"), "}")
+		if labels != "" {
+			labels += ","
+		}
+		labels += add
+	}
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatFloat formats a sample value
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler returns an HTTP handler serving the metrics, for
+// mounting at /metrics in long-running modes
+// A response that can't be written, e.g. to a scraper that went away, is
+// logged to logger
+func (m *Metrics) Handler(logger *Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := m.WriteText(w); err != nil {
+			logger.Warn("failed to write metrics response", "remote_addr", r.RemoteAddr, "error", err)
+		}
+	})
+}
+
+// WriteTextfile adds this process's metrics to the totals kept in dir and
+// atomically replaces dir/<program>.prom for node_exporter's textfile
+// collector
+// The running totals live in a hidden state file next to it, so counters and
+// histograms accumulate across one-shot runs; the in-memory values are
+// cleared once merged
+func (m *Metrics) WriteTextfile(dir, program string) error {
+	totals := NewMetrics()
+	stateFile := filepath.Join(dir, "."+program+".metrics.json")
+	promFile := filepath.Join(dir, program+".prom")
+
+	return UpdateStateFile(stateFile, totals, func() error {
+		if totals.Counters == nil {
+			totals.Counters = make(map[string]float64)
+		}
+		if totals.Histograms == nil {
+			totals.Histograms = make(map[string]*histogramValue)
+		}
+
+		m.mu.Lock()
+		totals.merge(m)
+		m.reset()
+		m.mu.Unlock()
+
+		tempFile, err := os.CreateTemp(dir, "."+program+".prom.*.tmp")
+		if err != nil {
+			return fmt.Errorf("creating metrics file: %w", err)
+		}
+		tempName := tempFile.Name()
+		defer os.Remove(tempName)
+
+		if err := totals.WriteText(tempFile, "program", program); err != nil {
+			tempFile.Close()
+			return fmt.Errorf("writing metrics file: %w", err)
+		}
+		if err := tempFile.Chmod(0644); err != nil {
+			tempFile.Close()
+			return fmt.Errorf("writing metrics file: %w", err)
+		}
+		if err := tempFile.Close(); err != nil {
+			return fmt.Errorf("writing metrics file: %w", err)
+		}
+		if err := os.Rename(tempName, promFile); err != nil {
+			return fmt.Errorf("replacing metrics file: %w", err)
+		}
+		return nil
+	})
+}
+
+// MetricsTransport wraps an HTTP transport to record the duration of every
+// Gmail API request by API method
+// A nil Metrics records nothing
+type MetricsTransport struct {
+	Base    http.RoundTripper
+	Metrics deliver.Metrics
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Metrics == nil {
+		return base.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	t.Metrics.ObserveAPICall(APIMethod(req.Method, req.URL.Path), code, time.Since(start))
+	return resp, err
+}
+
+// apiMethods maps request templates to Gmail API method names
+var apiMethods = map[string]string{
+	"GET users/{userId}/profile":               "users.getProfile",
+	"GET users/{userId}/history":               "users.history.list",
+	"GET users/{userId}/labels":                "users.labels.list",
+	"POST users/{userId}/labels":               "users.labels.create",
+	"GET users/{userId}/labels/{id}":           "users.labels.get",
+	"GET users/{userId}/messages":              "users.messages.list",
+	"POST users/{userId}/messages":             "users.messages.insert",
+	"GET users/{userId}/messages/{id}":         "users.messages.get",
+	"POST users/{userId}/messages/import":      "users.messages.import",
+	"POST users/{userId}/messages/send":        "users.messages.send",
+	"POST users/{userId}/messages/{id}/modify": "users.messages.modify",
+	"GET users/{userId}/settings/language":     "users.settings.getLanguage",
+	"GET users/{userId}/threads/{id}":          "users.threads.get",
+	"POST users/{userId}/messages/batchModify": "users.messages.batchModify",
+}
+
+// APIMethod returns the Gmail API method name for a request, e.g.
+// "users.messages.import", or its path template with IDs replaced if the
+// method isn't known, so label values stay low-cardinality
+func APIMethod(httpMethod, path string) string {
+	path = strings.TrimPrefix(path, "/upload")
+	path = strings.TrimPrefix(path, "/gmail/v1/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		switch {
+		case i > 0 && segments[i-1] == "users":
+			segments[i] = "{userId}"
+		case !isPathLiteral(segment):
+			segments[i] = "{id}"
+		}
+	}
+	template := httpMethod + " " + strings.Join(segments, "/")
+	if method, ok := apiMethods[template]; ok {
+		return method
+	}
+	return template
+}
+
+// isPathLiteral reports whether a path segment is part of the API's URL
+// scheme (lower camel case words) rather than an ID
+func isPathLiteral(segment string) bool {
+	if segment == "" || segment[0] < 'a' || segment[0] > 'z' {
+		return false
+	}
+	for _, r := range segment {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
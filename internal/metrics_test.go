@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gmail-api-client/pkg/deliver"
+)
+
+// parseTextfile parses the Prometheus text exposition format, checking that
+// every series follows its metric's HELP and TYPE lines and that histogram
+// buckets are cumulative, and returns the samples by series
+func parseTextfile(t *testing.T, data string) map[string]float64 {
+	t.Helper()
+	samples := make(map[string]float64)
+	var metric, kind string
+	var lastBucket float64
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+			metric, _, _ = strings.Cut(rest, " ")
+			kind, lastBucket = "", 0
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			if name != metric || (typ != "counter" && typ != "histogram") {
+				t.Fatalf("line %q: want the TYPE of %s", line, metric)
+			}
+			kind = typ
+			continue
+		}
+
+		// Label values may hold spaces, the value can't
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 || kind == "" || !strings.HasPrefix(line, metric) {
+			t.Fatalf("line %q isn't a sample of %s", line, metric)
+		}
+		series := line[:i]
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if _, dup := samples[series]; dup {
+			t.Fatalf("series %s appears twice", series)
+		}
+		samples[series] = v
+		if strings.HasPrefix(series, metric+"_bucket") {
+			if v < lastBucket {
+				t.Fatalf("bucket %s = %v is less than the one before, %v", series, v, lastBucket)
+			}
+			lastBucket = v
+		} else {
+			lastBucket = 0
+		}
+	}
+	return samples
+}
+
+// readTextfile reads and parses the textfile of program in dir
+func readTextfile(t *testing.T, dir, program string) map[string]float64 {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, program+".prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseTextfile(t, string(data))
+}
+
+// recordRun records the metrics of one delivery of a message of size bytes
+func recordRun(m *Metrics, size int) {
+	m.CountAttempt("message import", deliver.AttemptSuccess)
+	m.ObserveDelivery("api", "delivered", size)
+}
+
+func TestWriteTextfileAccumulates(t *testing.T) {
+	dir := t.TempDir()
+	deliveries := `gmail_transport_deliveries_total{transport="api",outcome="delivered",program="prog"}`
+	sizeCount := `gmail_transport_message_size_bytes_count{transport="api",program="prog"}`
+	smallBucket := `gmail_transport_message_size_bytes_bucket{transport="api",program="prog",le="1024"}`
+
+	for run := 1; run <= 3; run++ {
+		m := NewMetrics()
+		recordRun(m, 100*run)
+		if err := m.WriteTextfile(dir, "prog"); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Counters) != 0 || len(m.Histograms) != 0 {
+			t.Errorf("run %d: metrics not cleared once written", run)
+		}
+
+		samples := readTextfile(t, dir, "prog")
+		if samples[deliveries] != float64(run) || samples[sizeCount] != float64(run) || samples[smallBucket] != float64(run) {
+			t.Errorf("run %d: deliveries %v, size count %v, small messages %v; want %d of each",
+				run, samples[deliveries], samples[sizeCount], samples[smallBucket], run)
+		}
+	}
+	if sum := readTextfile(t, dir, "prog")[`gmail_transport_message_size_bytes_sum{transport="api",program="prog"}`]; sum != 600 {
+		t.Errorf("size sum = %v, want 600", sum)
+	}
+}
+
+func TestWriteTextfileReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMetrics()
+	recordRun(m, 100)
+	if err := m.WriteTextfile(dir, "prog"); err != nil {
+		t.Fatal(err)
+	}
+	promFile := filepath.Join(dir, "prog.prom")
+	before, err := os.ReadFile(promFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A collector reading the old file while it is replaced sees all of it
+	reader, err := os.Open(promFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	oldInfo, _ := reader.Stat()
+	recordRun(m, 100)
+	if err := m.WriteTextfile(dir, "prog"); err != nil {
+		t.Fatal(err)
+	}
+	var old bytes.Buffer
+	if _, err := old.ReadFrom(reader); err != nil {
+		t.Fatal(err)
+	}
+	if old.String() != string(before) {
+		t.Errorf("file being read changed from\n%s\nto\n%s", before, old.String())
+	}
+
+	newInfo, err := os.Stat(promFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(oldInfo, newInfo) {
+		t.Error("metrics file rewritten in place, want it replaced")
+	}
+	if perm := newInfo.Mode().Perm(); perm != 0644 {
+		t.Errorf("metrics file mode = %o, want 644 so node_exporter can read it", perm)
+	}
+
+	// Only the textfile and the hidden totals are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != ".prog.metrics.json prog.prom" {
+		t.Errorf("files = %q, want the totals and the textfile only", names)
+	}
+}
+
+func TestWriteTextfileBucketLayoutChange(t *testing.T) {
+	dir := t.TempDir()
+	series := seriesKey(metricMessageSize, "transport", "api")
+
+	// Totals written by a version with fewer buckets can't be added to
+	totals := NewMetrics()
+	totals.Histograms[series] = &histogramValue{Counts: []uint64{5, 5, 0}, Sum: 50000, Count: 10}
+	totals.Counters[seriesKey(metricDeliveries, "transport", "api", "outcome", "delivered")] = 10
+	data, err := json.Marshal(totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".prog.metrics.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetrics()
+	recordRun(m, 100)
+	if err := m.WriteTextfile(dir, "prog"); err != nil {
+		t.Fatal(err)
+	}
+	samples := readTextfile(t, dir, "prog")
+
+	// The histogram starts over with the current buckets, while counters
+	// carry on
+	if got := samples[`gmail_transport_message_size_bytes_count{transport="api",program="prog"}`]; got != 1 {
+		t.Errorf("size count = %v, want only the new observation", got)
+	}
+	if got := samples[`gmail_transport_message_size_bytes_sum{transport="api",program="prog"}`]; got != 100 {
+		t.Errorf("size sum = %v, want only the new observation", got)
+	}
+	buckets := 0
+	for key := range samples {
+		if strings.HasPrefix(key, "gmail_transport_message_size_bytes_bucket") {
+			buckets++
+		}
+	}
+	if want := len(metricDescs[metricMessageSize].buckets) + 1; buckets != want {
+		t.Errorf("%d size buckets, want %d", buckets, want)
+	}
+	if got := samples[`gmail_transport_deliveries_total{transport="api",outcome="delivered",program="prog"}`]; got != 11 {
+		t.Errorf("deliveries = %v, want 11", got)
+	}
+}
+
+// TestWriteTextfileProcesses has child processes write the textfile at once,
+// as transports started by the MTA do, and checks that no run is lost and
+// the file always parses
+func TestWriteTextfileProcesses(t *testing.T) {
+	const processes, runs = 4, 20
+	if dir := os.Getenv("METRICS_TEST_DIR"); dir != "" {
+		for i := 0; i < runs; i++ {
+			m := NewMetrics()
+			recordRun(m, 2000)
+			if err := m.WriteTextfile(dir, "prog"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		return
+	}
+
+	dir := t.TempDir()
+	errs := make(chan error, processes)
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWriteTextfileProcesses$")
+		cmd.Env = append(os.Environ(), "METRICS_TEST_DIR="+dir)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			err := cmd.Wait()
+			if err != nil {
+				err = fmt.Errorf("%w\n%s", err, out.String())
+			}
+			errs <- err
+		}()
+	}
+
+	// The file is replaced whole, so reading it while the children run
+	// never sees a partial write
+	for finished := 0; finished < processes; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("child: %v", err)
+			}
+			finished++
+		default:
+			if data, err := os.ReadFile(filepath.Join(dir, "prog.prom")); err == nil {
+				parseTextfile(t, string(data))
+			}
+		}
+	}
+
+	samples := readTextfile(t, dir, "prog")
+	want := float64(processes * runs)
+	for _, key := range []string{
+		`gmail_transport_deliveries_total{transport="api",outcome="delivered",program="prog"}`,
+		`gmail_transport_operation_attempts_total{operation="message import",result="success",program="prog"}`,
+		`gmail_transport_message_size_bytes_count{transport="api",program="prog"}`,
+		`gmail_transport_message_size_bytes_bucket{transport="api",program="prog",le="4096"}`,
+	} {
+		if samples[key] != want {
+			t.Errorf("%s = %v, want %v", key, samples[key], want)
+		}
+	}
+}
+
+// failingWriter is a ResponseWriter whose body can't be written
+type failingWriter struct {
+	header http.Header
+}
+
+func (w *failingWriter) Header() http.Header       { return w.header }
+func (w *failingWriter) WriteHeader(int)           {}
+func (w *failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset by peer") }
+
+func TestMetricsHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLoggerWithHandler(slog.NewJSONHandler(&buf, nil), "test")
+	m := NewMetrics()
+	recordRun(m, 100)
+
+	rec := httptest.NewRecorder()
+	m.Handler(logger).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	samples := parseTextfile(t, rec.Body.String())
+	if got := samples[`gmail_transport_deliveries_total{transport="api",outcome="delivered"}`]; got != 1 {
+		t.Errorf("deliveries = %v, want 1", got)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged %s for a successful scrape", buf.String())
+	}
+
+	m.Handler(logger).ServeHTTP(&failingWriter{header: make(http.Header)}, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(buf.String(), "failed to write metrics response") || !strings.Contains(buf.String(), "connection reset by peer") {
+		t.Errorf("log = %s, want the write error", buf.String())
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
+	"gmail-api-client/pkg/deliver"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
@@ -66,8 +71,8 @@ func releaseFileLock(file *os.File) error {
 // SaveToken writes an OAuth2 token to a file with specified permissions
 // Uses atomic write (write to temp file, then rename) to prevent corruption
 // Uses file locking to prevent concurrent write conflicts
-func SaveToken(filename string, token *oauth2.Token, perm os.FileMode) error {
-	log.Printf("Saving token to: %s", filename)
+func SaveToken(filename string, token *oauth2.Token, perm os.FileMode, logger *Logger) error {
+	logger.Debug("saving token", "file", filename)
 	data, err := json.MarshalIndent(token, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshaling token: %w", err)
@@ -122,40 +127,82 @@ func SaveToken(filename string, token *oauth2.Token, perm os.FileMode) error {
 		return fmt.Errorf("renaming temp file: %w", err)
 	}
 
-	log.Printf("Token saved successfully with permissions %v, expiry: %s", perm, token.Expiry)
+	logger.Info("token saved", "file", filename, "permissions", perm, "expiry", token.Expiry)
 	return nil
 }
 
 // LoadOAuthConfig reads credentials file and creates an OAuth2 config
-func LoadOAuthConfig(credentialsFile string) (*oauth2.Config, error) {
-	log.Printf("Reading credentials from: %s", credentialsFile)
+func LoadOAuthConfig(credentialsFile string, logger *Logger) (*oauth2.Config, error) {
+	logger.Debug("reading credentials", "file", credentialsFile)
 	credentials, err := os.ReadFile(credentialsFile)
 	if err != nil {
 		return nil, fmt.Errorf("reading credentials file: %w", err)
 	}
-	log.Printf("Credentials loaded: %d bytes", len(credentials))
-
-	log.Printf("Parsing OAuth2 configuration...")
+	logger.Debug("credentials loaded", "bytes", len(credentials))
 	// Use gmail.modify scope which includes insert and settings.basic permissions
 	oauthConfig, err := google.ConfigFromJSON(credentials, gmail.GmailModifyScope)
 	if err != nil {
 		return nil, fmt.Errorf("parsing credentials: %w", err)
 	}
-	log.Printf("OAuth2 config parsed successfully")
+	logger.Debug("OAuth2 config parsed successfully")
 
 	return oauthConfig, nil
 }
 
 // CreateTokenSource creates a token source that automatically refreshes tokens
+// and counts the refreshes in metrics, if not nil
 // Uses context.Background() to avoid timeout interference with token refresh
-func CreateTokenSource(oauthConfig *oauth2.Config, token *oauth2.Token) oauth2.TokenSource {
-	return oauthConfig.TokenSource(context.Background(), token)
+func CreateTokenSource(oauthConfig *oauth2.Config, token *oauth2.Token, metrics deliver.Metrics) oauth2.TokenSource {
+	src := oauthConfig.TokenSource(context.Background(), token)
+	if metrics == nil {
+		return src
+	}
+	return &refreshCountingSource{
+		src:     src,
+		last:    token.AccessToken,
+		metrics: metrics,
+	}
+}
+
+// refreshCountingSource counts token refreshes, including those made by the
+// HTTP client in the middle of a delivery
+type refreshCountingSource struct {
+	mu      sync.Mutex
+	src     oauth2.TokenSource
+	last    string
+	metrics deliver.Metrics
+}
+
+// Token implements oauth2.TokenSource
+func (s *refreshCountingSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.last {
+		s.last = token.AccessToken
+		s.metrics.CountTokenRefresh()
+	}
+	return token, nil
+}
+
+// NewHTTPClient returns an HTTP client that authorises requests with
+// tokenSource, records their duration in metrics (if not nil) and traces
+// them as children of the span in each request's context
+func NewHTTPClient(tokenSource oauth2.TokenSource, metrics deliver.Metrics) *http.Client {
+	transport := otelhttp.NewTransport(&MetricsTransport{Metrics: metrics},
+		otelhttp.WithPropagators(propagation.TraceContext{}))
+	base := &http.Client{Transport: transport}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, base)
+	return oauth2.NewClient(ctx, tokenSource)
 }
 
 // RefreshToken gets a fresh token from the token source, refreshing if needed
 // Returns the fresh token and whether it was refreshed
-func RefreshToken(tokenSource oauth2.TokenSource, originalToken *oauth2.Token) (*oauth2.Token, bool, error) {
-	log.Printf("Obtaining fresh token (will refresh if expired)...")
+func RefreshToken(tokenSource oauth2.TokenSource, originalToken *oauth2.Token, logger *Logger) (*oauth2.Token, bool, error) {
+	logger.Debug("obtaining fresh token (will refresh if expired)")
 	freshToken, err := tokenSource.Token()
 	if err != nil {
 		return nil, false, fmt.Errorf("getting fresh token: %w", err)
@@ -163,9 +210,9 @@ func RefreshToken(tokenSource oauth2.TokenSource, originalToken *oauth2.Token) (
 
 	wasRefreshed := freshToken.AccessToken != originalToken.AccessToken
 	if wasRefreshed {
-		log.Printf("Token was refreshed")
+		logger.Info("token was refreshed", "expiry", freshToken.Expiry)
 	} else {
-		log.Printf("Token is still valid")
+		logger.Debug("token is still valid", "expiry", freshToken.Expiry)
 	}
 
 	return freshToken, wasRefreshed, nil
@@ -181,65 +228,102 @@ func TokenChanged(t1, t2 *oauth2.Token) bool {
 
 // SaveTokenIfChanged saves a token only if it differs from the original
 // Preserves the original file permissions
-func SaveTokenIfChanged(filename string, originalToken, currentToken *oauth2.Token) error {
+func SaveTokenIfChanged(filename string, originalToken, currentToken *oauth2.Token, logger *Logger) error {
 	if !TokenChanged(originalToken, currentToken) {
-		log.Printf("Token unchanged, skipping save")
+		logger.Debug("token unchanged, skipping save")
 		return nil
 	}
-	log.Printf("Token changed, saving to file...")
+	logger.Debug("token changed, saving to file")
 
 	// Get original file permissions
 	perm, err := GetFilePermissions(filename)
 	if err != nil {
-		log.Printf("WARNING: Could not get original permissions, using 0600: %v", err)
+		logger.Warn("could not get original permissions, using 0600", "error", err)
 		perm = 0600
 	}
 
-	return SaveToken(filename, currentToken, perm)
+	return SaveToken(filename, currentToken, perm, logger)
 }
 
 // RefreshAndSaveToken is a convenience function that refreshes a token and saves it if changed
 // Preserves original token file permissions when saving
-func RefreshAndSaveToken(credentialsFile, tokenFile string) (*oauth2.Token, oauth2.TokenSource, error) {
+func RefreshAndSaveToken(credentialsFile, tokenFile string, logger *Logger, metrics deliver.Metrics) (*oauth2.Token, oauth2.TokenSource, error) {
 	// Load OAuth config
-	oauthConfig, err := LoadOAuthConfig(credentialsFile)
+	oauthConfig, err := LoadOAuthConfig(credentialsFile, logger)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Load token from file
-	log.Printf("Loading OAuth2 token from: %s", tokenFile)
+	logger.Debug("loading OAuth2 token", "file", tokenFile)
 	token, err := LoadToken(tokenFile)
 	if err != nil {
 		return nil, nil, fmt.Errorf("loading token: %w", err)
 	}
-	log.Printf("Token loaded, expiry: %s", token.Expiry)
+	logger.Debug("token loaded", "expiry", token.Expiry)
 
 	// Get original file permissions before any modifications
 	perm, err := GetFilePermissions(tokenFile)
 	if err != nil {
-		log.Printf("WARNING: Could not get original permissions, will use 0600: %v", err)
+		logger.Warn("could not get original permissions, will use 0600", "error", err)
 		perm = 0600
 	}
 
 	// Create token source
-	tokenSource := CreateTokenSource(oauthConfig, token)
+	tokenSource := CreateTokenSource(oauthConfig, token, metrics)
 
 	// Get fresh token (auto-refreshes if needed)
-	freshToken, wasRefreshed, err := RefreshToken(tokenSource, token)
+	freshToken, wasRefreshed, err := RefreshToken(tokenSource, token, logger)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Save if refreshed, using original permissions
 	if wasRefreshed {
-		log.Printf("Saving refreshed token to file...")
-		if err := SaveToken(tokenFile, freshToken, perm); err != nil {
-			log.Printf("WARNING: Failed to save refreshed token: %v", err)
+		logger.Debug("saving refreshed token to file")
+		if err := SaveToken(tokenFile, freshToken, perm, logger); err != nil {
+			logger.Warn("failed to save refreshed token", "error", err)
 		} else {
-			log.Printf("Refreshed token saved successfully")
+			logger.Debug("refreshed token saved successfully")
 		}
 	}
 
 	return freshToken, tokenSource, nil
 }
+
+// PrepareToken loads the token and refreshes and saves it if it expired
+// Transports call it before reading a message from stdin so an authorization
+// problem can't lose the message
+func PrepareToken(credentialsFile, tokenFile string, logger *Logger, metrics deliver.Metrics) error {
+	logger.Debug("loading and validating OAuth2 token")
+
+	// Load original token to compare later
+	originalToken, err := LoadToken(tokenFile)
+	if err != nil {
+		return fmt.Errorf("loading token: %w", err)
+	}
+
+	// Load OAuth config
+	oauthConfig, err := LoadOAuthConfig(credentialsFile, logger)
+	if err != nil {
+		return fmt.Errorf("loading OAuth config: %w", err)
+	}
+
+	// Get fresh token (auto-refreshes if needed)
+	tokenSource := CreateTokenSource(oauthConfig, originalToken, metrics)
+	freshToken, wasRefreshed, err := RefreshToken(tokenSource, originalToken, logger)
+	if err != nil {
+		return fmt.Errorf("refreshing token: %w", err)
+	}
+
+	// Save if refreshed, preserving original permissions
+	if wasRefreshed {
+		logger.Debug("token was refreshed, saving to file")
+		if err := SaveTokenIfChanged(tokenFile, originalToken, freshToken, logger); err != nil {
+			return fmt.Errorf("saving refreshed token: %w", err)
+		}
+		logger.Debug("refreshed token saved successfully")
+	}
+
+	return nil
+}
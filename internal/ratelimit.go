@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter is a token bucket shared between processes via a state file
+// Each account gets its own bucket so one busy mailbox can't starve another
+type RateLimiter struct {
+	path  string
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+	clock Clock
+}
+
+// rateLimiterState is the persisted bucket state
+type rateLimiterState struct {
+	Tokens     float64   `json:"tokens"`
+	LastRefill time.Time `json:"last_refill"`
+}
+
+// NewRateLimiter creates a rate limiter for an account storing its state in dir
+// rate is in requests per second; burst is the number of requests allowed at once
+func NewRateLimiter(dir, account string, rate float64, burst int, clock Clock) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	return &RateLimiter{
+		path:  StateFilePath(dir, account, "ratelimit.json"),
+		rate:  rate,
+		burst: float64(burst),
+		clock: clock,
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller must
+// wait before using it
+// The bucket may go negative, which queues callers behind each other rather
+// than letting them all wake up at the same moment
+func (r *RateLimiter) reserve() (time.Duration, error) {
+	var state rateLimiterState
+	var wait time.Duration
+
+	err := UpdateStateFile(r.path, &state, func() error {
+		now := r.clock.Now()
+		if state.LastRefill.IsZero() {
+			state.Tokens = r.burst
+		} else if elapsed := now.Sub(state.LastRefill); elapsed > 0 {
+			state.Tokens += elapsed.Seconds() * r.rate
+		}
+		if state.Tokens > r.burst {
+			state.Tokens = r.burst
+		}
+		state.LastRefill = now
+
+		state.Tokens--
+		if state.Tokens < 0 {
+			wait = time.Duration(-state.Tokens / r.rate * float64(time.Second))
+		}
+		return nil
+	})
+	return wait, err
+}
+
+// Wait blocks until the caller may make a request or ctx is done
+func (r *RateLimiter) Wait(ctx context.Context) (time.Duration, error) {
+	wait, err := r.reserve()
+	if err != nil {
+		return 0, err
+	}
+	if wait <= 0 {
+		return 0, nil
+	}
+	return wait, r.clock.Sleep(ctx, wait)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitFor calls Wait and checks how long the caller had to wait
+func waitFor(t *testing.T, r *RateLimiter, want time.Duration) {
+	t.Helper()
+	waited, err := r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited != want {
+		t.Errorf("Wait = %s, want %s", waited, want)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	r := NewRateLimiter(t.TempDir(), "user@example.com", 2, 3, clock)
+
+	// A new bucket is full, so a burst goes through at once
+	for i := 0; i < 3; i++ {
+		waitFor(t, r, 0)
+	}
+	if len(clock.sleeps) != 0 {
+		t.Fatalf("slept %v during the burst", clock.sleeps)
+	}
+
+	// Once empty, a token is added every 1/rate seconds
+	waitFor(t, r, 500*time.Millisecond)
+	waitFor(t, r, 500*time.Millisecond)
+
+	// Part of a token doesn't let a request through, but shortens the wait
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	waitFor(t, r, 300*time.Millisecond)
+
+	// An idle bucket fills up to the burst and no further
+	clock.now = clock.now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		waitFor(t, r, 0)
+	}
+	waitFor(t, r, 500*time.Millisecond)
+
+	want := []time.Duration{500 * time.Millisecond, 500 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond}
+	if !reflect.DeepEqual(clock.sleeps, want) {
+		t.Errorf("slept %v, want %v", clock.sleeps, want)
+	}
+}
+
+func TestRateLimiterSharedBucket(t *testing.T) {
+	// Processes waiting on an empty bucket queue behind each other instead of
+	// all waking up when the next token arrives
+	dir := t.TempDir()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := NewRateLimiter(dir, "user@example.com", 1, 1, &fakeClock{now: now})
+	second := NewRateLimiter(dir, "user@example.com", 1, 1, &fakeClock{now: now})
+	other := NewRateLimiter(dir, "other@example.com", 1, 1, &fakeClock{now: now})
+
+	waitFor(t, first, 0)
+	waitFor(t, second, time.Second)
+	waitFor(t, first, 2*time.Second)
+	waitFor(t, other, 0)
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	r := NewRateLimiter(t.TempDir(), "user@example.com", 1, 1, clock)
+	waitFor(t, r, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redactedValue replaces sensitive values in log output
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"token":         true,
+	"password":      true,
+	"client_secret": true,
+	"authorization": true,
+	"auth_string":   true,
+}
+
+// secretPattern is a regular expression for a secret embedded in free text
+// and its replacement
+type secretPattern struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// secretPatterns match known secret shapes wherever they appear in a log
+// message or string value, such as an error wrapping an HTTP response body
+var secretPatterns = []secretPattern{
+	// Authorization header values, with or without a scheme
+	{regexp.MustCompile(`(?i)(\bauthorization["']?\s*[:=]\s*["']?)(?:(?:basic|bearer|token)\s+)?[^\s"',;]+`), "${1}" + redactedValue},
+	// Bearer credentials, including the auth= part of a raw XOAUTH2 string
+	{regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redactedValue},
+	// Base64-encoded XOAUTH2 strings ("user=..." encodes to "dXNlcj[0-3]...")
+	{regexp.MustCompile(`\bdXNlcj[0-3][A-Za-z0-9+/]*=*`), redactedValue},
+	// Token fields in JSON or form-encoded OAuth request and response bodies
+	{regexp.MustCompile(`(?i)("?\b(?:access_token|refresh_token|id_token|client_secret|password|assertion)"?\s*[:=]\s*"?)[^"&\s,}]+`), "${1}" + redactedValue},
+	// Google OAuth access tokens, refresh tokens, authorization codes and
+	// client secrets
+	{regexp.MustCompile(`\bya29\.[A-Za-z0-9._-]+`), redactedValue},
+	{regexp.MustCompile(`\b1//[A-Za-z0-9._-]+`), redactedValue},
+	{regexp.MustCompile(`\b4/[A-Za-z0-9._-]{10,}`), redactedValue},
+	{regexp.MustCompile(`\bGOCSPX-[A-Za-z0-9_-]+`), redactedValue},
+}
+
+// Redactor scrubs secrets and selected message header values from log output
+// It is safe for concurrent use
+type Redactor struct {
+	mu         sync.RWMutex
+	headerKeys map[string]bool // attribute keys for the redacted headers
+	headerRe   *regexp.Regexp  // "Header: value" lines in free text
+}
+
+// NewRedactor creates a redactor that also hides the values of the given
+// message headers
+func NewRedactor(headers []string) *Redactor {
+	r := &Redactor{}
+	r.SetHeaders(headers)
+	return r
+}
+
+// secrets redacts secrets only, for output with no logger at hand
+var secrets = NewRedactor(nil)
+
+// SetHeaders replaces the list of message headers whose values are redacted
+// A header such as "Message-ID" matches attribute keys "message-id" and
+// "message_id" as well as "Message-ID: ..." in message text
+func (r *Redactor) SetHeaders(headers []string) {
+	keys := make(map[string]bool)
+	var names []string
+	for _, h := range headers {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		lower := strings.ToLower(h)
+		keys[lower] = true
+		keys[strings.ReplaceAll(lower, "-", "_")] = true
+		names = append(names, regexp.QuoteMeta(textproto.CanonicalMIMEHeaderKey(h)))
+	}
+
+	var headerRe *regexp.Regexp
+	if len(names) > 0 {
+		headerRe = regexp.MustCompile(`(?im)^([ \t]*(?:` + strings.Join(names, "|") + `):[ \t]*)[^\r\n]*`)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.headerKeys = keys
+	r.headerRe = headerRe
+}
+
+// String returns s with any secrets and redacted header values replaced
+func (r *Redactor) String(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+
+	r.mu.RLock()
+	headerRe := r.headerRe
+	r.mu.RUnlock()
+	if headerRe != nil {
+		s = headerRe.ReplaceAllString(s, "${1}"+redactedValue)
+	}
+	return s
+}
+
+// sensitiveKey reports whether values logged under key are always redacted
+func (r *Redactor) sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	if sensitiveKeys[key] {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.headerKeys[key]
+}
+
+// Attr returns a with its value redacted if its key is sensitive, or with
+// secrets scrubbed from its value otherwise
+func (r *Redactor) Attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		members := v.Group()
+		redacted := make([]slog.Attr, len(members))
+		for i, member := range members {
+			redacted[i] = r.Attr(member)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if r.sensitiveKey(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.String(v.String()))
+	case slog.KindAny:
+		return slog.Any(a.Key, r.value(v.Any()))
+	default:
+		return slog.Attr{Key: a.Key, Value: v}
+	}
+}
+
+// value scrubs secrets from the text of errors, stringers and string slices
+func (r *Redactor) value(value any) any {
+	switch v := value.(type) {
+	case error:
+		// Keep the error chain intact for handlers that inspect it
+		if s := v.Error(); r.String(s) != s {
+			return &redactedError{msg: r.String(s), err: v}
+		}
+		return v
+	case fmt.Stringer:
+		return r.String(v.String())
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = r.String(s)
+		}
+		return redacted
+	case []byte:
+		return r.String(string(v))
+	default:
+		return v
+	}
+}
+
+// redactedError is an error whose message has been scrubbed of secrets
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactHandler wraps a handler and scrubs every record before it reaches it
+type redactHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+// newRedactHandler wraps next with redaction
+func newRedactHandler(next slog.Handler, redactor *Redactor) slog.Handler {
+	return &redactHandler{next: next, redactor: redactor}
+}
+
+// Enabled implements slog.Handler
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// WithAttrs implements slog.Handler
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactor.Attr(a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+// WithGroup implements slog.Handler
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+// Handle implements slog.Handler
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, h.redactor.String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactor.Attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
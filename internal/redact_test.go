@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Secrets as they turn up in logs: headers, OAuth response bodies, raw and
+// encoded XOAUTH2 strings and client credentials
+const (
+	testAccessToken  = "ya29.a0AfH6SMBtestAccessToken"
+	testRefreshToken = "1//0gTestRefreshToken"
+	testClientSecret = "GOCSPX-testClientSecret"
+	testPlainSecret  = "plainSecretWithoutPrefix"
+	testOpaqueToken  = "opaqueBearerTokenValue"
+)
+
+var (
+	testXOAUTH2        = "user=user@example.com\x01auth=Bearer " + testOpaqueToken + "\x01\x01"
+	testXOAUTH2Encoded = base64.StdEncoding.EncodeToString([]byte(testXOAUTH2))
+)
+
+// testSecretTexts are strings carrying the secrets, in the shapes the
+// redactor has to recognise
+var testSecretTexts = []string{
+	"Authorization: Bearer " + testAccessToken,
+	"authorization=Bearer " + testOpaqueToken,
+	`{"access_token":"` + testAccessToken + `","refresh_token":"` + testRefreshToken + `","expires_in":3599}`,
+	"grant_type=refresh_token&refresh_token=" + testRefreshToken + "&client_secret=" + testPlainSecret,
+	`{"installed":{"client_id":"123.apps.googleusercontent.com","client_secret":"` + testClientSecret + `"}}`,
+	testXOAUTH2,
+	"AUTHENTICATE XOAUTH2 " + testXOAUTH2Encoded,
+}
+
+// testSecrets are the values that must never appear in output
+var testSecrets = []string{
+	testAccessToken,
+	testRefreshToken,
+	testClientSecret,
+	testPlainSecret,
+	testOpaqueToken,
+	testXOAUTH2Encoded,
+}
+
+// assertRedacted fails if output contains any of the test secrets
+func assertRedacted(t *testing.T, where, output string) {
+	t.Helper()
+	for _, secret := range testSecrets {
+		if strings.Contains(output, secret) {
+			t.Errorf("%s contains secret %q:\n%s", where, secret, output)
+		}
+	}
+	if !strings.Contains(output, redactedValue) {
+		t.Errorf("%s has no %s marker:\n%s", where, redactedValue, output)
+	}
+}
+
+// logSecrets logs every secret text in each place a record can carry it
+func logSecrets(logger *Logger) {
+	for i, text := range testSecretTexts {
+		logger.Info(text)
+		logger.Info("request failed", "detail", text, "attempt", i)
+		logger.Warn("request failed", "error", fmt.Errorf("calling API: %s", text))
+		logger.Error("request failed", "body", []byte(text), "headers", []string{text})
+		logger.Slog().Info("grouped", slog.Group("request", "authorization", text, "url", "https://example.com"))
+		logger.Slog().With("context", text).Info("with attrs")
+	}
+	logger.Info("token saved", "access_token", testOpaqueToken, "refresh_token", testPlainSecret, "client_secret", testPlainSecret)
+	logger.SetAttr("auth_string", testXOAUTH2)
+	logger.Info("authenticating")
+}
+
+func TestRedactString(t *testing.T) {
+	redactor := NewRedactor(nil)
+	for _, text := range testSecretTexts {
+		got := redactor.String(text)
+		assertRedacted(t, fmt.Sprintf("String(%q)", text), got)
+	}
+
+	// Ordinary text is left alone
+	for _, text := range []string{
+		"delivered message 18c2f0a1b2c3d4e5 to INBOX",
+		"token refreshed, valid until 2025-01-01T12:00:00Z",
+		"user=postmaster",
+	} {
+		if got := redactor.String(text); got != text {
+			t.Errorf("String(%q) = %q, want it unchanged", text, got)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	redactor := NewRedactor([]string{"Subject", "Message-ID"})
+	got := redactor.String("From: alice@example.com\nSubject: salary review\nmessage-id: <abc@example.com>\n")
+	if strings.Contains(got, "salary review") || strings.Contains(got, "abc@example.com") {
+		t.Errorf("header values not redacted: %q", got)
+	}
+	if !strings.Contains(got, "From: alice@example.com") {
+		t.Errorf("other headers redacted: %q", got)
+	}
+	if a := redactor.Attr(slog.String("message_id", "<abc@example.com>")); a.Value.String() != redactedValue {
+		t.Errorf("message_id attribute = %q, want it redacted", a.Value.String())
+	}
+}
+
+func TestRedactErrorChain(t *testing.T) {
+	cause := errors.New("refresh failed: " + testSecretTexts[2])
+	a := NewRedactor(nil).Attr(slog.Any("error", fmt.Errorf("saving token: %w", cause)))
+	err, ok := a.Value.Any().(error)
+	if !ok {
+		t.Fatalf("error attribute is %T, want an error", a.Value.Any())
+	}
+	assertRedacted(t, "error attribute", err.Error())
+	if !errors.Is(err, cause) {
+		t.Error("redacted error no longer wraps its cause")
+	}
+}
+
+func TestRedactOutputFormats(t *testing.T) {
+	for _, format := range []LogFormat{LogFormatText, LogFormatLogfmt, LogFormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			var verbose bytes.Buffer
+			logFile := filepath.Join(t.TempDir(), "test.log")
+			logger := NewLogger(true, "test")
+			logger.SetOutput(&verbose)
+			logger.SetFormat(format)
+			if err := logger.OpenLogFile(logFile); err != nil {
+				t.Fatal(err)
+			}
+
+			logSecrets(logger)
+			logger.Close()
+
+			assertRedacted(t, "verbose output", verbose.String())
+			data, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertRedacted(t, "log file", string(data))
+		})
+	}
+}
+
+func TestRedactCustomHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLoggerWithHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), "test")
+	logSecrets(logger)
+	assertRedacted(t, "custom handler output", buf.String())
+}
+
+func TestRedactResult(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "test.log")
+	logger := NewLogger(false, "test")
+	if err := logger.OpenLogFile(logFile); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	stdout := captureStdout(t, func() {
+		logger.Result(&DeliveryResult{
+			Status: "failed",
+			Error:  strings.Join(testSecretTexts, "; "),
+		})
+	})
+	assertRedacted(t, "result", stdout)
+
+	stdout = captureStdout(t, func() {
+		logger.Success("refreshed token " + testSecretTexts[0])
+	})
+	assertRedacted(t, "success message", stdout)
+}
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+// TestRedactFatal runs Fatal in a child process, since it exits, and checks
+// its stderr and log file
+func TestRedactFatal(t *testing.T) {
+	if logFile := os.Getenv("REDACT_TEST_FATAL_LOG"); logFile != "" {
+		logger := NewLogger(false, "test")
+		if err := logger.OpenLogFile(logFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		logger.Fatal("token refresh failed: "+testSecretTexts[0], errors.New(strings.Join(testSecretTexts, "; ")))
+		return
+	}
+
+	logFile := filepath.Join(t.TempDir(), "fatal.log")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRedactFatal$")
+	cmd.Env = append(os.Environ(), "REDACT_TEST_FATAL_LOG="+logFile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != ExitFailure {
+		t.Fatalf("child exited with %v, want exit code %d; stderr:\n%s", err, ExitFailure, stderr.String())
+	}
+	assertRedacted(t, "fatal stderr", stderr.String())
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedacted(t, "fatal log file", string(data))
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gmail-api-client/pkg/deliver"
+)
+
+// ResultFormat selects how the final delivery result is written to stdout
+type ResultFormat string
+
+const (
+	// ResultFormatText writes a single human-readable sentence
+	ResultFormatText ResultFormat = "text"
+	// ResultFormatJSON writes a single JSON object
+	ResultFormatJSON ResultFormat = "json"
+)
+
+// ParseResultFormat converts a configuration string to a ResultFormat
+// An empty string selects the text format
+func ParseResultFormat(s string) (ResultFormat, error) {
+	switch ResultFormat(strings.ToLower(s)) {
+	case "", ResultFormatText:
+		return ResultFormatText, nil
+	case ResultFormatJSON:
+		return ResultFormatJSON, nil
+	default:
+		return "", fmt.Errorf("unknown result format %q (expected text or json)", s)
+	}
+}
+
+// DeliveryResult is the machine-readable outcome of one delivery
+type DeliveryResult = deliver.Result
+
+// NewDeliveryResult builds a result from a finished audit record
+func NewDeliveryResult(record *AuditRecord, duration time.Duration) *DeliveryResult {
+	return &DeliveryResult{
+		Status:    record.Outcome,
+		GmailID:   record.GmailID,
+		ThreadID:  record.ThreadID,
+		Labels:    record.Labels,
+		HistoryID: record.HistoryID,
+		Attempts:  record.Attempts,
+		Duration:  duration.Seconds(),
+		Transport: record.Transport,
+		Error:     record.Error,
+	}
+}
+
+// MarshalResult encodes a result as a single line of JSON
+func MarshalResult(result *DeliveryResult) string {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Sprintf(`{"status":%q}`, result.Status)
+	}
+	return string(data)
+}
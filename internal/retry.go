@@ -1,79 +1,172 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand/v2"
 	"strings"
 	"time"
 
-	"google.golang.org/api/googleapi"
+	"gmail-api-client/pkg/deliver"
 )
 
-// IsRetryableError determines if an error is transient and should be retried
-func IsRetryableError(err error) bool {
-	if err == nil {
-		return false
-	}
+// maxBackoff caps any single backoff delay
+const maxBackoff = 60 * time.Second
 
-	// Check for Google API errors
-	if apiErr, ok := err.(*googleapi.Error); ok {
-		// Retry on rate limit, server errors, and service unavailable
-		// 429 - Too Many Requests (rate limit)
-		// 500 - Internal Server Error
-		// 502 - Bad Gateway
-		// 503 - Service Unavailable
-		// 504 - Gateway Timeout
-		return apiErr.Code == 429 || apiErr.Code >= 500
+// CalculateBackoff calculates exponential backoff delay
+func CalculateBackoff(attempt int, baseDelay int) time.Duration {
+	// Exponential backoff: baseDelay * 2^attempt
+	backoff := float64(baseDelay) * math.Pow(2, float64(attempt))
+	// Cap at 60 seconds
+	if backoff > maxBackoff.Seconds() {
+		backoff = maxBackoff.Seconds()
 	}
+	return time.Duration(backoff) * time.Second
+}
 
-	// Check for context deadline exceeded (timeout)
-	errStr := err.Error()
-	if strings.Contains(errStr, "context deadline exceeded") {
-		return true
-	}
+// JitterMode selects how backoff delays are randomised
+type JitterMode string
+
+const (
+	// JitterNone uses the plain exponential backoff
+	JitterNone JitterMode = "none"
+	// JitterFull picks a delay uniformly between 0 and the exponential backoff
+	JitterFull JitterMode = "full"
+	// JitterDecorrelated picks a delay between the base delay and three times
+	// the previous delay, capped at the maximum backoff
+	JitterDecorrelated JitterMode = "decorrelated"
+)
 
-	// Check for network errors
-	if strings.Contains(errStr, "connection refused") ||
-		strings.Contains(errStr, "connection reset") ||
-		strings.Contains(errStr, "timeout") ||
-		strings.Contains(errStr, "temporary failure") ||
-		strings.Contains(errStr, "i/o timeout") ||
-		strings.Contains(errStr, "EOF") ||
-		strings.Contains(errStr, "broken pipe") ||
-		strings.Contains(errStr, "UNAVAILABLE") {
-		return true
+// ParseJitterMode converts a configuration string to a JitterMode
+// An empty string selects full jitter
+func ParseJitterMode(s string) (JitterMode, error) {
+	switch JitterMode(strings.ToLower(s)) {
+	case "", JitterFull:
+		return JitterFull, nil
+	case JitterNone:
+		return JitterNone, nil
+	case JitterDecorrelated:
+		return JitterDecorrelated, nil
+	default:
+		return "", fmt.Errorf("unknown retry_jitter %q (expected none, full or decorrelated)", s)
 	}
+}
 
-	// OAuth token refresh errors are not retryable at this level
-	// (they should be handled before message delivery)
-	if strings.Contains(errStr, "oauth2") || strings.Contains(errStr, "token") {
-		return false
+// CalculateBackoffWithJitter calculates the backoff delay for an attempt using
+// the given jitter mode, where an empty mode means full jitter as in
+// ParseJitterMode. prev is the previous delay (used by decorrelated jitter)
+// and randInt63n returns a random value in [0, n); if nil, math/rand/v2 is used.
+func CalculateBackoffWithJitter(attempt int, baseDelay int, prev time.Duration, mode JitterMode, randInt63n func(n int64) int64) time.Duration {
+	if randInt63n == nil {
+		randInt63n = rand.Int64N
 	}
 
-	// Authentication errors are generally not retryable
-	if strings.Contains(errStr, "authentication failed") ||
-		strings.Contains(errStr, "invalid credentials") {
-		return false
+	switch mode {
+	case "", JitterFull:
+		backoff := CalculateBackoff(attempt, baseDelay)
+		if backoff <= 0 {
+			return 0
+		}
+		return time.Duration(randInt63n(int64(backoff) + 1))
+	case JitterDecorrelated:
+		base := time.Duration(baseDelay) * time.Second
+		if prev < base {
+			prev = base
+		}
+		upper := prev * 3
+		if upper > maxBackoff {
+			upper = maxBackoff
+		}
+		if upper <= base {
+			return base
+		}
+		return base + time.Duration(randInt63n(int64(upper-base)+1))
+	default:
+		return CalculateBackoff(attempt, baseDelay)
 	}
+}
 
-	return false
+// Clock abstracts time so retry timing can be controlled
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d or until ctx is done, returning ctx.Err() in the latter case
+	Sleep(ctx context.Context, d time.Duration) error
 }
 
-// CalculateBackoff calculates exponential backoff delay
-func CalculateBackoff(attempt int, baseDelay int) time.Duration {
-	// Exponential backoff: baseDelay * 2^attempt
-	backoff := float64(baseDelay) * math.Pow(2, float64(attempt))
-	// Cap at 60 seconds
-	if backoff > 60 {
-		backoff = 60
+// SystemClock is a Clock backed by the real system time
+type SystemClock struct{}
+
+// Now returns the current time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep waits for d or until ctx is done
+func (SystemClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	return time.Duration(backoff) * time.Second
 }
 
 // RetryConfig holds retry configuration
 type RetryConfig struct {
 	MaxRetries int
 	RetryDelay int
+	// AttemptTimeout bounds each individual attempt (zero means no per-attempt limit)
+	AttemptTimeout time.Duration
+	// Jitter selects how backoff delays are randomised (empty means full, as in ParseJitterMode)
+	Jitter JitterMode
+	// Clock is used for sleeping between attempts (nil means SystemClock)
+	Clock Clock
+	// RandInt63n overrides the random source used for jitter (nil means math/rand/v2)
+	RandInt63n func(n int64) int64
+	// Limiter throttles attempts across processes (nil disables rate limiting)
+	Limiter *RateLimiter
+	// Breaker short-circuits attempts while the API is failing (nil disables it)
+	Breaker *CircuitBreaker
+	// Metrics counts attempts and their errors (nil records nothing)
+	Metrics deliver.Metrics
+}
+
+// NewRetryConfig builds a RetryConfig from the common configuration
+// attemptTimeout bounds each attempt (zero means no per-attempt limit) and
+// attempts are counted in metrics, if not nil
+// The rate limiter and circuit breaker are enabled when a state directory is configured
+func NewRetryConfig(common *Common, attemptTimeout time.Duration, metrics deliver.Metrics) *RetryConfig {
+	cfg := &RetryConfig{
+		MaxRetries:     common.MaxRetries,
+		RetryDelay:     common.RetryDelay,
+		AttemptTimeout: attemptTimeout,
+		Jitter:         JitterMode(common.RetryJitter),
+		Metrics:        metrics,
+	}
+	if common.StateDir != "" {
+		if common.RateLimit > 0 {
+			cfg.Limiter = NewRateLimiter(common.StateDir, common.UserID, common.RateLimit, common.RateBurst, nil)
+		}
+		cfg.Breaker = NewCircuitBreaker(common.StateDir, common.UserID, common.BreakerThreshold,
+			time.Duration(common.BreakerCooldown)*time.Second, nil)
+	}
+	return cfg
+}
+
+// AttemptResult describes the result of an attempt for Metrics.CountAttempt:
+// success or the class of its error
+func AttemptResult(err error) string {
+	if err == nil {
+		return deliver.AttemptSuccess
+	}
+	return ClassifyError(err).String()
 }
 
 // LoggerInterface interface for retry operations
@@ -84,16 +177,51 @@ type LoggerInterface interface {
 
 // RetryOperation executes an operation with exponential backoff retry logic
 func RetryOperation(cfg *RetryConfig, logger LoggerInterface, operation func() error, operationName string) error {
+	return RetryOperationContext(context.Background(), cfg, logger, func(context.Context) error {
+		return operation()
+	}, operationName)
+}
+
+// RetryOperationContext executes an operation with exponential backoff retry logic
+// Retries stop as soon as ctx is cancelled or its deadline would pass before the
+// next attempt could start. Each attempt receives a context bounded by
+// cfg.AttemptTimeout, which should be passed on to the underlying API calls.
+func RetryOperationContext(ctx context.Context, cfg *RetryConfig, logger LoggerInterface, operation func(ctx context.Context) error, operationName string) error {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
 	var lastErr error
+	var prevBackoff time.Duration
+	// minBackoff is the delay requested by the server for the next attempt
+	var minBackoff time.Duration
 
 	for attempt := 0; attempt <= cfg.MaxRetries; attempt++ {
 		if attempt > 0 {
-			backoff := CalculateBackoff(attempt-1, cfg.RetryDelay)
+			backoff := CalculateBackoffWithJitter(attempt-1, cfg.RetryDelay, prevBackoff, cfg.Jitter, cfg.RandInt63n)
+			if backoff < minBackoff {
+				backoff = minBackoff
+			}
+			prevBackoff = backoff
+
+			// Don't start a sleep that would outlast the overall budget
+			if deadline, ok := ctx.Deadline(); ok && !clock.Now().Add(backoff).Before(deadline) {
+				logger.Error("operation deadline reached, giving up", "operation", operationName, "attempts", attempt, "backoff", backoff)
+				return fmt.Errorf("operation deadline reached after %d attempts: %w", attempt, lastErr)
+			}
+
 			logger.Info("retrying operation", "operation", operationName, "attempt", attempt, "max_attempts", cfg.MaxRetries, "backoff", backoff)
-			time.Sleep(backoff)
+			if err := clock.Sleep(ctx, backoff); err != nil {
+				logger.Error("operation cancelled while waiting to retry", "operation", operationName, "attempts", attempt, "error", err)
+				return fmt.Errorf("%w (last error: %v)", err, lastErr)
+			}
 		}
 
-		err := operation()
+		err := guardedAttempt(ctx, cfg, logger, operationName, operation)
+		if cfg.Metrics != nil {
+			cfg.Metrics.CountAttempt(operationName, AttemptResult(err))
+		}
 		if err == nil {
 			if attempt > 0 {
 				logger.Info("operation succeeded after retries", "operation", operationName, "attempts", attempt)
@@ -103,14 +231,94 @@ func RetryOperation(cfg *RetryConfig, logger LoggerInterface, operation func() e
 
 		lastErr = err
 
-		if !IsRetryableError(err) {
-			logger.Error("operation failed with non-retryable error", "operation", operationName, "error", err)
+		// The overall budget is gone; further attempts would fail immediately
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			logger.Error("operation cancelled", "operation", operationName, "attempts", attempt+1, "error", err)
+			if errors.Is(err, ctxErr) {
+				return err
+			}
+			return fmt.Errorf("%w (last error: %v)", ctxErr, err)
+		}
+
+		reason := APIErrorReason(err)
+
+		switch ClassifyError(err) {
+		case ClassDeferred:
+			logger.Error("operation failed with deferrable error, leaving retry to the MTA", "operation", operationName, "reason", reason, "error", err)
+			var tempErr *TempFailError
+			if errors.As(err, &tempErr) {
+				return err
+			}
+			return &TempFailError{Reason: reason, Err: err}
+		case ClassPermanent:
+			logger.Error("operation failed with non-retryable error", "operation", operationName, "reason", reason, "error", err)
 			return err
 		}
 
-		logger.Info("operation failed with retryable error", "operation", operationName, "attempt", attempt+1, "max_attempts", cfg.MaxRetries+1, "error", err)
+		// Honour the server's requested delay, but don't wait around for
+		// longer than a single backoff cap - the MTA can retry later instead
+		if retryAfter, ok := RetryAfter(err); ok {
+			if retryAfter > maxBackoff {
+				logger.Error("server requested retry beyond backoff limit, leaving retry to the MTA", "operation", operationName, "reason", reason, "retry_after", retryAfter)
+				return &TempFailError{Reason: reason, Err: err}
+			}
+			minBackoff = retryAfter
+		} else {
+			minBackoff = 0
+		}
+
+		logger.Info("operation failed with retryable error", "operation", operationName, "attempt", attempt+1, "max_attempts", cfg.MaxRetries+1, "reason", reason, "error", err)
 	}
 
 	logger.Error("operation failed after max retries", "operation", operationName, "attempts", cfg.MaxRetries+1)
 	return fmt.Errorf("max retries exceeded: %w", lastErr)
 }
+
+// runAttempt runs a single attempt with its own timeout derived from ctx
+func runAttempt(ctx context.Context, timeout time.Duration, operation func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return operation(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return operation(attemptCtx)
+}
+
+// guardedAttempt runs a single attempt behind the circuit breaker and rate limiter
+// Problems with the shared state files are logged but never block delivery
+func guardedAttempt(ctx context.Context, cfg *RetryConfig, logger LoggerInterface, operationName string, operation func(ctx context.Context) error) error {
+	if cfg.Breaker != nil {
+		if err := cfg.Breaker.Allow(); err != nil {
+			if errors.Is(err, ErrCircuitOpen) {
+				return err
+			}
+			logger.Error("circuit breaker unavailable", "operation", operationName, "error", err)
+		}
+	}
+
+	if cfg.Limiter != nil {
+		waited, err := cfg.Limiter.Wait(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			logger.Error("rate limiter unavailable", "operation", operationName, "error", err)
+		} else if waited > 0 {
+			logger.Info("rate limited", "operation", operationName, "waited", waited)
+		}
+	}
+
+	err := runAttempt(ctx, cfg.AttemptTimeout, operation)
+
+	// A cancelled run says nothing about the health of the API
+	if cfg.Breaker != nil && !errors.Is(err, context.Canceled) {
+		state, recordErr := cfg.Breaker.Record(err)
+		if recordErr != nil {
+			logger.Error("circuit breaker unavailable", "operation", operationName, "error", recordErr)
+		} else if state == BreakerOpen {
+			logger.Error("circuit breaker open", "operation", operationName)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fakeClock records sleeps and advances its time by them without waiting
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+	// onSleep, if set, runs at the start of every sleep
+	onSleep func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.sleeps = append(c.sleeps, d)
+	if c.onSleep != nil {
+		c.onSleep()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// nopLogger discards the retry loop's logs
+type nopLogger struct{}
+
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// apiError returns a Gmail API error with a status code and optional reason
+func apiError(code int, reason string) *googleapi.Error {
+	err := &googleapi.Error{Code: code, Message: http.StatusText(code)}
+	if reason != "" {
+		err.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return err
+}
+
+func TestRetryOperationAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		// errs are returned by successive attempts; later attempts succeed
+		errs       []error
+		maxRetries int
+		wantCalls  int
+		wantErr    string
+		wantExit   int
+	}{
+		{
+			name:       "success",
+			maxRetries: 3,
+			wantCalls:  1,
+		},
+		{
+			name:       "success after retries",
+			errs:       []error{apiError(503, ""), apiError(500, "")},
+			maxRetries: 3,
+			wantCalls:  3,
+		},
+		{
+			name:       "retries exhausted",
+			errs:       []error{apiError(503, ""), apiError(503, ""), apiError(503, ""), apiError(503, ""), apiError(503, "")},
+			maxRetries: 3,
+			wantCalls:  4,
+			wantErr:    "max retries exceeded",
+			wantExit:   ExitTempFail,
+		},
+		{
+			name:       "no retries configured",
+			errs:       []error{apiError(429, ReasonRateLimitExceeded)},
+			maxRetries: 0,
+			wantCalls:  1,
+			wantErr:    "max retries exceeded",
+			wantExit:   ExitTempFail,
+		},
+		{
+			name:       "permanent",
+			errs:       []error{apiError(400, ReasonInvalidArgument)},
+			maxRetries: 3,
+			wantCalls:  1,
+			wantErr:    "Bad Request",
+			wantExit:   ExitFailure,
+		},
+		{
+			name:       "deferred",
+			errs:       []error{apiError(403, ReasonDailyLimitExceeded)},
+			maxRetries: 3,
+			wantCalls:  1,
+			wantErr:    "temporary failure (dailyLimitExceeded)",
+			wantExit:   ExitTempFail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now()}
+			metrics := NewMetrics()
+			cfg := &RetryConfig{
+				MaxRetries: tt.maxRetries,
+				RetryDelay: 1,
+				Jitter:     JitterNone,
+				Clock:      clock,
+				Metrics:    metrics,
+			}
+
+			calls := 0
+			err := RetryOperationContext(context.Background(), cfg, nopLogger{}, func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			}, "test")
+
+			if calls != tt.wantCalls {
+				t.Errorf("attempts = %d, want %d", calls, tt.wantCalls)
+			}
+			if len(clock.sleeps) != calls-1 {
+				t.Errorf("sleeps = %v, want %d", clock.sleeps, calls-1)
+			}
+			for i, d := range clock.sleeps {
+				if want := CalculateBackoff(i, 1); d != want {
+					t.Errorf("sleep %d = %v, want %v", i, d, want)
+				}
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if code := ExitCode(err); code != tt.wantExit {
+					t.Errorf("exit code = %d, want %d", code, tt.wantExit)
+				}
+			}
+
+			failed := calls
+			if tt.wantErr == "" {
+				failed--
+			}
+			if got := metrics.Counters[seriesKey(metricAttempts, "operation", "test", "result", "error")]; got != float64(failed) {
+				t.Errorf("failed attempts counted = %v, want %d", got, failed)
+			}
+		})
+	}
+}
+
+func TestRetryOperationRetryAfter(t *testing.T) {
+	withRetryAfter := func(value string) error {
+		err := apiError(429, ReasonRateLimitExceeded)
+		err.Header = http.Header{"Retry-After": []string{value}}
+		return err
+	}
+
+	t.Run("honoured", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		cfg := &RetryConfig{MaxRetries: 3, RetryDelay: 1, Jitter: JitterNone, Clock: clock}
+		calls := 0
+		err := RetryOperationContext(context.Background(), cfg, nopLogger{}, func(context.Context) error {
+			calls++
+			if calls == 1 {
+				return withRetryAfter("5")
+			}
+			return nil
+		}, "test")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(clock.sleeps) != 1 || clock.sleeps[0] != 5*time.Second {
+			t.Errorf("sleeps = %v, want [5s]", clock.sleeps)
+		}
+	})
+
+	t.Run("beyond backoff limit", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		cfg := &RetryConfig{MaxRetries: 3, RetryDelay: 1, Jitter: JitterNone, Clock: clock}
+		calls := 0
+		err := RetryOperationContext(context.Background(), cfg, nopLogger{}, func(context.Context) error {
+			calls++
+			return withRetryAfter("120")
+		}, "test")
+		var tempErr *TempFailError
+		if !errors.As(err, &tempErr) {
+			t.Fatalf("error = %v, want a TempFailError", err)
+		}
+		if calls != 1 || len(clock.sleeps) != 0 {
+			t.Errorf("attempts = %d, sleeps = %v; want 1 attempt and no sleep", calls, clock.sleeps)
+		}
+	})
+}
+
+func TestRetryOperationDeadline(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	ctx, cancel := context.WithDeadline(context.Background(), clock.now.Add(10*time.Second))
+	defer cancel()
+	cfg := &RetryConfig{MaxRetries: 10, RetryDelay: 4, Jitter: JitterNone, Clock: clock}
+
+	calls := 0
+	err := RetryOperationContext(ctx, cfg, nopLogger{}, func(context.Context) error {
+		calls++
+		return apiError(503, "")
+	}, "test")
+
+	// 4s fits in the 10s budget; the 8s after it doesn't
+	if calls != 2 {
+		t.Errorf("attempts = %d, want 2", calls)
+	}
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 4*time.Second {
+		t.Errorf("sleeps = %v, want [4s]", clock.sleeps)
+	}
+	if err == nil || !strings.Contains(err.Error(), "deadline reached after 2 attempts") {
+		t.Fatalf("error = %v, want deadline reached after 2 attempts", err)
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 503 {
+		t.Errorf("error = %v, want it to wrap the last API error", err)
+	}
+}
+
+func TestRetryOperationCancelledWhileSleeping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Now(), onSleep: cancel}
+	cfg := &RetryConfig{MaxRetries: 5, RetryDelay: 1, Jitter: JitterNone, Clock: clock}
+
+	calls := 0
+	err := RetryOperationContext(ctx, cfg, nopLogger{}, func(context.Context) error {
+		calls++
+		return apiError(503, "")
+	}, "test")
+
+	if calls != 1 {
+		t.Errorf("attempts = %d, want 1", calls)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "last error") {
+		t.Errorf("error = %v, want it to mention the last error", err)
+	}
+}
+
+func TestRetryOperationAttemptTimeout(t *testing.T) {
+	cfg := &RetryConfig{MaxRetries: 0, AttemptTimeout: time.Minute, Clock: &fakeClock{}}
+	err := RetryOperationContext(context.Background(), cfg, nopLogger{}, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("attempt context has no deadline")
+		}
+		return nil
+	}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCalculateBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		base    int
+		want    time.Duration
+	}{
+		{0, 1, time.Second},
+		{1, 1, 2 * time.Second},
+		{3, 2, 16 * time.Second},
+		{5, 2, maxBackoff},
+		{30, 1, maxBackoff},
+		{0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := CalculateBackoff(tt.attempt, tt.base); got != tt.want {
+			t.Errorf("CalculateBackoff(%d, %d) = %v, want %v", tt.attempt, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateBackoffWithJitter(t *testing.T) {
+	// Random sources at either end of their range, and the real one
+	sources := []struct {
+		name   string
+		random func(n int64) int64
+	}{
+		{"lowest", func(int64) int64 { return 0 }},
+		{"highest", func(n int64) int64 { return n - 1 }},
+		{"random", nil},
+	}
+
+	const base = 2
+	for _, mode := range []JitterMode{"", JitterNone, JitterFull, JitterDecorrelated} {
+		for _, source := range sources {
+			prev := time.Duration(0)
+			for attempt := 0; attempt < 10; attempt++ {
+				got := CalculateBackoffWithJitter(attempt, base, prev, mode, source.random)
+
+				low, high := CalculateBackoff(attempt, base), CalculateBackoff(attempt, base)
+				switch mode {
+				case "", JitterFull:
+					low = 0
+				case JitterDecorrelated:
+					low = base * time.Second
+					high = min(max(prev, low)*3, maxBackoff)
+				}
+				if got < low || got > high {
+					t.Errorf("mode %q, %s source, attempt %d: backoff %v outside [%v, %v]", mode, source.name, attempt, got, low, high)
+				}
+				if source.name == "lowest" && got != low {
+					t.Errorf("mode %q, lowest source, attempt %d: backoff %v, want %v", mode, attempt, got, low)
+				}
+				if source.name == "highest" && got != high {
+					t.Errorf("mode %q, highest source, attempt %d: backoff %v, want %v", mode, attempt, got, high)
+				}
+				prev = got
+			}
+		}
+	}
+}
+
+func TestParseJitterMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    JitterMode
+		wantErr bool
+	}{
+		{"", JitterFull, false},
+		{"full", JitterFull, false},
+		{"None", JitterNone, false},
+		{"decorrelated", JitterDecorrelated, false},
+		{"random", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseJitterMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseJitterMode(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UpdateStateFile loads JSON state from a file, lets update modify it and
+// writes it back, all while holding an exclusive lock on the file
+// This allows several transport processes to share small pieces of state
+// (rate limiter buckets, circuit breaker status) safely
+// A missing or empty file leaves state at its zero value
+func UpdateStateFile(filename string, state interface{}, update func() error) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening state file: %w", err)
+	}
+	defer file.Close()
+
+	if err := acquireFileLock(file); err != nil {
+		return fmt.Errorf("locking state file: %w", err)
+	}
+	defer releaseFileLock(file)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("reading state file: %w", err)
+	}
+	if len(data) > 0 {
+		// A corrupt state file shouldn't block delivery, so decode errors are
+		// ignored and the file is overwritten with fresh state below
+		_ = json.Unmarshal(data, state)
+	}
+
+	if err := update(); err != nil {
+		return err
+	}
+
+	newData, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("truncating state file: %w", err)
+	}
+	if _, err := file.WriteAt(newData, 0); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return nil
+}
+
+// StateFilePath returns the path of a per-account state file in dir, named
+// "<account>.<suffix>"
+// The account name is sanitised so it is always a single path component
+func StateFilePath(dir, account, suffix string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '@' || r == '.' || r == '-' || r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, account)
+	if safe == "" || strings.Trim(safe, ".") == "" {
+		safe = "default"
+	}
+	return filepath.Join(dir, safe+"."+suffix)
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// counterState is the state the tests share
+type counterState struct {
+	Count int    `json:"count"`
+	Owner string `json:"owner,omitempty"`
+}
+
+func TestUpdateStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+
+	// A missing file starts from the zero value
+	var state counterState
+	if err := UpdateStateFile(file, &state, func() error {
+		if state != (counterState{}) {
+			t.Errorf("state of a missing file = %+v", state)
+		}
+		state.Count = 1
+		state.Owner = "a long owner name"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shorter state replaces longer state without leaving its tail behind
+	state = counterState{}
+	if err := UpdateStateFile(file, &state, func() error {
+		state.Count++
+		state.Owner = ""
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != `{"count":2}` {
+		t.Errorf("state file = %s, want the count alone", data)
+	}
+
+	// An error from update leaves the file as it was
+	failed := errors.New("update failed")
+	state = counterState{}
+	if err := UpdateStateFile(file, &state, func() error {
+		state.Count = 100
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("UpdateStateFile = %v, want the update's error", err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != `{"count":2}` {
+		t.Errorf("state file after a failed update = %s", data)
+	}
+
+	// A corrupt file is replaced with fresh state
+	if err := os.WriteFile(file, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state = counterState{}
+	if err := UpdateStateFile(file, &state, func() error {
+		state.Count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != `{"count":1}` {
+		t.Errorf("state file after corruption = %s", data)
+	}
+}
+
+// TestUpdateStateFileProcesses has several child processes increment a
+// shared counter at once; without the lock some increments would be lost
+func TestUpdateStateFileProcesses(t *testing.T) {
+	const processes, increments = 4, 25
+	if file := os.Getenv("STATEFILE_TEST_FILE"); file != "" {
+		for i := 0; i < increments; i++ {
+			var state counterState
+			if err := UpdateStateFile(file, &state, func() error {
+				count := state.Count
+				// Widen the window between reading and writing the state
+				time.Sleep(time.Millisecond)
+				state.Count = count + 1
+				return nil
+			}); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		return
+	}
+
+	file := filepath.Join(t.TempDir(), "counter.json")
+	var cmds []*exec.Cmd
+	var outputs []*bytes.Buffer
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestUpdateStateFileProcesses$")
+		cmd.Env = append(os.Environ(), "STATEFILE_TEST_FILE="+file)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+		outputs = append(outputs, &out)
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("child %d: %v\n%s", i, err, outputs[i])
+		}
+	}
+
+	var state counterState
+	if err := UpdateStateFile(file, &state, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if want := processes * increments; state.Count != want {
+		t.Errorf("count = %d, want %d", state.Count, want)
+	}
+}
+
+func TestStateFilePath(t *testing.T) {
+	tests := map[string]string{
+		"user@example.com": "user@example.com.breaker.json",
+		"../../etc/passwd": ".._.._etc_passwd.breaker.json",
+		"a b/c":            "a_b_c.breaker.json",
+		"..":               "default.breaker.json",
+		"":                 "default.breaker.json",
+	}
+	for account, want := range tests {
+		if got := StateFilePath("/var/lib/gmail", account, "breaker.json"); got != filepath.Join("/var/lib/gmail", want) {
+			t.Errorf("StateFilePath(%q) = %q, want %s in the state directory", account, got, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxThreadLookups bounds the mailbox searches made to thread one reply
+const maxThreadLookups = 5
+
+// ReplyReferences returns the Message-IDs a reply refers to, without angle
+// brackets and most recent first: In-Reply-To, then References from its end
+func ReplyReferences(rawMessage []byte) []string {
+	msg, err := mail.ReadMessage(bytes.NewReader(rawMessage))
+	if err != nil {
+		return nil
+	}
+	var refs []string
+	add := func(id string) {
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+		if id == "" {
+			return
+		}
+		for _, existing := range refs {
+			if existing == id {
+				return
+			}
+		}
+		refs = append(refs, id)
+	}
+	for _, id := range strings.Fields(msg.Header.Get("In-Reply-To")) {
+		add(id)
+	}
+	references := strings.Fields(msg.Header.Get("References"))
+	for i := len(references) - 1; i >= 0; i-- {
+		add(references[i])
+	}
+	return refs
+}
+
+// FindThread returns the Gmail thread of the most recent message a reply
+// refers to, searching the mailbox with rfc822msgid: queries, or "" if the
+// message isn't a reply or none of the messages it refers to is in the
+// mailbox
+// Only the first few references are searched, most recent first
+func FindThread(ctx context.Context, service *gmail.Service, userID string, retryCfg *RetryConfig, logger *Logger, rawMessage []byte) (threadID string, err error) {
+	refs := ReplyReferences(rawMessage)
+	if len(refs) == 0 {
+		return "", nil
+	}
+	if len(refs) > maxThreadLookups {
+		refs = refs[:maxThreadLookups]
+	}
+
+	ctx, span := StartSpan(ctx, "gmail.find_thread", attribute.Int("thread.references", len(refs)))
+	defer func() {
+		span.SetAttributes(attribute.String("gmail.thread_id", threadID))
+		EndSpan(span, err)
+	}()
+
+	for _, ref := range refs {
+		query := "rfc822msgid:" + ref
+		logger.Debug("searching mailbox for referenced message", "query", query)
+
+		var found string
+		err = RetryOperationContext(ctx, retryCfg, logger, func(ctx context.Context) error {
+			resp, err := service.Users.Messages.List(userID).
+				Q(query).
+				IncludeSpamTrash(true).
+				MaxResults(1).
+				Context(ctx).
+				Do()
+			if err != nil {
+				return err
+			}
+			if len(resp.Messages) > 0 {
+				found = resp.Messages[0].ThreadId
+			}
+			return nil
+		}, "thread search")
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			logger.Debug("found thread of referenced message", "message_id", ref, "thread_id", found)
+			return found, nil
+		}
+	}
+	logger.Debug("no referenced message found in mailbox")
+	return "", nil
+}
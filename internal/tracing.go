@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies spans created by this module
+const tracerName = "gmail-api-client"
+
+// tracingShutdownTimeout bounds how long exiting waits to flush spans
+const tracingShutdownTimeout = 5 * time.Second
+
+// TracingEnabled reports whether spans should be exported: when otlp_endpoint
+// is configured or a standard OTLP endpoint variable is set, and the SDK
+// hasn't been disabled with OTEL_SDK_DISABLED
+func TracingEnabled(common *Common) bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	return common.OTLPEndpoint != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// InitTracing returns a tracer provider exporting spans over OTLP/HTTP, or
+// a no-op provider if tracing is disabled
+// The exporter is configured by the standard OTEL_EXPORTER_OTLP_* variables,
+// with otlp_endpoint taking precedence; OTEL_SERVICE_NAME,
+// OTEL_RESOURCE_ATTRIBUTES and OTEL_TRACES_SAMPLER are honoured too
+// The returned function flushes and stops the provider and must be called
+// before exiting; warnings go to logger
+func InitTracing(ctx context.Context, common *Common, serviceName string, logger *Logger) (trace.TracerProvider, func(), error) {
+	if !TracingEnabled(common) {
+		return noop.NewTracerProvider(), func() {}, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if common.OTLPEndpoint != "" {
+		endpoint, err := tracesEndpointURL(common.OTLPEndpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	// Attributes from the environment override the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithProcessPID(),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	return provider, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+	}, nil
+}
+
+// tracesEndpointURL validates an otlp_endpoint value, adding the standard
+// /v1/traces path when only a collector base URL is given
+func tracesEndpointURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid otlp_endpoint %q (expected an http:// or https:// URL)", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Tracer returns the tracer for the delivery pipeline from a provider
+func Tracer(provider trace.TracerProvider) trace.Tracer {
+	return provider.Tracer(tracerName)
+}
+
+// StartSpan starts a span as a child of the span in ctx, from the same
+// provider; without a span in ctx the new span is a no-op
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer(trace.SpanFromContext(ctx).TracerProvider()).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartRootSpan starts the span of one delivery from provider, if not nil,
+// and otherwise as StartSpan does
+func StartRootSpan(ctx context.Context, provider trace.TracerProvider, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if provider == nil {
+		return StartSpan(ctx, name, attrs...)
+	}
+	return Tracer(provider).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends a span, recording err and marking the span as failed if set
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		msg := secrets.String(err.Error())
+		span.RecordError(&redactedError{msg: msg, err: err})
+		span.SetStatus(codes.Error, msg)
+		span.SetAttributes(attribute.String("error.class", ClassifyError(err).String()))
+	}
+	span.End()
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version is the release version, set at build time with
+// -ldflags "-X gmail-api-client/internal.Version=v1.2.3"
+// When unset, the module version from the build info is used
+var Version = ""
+
+// VersionString describes the build of a program for --version
+func VersionString(program string) string {
+	version := Version
+	var revision, buildTime string
+	var modified bool
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.time":
+				buildTime = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if version == "" {
+		version = "(devel)"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", program, version)
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	// Pseudo-versions already name the commit
+	if revision != "" && !strings.Contains(version, revision) {
+		fmt.Fprintf(&b, " commit %s", revision)
+		if modified {
+			b.WriteString("-dirty")
+		}
+	}
+	if buildTime != "" {
+		fmt.Fprintf(&b, " (%s)", buildTime)
+	}
+	fmt.Fprintf(&b, " %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return b.String()
+}
@@ -0,0 +1,58 @@
+package deliver
+
+// Common holds configuration options shared by the delivery packages, read
+// from the configuration file of each transport
+type Common struct {
+	CredentialsFile string `json:"credentials_file" help:"OAuth2 client credentials from Google Cloud Console"`
+	TokenFile       string `json:"token_file" help:"OAuth2 token file created by gmail-api-transport-get-token"`
+	UserID          string `json:"user_id" help:"Gmail user ID or email address" default:"me"`
+	Verbose         bool   `json:"verbose" help:"Enable verbose logging"`
+	MaxRetries      int    `json:"max_retries" help:"Maximum retry attempts for transient failures" default:"3"`
+	RetryDelay      int    `json:"retry_delay" help:"Initial retry delay in seconds" default:"1"`
+	// Backoff jitter: "none", "full" or "decorrelated" (default: full)
+	RetryJitter string `json:"retry_jitter" help:"Retry delay jitter: none, full or decorrelated" default:"full"`
+	// Directory for state shared between processes (rate limiter, circuit
+	// breaker); both are disabled when empty
+	StateDir string `json:"state_dir" help:"Directory for state shared between processes"`
+	// Maximum API requests per second per account (0 disables rate limiting)
+	RateLimit float64 `json:"rate_limit" help:"Maximum API requests per second per account, 0 for unlimited" default:"0"`
+	// Number of requests allowed in a burst (default: 1)
+	RateBurst int `json:"rate_burst" help:"Requests allowed in a burst by the rate limiter" default:"1"`
+	// Consecutive transient failures before the circuit breaker opens (default: 5)
+	BreakerThreshold int `json:"breaker_threshold" help:"Consecutive transient failures before the circuit breaker opens" default:"5"`
+	// Seconds the circuit breaker stays open before allowing a probe (default: 60)
+	BreakerCooldown int `json:"breaker_cooldown" help:"Seconds the circuit breaker stays open" default:"60"`
+	// Duplicate delivery check: "off", "local", "search" or "both" (default: off)
+	DedupMode string `json:"dedup_mode" help:"Duplicate delivery check: off, local, search or both" default:"off"`
+	// Index of delivered messages for local deduplication
+	// (default: <state_dir>/<user_id>.delivered.jsonl)
+	DedupIndex string `json:"dedup_index" help:"Local index of delivered messages" default:"<state_dir>/<user_id>.delivered.jsonl"`
+	// Hours to remember delivered messages in the local index (default: 168)
+	DedupExpiry int `json:"dedup_expiry" help:"Hours to remember delivered messages" default:"168"`
+	// Log line format: "text", "logfmt" or "json" (default: text)
+	LogFormat string `json:"log_format" help:"Log line format: text, logfmt or json" default:"text"`
+	// File receiving Info/Warn/Error logs even when not verbose (default: none)
+	LogFile string `json:"log_file" help:"File receiving Info, Warn and Error logs"`
+	// Structured log sink: "none", "syslog" or "journald" (default: none)
+	LogSink string `json:"log_sink" help:"Structured log sink: none, syslog or journald" default:"none"`
+	// Syslog address: "unix:///path", "/path" or "udp://host:port" (default: /dev/log)
+	SyslogAddress string `json:"syslog_address" help:"Syslog address, unix:///path, /path or udp://host:port" default:"/dev/log"`
+	// Syslog facility name (default: mail)
+	SyslogFacility string `json:"syslog_facility" help:"Syslog facility name" default:"mail"`
+	// Message headers whose values are redacted from log output, e.g.
+	// ["Subject", "To"] (default: none)
+	RedactHeaders []string `json:"redact_headers" help:"Message headers redacted from log output"`
+	// Append-only JSON lines audit log of deliveries (default: none)
+	AuditLog string `json:"audit_log" help:"JSON lines audit log of deliveries"`
+	// Size in MB at which the audit log is rotated (default: 100)
+	AuditMaxSize int `json:"audit_max_size" help:"Size in MB at which the audit log is rotated" default:"100"`
+	// Number of rotated audit logs kept (default: 10)
+	AuditMaxFiles int `json:"audit_max_files" help:"Number of rotated audit logs kept" default:"10"`
+	// node_exporter textfile collector directory for metrics (default: none)
+	MetricsDir string `json:"metrics_dir" help:"node_exporter textfile collector directory"`
+	// OTLP/HTTP collector URL for traces; tracing is also enabled by the
+	// standard OTEL_EXPORTER_OTLP_ENDPOINT variables (default: none)
+	OTLPEndpoint string `json:"otlp_endpoint" help:"OTLP/HTTP collector URL for traces"`
+	// Final result on stdout: "text" or "json" (default: text)
+	ResultFormat string `json:"result_format" help:"Final result on stdout: text or json" default:"text"`
+}
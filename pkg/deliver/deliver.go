@@ -0,0 +1,85 @@
+// Package deliver defines what the Gmail delivery packages have in common,
+// so a program can embed delivery without caring whether it uses the Gmail
+// API (package gmaildeliver) or IMAP (package imapdeliver)
+package deliver
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Deliverer delivers a single message to a Gmail mailbox
+type Deliverer interface {
+	// Deliver reads an RFC 5322 message from msg and delivers it
+	// The result is returned even when delivery fails, describing the
+	// attempts made; use Temporary to decide whether to try again later
+	Deliver(ctx context.Context, msg io.Reader, opts Options) (*Result, error)
+}
+
+// Options describe one delivery
+type Options struct {
+	// Sender and Recipient are the envelope addresses recorded in the audit
+	// log, such as the SENDER and RECIPIENT variables set by Exim's pipe
+	// transport
+	Sender    string
+	Recipient string
+	// SkipDuplicateCheck delivers the message even if dedup_mode would
+	// skip it as already delivered
+	SkipDuplicateCheck bool
+}
+
+// Result statuses
+const (
+	// StatusDelivered means the message was delivered by this call
+	StatusDelivered = "delivered"
+	// StatusDuplicate means the message had already been delivered and was skipped
+	StatusDuplicate = "duplicate"
+	// StatusDeferred means delivery failed temporarily and may be retried later
+	StatusDeferred = "deferred"
+	// StatusFailed means delivery failed permanently
+	StatusFailed = "failed"
+)
+
+// Result is the machine-readable outcome of one delivery
+type Result struct {
+	// Status is the audit outcome: delivered, duplicate, deferred or failed
+	Status    string   `json:"status"`
+	GmailID   string   `json:"gmail_id,omitempty"`
+	ThreadID  string   `json:"thread_id,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+	HistoryID uint64   `json:"history_id,omitempty"`
+	Attempts  int      `json:"attempts"`
+	// Duration is the wall-clock time of the whole run in seconds
+	Duration  float64 `json:"duration"`
+	Transport string  `json:"transport"`
+	Error     string  `json:"error,omitempty"`
+	// Warning describes a problem after a successful delivery, such as a
+	// failed label change
+	Warning string `json:"warning,omitempty"`
+}
+
+// ErrEmptyMessage is returned when there is no message to deliver
+var ErrEmptyMessage = errors.New("no message received")
+
+// Error is a failed delivery, as returned by the delivery packages
+type Error struct {
+	// Temporary is set when the delivery may succeed if retried later
+	Temporary bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether a delivery error may succeed if retried later
+// Exim defers the message in that case rather than bouncing it
+func Temporary(err error) bool {
+	var deliverErr *Error
+	return errors.As(err, &deliverErr) && deliverErr.Temporary
+}
@@ -0,0 +1,47 @@
+package deliver
+
+import (
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry says where a deliverer sends its logs, metrics and spans
+// The zero value discards all three
+type Telemetry struct {
+	// Logger receives the log records; nil discards them
+	Logger slog.Handler
+	// Metrics receives measurements of API calls and deliveries; nil
+	// discards them
+	Metrics Metrics
+	// TracerProvider creates a span for each delivery with the steps as its
+	// children; when nil, spans are only created under a span already in
+	// the context passed in
+	TracerProvider trace.TracerProvider
+}
+
+// Attempt results passed to Metrics.CountAttempt
+const (
+	AttemptSuccess   = "success"
+	AttemptPermanent = "permanent"
+	AttemptRetryable = "retryable"
+	AttemptDeferred  = "deferred"
+)
+
+// Metrics receives the measurements made while delivering, for example to
+// feed a Prometheus registry
+// Methods may be called from several goroutines at once
+type Metrics interface {
+	// ObserveAPICall records the duration of one Gmail API request, by API
+	// method (e.g. "users.messages.import") and HTTP status code
+	ObserveAPICall(method string, code int, d time.Duration)
+	// CountAttempt records one attempt at a retried operation and its
+	// result: AttemptSuccess or the class of the error
+	CountAttempt(operation, result string)
+	// CountTokenRefresh records an OAuth2 access token refresh
+	CountTokenRefresh()
+	// ObserveDelivery records the status and message size of a finished
+	// delivery
+	ObserveDelivery(transport, status string, size int)
+}
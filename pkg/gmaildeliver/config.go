@@ -0,0 +1,80 @@
+package gmaildeliver
+
+import (
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+)
+
+// Config holds the configuration of API delivery
+type Config struct {
+	deliver.Common
+	// Never mark as spam (ignore Gmail spam classifier)
+	NotSpam bool `json:"not_spam" help:"Never mark messages as spam (import only)"`
+	// Use Insert instead of Import (bypasses scanning, similar to IMAP APPEND)
+	UseInsert bool `json:"use_insert" help:"Use the Insert API instead of Import (bypasses scanning)"`
+	// API call timeout in seconds (default: 30)
+	APITimeout int `json:"api_timeout" help:"Timeout for individual API calls in seconds" default:"30"`
+	// Overall operation timeout in seconds (default: 120)
+	OperationTimeout int `json:"operation_timeout" help:"Overall timeout in seconds, including retries" default:"120"`
+	// Filter processing delay in seconds (default: 2)
+	FilterDelay int `json:"filter_delay" help:"Seconds to wait for Gmail filters after delivery" default:"2"`
+	// Add replies to the Gmail thread of the message they answer
+	ThreadReplies bool `json:"thread_replies" help:"Add replies to the Gmail thread of the message they answer"`
+	// Gmail API base URL override, e.g. a fake server in integration tests
+	APIEndpoint string `json:"api_endpoint" help:"Gmail API base URL override, for testing against a fake server"`
+}
+
+// Validate checks the configuration and fills in defaults
+func (cfg *Config) Validate() error {
+	return cfg.validate(internal.LoggerForHandler(nil, ""))
+}
+
+// validate checks the configuration and fills in defaults, logging the
+// values used
+func (cfg *Config) validate(logger *internal.Logger) error {
+	logger.Debug("validating configuration")
+
+	if cfg.UserID == "" {
+		cfg.UserID = "me"
+		logger.Debug("using default user ID", "user_id", "me")
+	}
+
+	// Validate common fields
+	if err := internal.ValidateCommon(&cfg.Common); err != nil {
+		return err
+	}
+
+	// Set timeout defaults if not specified
+	internal.SetDefaults(&cfg.APITimeout, 30)
+	internal.SetDefaults(&cfg.OperationTimeout, 120)
+	internal.SetDefaults(&cfg.FilterDelay, 2)
+
+	logger.Debug("defaults applied",
+		"api_timeout", cfg.APITimeout,
+		"operation_timeout", cfg.OperationTimeout,
+		"filter_delay", cfg.FilterDelay,
+		"max_retries", cfg.MaxRetries,
+		"retry_delay", cfg.RetryDelay,
+		"retry_jitter", cfg.RetryJitter)
+
+	// Validate timeout values are reasonable
+	if err := internal.ValidateTimeout(cfg.APITimeout, cfg.OperationTimeout); err != nil {
+		return err
+	}
+
+	// Validate delay
+	if err := internal.ValidateDelay(cfg.FilterDelay, 30, "filter_delay"); err != nil {
+		return err
+	}
+
+	logger.Debug("configuration validated successfully")
+	return nil
+}
+
+// transport returns the audit transport name for the configured API method
+func (cfg *Config) transport() string {
+	if cfg.UseInsert {
+		return internal.AuditTransportInsert
+	}
+	return internal.AuditTransportImport
+}
@@ -0,0 +1,68 @@
+package gmaildeliver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gmail-api-client/internal"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// DryRun writes a description of how a message would be delivered, without
+// contacting Gmail: the duplicate check and the exact import or insert request
+func (d *Deliverer) DryRun(w io.Writer, rawMessage []byte) error {
+	cfg := d.cfg
+	report := &internal.DryRunReport{}
+	report.Message(rawMessage)
+	duplicate := report.Dedup(&cfg.Common, rawMessage)
+
+	method := cfg.transport()
+
+	if duplicate {
+		fmt.Fprintf(w, "Dry run: message is a duplicate and would not be delivered to %s\n\n", cfg.UserID)
+		report.Print(w, d.logger)
+		return nil
+	}
+
+	// Build the request with the real client, capturing it instead of sending it
+	capture := &internal.CaptureTransport{}
+	service, err := gmail.NewService(context.Background(), d.serviceOptions(&http.Client{Transport: capture})...)
+	if err != nil {
+		return fmt.Errorf("creating Gmail service: %w", err)
+	}
+	message := &gmail.Message{
+		Raw: base64.URLEncoding.EncodeToString(rawMessage),
+	}
+	_, err = d.sendMessage(context.Background(), service, message)
+	if len(capture.Requests) == 0 {
+		return fmt.Errorf("building %s request: %w", method, err)
+	}
+
+	if refs := internal.ReplyReferences(rawMessage); cfg.ThreadReplies && len(refs) > 0 {
+		report.Section("Before delivery")
+		report.Line("search for the thread of %s with rfc822msgid: and set threadId if found", strings.Join(refs, ", "))
+	}
+
+	report.Section(fmt.Sprintf("Request (users.messages.%s)", method))
+	report.Request(capture.Requests[0])
+
+	report.Section("After delivery")
+	report.Line("wait %ds for Gmail filters", cfg.FilterDelay)
+	report.Line("fetch the message's labels with users.messages.get")
+	report.Line("add INBOX and UNREAD if no filter labelled or archived it, otherwise add UNREAD if missing")
+	if internal.DedupUsesIndex(cfg.DedupMode) {
+		report.Line("record the delivery in %s", cfg.DedupIndex)
+	}
+	if cfg.AuditLog != "" {
+		report.Line("append an audit record to %s", cfg.AuditLog)
+	}
+
+	fmt.Fprintf(w, "Dry run: message would be delivered to %s with users.messages.%s; nothing was sent\n\n", cfg.UserID, method)
+	report.Print(w, d.logger)
+	return nil
+}
@@ -0,0 +1,505 @@
+// Package gmaildeliver delivers messages to Gmail with the users.messages
+// import or insert API, as gmail-api-transport does
+//
+// After delivery it waits for Gmail's filters, then adds INBOX and UNREAD
+// unless a filter labelled or archived the message. Retries, duplicate
+// protection, audit records and metrics follow the shared configuration.
+package gmaildeliver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Deliverer delivers messages with the Gmail API
+type Deliverer struct {
+	cfg            *Config
+	logger         *internal.Logger
+	metrics        deliver.Metrics
+	tracerProvider trace.TracerProvider
+}
+
+var _ deliver.Deliverer = (*Deliverer)(nil)
+
+// New validates cfg and returns a Deliverer using it, reporting through
+// telemetry
+func New(cfg *Config, telemetry deliver.Telemetry) (*Deliverer, error) {
+	logger := internal.LoggerForHandler(telemetry.Logger, "gmaildeliver")
+	if err := cfg.validate(logger); err != nil {
+		return nil, err
+	}
+	return &Deliverer{
+		cfg:            cfg,
+		logger:         logger,
+		metrics:        telemetry.Metrics,
+		tracerProvider: telemetry.TracerProvider,
+	}, nil
+}
+
+// Config returns the validated configuration
+func (d *Deliverer) Config() *Config {
+	return d.cfg
+}
+
+// PrepareToken loads the token and refreshes and saves it if it expired
+// Transports call it before reading a message so an authorization problem
+// doesn't lose one
+func (d *Deliverer) PrepareToken() error {
+	return internal.DeliveryError(internal.PrepareToken(d.cfg.CredentialsFile, d.cfg.TokenFile, d.logger, d.metrics))
+}
+
+// serviceOptions returns the client options for a Gmail service using an
+// HTTP client
+func (d *Deliverer) serviceOptions(client *http.Client) []option.ClientOption {
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if d.cfg.APIEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(d.cfg.APIEndpoint))
+	}
+	return opts
+}
+
+// Service creates a Gmail service client, refreshing the token if needed,
+// and returns it with its token source
+func (d *Deliverer) Service() (*gmail.Service, oauth2.TokenSource, error) {
+	d.logger.Debug("creating Gmail API service")
+
+	// Use shared oauth package to handle token refresh
+	_, tokenSource, err := internal.RefreshAndSaveToken(d.cfg.CredentialsFile, d.cfg.TokenFile, d.logger, d.metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create OAuth2 client with background context
+	// The token source handles refresh independently
+	d.logger.Debug("creating OAuth2 HTTP client")
+	client := internal.NewHTTPClient(tokenSource, d.metrics)
+
+	// Create Gmail service with timeout context for API operations
+	// This timeout applies to API calls, not token refresh
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.APITimeout)*time.Second)
+	defer cancel()
+
+	d.logger.Debug("initializing Gmail API service")
+	service, err := gmail.NewService(ctx, d.serviceOptions(client)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating Gmail service: %w", err)
+	}
+	d.logger.Debug("Gmail API service created successfully")
+
+	return service, tokenSource, nil
+}
+
+// saveToken saves the token source's current token if it changed from
+// originalToken
+func (d *Deliverer) saveToken(tokenSource oauth2.TokenSource, originalToken *oauth2.Token) {
+	if token, err := tokenSource.Token(); err == nil {
+		if err := internal.SaveTokenIfChanged(d.cfg.TokenFile, originalToken, token, d.logger); err != nil {
+			d.logger.Warn("failed to save token", "error", err)
+		}
+	}
+}
+
+// TestConnection checks the API connection by calling getLanguage
+func (d *Deliverer) TestConnection(ctx context.Context) (*gmail.LanguageSettings, error) {
+	d.logger.Debug("creating Gmail API service for testing")
+
+	// Load original token to compare later
+	originalToken, err := internal.LoadToken(d.cfg.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading token: %w", err)
+	}
+
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	service, tokenSource, err := d.Service()
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("creating Gmail service: %w", err)
+	}
+	defer d.saveToken(tokenSource, originalToken)
+
+	d.logger.Debug("calling Gmail API users.settings.getLanguage", "user_id", d.cfg.UserID)
+	apiCtx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.APITimeout)*time.Second)
+	defer cancel()
+	langSettings, err := service.Users.Settings.GetLanguage(d.cfg.UserID).Context(apiCtx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("calling getLanguage: %w", err)
+	}
+
+	d.logger.Info("API test successful")
+	return langSettings, nil
+}
+
+// Deliver reads a message and delivers it with the Import or Insert API
+// The returned result describes the delivery even if it failed; errors are
+// *deliver.Error
+func (d *Deliverer) Deliver(ctx context.Context, msg io.Reader, opts deliver.Options) (*deliver.Result, error) {
+	start := time.Now()
+	rawMessage, err := internal.ReadMessage(msg)
+	if err != nil {
+		return nil, internal.DeliveryError(err)
+	}
+
+	record := internal.NewAuditRecord(d.cfg.transport(), rawMessage)
+	record.Sender = opts.Sender
+	record.Recipient = opts.Recipient
+
+	ctx, span := internal.StartRootSpan(ctx, d.tracerProvider, "gmaildeliver.deliver",
+		attribute.String("gmail.user_id", d.cfg.UserID))
+	warning, err := d.deliverMessage(ctx, rawMessage, record, opts)
+	internal.EndSpan(span, err)
+	result := internal.FinishDelivery(&d.cfg.Common, d.logger, d.metrics, d.cfg.UserID, record, start, err)
+	result.Warning = warning
+	return result, internal.DeliveryError(err)
+}
+
+// deliverMessage delivers an email message to Gmail using either Import or Insert API
+// The Gmail IDs, final labels and retry count are filled in on record, and
+// a label modification problem after delivery is returned as a warning
+func (d *Deliverer) deliverMessage(ctx context.Context, rawMessage []byte, record *internal.AuditRecord, opts deliver.Options) (string, error) {
+	cfg := d.cfg
+	logger := d.logger
+	logger.Debug("preparing to deliver message")
+
+	// Load original token to compare later
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("loading token: %w", err)
+	}
+
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	service, tokenSource, err := d.Service()
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		return "", fmt.Errorf("creating Gmail service: %w", err)
+	}
+	defer d.saveToken(tokenSource, originalToken)
+
+	// Skip messages that an earlier, interrupted attempt already delivered
+	var dedupKey string
+	if !opts.SkipDuplicateCheck {
+		dedupCtx, dedupSpan := internal.StartSpan(ctx, "dedup.check", attribute.String("dedup.mode", cfg.DedupMode))
+		var existingID string
+		var found bool
+		dedupKey, existingID, found = d.findDuplicate(dedupCtx, service, rawMessage)
+		dedupSpan.SetAttributes(attribute.Bool("dedup.found", found))
+		dedupSpan.End()
+		if found {
+			logger.Info("message already delivered, skipping import", "gmail_id", existingID)
+			record.Outcome = internal.AuditDuplicate
+			record.GmailID = existingID
+			return "", nil
+		}
+	} else if key, ok := internal.DedupKey(rawMessage); ok {
+		dedupKey = key
+	}
+
+	// Encode message in base64url format (required by Gmail API)
+	logger.Debug("encoding message to base64url", "bytes", len(rawMessage))
+	encodedMessage := base64.URLEncoding.EncodeToString(rawMessage)
+	logger.Debug("message encoded", "encoded_bytes", len(encodedMessage))
+
+	// Create the message object without labels - let Gmail apply filters first
+	message := &gmail.Message{
+		Raw: encodedMessage,
+	}
+
+	var result *gmail.Message
+
+	// Wrap the API call in retry logic
+	retryCfg := internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, d.metrics)
+
+	// Add a reply to the thread of the message it answers
+	if cfg.ThreadReplies {
+		threadID, err := internal.FindThread(ctx, service, cfg.UserID, retryCfg, logger, rawMessage)
+		if err != nil {
+			logger.Warn("failed to find thread, delivering as a new conversation", "error", err)
+		}
+		message.ThreadId = threadID
+	}
+
+	deliverCtx, deliverSpan := internal.StartSpan(ctx, "gmail."+record.Transport)
+	attempt := 0
+	err = internal.RetryOperationContext(deliverCtx, retryCfg, logger, func(ctx context.Context) error {
+		var apiErr error
+		attempt++
+		record.CountAttempt(attempt)
+
+		result, apiErr = d.sendMessage(ctx, service, message)
+		return apiErr
+	}, "message delivery")
+	deliverSpan.SetAttributes(attribute.Int("delivery.attempts", attempt))
+	if err == nil {
+		deliverSpan.SetAttributes(
+			attribute.String("gmail.message_id", result.Id),
+			attribute.String("gmail.thread_id", result.ThreadId))
+	}
+	internal.EndSpan(deliverSpan, err)
+
+	if err != nil {
+		return "", fmt.Errorf("delivering message: %w", err)
+	}
+
+	logger.Info("message delivered successfully",
+		"gmail_id", result.Id,
+		"thread_id", result.ThreadId)
+
+	record.GmailID = result.Id
+	record.ThreadID = result.ThreadId
+	record.Labels = result.LabelIds
+	record.HistoryID = result.HistoryId
+
+	d.recordDelivery(dedupKey, rawMessage, result.Id)
+	if len(result.LabelIds) > 0 {
+		logger.Debug("initial labels", "labels", result.LabelIds)
+	}
+
+	// Wait for Gmail filters to apply (labels may be applied asynchronously)
+	filterDelay := time.Duration(cfg.FilterDelay) * time.Second
+	logger.Debug("waiting for Gmail filters to process", "delay", filterDelay)
+	_, waitSpan := internal.StartSpan(ctx, "filter.wait", attribute.Float64("filter.delay_seconds", filterDelay.Seconds()))
+	if err := (internal.SystemClock{}).Sleep(ctx, filterDelay); err != nil {
+		// The message is already delivered; skip straight to label handling
+		logger.Warn("operation timeout reached while waiting for filters", "error", err)
+		internal.EndSpan(waitSpan, err)
+	} else {
+		waitSpan.End()
+	}
+
+	// Re-fetch the message to get updated labels after filters have run
+	// Wrap in retry logic
+	delivered := result
+	fetchCtx, fetchSpan := internal.StartSpan(ctx, "gmail.refetch")
+	err = internal.RetryOperationContext(fetchCtx, retryCfg, logger, func(ctx context.Context) error {
+		fetched, fetchErr := service.Users.Messages.Get(cfg.UserID, delivered.Id).Format("metadata").Context(ctx).Do()
+		if fetchErr != nil {
+			return fetchErr
+		}
+		result = fetched
+		return nil
+	}, "message re-fetch")
+	internal.EndSpan(fetchSpan, err)
+
+	if err != nil {
+		// Non-fatal: continue even if re-fetch fails
+		logger.Warn("failed to re-fetch message, continuing with original labels", "error", err)
+	} else {
+		logger.Debug("labels after filter processing", "labels", result.LabelIds)
+		record.HistoryID = result.HistoryId
+	}
+
+	// Attempt to apply labels - failures are non-fatal
+	labelCtx, labelSpan := internal.StartSpan(ctx, "gmail.modify_labels")
+	labels, err := d.applyLabels(labelCtx, service, result)
+	labelSpan.SetAttributes(attribute.StringSlice("gmail.labels", labels))
+	internal.EndSpan(labelSpan, err)
+	record.Labels = labels
+	if err != nil {
+		// Log warning but don't fail the delivery
+		logger.Warn("label modification had issues", "error", err)
+		return fmt.Sprintf("Message delivered but label modification failed: %v", err), nil
+	}
+
+	return "", nil
+}
+
+// sendMessage makes a single users.messages.import or users.messages.insert
+// call for a message
+func (d *Deliverer) sendMessage(ctx context.Context, service *gmail.Service, message *gmail.Message) (*gmail.Message, error) {
+	cfg := d.cfg
+	if cfg.UseInsert {
+		// Use Insert API - bypasses most scanning and classification (like IMAP APPEND)
+		d.logger.Debug("calling Gmail API users.messages.insert", "user_id", cfg.UserID)
+		d.logger.Info("using Insert API (bypasses scanning)")
+
+		call := service.Users.Messages.Insert(cfg.UserID, message).
+			InternalDateSource("dateHeader").
+			Context(ctx)
+
+		return call.Do()
+	}
+
+	// Use Import API - performs standard email delivery scanning and classification
+	d.logger.Debug("calling Gmail API users.messages.import", "user_id", cfg.UserID)
+	if cfg.NotSpam {
+		d.logger.Info("using Import API with neverMarkSpam=true")
+	} else {
+		d.logger.Info("using Import API (standard delivery)")
+	}
+
+	call := service.Users.Messages.Import(cfg.UserID, message).
+		InternalDateSource("dateHeader").
+		Context(ctx)
+
+	if cfg.NotSpam {
+		call = call.NeverMarkSpam(true)
+	}
+
+	return call.Do()
+}
+
+// applyLabels applies INBOX and UNREAD labels as needed
+// It returns the message's labels after any modification
+func (d *Deliverer) applyLabels(ctx context.Context, service *gmail.Service, result *gmail.Message) ([]string, error) {
+	cfg := d.cfg
+	logger := d.logger
+
+	// Check if Gmail applied any user labels (from filters)
+	// If not, add INBOX label so message appears in inbox
+	hasUserLabel := false
+	for _, label := range result.LabelIds {
+		// System labels start with uppercase, user labels are IDs
+		// Check for common system labels
+		if label != "UNREAD" && label != "IMPORTANT" && label != "CATEGORY_PERSONAL" &&
+			label != "CATEGORY_SOCIAL" && label != "CATEGORY_PROMOTIONS" &&
+			label != "CATEGORY_UPDATES" && label != "CATEGORY_FORUMS" {
+			hasUserLabel = true
+			break
+		}
+	}
+
+	// If no user labels and not already in INBOX, add INBOX label
+	hasInbox := false
+	for _, label := range result.LabelIds {
+		if label == "INBOX" {
+			hasInbox = true
+			break
+		}
+	}
+
+	retryCfg := internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, d.metrics)
+	labels := result.LabelIds
+
+	if !hasUserLabel && !hasInbox {
+		logger.Debug("no user labels applied, adding INBOX label")
+		// Add INBOX and UNREAD labels to the message with retry logic
+		err := internal.RetryOperationContext(ctx, retryCfg, logger, func(ctx context.Context) error {
+			modifyReq := &gmail.ModifyMessageRequest{
+				AddLabelIds: []string{"INBOX", "UNREAD"},
+			}
+			modified, modifyErr := service.Users.Messages.Modify(cfg.UserID, result.Id, modifyReq).Context(ctx).Do()
+			if modifyErr != nil {
+				return modifyErr
+			}
+			labels = modified.LabelIds
+			return nil
+		}, "add INBOX and UNREAD labels")
+
+		if err != nil {
+			return labels, fmt.Errorf("failed to add INBOX and UNREAD labels: %w", err)
+		}
+		logger.Debug("INBOX and UNREAD labels added successfully")
+	} else {
+		// Even if message has labels or is in INBOX, ensure it's marked UNREAD
+		hasUnread := false
+		for _, label := range result.LabelIds {
+			if label == "UNREAD" {
+				hasUnread = true
+				break
+			}
+		}
+
+		if !hasUnread {
+			logger.Debug("adding UNREAD label")
+			err := internal.RetryOperationContext(ctx, retryCfg, logger, func(ctx context.Context) error {
+				modifyReq := &gmail.ModifyMessageRequest{
+					AddLabelIds: []string{"UNREAD"},
+				}
+				modified, modifyErr := service.Users.Messages.Modify(cfg.UserID, result.Id, modifyReq).Context(ctx).Do()
+				if modifyErr != nil {
+					return modifyErr
+				}
+				labels = modified.LabelIds
+				return nil
+			}, "add UNREAD label")
+
+			if err != nil {
+				return labels, fmt.Errorf("failed to add UNREAD label: %w", err)
+			}
+			logger.Debug("UNREAD label added successfully")
+		}
+	}
+
+	return labels, nil
+}
+
+// findDuplicate checks whether a message has already been delivered, using the
+// local delivered index and/or a mailbox search depending on dedup_mode
+// Lookup failures are logged and treated as "not found" so delivery proceeds
+func (d *Deliverer) findDuplicate(ctx context.Context, service *gmail.Service, rawMessage []byte) (string, string, bool) {
+	cfg := d.cfg
+	logger := d.logger
+	if cfg.DedupMode == internal.DedupOff {
+		return "", "", false
+	}
+
+	dedupKey, ok := internal.DedupKey(rawMessage)
+	if !ok {
+		logger.Debug("message has no Message-ID, skipping duplicate check")
+		return "", "", false
+	}
+
+	if internal.DedupUsesIndex(cfg.DedupMode) {
+		index := internal.NewDeliveredIndex(cfg.DedupIndex, time.Duration(cfg.DedupExpiry)*time.Hour, nil)
+		existingID, found, err := index.Lookup(dedupKey)
+		if err != nil {
+			logger.Warn("failed to check delivered index", "error", err)
+		} else if found {
+			return dedupKey, existingID, true
+		}
+	}
+
+	if internal.DedupUsesSearch(cfg.DedupMode) {
+		query := "rfc822msgid:" + internal.MessageID(rawMessage)
+		logger.Debug("searching mailbox for existing message", "query", query)
+
+		var existingID string
+		retryCfg := internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, d.metrics)
+		err := internal.RetryOperationContext(ctx, retryCfg, logger, func(ctx context.Context) error {
+			resp, listErr := service.Users.Messages.List(cfg.UserID).
+				Q(query).
+				IncludeSpamTrash(true).
+				MaxResults(1).
+				Context(ctx).
+				Do()
+			if listErr != nil {
+				return listErr
+			}
+			if len(resp.Messages) > 0 {
+				existingID = resp.Messages[0].Id
+			}
+			return nil
+		}, "duplicate search")
+		if err != nil {
+			logger.Warn("failed to search for duplicate message", "error", err)
+		} else if existingID != "" {
+			return dedupKey, existingID, true
+		}
+	}
+
+	return dedupKey, "", false
+}
+
+// recordDelivery adds a delivered message to the local delivered index
+// Failures are logged but don't affect the delivery result
+func (d *Deliverer) recordDelivery(dedupKey string, rawMessage []byte, gmailID string) {
+	if dedupKey == "" || !internal.DedupUsesIndex(d.cfg.DedupMode) {
+		return
+	}
+	index := internal.NewDeliveredIndex(d.cfg.DedupIndex, time.Duration(d.cfg.DedupExpiry)*time.Hour, nil)
+	if err := index.Add(dedupKey, internal.MessageID(rawMessage), gmailID); err != nil {
+		d.logger.Warn("failed to record delivery in index", "error", err)
+	}
+}
@@ -0,0 +1,312 @@
+package gmaildeliver_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/internal/fakegmail"
+	"gmail-api-client/internal/fakeoauth"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"Message-ID: <report@example.com>\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"The report is attached.\r\n"
+
+// testConfig returns a configuration for the fake server api with one retry
+// and a one second filter delay, and the token endpoint of its token, which
+// has expired if expired is set
+func testConfig(t *testing.T, api *fakegmail.Server, expired bool) (*gmaildeliver.Config, *fakeoauth.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	tokens := fakeoauth.New()
+	t.Cleanup(tokens.Close)
+
+	cfg := &gmaildeliver.Config{
+		Common: deliver.Common{
+			CredentialsFile: filepath.Join(dir, "credentials.json"),
+			TokenFile:       filepath.Join(dir, "token.json"),
+			MaxRetries:      1,
+		},
+		FilterDelay: 1,
+		APIEndpoint: api.Endpoint(),
+	}
+	if err := tokens.WriteCredentials(cfg.CredentialsFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.WriteToken(cfg.TokenFile, expired); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, tokens
+}
+
+// newDeliverer returns a Deliverer for the fake server api using testConfig
+// with a valid token, changed by configure if not nil
+func newDeliverer(t *testing.T, api *fakegmail.Server, configure func(*gmaildeliver.Config)) *gmaildeliver.Deliverer {
+	t.Helper()
+	cfg, _ := testConfig(t, api, false)
+	if configure != nil {
+		configure(cfg)
+	}
+	deliverer, err := gmaildeliver.New(cfg, deliver.Telemetry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliverer
+}
+
+// deliverTest delivers testMessage
+func deliverTest(t *testing.T, deliverer *gmaildeliver.Deliverer) (*deliver.Result, error) {
+	t.Helper()
+	return deliverer.Deliver(context.Background(), strings.NewReader(testMessage), deliver.Options{
+		Sender:    "alice@example.com",
+		Recipient: "user@example.com",
+	})
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	deliverer := newDeliverer(t, api, nil)
+
+	result, err := deliverTest(t, deliverer)
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if result.Status != deliver.StatusDelivered || result.Transport != internal.AuditTransportImport {
+		t.Errorf("result = %+v, want delivered by import", result)
+	}
+	if result.Attempts != 1 || result.Warning != "" {
+		t.Errorf("result = %+v, want one attempt and no warning", result)
+	}
+
+	msg, ok := api.Message(result.GmailID)
+	if !ok {
+		t.Fatalf("message %s not in the mailbox", result.GmailID)
+	}
+	if result.ThreadID != msg.ThreadId {
+		t.Errorf("thread ID = %q, want %q", result.ThreadID, msg.ThreadId)
+	}
+	// Nothing filtered the message, so it goes to the inbox unread
+	for _, label := range []string{"INBOX", "UNREAD"} {
+		if !slices.Contains(msg.LabelIds, label) || !slices.Contains(result.Labels, label) {
+			t.Errorf("labels = %v in the mailbox, %v in the result; want %s", msg.LabelIds, result.Labels, label)
+		}
+	}
+
+	var imported bool
+	for _, req := range api.Requests() {
+		if req.Method == "users.messages.import" {
+			imported = true
+			if !strings.Contains(req.Query, "internalDateSource=dateHeader") {
+				t.Errorf("import query = %q, want internalDateSource=dateHeader", req.Query)
+			}
+		}
+	}
+	if !imported {
+		t.Error("users.messages.import not called")
+	}
+	if n := api.CountRequests("users.messages.modify"); n != 1 {
+		t.Errorf("users.messages.modify called %d times, want 1", n)
+	}
+}
+
+func TestDeliverInsert(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	deliverer := newDeliverer(t, api, func(cfg *gmaildeliver.Config) {
+		cfg.UseInsert = true
+	})
+
+	result, err := deliverTest(t, deliverer)
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if result.Transport != internal.AuditTransportInsert {
+		t.Errorf("transport = %q, want %q", result.Transport, internal.AuditTransportInsert)
+	}
+	if api.CountRequests("users.messages.insert") != 1 || api.CountRequests("users.messages.import") != 0 {
+		t.Error("want one users.messages.insert call and no import")
+	}
+}
+
+func TestDeliverFilterLabels(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		// delay is how long after delivery the filter runs
+		delay time.Duration
+		// inbox is whether the message should end up in the inbox
+		inbox bool
+	}{
+		{"filter runs during the filter delay", 200 * time.Millisecond, false},
+		{"filter runs at delivery", 0, false},
+		{"filter runs after the filter delay", 5 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			api := fakegmail.New()
+			defer api.Close()
+			label := api.CreateLabel("Reports")
+			api.AddFilter(fakegmail.Filter{Match: "Subject: Quarterly", AddLabels: []string{label.Id}, Delay: tt.delay})
+			deliverer := newDeliverer(t, api, nil)
+
+			result, err := deliverTest(t, deliverer)
+			if err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+			if got := slices.Contains(result.Labels, "INBOX"); got != tt.inbox {
+				t.Errorf("labels = %v, want INBOX %v", result.Labels, tt.inbox)
+			}
+			if !tt.inbox && !slices.Contains(result.Labels, label.Id) {
+				t.Errorf("labels = %v, want the filter's label %s", result.Labels, label.Id)
+			}
+			if !slices.Contains(result.Labels, "UNREAD") {
+				t.Errorf("labels = %v, want UNREAD", result.Labels)
+			}
+			if n := api.CountRequests("users.messages.get"); n != 1 {
+				t.Errorf("users.messages.get called %d times, want one re-fetch after the filter delay", n)
+			}
+		})
+	}
+}
+
+func TestDeliverFaults(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		fault fakegmail.Fault
+		// wantAttempts is the number of import calls
+		wantAttempts int
+		wantStatus   string
+		// wantTemporary is whether a failure should be retried later
+		wantTemporary bool
+	}{
+		{
+			name:         "rate limited once",
+			fault:        fakegmail.Fault{Method: "users.messages.import", Status: 429, Reason: "rateLimitExceeded", Times: 1},
+			wantAttempts: 2,
+			wantStatus:   deliver.StatusDelivered,
+		},
+		{
+			name:         "server error once",
+			fault:        fakegmail.Fault{Method: "users.messages.import", Status: 503, Times: 1},
+			wantAttempts: 2,
+			wantStatus:   deliver.StatusDelivered,
+		},
+		{
+			name:          "server errors until retries run out",
+			fault:         fakegmail.Fault{Method: "users.messages.import", Status: 500},
+			wantAttempts:  2,
+			wantStatus:    deliver.StatusDeferred,
+			wantTemporary: true,
+		},
+		{
+			name:          "daily limit",
+			fault:         fakegmail.Fault{Method: "users.messages.import", Status: 403, Reason: "dailyLimitExceeded"},
+			wantAttempts:  1,
+			wantStatus:    deliver.StatusDeferred,
+			wantTemporary: true,
+		},
+		{
+			name:         "rejected",
+			fault:        fakegmail.Fault{Method: "users.messages.import", Status: 400, Reason: "invalidArgument"},
+			wantAttempts: 1,
+			wantStatus:   deliver.StatusFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			api := fakegmail.New()
+			defer api.Close()
+			api.InjectFault(tt.fault)
+			deliverer := newDeliverer(t, api, nil)
+
+			result, err := deliverTest(t, deliverer)
+			if n := api.CountRequests("users.messages.import"); n != tt.wantAttempts {
+				t.Errorf("users.messages.import called %d times, want %d", n, tt.wantAttempts)
+			}
+			if result.Status != tt.wantStatus || result.Attempts != tt.wantAttempts {
+				t.Errorf("result = %+v, want status %s after %d attempts", result, tt.wantStatus, tt.wantAttempts)
+			}
+
+			if tt.wantStatus == deliver.StatusDelivered {
+				if err != nil {
+					t.Fatalf("Deliver: %v", err)
+				}
+				if len(api.Messages()) != 1 {
+					t.Errorf("mailbox has %d messages, want 1", len(api.Messages()))
+				}
+				return
+			}
+			var deliverErr *deliver.Error
+			if !errors.As(err, &deliverErr) {
+				t.Fatalf("error = %v, want a *deliver.Error", err)
+			}
+			if deliver.Temporary(err) != tt.wantTemporary {
+				t.Errorf("Temporary(%v) = %v, want %v", err, deliver.Temporary(err), tt.wantTemporary)
+			}
+			if result.Error == "" {
+				t.Error("failed result has no error")
+			}
+			if len(api.Messages()) != 0 {
+				t.Errorf("mailbox has %d messages, want none", len(api.Messages()))
+			}
+		})
+	}
+}
+
+func TestDeliverLabelFailure(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	api.InjectFault(fakegmail.Fault{Method: "users.messages.modify", Status: 500})
+	deliverer := newDeliverer(t, api, nil)
+
+	// The message is in the mailbox, so a label problem only warns
+	result, err := deliverTest(t, deliverer)
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if result.Status != deliver.StatusDelivered {
+		t.Errorf("status = %q, want delivered", result.Status)
+	}
+	if !strings.Contains(result.Warning, "label modification failed") {
+		t.Errorf("warning = %q, want a label modification warning", result.Warning)
+	}
+	if n := api.CountRequests("users.messages.modify"); n != 2 {
+		t.Errorf("users.messages.modify called %d times, want 2", n)
+	}
+}
+
+func TestDeliverEmptyMessage(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	deliverer := newDeliverer(t, api, nil)
+
+	_, err := deliverer.Deliver(context.Background(), strings.NewReader(""), deliver.Options{})
+	if !errors.Is(err, deliver.ErrEmptyMessage) {
+		t.Fatalf("error = %v, want ErrEmptyMessage", err)
+	}
+	if len(api.Requests()) != 0 {
+		t.Errorf("made %d API requests for an empty message", len(api.Requests()))
+	}
+}
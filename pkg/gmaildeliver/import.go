@@ -0,0 +1,96 @@
+package gmaildeliver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/gmail/v1"
+)
+
+// ImportOptions control the import of one message from a local mail store
+type ImportOptions struct {
+	// LabelIDs are the labels the message gets, such as INBOX, UNREAD or a
+	// user label ID; unlike Deliver, nothing else is added afterwards
+	LabelIDs []string
+}
+
+// Import imports a message with the labels given, using a service from
+// Service so a bulk import shares one client and token
+// Unlike Deliver it doesn't wait for filters or add INBOX and UNREAD; the
+// labels are set in the import call itself. Duplicate checks, threading,
+// retries and audit records follow the configuration as for Deliver
+func (d *Deliverer) Import(ctx context.Context, service *gmail.Service, rawMessage []byte, opts ImportOptions) (*deliver.Result, error) {
+	start := time.Now()
+	record := internal.NewAuditRecord(d.cfg.transport(), rawMessage)
+	ctx, span := internal.StartRootSpan(ctx, d.tracerProvider, "gmaildeliver.import",
+		attribute.String("gmail.user_id", d.cfg.UserID))
+	err := d.importMessage(ctx, service, rawMessage, record, opts)
+	internal.EndSpan(span, err)
+	result := internal.FinishDelivery(&d.cfg.Common, d.logger, d.metrics, d.cfg.UserID, record, start, err)
+	return result, internal.DeliveryError(err)
+}
+
+// importMessage imports a message, filling in its audit record
+func (d *Deliverer) importMessage(ctx context.Context, service *gmail.Service, rawMessage []byte, record *internal.AuditRecord, opts ImportOptions) error {
+	cfg := d.cfg
+	logger := d.logger
+	if len(rawMessage) == 0 {
+		return internal.ErrEmptyMessage
+	}
+
+	dedupCtx, dedupSpan := internal.StartSpan(ctx, "dedup.check", attribute.String("dedup.mode", cfg.DedupMode))
+	dedupKey, existingID, found := d.findDuplicate(dedupCtx, service, rawMessage)
+	dedupSpan.SetAttributes(attribute.Bool("dedup.found", found))
+	dedupSpan.End()
+	if found {
+		logger.Info("message already imported, skipping", "gmail_id", existingID)
+		record.Outcome = internal.AuditDuplicate
+		record.GmailID = existingID
+		return nil
+	}
+
+	message := &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(rawMessage),
+		LabelIds: opts.LabelIDs,
+	}
+	retryCfg := internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, d.metrics)
+
+	if cfg.ThreadReplies {
+		threadID, err := internal.FindThread(ctx, service, cfg.UserID, retryCfg, logger, rawMessage)
+		if err != nil {
+			logger.Warn("failed to find thread, importing as a new conversation", "error", err)
+		}
+		message.ThreadId = threadID
+	}
+
+	importCtx, importSpan := internal.StartSpan(ctx, "gmail."+record.Transport,
+		attribute.StringSlice("gmail.labels", opts.LabelIDs))
+	var result *gmail.Message
+	attempt := 0
+	err := internal.RetryOperationContext(importCtx, retryCfg, logger, func(ctx context.Context) error {
+		var apiErr error
+		attempt++
+		record.CountAttempt(attempt)
+		result, apiErr = d.sendMessage(ctx, service, message)
+		return apiErr
+	}, "message import")
+	importSpan.SetAttributes(attribute.Int("delivery.attempts", attempt))
+	internal.EndSpan(importSpan, err)
+	if err != nil {
+		return fmt.Errorf("importing message: %w", err)
+	}
+
+	logger.Debug("message imported", "gmail_id", result.Id, "thread_id", result.ThreadId)
+	record.GmailID = result.Id
+	record.ThreadID = result.ThreadId
+	record.Labels = result.LabelIds
+	record.HistoryID = result.HistoryId
+	d.recordDelivery(dedupKey, rawMessage, result.Id)
+	return nil
+}
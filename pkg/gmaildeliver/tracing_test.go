@@ -0,0 +1,160 @@
+package gmaildeliver_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"gmail-api-client/internal/fakegmail"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttr returns the value of a span attribute
+func spanAttr(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestDeliverSpans(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	// An expired token makes the delivery refresh it first
+	cfg, tokens := testConfig(t, api, true)
+	deliverer, err := gmaildeliver.New(cfg, deliver.Telemetry{TracerProvider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := deliverer.Deliver(context.Background(), strings.NewReader(testMessage), deliver.Options{})
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if tokens.Refreshes() != 1 {
+		t.Errorf("token refreshed %d times, want 1", tokens.Refreshes())
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	root, ok := byName["gmaildeliver.deliver"]
+	if !ok {
+		t.Fatalf("no gmaildeliver.deliver span in %d spans", len(spans))
+	}
+	if root.Parent.IsValid() {
+		t.Error("gmaildeliver.deliver has a parent, want a root span")
+	}
+	if v, _ := spanAttr(root, "gmail.user_id"); v.AsString() != "me" {
+		t.Errorf("gmail.user_id = %q, want me", v.AsString())
+	}
+
+	// The steps of the delivery, in order, each a child of the root span
+	steps := []string{"token.refresh", "dedup.check", "gmail.import", "filter.wait", "gmail.refetch", "gmail.modify_labels"}
+	var previous tracetest.SpanStub
+	for i, name := range steps {
+		span, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%s is not a child of gmaildeliver.deliver", name)
+		}
+		if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("%s is in another trace", name)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("%s has error status: %s", name, span.Status.Description)
+		}
+		if i > 0 && span.StartTime.Before(previous.EndTime) {
+			t.Errorf("%s started before %s ended", name, previous.Name)
+		}
+		previous = span
+	}
+
+	// The API call and its attributes
+	imported := byName["gmail.import"]
+	if v, _ := spanAttr(imported, "delivery.attempts"); v.AsInt64() != 1 {
+		t.Errorf("delivery.attempts = %d, want 1", v.AsInt64())
+	}
+	if v, _ := spanAttr(imported, "gmail.message_id"); v.AsString() != result.GmailID {
+		t.Errorf("gmail.message_id = %q, want %q", v.AsString(), result.GmailID)
+	}
+	if v, _ := spanAttr(imported, "gmail.thread_id"); v.AsString() != result.ThreadID {
+		t.Errorf("gmail.thread_id = %q, want %q", v.AsString(), result.ThreadID)
+	}
+	var httpChild bool
+	for _, span := range spans {
+		if span.Parent.SpanID() == imported.SpanContext.SpanID() {
+			httpChild = true
+		}
+	}
+	if !httpChild {
+		t.Error("gmail.import has no HTTP client span")
+	}
+
+	// Label application
+	if v, _ := spanAttr(byName["dedup.check"], "dedup.found"); v.AsBool() {
+		t.Error("dedup.found = true for a new message")
+	}
+	if v, _ := spanAttr(byName["filter.wait"], "filter.delay_seconds"); v.AsFloat64() != 1 {
+		t.Errorf("filter.delay_seconds = %v, want 1", v.AsFloat64())
+	}
+	labels, _ := spanAttr(byName["gmail.modify_labels"], "gmail.labels")
+	for _, label := range []string{"INBOX", "UNREAD"} {
+		if !slices.Contains(labels.AsStringSlice(), label) {
+			t.Errorf("gmail.labels = %v, want %s", labels.AsStringSlice(), label)
+		}
+	}
+}
+
+func TestDeliverSpanError(t *testing.T) {
+	t.Parallel()
+	api := fakegmail.New()
+	defer api.Close()
+	api.InjectFault(fakegmail.Fault{Method: "users.messages.import", Status: 400, Reason: "invalidArgument"})
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	cfg, _ := testConfig(t, api, false)
+	deliverer, err := gmaildeliver.New(cfg, deliver.Telemetry{TracerProvider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deliverer.Deliver(context.Background(), strings.NewReader(testMessage), deliver.Options{}); err == nil {
+		t.Fatal("Deliver succeeded, want an error")
+	}
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+		switch span.Name {
+		case "gmail.import", "gmaildeliver.deliver":
+			if span.Status.Code != codes.Error {
+				t.Errorf("%s status = %v, want error", span.Name, span.Status.Code)
+			}
+		case "filter.wait", "gmail.refetch", "gmail.modify_labels":
+			t.Errorf("%s span after a failed import", span.Name)
+		}
+	}
+	if !slices.Contains(names, "gmail.import") {
+		t.Errorf("spans = %v, want gmail.import", names)
+	}
+}
@@ -0,0 +1,79 @@
+package gmailsend
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+)
+
+// Config holds the configuration of sending
+type Config struct {
+	deliver.Common
+	// API call timeout in seconds (default: 30)
+	APITimeout int `json:"api_timeout" help:"Timeout for individual API calls in seconds" default:"30"`
+	// Overall operation timeout in seconds (default: 120)
+	OperationTimeout int `json:"operation_timeout" help:"Overall timeout in seconds, including retries" default:"120"`
+	// Add replies to the Gmail thread of the message they answer
+	ThreadReplies bool `json:"thread_replies" help:"Add replies to the Gmail thread of the message they answer"`
+	// Gmail API base URL override, e.g. a fake server in integration tests
+	APIEndpoint string `json:"api_endpoint" help:"Gmail API base URL override, for testing against a fake server"`
+	// Addresses for local recipients without a domain, such as root
+	Aliases map[string]string `json:"aliases" help:"Addresses for local recipients without a domain, e.g. root=admin@example.com"`
+	// Domain added to other local recipients without a domain
+	DefaultDomain string `json:"default_domain" help:"Domain added to local recipients without a domain that have no alias"`
+}
+
+// addresses returns how the configuration resolves local recipients
+func (cfg *Config) addresses() Addresses {
+	return Addresses{Aliases: cfg.Aliases, DefaultDomain: cfg.DefaultDomain}
+}
+
+// Validate checks the configuration and fills in defaults
+func (cfg *Config) Validate() error {
+	return cfg.validate(internal.LoggerForHandler(nil, ""))
+}
+
+// validate checks the configuration and fills in defaults, logging the
+// values used
+func (cfg *Config) validate(logger *internal.Logger) error {
+	logger.Debug("validating configuration")
+
+	if cfg.UserID == "" {
+		cfg.UserID = "me"
+		logger.Debug("using default user ID", "user_id", "me")
+	}
+
+	// Validate common fields
+	if err := internal.ValidateCommon(&cfg.Common); err != nil {
+		return err
+	}
+
+	// Set timeout defaults if not specified
+	internal.SetDefaults(&cfg.APITimeout, 30)
+	internal.SetDefaults(&cfg.OperationTimeout, 120)
+
+	if err := internal.ValidateTimeout(cfg.APITimeout, cfg.OperationTimeout); err != nil {
+		return err
+	}
+
+	for name, address := range cfg.Aliases {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid address %q for alias %q: %w", address, name, err)
+		}
+	}
+	if strings.ContainsAny(cfg.DefaultDomain, "@ <>,") {
+		return fmt.Errorf("invalid default_domain %q (expected a domain such as example.com)", cfg.DefaultDomain)
+	}
+
+	// Each sendmail invocation is a new message, so there is nothing to
+	// deduplicate against
+	if cfg.DedupMode != internal.DedupOff {
+		return fmt.Errorf("dedup_mode %q is not supported when sending (use \"off\")", cfg.DedupMode)
+	}
+
+	logger.Debug("configuration validated successfully")
+	return nil
+}
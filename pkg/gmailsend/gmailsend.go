@@ -0,0 +1,207 @@
+// Package gmailsend sends outbound mail through a Gmail account with
+// users.messages.send, for hosts without SMTP egress
+//
+// Gmail sends to the addresses in the message's To, Cc and Bcc headers, so
+// Send first rewrites the message to match the envelope recipients the way
+// sendmail would deliver it. Retries, audit records and metrics follow the
+// shared configuration.
+package gmailsend
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/gmaildeliver"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Options describe the envelope of one message, as sendmail's command line
+// does
+type Options struct {
+	// From is the envelope sender (sendmail -f), recorded in the audit log
+	// and used for a From header if the message has none; Gmail only sends
+	// as the account or its verified send-as aliases
+	From string
+	// FromName is the full name for an added From header (sendmail -F)
+	FromName string
+	// Recipients are the envelope recipients
+	Recipients []string
+	// ExtractRecipients also sends to the To, Cc and Bcc addresses in the
+	// message (sendmail -t)
+	ExtractRecipients bool
+}
+
+// Sender sends messages with the Gmail API
+type Sender struct {
+	cfg            *Config
+	api            *gmaildeliver.Deliverer
+	logger         *internal.Logger
+	metrics        deliver.Metrics
+	tracerProvider trace.TracerProvider
+}
+
+// New validates cfg and returns a Sender using it, reporting through
+// telemetry
+func New(cfg *Config, telemetry deliver.Telemetry) (*Sender, error) {
+	logger := internal.LoggerForHandler(telemetry.Logger, "gmailsend")
+	if err := cfg.validate(logger); err != nil {
+		return nil, err
+	}
+	// The Gmail service is created the same way as for delivery, logging
+	// through the same logger
+	api, err := gmaildeliver.New(&gmaildeliver.Config{
+		Common:           cfg.Common,
+		APITimeout:       cfg.APITimeout,
+		OperationTimeout: cfg.OperationTimeout,
+		APIEndpoint:      cfg.APIEndpoint,
+	}, deliver.Telemetry{Logger: logger.Handler(), Metrics: telemetry.Metrics})
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{
+		cfg:            cfg,
+		api:            api,
+		logger:         logger,
+		metrics:        telemetry.Metrics,
+		tracerProvider: telemetry.TracerProvider,
+	}, nil
+}
+
+// Config returns the validated configuration
+func (s *Sender) Config() *Config {
+	return s.cfg
+}
+
+// PrepareToken loads the token and refreshes and saves it if it expired
+// Programs call it before reading a message so an authorization problem
+// doesn't lose one
+func (s *Sender) PrepareToken() error {
+	return s.api.PrepareToken()
+}
+
+// Send reads a message and sends it to the recipients opts describe
+// The returned result describes the attempt even if it failed; errors are
+// *deliver.Error
+func (s *Sender) Send(ctx context.Context, msg io.Reader, opts Options) (*deliver.Result, error) {
+	start := time.Now()
+	rawMessage, err := internal.ReadMessage(msg)
+	if err != nil {
+		return nil, internal.DeliveryError(err)
+	}
+
+	record := internal.NewAuditRecord(internal.AuditTransportSend, rawMessage)
+	record.Sender = opts.From
+
+	ctx, span := internal.StartRootSpan(ctx, s.tracerProvider, "gmailsend.send",
+		attribute.String("gmail.user_id", s.cfg.UserID))
+	prepared, recipients, err := PrepareMessage(rawMessage, opts, s.cfg.addresses())
+	if err == nil {
+		record.Recipient = strings.Join(recipients, ", ")
+		s.logger.Debug("sending message", "recipients", recipients)
+		err = s.sendMessage(ctx, prepared, record)
+	}
+	internal.EndSpan(span, err)
+	result := internal.FinishDelivery(&s.cfg.Common, s.logger, s.metrics, s.cfg.UserID, record, start, err)
+	return result, internal.DeliveryError(err)
+}
+
+// sendMessage makes the users.messages.send call, retrying transient
+// failures until the request reaches Gmail; after that only rejections are
+// retried, and a lost answer or server error is a temporary failure left to
+// the caller, so the message isn't sent twice
+// The Gmail IDs, labels and retry count are filled in on record
+func (s *Sender) sendMessage(ctx context.Context, rawMessage []byte, record *internal.AuditRecord) error {
+	cfg := s.cfg
+
+	// Load original token to compare later
+	originalToken, err := internal.LoadToken(cfg.TokenFile)
+	if err != nil {
+		return fmt.Errorf("loading token: %w", err)
+	}
+
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	service, tokenSource, err := s.api.Service()
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		return fmt.Errorf("creating Gmail service: %w", err)
+	}
+	defer func() {
+		if token, err := tokenSource.Token(); err == nil {
+			if err := internal.SaveTokenIfChanged(cfg.TokenFile, originalToken, token, s.logger); err != nil {
+				s.logger.Warn("failed to save token", "error", err)
+			}
+		}
+	}()
+
+	message := &gmail.Message{
+		Raw: base64.URLEncoding.EncodeToString(rawMessage),
+	}
+	retryCfg := internal.NewRetryConfig(&cfg.Common, time.Duration(cfg.APITimeout)*time.Second, s.metrics)
+
+	// Send a reply in the thread of the message it answers
+	if cfg.ThreadReplies {
+		threadID, err := internal.FindThread(ctx, service, cfg.UserID, retryCfg, s.logger, rawMessage)
+		if err != nil {
+			s.logger.Warn("failed to find thread, sending as a new conversation", "error", err)
+		}
+		message.ThreadId = threadID
+	}
+
+	var result *gmail.Message
+	sendCtx, sendSpan := internal.StartSpan(ctx, "gmail.send")
+	attempt := 0
+	err = internal.RetryOperationContext(sendCtx, retryCfg, s.logger, func(ctx context.Context) error {
+		var apiErr error
+		attempt++
+		record.CountAttempt(attempt)
+
+		// Sending isn't idempotent: once the request has gone out, only a
+		// rejection is known not to have sent the message
+		var wrote atomic.Bool
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					wrote.Store(true)
+				}
+			},
+		})
+
+		s.logger.Debug("calling Gmail API users.messages.send", "user_id", cfg.UserID)
+		result, apiErr = service.Users.Messages.Send(cfg.UserID, message).Context(ctx).Do()
+		if apiErr == nil || !wrote.Load() || isRejection(apiErr) {
+			return apiErr
+		}
+		return &internal.TempFailError{Reason: "may have been sent", Err: apiErr}
+	}, "message send")
+	sendSpan.SetAttributes(attribute.Int("delivery.attempts", attempt))
+	internal.EndSpan(sendSpan, err)
+	if err != nil {
+		return fmt.Errorf("sending message: %w", err)
+	}
+
+	s.logger.Info("message sent successfully", "gmail_id", result.Id, "thread_id", result.ThreadId)
+	record.GmailID = result.Id
+	record.ThreadID = result.ThreadId
+	record.Labels = result.LabelIds
+	return nil
+}
+
+// isRejection reports whether Gmail answered a send with a client error
+// such as a rate limit, which means the message wasn't sent
+func isRejection(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code >= 400 && apiErr.Code < 500
+}
@@ -0,0 +1,326 @@
+package gmailsend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// ErrNoRecipients is returned when a message has no one to send it to
+var ErrNoRecipients = errors.New("no recipients")
+
+// headerField is one header field with its continuation lines, as written
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// PrepareMessage rewrites a message so that Gmail, which sends to the
+// addresses in its To, Cc and Bcc headers, sends it to the envelope
+// recipients opts describe, and returns it with the addresses Gmail will
+// send it to
+//
+// Recipients that aren't in To or Cc are added to Bcc, which Gmail removes
+// from the copies it delivers. Without ExtractRecipients any Bcc header is
+// dropped and To and Cc are left as written, even if they can't be parsed;
+// Gmail can't be told to skip an address, so it also sends to those that
+// aren't recipients. Local names without a domain, such as root, are
+// resolved with addresses, in the recipients given and, with
+// ExtractRecipients, in To, Cc and Bcc, whose fields are rewritten with the
+// result. A From header is added from opts.From if the message has none.
+func PrepareMessage(raw []byte, opts Options, addresses Addresses) ([]byte, []string, error) {
+	header, body := splitHeader(raw)
+	fields := parseHeader(header)
+	newline := "\n"
+	if bytes.Contains(header, []byte("\r\n")) || (len(header) == 0 && bytes.Contains(body, []byte("\r\n"))) {
+		newline = "\r\n"
+	}
+
+	// Only recipients taken from the header must be valid
+	var visible, bcc []string
+	if opts.ExtractRecipients {
+		var err error
+		if visible, err = headerAddresses(fields, addresses, newline, "To", "Cc"); err != nil {
+			return nil, nil, err
+		}
+		if bcc, err = headerAddresses(fields, addresses, newline, "Bcc"); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		visible = writtenAddresses(fields, "To", "Cc")
+	}
+	var given []string
+	for _, recipient := range opts.Recipients {
+		list, _, err := addresses.ParseList(recipient)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		for _, address := range list {
+			given = append(given, address.Address)
+		}
+	}
+
+	var recipients []string
+	if opts.ExtractRecipients {
+		recipients = unique(visible, bcc, given)
+	} else {
+		recipients = unique(given)
+	}
+	if len(recipients) == 0 {
+		return nil, nil, ErrNoRecipients
+	}
+
+	// Hide recipients the headers don't name in Bcc
+	hidden := bcc
+	for _, address := range recipients {
+		if !containsFold(visible, address) && !containsFold(bcc, address) {
+			hidden = append(hidden, address)
+		}
+	}
+	if !opts.ExtractRecipients || len(hidden) > len(bcc) {
+		fields = removeFields(fields, "Bcc")
+		if len(hidden) > 0 {
+			fields = append(fields, headerField{name: "Bcc", raw: []byte("Bcc: " + strings.Join(hidden, ", ") + newline)})
+		}
+	}
+
+	if opts.From != "" && !hasField(fields, "From") {
+		from := (&mail.Address{Name: opts.FromName, Address: opts.From}).String()
+		fields = append(fields, headerField{name: "From", raw: []byte("From: " + from + newline)})
+	}
+
+	var out bytes.Buffer
+	for _, field := range fields {
+		out.Write(field.raw)
+	}
+	out.WriteString(newline)
+	out.Write(body)
+	return out.Bytes(), unique(visible, hidden), nil
+}
+
+// Addresses resolves local names without a domain, such as root, as the
+// aliases file and qualify domain of a local MTA would
+type Addresses struct {
+	// Aliases maps local names, compared case-insensitively, to addresses
+	Aliases map[string]string
+	// DefaultDomain is added to local names without an alias
+	DefaultDomain string
+}
+
+// ParseList parses an address list, resolving local names without a
+// domain, and reports whether any was resolved
+func (a Addresses) ParseList(list string) ([]*mail.Address, bool, error) {
+	parsed, err := mail.ParseAddressList(list)
+	if err == nil {
+		return parsed, false, nil
+	}
+	parsed = nil
+	for _, part := range splitAddressList(list) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		address, err := mail.ParseAddress(part)
+		if err != nil {
+			address, err = a.parseLocal(part, err)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		parsed = append(parsed, address)
+	}
+	return parsed, true, nil
+}
+
+// parseLocal resolves an address such as root or "Admin <root>", returning
+// parseErr if it isn't a local name
+func (a Addresses) parseLocal(s string, parseErr error) (*mail.Address, error) {
+	name, local := "", s
+	if i := strings.LastIndexByte(s, '<'); i >= 0 && strings.HasSuffix(s, ">") {
+		name, local = strings.Trim(strings.TrimSpace(s[:i]), `"`), s[i+1:len(s)-1]
+	}
+	if local == "" || strings.ContainsAny(local, "@<>()[]\\,;:\" \t") {
+		return nil, parseErr
+	}
+	resolved := a.resolve(local)
+	if resolved == "" {
+		return nil, fmt.Errorf("%q has no domain; set an alias or default_domain for it", local)
+	}
+	address, err := mail.ParseAddress(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q for %q: %w", resolved, local, err)
+	}
+	if name != "" {
+		address.Name = name
+	}
+	return address, nil
+}
+
+// resolve returns the address for a local name, or "" if there is none
+func (a Addresses) resolve(local string) string {
+	for name, address := range a.Aliases {
+		if strings.EqualFold(name, local) {
+			return address
+		}
+	}
+	if a.DefaultDomain != "" {
+		return local + "@" + a.DefaultDomain
+	}
+	return ""
+}
+
+// splitAddressList splits an address list at the commas outside quotes,
+// comments and angle brackets
+func splitAddressList(list string) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<', c == '(':
+			depth++
+		case (c == '>' || c == ')') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, list[start:])
+}
+
+// splitHeader returns the header section of a message, ending with its last
+// line break, and the body after the blank line that ends the header
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			return raw, nil
+		}
+		line := raw[i : i+end+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:i], raw[i+len(line):]
+		}
+		i += len(line)
+	}
+	return raw, nil
+}
+
+// parseHeader splits a header section into fields
+func parseHeader(header []byte) []headerField {
+	var fields []headerField
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n') + 1
+		if end == 0 {
+			end = len(header)
+		}
+		line := header[:end]
+		header = header[end:]
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		fields = append(fields, headerField{name: strings.TrimSpace(string(name)), raw: append([]byte(nil), line...)})
+	}
+	return fields
+}
+
+// headerAddresses returns the addresses in the named fields, rewriting
+// fields that name a local address resolved with resolver
+func headerAddresses(fields []headerField, resolver Addresses, newline string, names ...string) ([]string, error) {
+	var addresses []string
+	for i, field := range fields {
+		if !containsFold(names, field.name) {
+			continue
+		}
+		_, value, _ := strings.Cut(string(field.raw), ":")
+		value = strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+		if value == "" {
+			continue
+		}
+		list, resolved, err := resolver.ParseList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", field.name, err)
+		}
+		formatted := make([]string, len(list))
+		for j, address := range list {
+			addresses = append(addresses, address.Address)
+			formatted[j] = address.String()
+		}
+		if resolved {
+			fields[i].raw = []byte(field.name + ": " + strings.Join(formatted, ", ") + newline)
+		}
+	}
+	return addresses, nil
+}
+
+// writtenAddresses returns the addresses in the named fields that parse as
+// written, skipping any that don't
+func writtenAddresses(fields []headerField, names ...string) []string {
+	var addresses []string
+	for _, field := range fields {
+		if !containsFold(names, field.name) {
+			continue
+		}
+		_, value, _ := strings.Cut(string(field.raw), ":")
+		value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+		for _, part := range splitAddressList(value) {
+			if address, err := mail.ParseAddress(strings.TrimSpace(part)); err == nil {
+				addresses = append(addresses, address.Address)
+			}
+		}
+	}
+	return addresses
+}
+
+// hasField reports whether a header has a field
+func hasField(fields []headerField, name string) bool {
+	for _, field := range fields {
+		if strings.EqualFold(field.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFields returns the fields without those with a name
+func removeFields(fields []headerField, name string) []headerField {
+	kept := fields[:0]
+	for _, field := range fields {
+		if !strings.EqualFold(field.name, name) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// unique concatenates address lists, dropping repeats regardless of case
+func unique(lists ...[]string) []string {
+	var addresses []string
+	for _, list := range lists {
+		for _, address := range list {
+			if !containsFold(addresses, address) {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package gmailsend
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrepareMessage(t *testing.T) {
+	aliases := Addresses{
+		Aliases:       map[string]string{"root": "admin@example.com"},
+		DefaultDomain: "example.org",
+	}
+
+	tests := []struct {
+		name           string
+		raw            string
+		opts           Options
+		addresses      Addresses
+		want           string
+		wantRecipients []string
+		wantErr        string
+	}{
+		{
+			name: "recipient in To",
+			raw:  "From: a@example.com\nTo: b@example.com\nSubject: hi\n\nbody\n",
+			opts: Options{Recipients: []string{"b@example.com"}},
+			want: "From: a@example.com\nTo: b@example.com\nSubject: hi\n\nbody\n",
+			// Gmail sends to the headers' addresses, which are all recipients
+			wantRecipients: []string{"b@example.com"},
+		},
+		{
+			name:           "Bcc dropped without -t",
+			raw:            "From: a@example.com\nTo: b@example.com\nBcc: secret@example.com,\n other@example.com\nSubject: hi\n\nbody\n",
+			opts:           Options{Recipients: []string{"b@example.com"}},
+			want:           "From: a@example.com\nTo: b@example.com\nSubject: hi\n\nbody\n",
+			wantRecipients: []string{"b@example.com"},
+		},
+		{
+			name:           "recipient not in the headers hidden in Bcc",
+			raw:            "From: a@example.com\nTo: b@example.com\nBcc: secret@example.com\n\nbody\n",
+			opts:           Options{Recipients: []string{"c@example.com"}},
+			want:           "From: a@example.com\nTo: b@example.com\nBcc: c@example.com\n\nbody\n",
+			wantRecipients: []string{"b@example.com", "c@example.com"},
+		},
+		{
+			name:           "-t sends to To, Cc and Bcc",
+			raw:            "From: a@example.com\nTo: b@example.com\nCc: C <c@example.com>\nBcc: d@example.com\n\nbody\n",
+			opts:           Options{ExtractRecipients: true},
+			want:           "From: a@example.com\nTo: b@example.com\nCc: C <c@example.com>\nBcc: d@example.com\n\nbody\n",
+			wantRecipients: []string{"b@example.com", "c@example.com", "d@example.com"},
+		},
+		{
+			name:           "-t with recipients given",
+			raw:            "From: a@example.com\nTo: b@example.com\nBcc: d@example.com\n\nbody\n",
+			opts:           Options{ExtractRecipients: true, Recipients: []string{"B@example.com", "e@example.com"}},
+			want:           "From: a@example.com\nTo: b@example.com\nBcc: d@example.com, e@example.com\n\nbody\n",
+			wantRecipients: []string{"b@example.com", "d@example.com", "e@example.com"},
+		},
+		{
+			name:           "-t rewrites local names with aliases and the default domain",
+			raw:            "From: a@example.com\nTo: root, Ops <ops>\nCc: c@example.com\n\nbody\n",
+			opts:           Options{ExtractRecipients: true},
+			addresses:      aliases,
+			want:           "From: a@example.com\nTo: <admin@example.com>, \"Ops\" <ops@example.org>\nCc: c@example.com\n\nbody\n",
+			wantRecipients: []string{"admin@example.com", "ops@example.org", "c@example.com"},
+		},
+		{
+			name:           "recipients given resolved with aliases",
+			raw:            "From: a@example.com\nSubject: cron\n\nbody\n",
+			opts:           Options{Recipients: []string{"root"}},
+			addresses:      aliases,
+			want:           "From: a@example.com\nSubject: cron\nBcc: admin@example.com\n\nbody\n",
+			wantRecipients: []string{"admin@example.com"},
+		},
+		{
+			name:           "unresolvable To left alone without -t",
+			raw:            "From: a@example.com\nTo: root, b@example.com\n\nbody\n",
+			opts:           Options{Recipients: []string{"b@example.com"}},
+			want:           "From: a@example.com\nTo: root, b@example.com\n\nbody\n",
+			wantRecipients: []string{"b@example.com"},
+		},
+		{
+			name:    "unresolvable To with -t",
+			raw:     "From: a@example.com\nTo: root\n\nbody\n",
+			opts:    Options{ExtractRecipients: true},
+			wantErr: "invalid To header",
+		},
+		{
+			name:    "no recipients",
+			raw:     "From: a@example.com\nTo: b@example.com\n\nbody\n",
+			opts:    Options{},
+			wantErr: ErrNoRecipients.Error(),
+		},
+		{
+			name:           "From added when missing",
+			raw:            "To: b@example.com\nSubject: hi\n\nbody\n",
+			opts:           Options{From: "me@example.com", FromName: "Cron Daemon", Recipients: []string{"b@example.com"}},
+			want:           "To: b@example.com\nSubject: hi\nFrom: \"Cron Daemon\" <me@example.com>\n\nbody\n",
+			wantRecipients: []string{"b@example.com"},
+		},
+		{
+			name:           "From kept when present",
+			raw:            "from: them@example.com\nTo: b@example.com\n\nbody\n",
+			opts:           Options{From: "me@example.com", Recipients: []string{"b@example.com"}},
+			want:           "from: them@example.com\nTo: b@example.com\n\nbody\n",
+			wantRecipients: []string{"b@example.com"},
+		},
+		{
+			name:           "CRLF line endings kept",
+			raw:            "To: b@example.com\r\nBcc: x@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+			opts:           Options{From: "me@example.com", Recipients: []string{"c@example.com"}},
+			want:           "To: b@example.com\r\nSubject: hi\r\nBcc: c@example.com\r\nFrom: <me@example.com>\r\n\r\nbody\r\n",
+			wantRecipients: []string{"b@example.com", "c@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, recipients, err := PrepareMessage([]byte(tt.raw), tt.opts, tt.addresses)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PrepareMessage: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("message =\n%q\nwant\n%q", got, tt.want)
+			}
+			if !reflect.DeepEqual(recipients, tt.wantRecipients) {
+				t.Errorf("recipients = %q, want %q", recipients, tt.wantRecipients)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageNoRecipients(t *testing.T) {
+	_, _, err := PrepareMessage([]byte("Subject: hi\n\nbody\n"), Options{ExtractRecipients: true}, Addresses{})
+	if !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("error = %v, want ErrNoRecipients", err)
+	}
+}
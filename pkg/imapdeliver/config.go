@@ -0,0 +1,83 @@
+package imapdeliver
+
+import (
+	"fmt"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+)
+
+// Config holds the configuration of IMAP delivery
+type Config struct {
+	deliver.Common
+	// IMAP server address (default: imap.gmail.com:993)
+	IMAPServer string `json:"imap_server" help:"IMAP server address" default:"imap.gmail.com:993"`
+	// Connection timeout in seconds (default: 30)
+	ConnectionTimeout int `json:"connection_timeout" help:"Connection timeout in seconds" default:"30"`
+	// Connection security: tls (default), starttls or none
+	IMAPTLS string `json:"imap_tls" help:"Connection security: tls, starttls or none" default:"tls"`
+	// CA certificates to trust instead of the system roots
+	IMAPCAFile string `json:"imap_ca_file" help:"PEM file of CA certificates to trust instead of the system roots"`
+}
+
+// IMAP connection security modes
+const (
+	TLSImplicit = "tls"
+	TLSStartTLS = "starttls"
+	TLSNone     = "none"
+)
+
+// Validate checks the configuration and fills in defaults
+func (cfg *Config) Validate() error {
+	return cfg.validate(internal.LoggerForHandler(nil, ""))
+}
+
+// validate checks the configuration and fills in defaults, logging the
+// values used
+func (cfg *Config) validate(logger *internal.Logger) error {
+	logger.Debug("validating configuration")
+
+	// Set defaults
+	if cfg.UserID == "" {
+		cfg.UserID = "me"
+		logger.Debug("using default user ID", "user_id", "me")
+	}
+
+	if cfg.IMAPServer == "" {
+		cfg.IMAPServer = "imap.gmail.com:993"
+		logger.Debug("using default IMAP server", "server", cfg.IMAPServer)
+	}
+
+	if cfg.IMAPTLS == "" {
+		cfg.IMAPTLS = TLSImplicit
+	}
+
+	internal.SetDefaults(&cfg.ConnectionTimeout, 30)
+
+	// Validate common fields
+	if err := internal.ValidateCommon(&cfg.Common); err != nil {
+		return err
+	}
+
+	switch cfg.IMAPTLS {
+	case TLSImplicit, TLSStartTLS:
+	case TLSNone:
+		logger.Warn("imap_tls is none; the access token will be sent unencrypted")
+	default:
+		return fmt.Errorf("imap_tls must be %q, %q or %q, got %q", TLSImplicit, TLSStartTLS, TLSNone, cfg.IMAPTLS)
+	}
+
+	// IMAP has no equivalent of the API's rfc822msgid: search
+	if internal.DedupUsesSearch(cfg.DedupMode) {
+		return fmt.Errorf("dedup_mode %q is only supported by gmail-api-transport (use \"local\")", cfg.DedupMode)
+	}
+
+	logger.Debug("defaults applied",
+		"connection_timeout", cfg.ConnectionTimeout,
+		"max_retries", cfg.MaxRetries,
+		"retry_delay", cfg.RetryDelay,
+		"retry_jitter", cfg.RetryJitter)
+
+	logger.Debug("configuration validated successfully")
+	return nil
+}
@@ -0,0 +1,61 @@
+package imapdeliver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gmail-api-client/internal"
+
+	"github.com/emersion/go-imap"
+)
+
+// DryRun writes a description of how a message would be delivered, without
+// contacting the IMAP server: the duplicate check and the exact APPEND command
+func (d *Deliverer) DryRun(w io.Writer, rawMessage []byte) error {
+	cfg := d.cfg
+	report := &internal.DryRunReport{}
+	report.Message(rawMessage)
+
+	if report.Dedup(&cfg.Common, rawMessage) {
+		fmt.Fprintf(w, "Dry run: message is a duplicate and would not be appended for %s\n\n", cfg.UserID)
+		report.Print(w, d.logger)
+		return nil
+	}
+
+	// Render the command as the client would send it, minus the literal
+	appendCmd := d.newAppendCommand(rawMessage)
+	cmd := appendCmd.Command()
+	cmd.Tag = "A1"
+	var buf bytes.Buffer
+	iw := imap.NewWriter(&buf)
+	if err := cmd.WriteTo(iw); err != nil {
+		return fmt.Errorf("building APPEND command: %w", err)
+	}
+	if err := iw.Flush(); err != nil {
+		return fmt.Errorf("building APPEND command: %w", err)
+	}
+	literalHeader := "{" + strconv.Itoa(len(rawMessage)) + "}\r\n"
+	line, _, _ := strings.Cut(buf.String(), literalHeader)
+
+	report.Section(fmt.Sprintf("Command (%s, imap_tls %s)", cfg.IMAPServer, cfg.IMAPTLS))
+	report.Line("AUTHENTICATE XOAUTH2 as %s", cfg.UserID)
+	report.Line("%s%s", line, strings.TrimSuffix(literalHeader, "\r\n"))
+	report.Line("<%d bytes of message>", len(rawMessage))
+
+	if internal.DedupUsesIndex(cfg.DedupMode) || cfg.AuditLog != "" {
+		report.Section("After delivery")
+		if internal.DedupUsesIndex(cfg.DedupMode) {
+			report.Line("record the delivery in %s", cfg.DedupIndex)
+		}
+		if cfg.AuditLog != "" {
+			report.Line("append an audit record to %s", cfg.AuditLog)
+		}
+	}
+
+	fmt.Fprintf(w, "Dry run: message would be appended to %s for %s; nothing was sent\n\n", appendCmd.Mailbox, cfg.UserID)
+	report.Print(w, d.logger)
+	return nil
+}
@@ -0,0 +1,377 @@
+// Package imapdeliver delivers messages to Gmail with IMAP APPEND, as
+// gmail-imap-transport does
+//
+// It authenticates with XOAUTH2 and appends to INBOX, leaving labels to
+// Gmail's filters. Retries, duplicate protection, audit records and metrics
+// follow the shared configuration.
+package imapdeliver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"gmail-api-client/internal"
+	"gmail-api-client/pkg/deliver"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Deliverer delivers messages with IMAP APPEND
+type Deliverer struct {
+	cfg            *Config
+	logger         *internal.Logger
+	metrics        deliver.Metrics
+	tracerProvider trace.TracerProvider
+}
+
+var _ deliver.Deliverer = (*Deliverer)(nil)
+
+// New validates cfg and returns a Deliverer using it, reporting through
+// telemetry
+func New(cfg *Config, telemetry deliver.Telemetry) (*Deliverer, error) {
+	logger := internal.LoggerForHandler(telemetry.Logger, "imapdeliver")
+	if err := cfg.validate(logger); err != nil {
+		return nil, err
+	}
+	return &Deliverer{
+		cfg:            cfg,
+		logger:         logger,
+		metrics:        telemetry.Metrics,
+		tracerProvider: telemetry.TracerProvider,
+	}, nil
+}
+
+// Config returns the validated configuration
+func (d *Deliverer) Config() *Config {
+	return d.cfg
+}
+
+// PrepareToken loads the token and refreshes and saves it if it expired
+// Transports call it before reading a message so an authorization problem
+// doesn't lose one
+func (d *Deliverer) PrepareToken() error {
+	return internal.DeliveryError(internal.PrepareToken(d.cfg.CredentialsFile, d.cfg.TokenFile, d.logger, d.metrics))
+}
+
+// Connect creates and authenticates an IMAP connection to Gmail, refreshing
+// the token if needed; the caller must Logout when done
+func (d *Deliverer) Connect(ctx context.Context) (*client.Client, error) {
+	cfg := d.cfg
+	d.logger.Debug("connecting to IMAP server", "server", cfg.IMAPServer)
+
+	// Use shared oauth package to handle token refresh
+	_, refreshSpan := internal.StartSpan(ctx, "token.refresh")
+	freshToken, _, err := internal.RefreshAndSaveToken(cfg.CredentialsFile, cfg.TokenFile, d.logger, d.metrics)
+	internal.EndSpan(refreshSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	dialCtx, dialSpan := internal.StartSpan(ctx, "imap.connect", attribute.String("server.address", cfg.IMAPServer))
+	c, err := d.dial(dialCtx)
+	internal.EndSpan(dialSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine the username (email address)
+	username := cfg.UserID
+	if username == "me" {
+		// We need the actual email address for XOAUTH2
+		// Try to extract from credentials or token file
+		// For now, we'll require the user to specify it
+		c.Logout()
+		return nil, fmt.Errorf("user_id must be a valid email address (not 'me') for IMAP authentication")
+	}
+
+	// Authenticate using XOAUTH2 with the fresh token
+	d.logger.Debug("authenticating as", "username", username)
+	auth := &XOAuth2{
+		Username: username,
+		Token:    freshToken.AccessToken,
+	}
+
+	_, authSpan := internal.StartSpan(ctx, "imap.authenticate", attribute.String("imap.mechanism", "XOAUTH2"))
+	err = c.Authenticate(auth)
+	if err != nil {
+		err = commandError(c, "AUTHENTICATE", nil, err)
+	}
+	internal.EndSpan(authSpan, err)
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("IMAP authentication failed: %w", err)
+	}
+
+	d.logger.Debug("successfully authenticated to IMAP server")
+	return c, nil
+}
+
+// dial opens a connection to the IMAP server secured as imap_tls says
+func (d *Deliverer) dial(ctx context.Context) (*client.Client, error) {
+	cfg := d.cfg
+	timeout := time.Duration(cfg.ConnectionTimeout) * time.Second
+
+	// Create a dialer with timeout
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+
+	// Dial with timeout, giving up early if ctx is cancelled
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.IMAPServer)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to IMAP server: %w", err)
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// With implicit TLS the handshake comes before the server greeting
+	if cfg.IMAPTLS == TLSImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	c, err := client.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("creating IMAP client: %w", err)
+	}
+
+	if cfg.IMAPTLS == TLSStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+
+	d.logger.Debug("connected to IMAP server", "tls", cfg.IMAPTLS)
+	return c, nil
+}
+
+// tlsConfig returns the TLS settings for the IMAP server, verifying its
+// certificate against imap_ca_file if set
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(cfg.IMAPServer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid imap_server: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if cfg.IMAPCAFile != "" {
+		pemData, err := os.ReadFile(cfg.IMAPCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading imap_ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("imap_ca_file %s contains no PEM certificates", cfg.IMAPCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// commandError wraps a failed IMAP command so it can be classified for retry
+// It must be called before Logout, since it checks whether the connection
+// dropped while the command was running
+func commandError(c *client.Client, command string, status *imap.StatusResp, err error) error {
+	disconnected := false
+	select {
+	case <-c.LoggedOut():
+		disconnected = true
+	default:
+	}
+	return &internal.IMAPCommandError{
+		Command:      command,
+		Status:       status,
+		Disconnected: disconnected,
+		Err:          err,
+	}
+}
+
+// XOAuth2 implements the SASL XOAUTH2 authentication mechanism
+type XOAuth2 struct {
+	Username string
+	Token    string
+}
+
+// Start implements sasl.Client interface
+// The initial response is returned unencoded; the IMAP client base64-encodes it
+func (a *XOAuth2) Start() (mech string, ir []byte, err error) {
+	mech = "XOAUTH2"
+	ir = []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.Username, a.Token))
+	return
+}
+
+// Next implements sasl.Client interface
+func (a *XOAuth2) Next(challenge []byte) (response []byte, err error) {
+	// If we receive a challenge (error response), send empty response so
+	// the server fails the command with its status
+	if len(challenge) > 0 {
+		return []byte{}, nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge")
+}
+
+// Deliver reads a message and appends it to INBOX
+// The returned result describes the delivery even if it failed; errors are
+// *deliver.Error
+func (d *Deliverer) Deliver(ctx context.Context, msg io.Reader, opts deliver.Options) (*deliver.Result, error) {
+	start := time.Now()
+	rawMessage, err := internal.ReadMessage(msg)
+	if err != nil {
+		return nil, internal.DeliveryError(err)
+	}
+
+	record := internal.NewAuditRecord(internal.AuditTransportIMAP, rawMessage)
+	record.Sender = opts.Sender
+	record.Recipient = opts.Recipient
+
+	ctx, span := internal.StartRootSpan(ctx, d.tracerProvider, "imapdeliver.deliver",
+		attribute.String("gmail.user_id", d.cfg.UserID))
+	err = d.deliverMessage(ctx, rawMessage, record, opts)
+	internal.EndSpan(span, err)
+	result := internal.FinishDelivery(&d.cfg.Common, d.logger, d.metrics, d.cfg.UserID, record, start, err)
+	return result, internal.DeliveryError(err)
+}
+
+// deliverMessage delivers an email message to Gmail using IMAP APPEND
+// The mailbox and retry count are filled in on record
+func (d *Deliverer) deliverMessage(ctx context.Context, rawMessage []byte, record *internal.AuditRecord, opts deliver.Options) error {
+	cfg := d.cfg
+	logger := d.logger
+	logger.Debug("preparing to deliver message via IMAP")
+
+	var c *client.Client
+	var err error
+
+	// Skip messages that an earlier, interrupted attempt already delivered
+	var index *internal.DeliveredIndex
+	dedupKey, dedupOK := internal.DedupKey(rawMessage)
+	if internal.DedupUsesIndex(cfg.DedupMode) && dedupOK {
+		index = internal.NewDeliveredIndex(cfg.DedupIndex, time.Duration(cfg.DedupExpiry)*time.Hour, nil)
+		if opts.SkipDuplicateCheck {
+			logger.Debug("skipping duplicate check")
+		} else if _, found, lookupErr := index.Lookup(dedupKey); lookupErr != nil {
+			logger.Warn("failed to check delivered index", "error", lookupErr)
+		} else if found {
+			logger.Info("message already delivered, skipping APPEND")
+			record.Outcome = internal.AuditDuplicate
+			return nil
+		}
+	}
+
+	// Wrap the entire delivery operation in retry logic
+	retryCfg := internal.NewRetryConfig(&cfg.Common, 0, d.metrics)
+
+	attempt := 0
+	err = internal.RetryOperationContext(ctx, retryCfg, logger, func(ctx context.Context) error {
+		attempt++
+		record.CountAttempt(attempt)
+
+		// Connect and authenticate to IMAP
+		c, err = d.Connect(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Execute APPEND directly rather than via c.Append so the server's
+		// status response (and its response code) is kept for classification
+		cmd := d.newAppendCommand(rawMessage)
+		mailbox := cmd.Mailbox
+		_, appendSpan := internal.StartSpan(ctx, "imap.append",
+			attribute.String("imap.mailbox", mailbox),
+			attribute.Int("email.size", len(rawMessage)))
+		status, appendErr := c.Execute(cmd, nil)
+		if appendErr == nil {
+			appendErr = status.Err()
+		}
+		if appendErr != nil {
+			appendErr = commandError(c, "APPEND", status, appendErr)
+		}
+		internal.EndSpan(appendSpan, appendErr)
+		if appendErr != nil {
+			// Close connection on error before potential retry
+			c.Logout()
+			return appendErr
+		}
+
+		logger.Info("message successfully appended", "mailbox", mailbox)
+		record.Labels = []string{mailbox}
+		logger.Debug("Gmail will apply filters and labels automatically")
+
+		// Logout cleanly after successful delivery
+		c.Logout()
+		return nil
+	}, "IMAP message delivery")
+
+	if err == nil && index != nil {
+		if addErr := index.Add(dedupKey, internal.MessageID(rawMessage), ""); addErr != nil {
+			logger.Warn("failed to record delivery in index", "error", addErr)
+		}
+	}
+
+	return err
+}
+
+// newAppendCommand builds the APPEND command delivering a message
+func (d *Deliverer) newAppendCommand(rawMessage []byte) *commands.Append {
+	// Parse the message to extract the date (optional, for INTERNALDATE)
+	// For simplicity, we'll use the current time
+	internalDate := time.Now()
+	d.logger.Debug("using internal date", "date", internalDate.Format(time.RFC3339))
+
+	// APPEND the message to INBOX with \Seen flag unset (mark as unread)
+	// Gmail will apply filters and labels automatically
+	flags := []string{} // No flags = unread
+	mailbox := "INBOX"
+
+	d.logger.Debug("appending message to mailbox",
+		"mailbox", mailbox,
+		"bytes", len(rawMessage),
+		"flags", flags)
+
+	// Create a literal from the raw message
+	literal := &imapLiteral{data: rawMessage}
+
+	return &commands.Append{
+		Mailbox: mailbox,
+		Flags:   flags,
+		Date:    internalDate,
+		Message: literal,
+	}
+}
+
+// imapLiteral implements the imap.Literal interface
+type imapLiteral struct {
+	data []byte
+	pos  int
+}
+
+func (l *imapLiteral) Len() int {
+	return len(l.data)
+}
+
+func (l *imapLiteral) Read(p []byte) (n int, err error) {
+	if l.pos >= len(l.data) {
+		return 0, io.EOF
+	}
+	n = copy(p, l.data[l.pos:])
+	l.pos += n
+	return n, nil
+}
@@ -0,0 +1,257 @@
+package imapdeliver_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gmail-api-client/internal/fakeimap"
+	"gmail-api-client/internal/fakeoauth"
+	"gmail-api-client/pkg/deliver"
+	"gmail-api-client/pkg/imapdeliver"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"Message-ID: <report@example.com>\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"The report is attached.\r\n"
+
+// testServers are the fakes one delivery talks to
+type testServers struct {
+	imap   *fakeimap.Server
+	tokens *fakeoauth.Server
+}
+
+// newServers starts a fake IMAP server securing connections as mode, which
+// accepts only the token endpoint's access token
+func newServers(t *testing.T, mode fakeimap.TLSMode) *testServers {
+	t.Helper()
+	server, err := fakeimap.New(mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	tokens := fakeoauth.New()
+	t.Cleanup(tokens.Close)
+	server.AccessToken = tokens.AccessToken
+	return &testServers{imap: server, tokens: tokens}
+}
+
+// newDeliverer returns a Deliverer for the fakes with one retry and an
+// expired token, trusting the IMAP server's certificate, changed by
+// configure if not nil
+func newDeliverer(t *testing.T, servers *testServers, mode string, configure func(*imapdeliver.Config)) *imapdeliver.Deliverer {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &imapdeliver.Config{
+		Common: deliver.Common{
+			CredentialsFile: filepath.Join(dir, "credentials.json"),
+			TokenFile:       filepath.Join(dir, "token.json"),
+			UserID:          fakeimap.DefaultEmail,
+			MaxRetries:      1,
+		},
+		IMAPServer:        servers.imap.Addr(),
+		IMAPTLS:           mode,
+		IMAPCAFile:        filepath.Join(dir, "ca.pem"),
+		ConnectionTimeout: 5,
+	}
+	if err := servers.tokens.WriteCredentials(cfg.CredentialsFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers.tokens.WriteToken(cfg.TokenFile, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers.imap.WriteCACert(cfg.IMAPCAFile); err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	deliverer, err := imapdeliver.New(cfg, deliver.Telemetry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliverer
+}
+
+// deliverTest delivers testMessage
+func deliverTest(t *testing.T, deliverer *imapdeliver.Deliverer) (*deliver.Result, error) {
+	t.Helper()
+	return deliverer.Deliver(context.Background(), strings.NewReader(testMessage), deliver.Options{})
+}
+
+func TestDeliverTLSModes(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []fakeimap.TLSMode{fakeimap.TLSImplicit, fakeimap.TLSStartTLS, fakeimap.TLSNone} {
+		t.Run(string(mode), func(t *testing.T) {
+			t.Parallel()
+			servers := newServers(t, mode)
+			deliverer := newDeliverer(t, servers, string(mode), nil)
+
+			result, err := deliverTest(t, deliverer)
+			if err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+			if result.Status != deliver.StatusDelivered || result.Attempts != 1 {
+				t.Errorf("result = %+v, want delivered at the first attempt", result)
+			}
+			if servers.tokens.Refreshes() != 1 || servers.imap.Authentications() != 1 {
+				t.Errorf("%d refreshes and %d logins, want one of each", servers.tokens.Refreshes(), servers.imap.Authentications())
+			}
+			messages := servers.imap.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("server has %d messages, want 1", len(messages))
+			}
+			if messages[0].Mailbox != "INBOX" || string(messages[0].Body) != testMessage {
+				t.Errorf("appended %q to %s, want the test message in INBOX", messages[0].Body, messages[0].Mailbox)
+			}
+		})
+	}
+}
+
+func TestDeliverUntrustedCertificate(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []fakeimap.TLSMode{fakeimap.TLSImplicit, fakeimap.TLSStartTLS} {
+		t.Run(string(mode), func(t *testing.T) {
+			t.Parallel()
+			servers := newServers(t, mode)
+			deliverer := newDeliverer(t, servers, string(mode), func(cfg *imapdeliver.Config) {
+				cfg.IMAPCAFile = ""
+			})
+
+			// A certificate problem won't go away by retrying
+			result, err := deliverTest(t, deliverer)
+			if err == nil || deliver.Temporary(err) {
+				t.Fatalf("error = %v, want a permanent failure", err)
+			}
+			if result.Status != deliver.StatusFailed || result.Attempts != 1 {
+				t.Errorf("result = %+v, want failed after one attempt", result)
+			}
+			if servers.imap.Authentications() != 0 {
+				t.Error("authenticated over an untrusted connection")
+			}
+		})
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		prepare func(*testServers)
+		// wantAttempts counts connections, each authenticating and appending
+		wantAttempts  int
+		wantStatus    string
+		wantTemporary bool
+		wantMessages  int
+	}{
+		{
+			name:         "XOAUTH2 rejects the token",
+			prepare:      func(s *testServers) { s.imap.AccessToken = "another-token" },
+			wantAttempts: 1,
+			wantStatus:   deliver.StatusFailed,
+		},
+		{
+			name:         "refresh token revoked",
+			prepare:      func(s *testServers) { s.tokens.Error = "invalid_grant" },
+			wantAttempts: 1,
+			wantStatus:   deliver.StatusFailed,
+		},
+		{
+			name: "disconnect during AUTHENTICATE once",
+			prepare: func(s *testServers) {
+				s.imap.InjectFault(fakeimap.Fault{Command: "AUTHENTICATE", Disconnect: true, Times: 1})
+			},
+			wantAttempts: 2,
+			wantStatus:   deliver.StatusDelivered,
+			wantMessages: 1,
+		},
+		{
+			name: "disconnect during APPEND once",
+			prepare: func(s *testServers) {
+				s.imap.InjectFault(fakeimap.Fault{Command: "APPEND", Disconnect: true, Times: 1})
+			},
+			wantAttempts: 2,
+			wantStatus:   deliver.StatusDelivered,
+			wantMessages: 1,
+		},
+		{
+			name: "disconnect during every APPEND",
+			prepare: func(s *testServers) {
+				s.imap.InjectFault(fakeimap.Fault{Command: "APPEND", Disconnect: true})
+			},
+			wantAttempts:  2,
+			wantStatus:    deliver.StatusDeferred,
+			wantTemporary: true,
+		},
+		{
+			name: "APPEND over quota",
+			prepare: func(s *testServers) {
+				s.imap.InjectFault(fakeimap.Fault{Command: "APPEND", Code: "OVERQUOTA", Info: "Account exceeded storage quota"})
+			},
+			wantAttempts:  1,
+			wantStatus:    deliver.StatusDeferred,
+			wantTemporary: true,
+		},
+		{
+			name: "APPEND rejected",
+			prepare: func(s *testServers) {
+				s.imap.InjectFault(fakeimap.Fault{Command: "APPEND", Info: "Message too large"})
+			},
+			wantAttempts: 1,
+			wantStatus:   deliver.StatusFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			servers := newServers(t, fakeimap.TLSImplicit)
+			tt.prepare(servers)
+			deliverer := newDeliverer(t, servers, imapdeliver.TLSImplicit, nil)
+
+			result, err := deliverTest(t, deliverer)
+			if result.Status != tt.wantStatus || result.Attempts != tt.wantAttempts {
+				t.Errorf("result = %+v, want status %s after %d attempts", result, tt.wantStatus, tt.wantAttempts)
+			}
+			if n := len(servers.imap.Messages()); n != tt.wantMessages {
+				t.Errorf("server has %d messages, want %d", n, tt.wantMessages)
+			}
+			if tt.wantStatus == deliver.StatusDelivered {
+				if err != nil {
+					t.Fatalf("Deliver: %v", err)
+				}
+				return
+			}
+			var deliverErr *deliver.Error
+			if !errors.As(err, &deliverErr) {
+				t.Fatalf("error = %v, want a *deliver.Error", err)
+			}
+			if deliver.Temporary(err) != tt.wantTemporary {
+				t.Errorf("Temporary(%v) = %v, want %v", err, deliver.Temporary(err), tt.wantTemporary)
+			}
+		})
+	}
+}
+
+func TestDeliverNeedsEmailAddress(t *testing.T) {
+	t.Parallel()
+	servers := newServers(t, fakeimap.TLSNone)
+	deliverer := newDeliverer(t, servers, imapdeliver.TLSNone, func(cfg *imapdeliver.Config) {
+		cfg.UserID = "me"
+	})
+
+	_, err := deliverTest(t, deliverer)
+	if err == nil || !strings.Contains(err.Error(), "user_id must be a valid email address") {
+		t.Fatalf("error = %v, want user_id must be a valid email address", err)
+	}
+	if servers.imap.Authentications() != 0 {
+		t.Error("authenticated without an email address")
+	}
+}
@@ -0,0 +1,145 @@
+package mailbox
+
+import (
+	"bytes"
+	"strings"
+)
+
+// GmailLabelsHeader records a message's Gmail labels by name, as in Google
+// Takeout's mbox files and gmailctl export
+const GmailLabelsHeader = "X-Gmail-Labels"
+
+// systemLabelNames are the names Takeout gives Gmail's system labels
+var systemLabelNames = map[string]string{
+	"INBOX":               "Inbox",
+	"SENT":                "Sent",
+	"DRAFT":               "Drafts",
+	"SPAM":                "Spam",
+	"TRASH":               "Trash",
+	"IMPORTANT":           "Important",
+	"STARRED":             "Starred",
+	"UNREAD":              "Unread",
+	"CHAT":                "Chat",
+	"CATEGORY_PERSONAL":   "Category Personal",
+	"CATEGORY_SOCIAL":     "Category Social",
+	"CATEGORY_PROMOTIONS": "Category Promotions",
+	"CATEGORY_UPDATES":    "Category Updates",
+	"CATEGORY_FORUMS":     "Category Forums",
+}
+
+// stateLabels are X-Gmail-Labels entries describing the message's state
+// rather than a label: Unread and Starred become Message.Seen and Flagged,
+// and Takeout adds Opened and Archived
+var stateLabels = []string{"Unread", "Starred", "Opened", "Archived"}
+
+// isStateLabel reports whether an X-Gmail-Labels entry is a state label
+func isStateLabel(name string) bool {
+	for _, state := range stateLabels {
+		if strings.EqualFold(name, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// SystemLabelName returns the X-Gmail-Labels name of a system label ID, or
+// the ID itself for a user label
+func SystemLabelName(id string) string {
+	if name, ok := systemLabelNames[id]; ok {
+		return name
+	}
+	return id
+}
+
+// SystemLabelID returns the ID of the system label an X-Gmail-Labels name
+// stands for, compared case-insensitively
+func SystemLabelID(name string) (string, bool) {
+	for id, systemName := range systemLabelNames {
+		if strings.EqualFold(name, systemName) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// FormatGmailLabels returns an X-Gmail-Labels header field for the label
+// names given, folded to keep lines short
+// Names holding a comma or a double quote are quoted
+func FormatGmailLabels(names []string) string {
+	var b strings.Builder
+	b.WriteString(GmailLabelsHeader + ": ")
+	lineLen := b.Len()
+	for i, name := range names {
+		if strings.ContainsAny(name, ",\"") {
+			name = `"` + strings.ReplaceAll(name, `"`, `\"`) + `"`
+		}
+		if i > 0 {
+			b.WriteString(",")
+			lineLen++
+			if lineLen+len(name) > 76 {
+				b.WriteString("\n ")
+				lineLen = 1
+			}
+		}
+		b.WriteString(name)
+		lineLen += len(name)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// SetGmailLabels returns the message normalized as by Normalize, with an
+// X-Gmail-Labels header field for the label names given at the top in place
+// of any it already has
+func SetGmailLabels(raw []byte, names []string) []byte {
+	rest := Normalize(raw)
+	out := []byte(FormatGmailLabels(names))
+	drop := false
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		line := rest[:end]
+		if len(line) == 1 {
+			// The blank line ending the header
+			break
+		}
+		// Continuation lines belong to the field before them
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, ok := bytes.Cut(line, []byte(":"))
+			drop = ok && strings.EqualFold(string(bytes.TrimSpace(name)), GmailLabelsHeader)
+		}
+		if !drop {
+			out = append(out, line...)
+		}
+		rest = rest[end:]
+	}
+	return append(out, rest...)
+}
+
+// parseGmailLabels splits an X-Gmail-Labels value into label names
+func parseGmailLabels(value string) []string {
+	var names []string
+	var name strings.Builder
+	quoted, escaped := false, false
+	for _, r := range value {
+		switch {
+		case escaped:
+			name.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			if s := strings.TrimSpace(name.String()); s != "" {
+				names = append(names, s)
+			}
+			name.Reset()
+		default:
+			name.WriteRune(r)
+		}
+	}
+	if s := strings.TrimSpace(name.String()); s != "" {
+		names = append(names, s)
+	}
+	return names
+}
@@ -0,0 +1,278 @@
+// Package mailbox reads and writes local mail stores, mbox files and Maildir
+// trees, for bulk import into Gmail and export from it
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InboxFolder is the folder of the messages in the top level of a Maildir
+const InboxFolder = "INBOX"
+
+// Message is a message found in a mail store
+type Message struct {
+	// Key identifies the message within its store across runs: the mbox file
+	// and offset of its "From " line, or the Maildir file without its flags
+	Key string
+	// Folder is the message's folder, with "/" between nested folder names
+	Folder string
+	// Raw is the message in RFC 5322 format
+	Raw []byte
+	// Seen and Flagged are the message's read and flagged (starred) state
+	Seen    bool
+	Flagged bool
+	// Labels are the names in the message's X-Gmail-Labels header, other
+	// than those describing its state such as Unread, or nil without one
+	Labels []string
+}
+
+// WalkFunc is called for each message found by Walk; an error stops the walk
+type WalkFunc func(msg *Message) error
+
+// Walk calls fn for every message under root, in order
+// root may be an mbox file, a Maildir, or a directory holding mbox files,
+// Maildirs and further directories, each of which becomes a folder. Maildir++
+// subfolders (".Work.Projects") and Thunderbird ".sbd" directories are
+// understood; other hidden files are skipped
+// mboxFormat is the variant used for all mbox files, see ParseMboxFormat
+func Walk(root, mboxFormat string, fn WalkFunc) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return walkMbox(root, folderName(filepath.Base(root)), mboxFormat, fn)
+	}
+	return walkDir(root, "", mboxFormat, fn)
+}
+
+// walkDir walks a directory that is the given folder, "" for the top level
+func walkDir(dir, folder, mboxFormat string, fn WalkFunc) error {
+	maildir := isMaildir(dir)
+	if maildir {
+		name := folder
+		if name == "" {
+			name = InboxFolder
+		}
+		if err := walkMaildir(dir, name, fn); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		full := filepath.Join(dir, name)
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			if info, err := os.Stat(full); err == nil {
+				isDir = info.IsDir()
+			}
+		}
+
+		switch {
+		case maildir && (name == "cur" || name == "new" || name == "tmp"):
+			continue
+		case maildir && isDir && strings.HasPrefix(name, ".") && len(name) > 1 && isMaildir(full):
+			// Maildir++ subfolder, its hierarchy separated by dots
+			sub := strings.ReplaceAll(strings.TrimPrefix(name, "."), ".", "/")
+			if err := walkMaildir(full, path.Join(folder, sub), fn); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, "."):
+			continue
+		case isDir:
+			// Thunderbird keeps the subfolders of "A" in "A.sbd"
+			sub := path.Join(folder, strings.TrimSuffix(name, ".sbd"))
+			if err := walkDir(full, sub, mboxFormat, fn); err != nil {
+				return err
+			}
+		case entry.Type().IsRegular() || entry.Type()&os.ModeSymlink != 0:
+			ok, err := isMboxFile(full)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := walkMbox(full, path.Join(folder, folderName(name)), mboxFormat, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// folderName returns the folder name of an mbox file
+func folderName(file string) string {
+	for _, ext := range []string{".mbox", ".mbx"} {
+		if strings.HasSuffix(strings.ToLower(file), ext) && len(file) > len(ext) {
+			return file[:len(file)-len(ext)]
+		}
+	}
+	return file
+}
+
+// isMboxFile reports whether a file starts with an mbox "From " line, which
+// tells mbox files apart from indexes and other files kept alongside them
+func isMboxFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	start := make([]byte, 5)
+	if _, err := io.ReadFull(f, start); err != nil {
+		return false, nil
+	}
+	return string(start) == "From ", nil
+}
+
+// walkMbox calls fn for every message in an mbox file
+func walkMbox(file, folder, mboxFormat string, fn WalkFunc) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := NewMboxReader(f, mboxFormat)
+	for {
+		raw, offset, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		msg := &Message{
+			Key:    file + "@" + strconv.FormatInt(offset, 10),
+			Folder: folder,
+			Raw:    raw,
+		}
+		readHeaderState(msg)
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// readHeaderState sets the read and flagged state an mbox message records
+// in its headers: Status and X-Status, X-Mozilla-Status from Thunderbird, or
+// X-Gmail-Labels from Google Takeout and gmailctl export, which also gives
+// its labels
+// A message without any of them is unread, as in a mail client
+func readHeaderState(msg *Message) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg.Raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return
+	}
+
+	if values, ok := header[GmailLabelsHeader]; ok {
+		msg.Seen = true
+		msg.Labels = []string{}
+		for _, name := range parseGmailLabels(strings.Join(values, ",")) {
+			switch {
+			case strings.EqualFold(name, "Unread"):
+				msg.Seen = false
+			case strings.EqualFold(name, "Starred"):
+				msg.Flagged = true
+			}
+			if !isStateLabel(name) {
+				msg.Labels = append(msg.Labels, name)
+			}
+		}
+		return
+	}
+	if status := header.Get("X-Mozilla-Status"); status != "" {
+		if bits, err := strconv.ParseUint(strings.TrimSpace(status), 16, 32); err == nil {
+			msg.Seen = bits&0x1 != 0
+			msg.Flagged = bits&0x4 != 0
+		}
+	}
+	if strings.Contains(header.Get("Status"), "R") {
+		msg.Seen = true
+	}
+	if strings.Contains(header.Get("X-Status"), "F") {
+		msg.Flagged = true
+	}
+}
+
+// isMaildir reports whether a directory is a Maildir, holding cur and new
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// walkMaildir calls fn for every message in a Maildir's new and cur
+func walkMaildir(dir, folder string, fn WalkFunc) error {
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			file := filepath.Join(dir, sub, name)
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			unique, flags := maildirInfo(name)
+			msg := &Message{
+				Key:    filepath.Join(dir, unique),
+				Folder: folder,
+				Raw:    raw,
+			}
+			readHeaderState(msg)
+			// The Maildir flags take precedence over the headers; messages
+			// in new haven't been seen by any client yet
+			msg.Seen = sub == "cur" && strings.Contains(flags, "S")
+			msg.Flagged = strings.Contains(flags, "F")
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maildirInfo splits a Maildir file name into its unique part and its flags
+// Some systems separate the info with "!" or ";" since ":" isn't allowed in
+// their file names
+func maildirInfo(name string) (unique, flags string) {
+	for _, sep := range []string{":2,", "!2,", ";2,"} {
+		if i := strings.LastIndex(name, sep); i >= 0 {
+			return name[:i], name[i+len(sep):]
+		}
+	}
+	return name, ""
+}
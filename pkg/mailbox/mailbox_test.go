@@ -0,0 +1,239 @@
+package mailbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaildirInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantUnique string
+		wantFlags  string
+	}{
+		{"1700000000.M1P2.host:2,S", "1700000000.M1P2.host", "S"},
+		{"1700000000.M1P2.host:2,FRS", "1700000000.M1P2.host", "FRS"},
+		{"1700000000.M1P2.host:2,", "1700000000.M1P2.host", ""},
+		{"1700000000.M1P2.host!2,F", "1700000000.M1P2.host", "F"},
+		{"1700000000.M1P2.host;2,FS", "1700000000.M1P2.host", "FS"},
+		{"1700000000.M1P2.host", "1700000000.M1P2.host", ""},
+	}
+	for _, tt := range tests {
+		unique, flags := maildirInfo(tt.name)
+		if unique != tt.wantUnique || flags != tt.wantFlags {
+			t.Errorf("maildirInfo(%q) = %q, %q; want %q, %q", tt.name, unique, flags, tt.wantUnique, tt.wantFlags)
+		}
+	}
+}
+
+func TestMaildirFlags(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file        string
+		header      string
+		wantSeen    bool
+		wantFlagged bool
+	}{
+		{"cur/1.a.host:2,S", "", true, false},
+		{"cur/2.b.host:2,FS", "", true, true},
+		{"cur/3.c.host:2,F", "", false, true},
+		{"cur/4.d.host:2,", "", false, false},
+		{"cur/5.e.host!2,RS", "", true, false},
+		// The flags override the state recorded in the headers
+		{"cur/6.f.host:2,", "Status: RO\nX-Status: F\n", false, false},
+		{"cur/7.g.host:2,S", "X-Gmail-Labels: Unread,Inbox\n", true, false},
+		// Messages in new haven't been seen, whatever their name says
+		{"new/8.h.host", "", false, false},
+		{"new/9.i.host:2,S", "", false, false},
+	}
+	want := make(map[string]int)
+	for i, tt := range tests {
+		raw := tt.header + "Subject: message " + tt.file + "\n\nbody\n"
+		if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+		unique, _ := maildirInfo(filepath.Base(tt.file))
+		want[filepath.Join(dir, unique)] = i
+	}
+
+	seen := 0
+	err := Walk(dir, MboxRD, func(msg *Message) error {
+		i, ok := want[msg.Key]
+		if !ok {
+			t.Errorf("unexpected key %q", msg.Key)
+			return nil
+		}
+		seen++
+		tt := tests[i]
+		if msg.Folder != InboxFolder {
+			t.Errorf("%s folder = %q, want %s", tt.file, msg.Folder, InboxFolder)
+		}
+		if msg.Seen != tt.wantSeen || msg.Flagged != tt.wantFlagged {
+			t.Errorf("%s seen %v flagged %v, want %v %v", tt.file, msg.Seen, msg.Flagged, tt.wantSeen, tt.wantFlagged)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(tests) {
+		t.Errorf("walked %d messages, want %d", seen, len(tests))
+	}
+}
+
+func TestMaildirWriterRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	w, err := CreateMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	key, err := w.Write([]byte("Subject: x\r\n\r\nbody"), "18c/0:1.2", date, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*Message
+	if err := Walk(dir, MboxRD, func(msg *Message) error {
+		got = append(got, msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("walked %d messages, want 1", len(got))
+	}
+	if got[0].Key != key || !got[0].Seen || !got[0].Flagged {
+		t.Errorf("read back %+v, want key %q, seen and flagged", got[0], key)
+	}
+	if string(got[0].Raw) != "Subject: x\n\nbody\n" {
+		t.Errorf("read back %q, want the normalized message", got[0].Raw)
+	}
+}
+
+func TestParseGmailLabels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"Inbox,Important", []string{"Inbox", "Important"}},
+		{" Inbox , Sent ,", []string{"Inbox", "Sent"}},
+		{`"Work, Projects",Inbox`, []string{"Work, Projects", "Inbox"}},
+		{`"Say \"hi\"",Starred`, []string{`Say "hi"`, "Starred"}},
+		{"Work/Projects/2024,Work/Projects", []string{"Work/Projects/2024", "Work/Projects"}},
+		{`"Clients/Acme, Inc",Archived`, []string{"Clients/Acme, Inc", "Archived"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := parseGmailLabels(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseGmailLabels(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatGmailLabelsRoundTrip(t *testing.T) {
+	names := []string{"Inbox", "Work, Projects", `Say "hi"`, "Work/Projects/2024"}
+	for i := 0; i < 8; i++ {
+		names = append(names, "Archive/Year "+strings.Repeat("x", i+1))
+	}
+	field := FormatGmailLabels(names)
+	for _, line := range strings.Split(strings.TrimSuffix(field, "\n"), "\n") {
+		if len(line) > 78 {
+			t.Errorf("line %q is longer than 78 characters", line)
+		}
+	}
+
+	msg := &Message{Raw: []byte(field + "Subject: labels\n\nbody\n")}
+	readHeaderState(msg)
+	if !reflect.DeepEqual(msg.Labels, names) {
+		t.Errorf("labels read back = %q, want %q", msg.Labels, names)
+	}
+}
+
+func TestSetGmailLabels(t *testing.T) {
+	names := []string{"Inbox", "Work"}
+	field := "X-Gmail-Labels: Inbox,Work\n"
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"no header", "Subject: x\n\nbody\n", field + "Subject: x\n\nbody\n"},
+		{"header replaced", "X-Gmail-Labels: Old\nSubject: x\n\nbody\n", field + "Subject: x\n\nbody\n"},
+		{
+			"folded header and others dropped",
+			"Subject: x\nx-gmail-labels: Old,\n Older\nFrom: a@example.com\nX-Gmail-Labels : Stale\n\nbody\n",
+			field + "Subject: x\nFrom: a@example.com\n\nbody\n",
+		},
+		{"body left alone", "Subject: x\n\nX-Gmail-Labels: in the body\n", field + "Subject: x\n\nX-Gmail-Labels: in the body\n"},
+		{"CRLF normalized", "X-Gmail-Labels: Old\r\nSubject: x\r\n\r\nbody", field + "Subject: x\n\nbody\n"},
+		{"header only", "X-Gmail-Labels: Old\nSubject: x\n", field + "Subject: x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(SetGmailLabels([]byte(tt.raw), names)); got != tt.want {
+				t.Errorf("SetGmailLabels = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHeaderState(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantSeen    bool
+		wantFlagged bool
+		wantLabels  []string
+	}{
+		{"no state headers", "", false, false, nil},
+		{"Status read", "Status: RO\n", true, false, nil},
+		{"X-Status flagged", "X-Status: F\n", false, true, nil},
+		{"Thunderbird read and flagged", "X-Mozilla-Status: 0005\n", true, true, nil},
+		{
+			"Gmail labels with state labels",
+			"X-Gmail-Labels: Inbox,Unread,Starred,Opened,\"Clients/Acme, Inc\"\n",
+			false, true, []string{"Inbox", "Clients/Acme, Inc"},
+		},
+		{"Gmail labels read", "X-Gmail-Labels: Archived,Work/Projects\n", true, false, []string{"Work/Projects"}},
+		{"Gmail labels folded", "X-Gmail-Labels: Inbox,\n Work/Projects\n", true, false, []string{"Inbox", "Work/Projects"}},
+		{"Gmail labels empty", "X-Gmail-Labels: \n", true, false, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &Message{Raw: []byte(tt.header + "Subject: state\n\nbody\n")}
+			readHeaderState(msg)
+			if msg.Seen != tt.wantSeen || msg.Flagged != tt.wantFlagged {
+				t.Errorf("seen %v flagged %v, want %v %v", msg.Seen, msg.Flagged, tt.wantSeen, tt.wantFlagged)
+			}
+			if !reflect.DeepEqual(msg.Labels, tt.wantLabels) {
+				t.Errorf("labels = %#v, want %#v", msg.Labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestSystemLabelNames(t *testing.T) {
+	for _, id := range []string{"INBOX", "SENT", "CATEGORY_SOCIAL"} {
+		name := SystemLabelName(id)
+		if got, ok := SystemLabelID(strings.ToLower(name)); !ok || got != id {
+			t.Errorf("SystemLabelID(%q) = %q, %v; want %q", name, got, ok, id)
+		}
+	}
+	if name := SystemLabelName("Label_12"); name != "Label_12" {
+		t.Errorf("SystemLabelName(Label_12) = %q, want the ID", name)
+	}
+	if _, ok := SystemLabelID("Work"); ok {
+		t.Error("SystemLabelID(Work) found a system label")
+	}
+}
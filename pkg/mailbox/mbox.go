@@ -0,0 +1,219 @@
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// mbox variants, which differ in how a message's end is found and how body
+// lines starting with "From " are escaped
+const (
+	// MboxRD ends messages at a "From " line and escapes ">*From " lines with
+	// one more ">"
+	MboxRD = "mboxrd"
+	// MboxO ends messages at a "From " line and escapes "From " lines as
+	// ">From ", which can't be told apart from a real ">From "
+	MboxO = "mboxo"
+	// MboxCL gives the body length in Content-Length and escapes like mboxo
+	MboxCL = "mboxcl"
+	// MboxCL2 gives the body length in Content-Length and doesn't escape
+	MboxCL2 = "mboxcl2"
+)
+
+// ParseMboxFormat validates an mbox variant name
+func ParseMboxFormat(s string) (string, error) {
+	switch s {
+	case "":
+		return MboxRD, nil
+	case MboxRD, MboxO, MboxCL, MboxCL2:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown mbox format %q (expected %s, %s, %s or %s)", s, MboxRD, MboxO, MboxCL, MboxCL2)
+}
+
+// MboxReader reads the messages of an mbox file in order
+type MboxReader struct {
+	r      *bufio.Reader
+	format string
+	// offset is the position in the file of the next unread byte
+	offset int64
+	// next is a "From " line already read that starts the next message
+	next []byte
+}
+
+// NewMboxReader returns a reader for an mbox file in the given variant
+func NewMboxReader(r io.Reader, format string) *MboxReader {
+	return &MboxReader{r: bufio.NewReaderSize(r, 64*1024), format: format}
+}
+
+// readLine reads one line including its line ending
+func (m *MboxReader) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	m.offset += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+// Next returns the next message without its "From " separator line, and
+// the offset of that line in the file, or io.EOF after the last message
+func (m *MboxReader) Next() (raw []byte, offset int64, err error) {
+	// Find the separator starting the message
+	fromLine := m.next
+	m.next = nil
+	offset = m.offset - int64(len(fromLine))
+	for fromLine == nil {
+		offset = m.offset
+		line, err := m.readLine()
+		if err != nil {
+			return nil, 0, err
+		}
+		if isFromLine(line) {
+			fromLine = line
+		} else if len(bytes.TrimRight(line, "\r\n")) > 0 {
+			return nil, 0, fmt.Errorf("offset %d: not an mbox file: expected a \"From \" line", offset)
+		}
+	}
+
+	var msg bytes.Buffer
+	if m.format == MboxCL || m.format == MboxCL2 {
+		done, err := m.readContentLength(&msg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if done {
+			return msg.Bytes(), offset, nil
+		}
+	}
+
+	// Read lines up to the next separator, which follows a blank line
+	prevBlank := true
+	var pendingBlank []byte
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if prevBlank && pendingBlank != nil && isFromLine(line) {
+			// The blank line belongs to the separator, not the message
+			m.next = line
+			return msg.Bytes(), offset, nil
+		}
+		if pendingBlank != nil {
+			msg.Write(pendingBlank)
+			pendingBlank = nil
+		}
+		prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		if prevBlank {
+			pendingBlank = line
+			continue
+		}
+		msg.Write(m.unescape(line))
+	}
+	// The last message keeps no trailing separator blank line either
+	return msg.Bytes(), offset, nil
+}
+
+// readContentLength reads a message whose body length is given by its
+// Content-Length header into msg
+// done is false if the message has no Content-Length, in which case msg
+// holds the header and the body must be read line by line
+func (m *MboxReader) readContentLength(msg *bytes.Buffer) (done bool, err error) {
+	length := -1
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		msg.Write(line)
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			break
+		}
+		if name, value, ok := strings.Cut(string(trimmed), ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n >= 0 {
+				length = n
+			}
+		}
+	}
+	if length < 0 {
+		return false, nil
+	}
+
+	body := make([]byte, length)
+	n, err := io.ReadFull(m.r, body)
+	m.offset += int64(n)
+	if err != nil {
+		return false, errors.New("Content-Length runs past the end of the file")
+	}
+	if m.format == MboxCL {
+		body = unescapeLines(body, m.unescape)
+	}
+	msg.Write(body)
+
+	// The body must be followed by a blank line and the next separator, or
+	// the end of the file
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if isFromLine(line) {
+			m.next = line
+			return true, nil
+		}
+		if len(bytes.TrimRight(line, "\r\n")) > 0 {
+			return false, errors.New("Content-Length doesn't end at a message boundary (try another mbox format)")
+		}
+	}
+}
+
+// unescape reverses the variant's escaping of a body line
+func (m *MboxReader) unescape(line []byte) []byte {
+	switch m.format {
+	case MboxRD:
+		unquoted := bytes.TrimLeft(line, ">")
+		if len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			return line[1:]
+		}
+	case MboxO, MboxCL:
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+	}
+	return line
+}
+
+// unescapeLines applies unescape to every line of body
+func unescapeLines(body []byte, unescape func([]byte) []byte) []byte {
+	var out bytes.Buffer
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n') + 1
+		if end == 0 {
+			end = len(body)
+		}
+		out.Write(unescape(body[:end]))
+		body = body[end:]
+	}
+	return out.Bytes()
+}
+
+// isFromLine reports whether a line is an mbox "From " separator
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
@@ -0,0 +1,338 @@
+package mailbox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readMbox returns the messages of an mbox file held in data
+func readMbox(t *testing.T, data, format string) ([]string, error) {
+	t.Helper()
+	reader := NewMboxReader(strings.NewReader(data), format)
+	var messages []string
+	for {
+		raw, _, err := reader.Next()
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, string(raw))
+	}
+}
+
+func TestMboxFromQuoting(t *testing.T) {
+	// Body lines that look like separators, escaped or not
+	body := "From: alice@example.com\n" +
+		"Subject: quoting\n" +
+		"\n" +
+		"From here on\n" +
+		">From the start\n" +
+		">>From further back\n" +
+		"Not From at the start\n"
+
+	tests := []struct {
+		format string
+		// want is the message read back from a file written by MboxWriter
+		want string
+	}{
+		// mboxrd adds and removes one ">", so every line survives
+		{MboxRD, body},
+		// mboxo removes a ">" only from ">From ", so lines that were quoted
+		// already keep the ">" the writer added
+		{MboxO, strings.NewReplacer(">From the", ">>From the", ">>From further", ">>>From further").Replace(body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "test.mbox")
+			w, err := CreateMbox(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			var keys []string
+			for i := 0; i < 2; i++ {
+				key, err := w.Write([]byte(body), date)
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []*Message
+			if err := Walk(file, tt.format, func(msg *Message) error {
+				got = append(got, msg)
+				return nil
+			}); err != nil {
+				t.Fatalf("Walk: %v", err)
+			}
+			if len(got) != 2 {
+				t.Fatalf("read %d messages, want 2", len(got))
+			}
+			for i, msg := range got {
+				if msg.Key != keys[i] {
+					t.Errorf("message %d key = %q, want the writer's %q", i, msg.Key, keys[i])
+				}
+				if string(msg.Raw) != tt.want {
+					t.Errorf("message %d read as %s:\n%q\nwant\n%q", i, tt.format, msg.Raw, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMboxUnescape(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+		want   string
+	}{
+		{MboxRD, ">From here\n", "From here\n"},
+		{MboxRD, ">>From here\n", ">From here\n"},
+		{MboxRD, ">Fromage\n", ">Fromage\n"},
+		{MboxRD, ">quoted\n", ">quoted\n"},
+		{MboxO, ">From here\n", "From here\n"},
+		{MboxO, ">>From here\n", ">>From here\n"},
+		{MboxCL, ">From here\n", "From here\n"},
+		{MboxCL2, ">From here\n", ">From here\n"},
+	}
+	for _, tt := range tests {
+		m := &MboxReader{format: tt.format}
+		if got := string(m.unescape([]byte(tt.line))); got != tt.want {
+			t.Errorf("%s unescape(%q) = %q, want %q", tt.format, tt.line, got, tt.want)
+		}
+	}
+}
+
+// clMessage returns an mbox message with a Content-Length header of length
+// and the given body, followed by a blank line
+func clMessage(length int, body string) string {
+	return "From alice@example.com Fri Mar  1 12:00:00 2024\n" +
+		"Subject: framed\n" +
+		fmt.Sprintf("Content-Length: %d\n", length) +
+		"\n" +
+		body + "\n"
+}
+
+func TestMboxContentLength(t *testing.T) {
+	// An unescaped "From " line that only Content-Length can keep in the body
+	body := "first line\n\nFrom the body, not a separator\nlast line\n"
+	header := "Subject: framed\nContent-Length: %d\n\n"
+
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "mboxcl2 keeps From lines in the body",
+			format: MboxCL2,
+			data:   clMessage(len(body), body) + clMessage(4, "end\n"),
+			want: []string{
+				fmt.Sprintf(header, len(body)) + body,
+				fmt.Sprintf(header, 4) + "end\n",
+			},
+		},
+		{
+			name:   "mboxcl unescapes >From lines in the body",
+			format: MboxCL,
+			data:   clMessage(len(body)+1, strings.Replace(body, "From the", ">From the", 1)),
+			want:   []string{fmt.Sprintf(header, len(body)+1) + body},
+		},
+		{
+			name:   "last message without a trailing blank line",
+			format: MboxCL2,
+			data:   strings.TrimSuffix(clMessage(len(body), body), "\n"),
+			want:   []string{fmt.Sprintf(header, len(body)) + body},
+		},
+		{
+			name:   "no Content-Length falls back to separators",
+			format: MboxCL2,
+			data:   "From a\nSubject: one\n\nbody one\n\nFrom b\nSubject: two\n\nbody two\n",
+			want:   []string{"Subject: one\n\nbody one\n", "Subject: two\n\nbody two\n"},
+		},
+		{
+			name:    "Content-Length too short",
+			format:  MboxCL2,
+			data:    clMessage(len(body)-10, body),
+			wantErr: "doesn't end at a message boundary",
+		},
+		{
+			name:    "Content-Length too long",
+			format:  MboxCL2,
+			data:    clMessage(len(body)+100, body),
+			wantErr: "runs past the end of the file",
+		},
+		{
+			name:   "mboxrd splits at the From line in the body",
+			format: MboxRD,
+			data:   clMessage(len(body), body),
+			want: []string{
+				fmt.Sprintf(header, len(body)) + "first line\n",
+				"last line\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMbox(t, tt.data, tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMboxCRLF(t *testing.T) {
+	data := "From a Fri Mar  1 12:00:00 2024\r\n" +
+		"Subject: one\r\n" +
+		"\r\n" +
+		"body one\r\n" +
+		">From quoted\r\n" +
+		"\r\n" +
+		"From b Fri Mar  1 12:00:01 2024\r\n" +
+		"Subject: two\r\n" +
+		"\r\n" +
+		"body two\r\n"
+
+	for _, format := range []string{MboxRD, MboxO, MboxCL, MboxCL2} {
+		t.Run(format, func(t *testing.T) {
+			got, err := readMbox(t, data, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"Subject: one\r\n\r\nbody one\r\nFrom quoted\r\n",
+				"Subject: two\r\n\r\nbody two\r\n",
+			}
+			if format == MboxCL2 {
+				want[0] = strings.Replace(want[0], "From quoted", ">From quoted", 1)
+			}
+			if strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+				t.Errorf("messages = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Written messages are stored with LF line endings
+	file := filepath.Join(t.TempDir(), "crlf.mbox")
+	w, err := CreateMbox(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: crlf\r\n\r\nFrom the body\r\nno final newline"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	var raw string
+	if err := Walk(file, MboxRD, func(msg *Message) error {
+		raw = string(msg.Raw)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Subject: crlf\n\nFrom the body\nno final newline\n"; raw != want {
+		t.Errorf("read back %q, want %q", raw, want)
+	}
+}
+
+func TestMboxWriterLocks(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "locked.mbox")
+	w, err := CreateMbox(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Another writer holding the lock appends a message of its own
+	other, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	type written struct {
+		key string
+		err error
+	}
+	done := make(chan written)
+	go func() {
+		key, err := w.Write([]byte("Subject: ours\n\nbody\n"), date)
+		done <- written{key, err}
+	}()
+	select {
+	case <-done:
+		t.Fatal("Write didn't wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	theirs := "From other Fri Mar  1 12:00:00 2024\nSubject: theirs\n\nbody\n\n"
+	if _, err := other.WriteString(theirs); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	result := <-done
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	// The key is the message's offset after the other writer's message
+	var got []*Message
+	if err := Walk(file, MboxRD, func(msg *Message) error {
+		got = append(got, msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[0].Raw) != "Subject: theirs\n\nbody\n" || string(got[1].Raw) != "Subject: ours\n\nbody\n" {
+		t.Fatalf("read back %d messages, want theirs then ours", len(got))
+	}
+	if want := fmt.Sprintf("%s@%d", file, len(theirs)); result.key != want || got[1].Key != want {
+		t.Errorf("key = %q, read back as %q, want %q", result.key, got[1].Key, want)
+	}
+}
+
+func TestMboxNotAnMbox(t *testing.T) {
+	_, err := readMbox(t, "Subject: no separator\n\nbody\n", MboxRD)
+	if err == nil || !strings.Contains(err.Error(), "not an mbox file") {
+		t.Errorf("error = %v, want not an mbox file", err)
+	}
+}
+
+func TestParseMboxFormat(t *testing.T) {
+	for in, want := range map[string]string{"": MboxRD, MboxO: MboxO, MboxCL: MboxCL, MboxCL2: MboxCL2} {
+		if got, err := ParseMboxFormat(in); err != nil || got != want {
+			t.Errorf("ParseMboxFormat(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMboxFormat("mbox"); err == nil {
+		t.Error("ParseMboxFormat(mbox) succeeded, want an error")
+	}
+}
@@ -0,0 +1,153 @@
+package mailbox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Normalize converts a message to the form the writers store: LF line
+// endings, as mail clients expect in local stores, and a final newline
+// Reading a stored message back returns exactly these bytes
+func Normalize(raw []byte) []byte {
+	out := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// MboxWriter appends messages to an mbox file in the mboxrd variant
+// Each message is appended under an exclusive flock, so mail clients and
+// other writers that lock the file never see or interleave a partial message
+type MboxWriter struct {
+	file *os.File
+	path string
+}
+
+// CreateMbox opens an mbox file for appending, creating it if needed
+func CreateMbox(filename string) (*MboxWriter, error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &MboxWriter{file: file, path: path}, nil
+}
+
+// Write appends a message received at date and returns its key, the same
+// key Walk gives it
+func (w *MboxWriter) Write(raw []byte, date time.Time) (string, error) {
+	var b bytes.Buffer
+	b.WriteString("From MAILER-DAEMON " + date.UTC().Format(time.ANSIC) + "\n")
+	body := Normalize(raw)
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n') + 1
+		line := body[:end]
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+		body = body[end:]
+	}
+	// A blank line separates the message from the next one
+	b.WriteByte('\n')
+
+	if err := syscall.Flock(int(w.file.Fd()), syscall.LOCK_EX); err != nil {
+		return "", fmt.Errorf("locking %s: %w", w.path, err)
+	}
+	defer syscall.Flock(int(w.file.Fd()), syscall.LOCK_UN)
+	// Other writers may have appended since the last message, so the
+	// message starts at the file's size once it is locked
+	info, err := w.file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("writing %s: %w", w.path, err)
+	}
+	if _, err := w.file.Write(b.Bytes()); err != nil {
+		return "", fmt.Errorf("writing %s: %w", w.path, err)
+	}
+	return w.path + "@" + strconv.FormatInt(info.Size(), 10), nil
+}
+
+// Close syncs and closes the file
+func (w *MboxWriter) Close() error {
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// MaildirWriter delivers messages into a Maildir
+type MaildirWriter struct {
+	dir  string
+	host string
+}
+
+// CreateMaildir opens a Maildir, creating it if needed
+func CreateMaildir(dir string) (*MaildirWriter, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// "/" and ":" can't appear in a Maildir file name
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return &MaildirWriter{dir: dir, host: host}, nil
+}
+
+// Write stores a message received at date in cur, with id making its file
+// name unique, and returns its key, the same key Walk gives it
+func (w *MaildirWriter) Write(raw []byte, id string, date time.Time, seen, flagged bool) (string, error) {
+	id = strings.NewReplacer("/", "_", ":", "_", ".", "_").Replace(id)
+	unique := fmt.Sprintf("%d.%s.%s", date.Unix(), id, w.host)
+	flags := ""
+	if flagged {
+		flags += "F"
+	}
+	if seen {
+		flags += "S"
+	}
+
+	// Write to tmp, then move into cur so readers never see a partial file
+	tmp := filepath.Join(w.dir, "tmp", unique)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(Normalize(raw)); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(w.dir, "cur", unique+":2,"+flags)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return filepath.Join(w.dir, unique), nil
+}